@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/nkiryanov/gophermart/internal/cache"
 	"github.com/nkiryanov/gophermart/internal/db"
 	"github.com/nkiryanov/gophermart/internal/handlers"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
 	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/mailer"
+	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository/postgres"
+	"github.com/nkiryanov/gophermart/internal/service/accrual"
 	"github.com/nkiryanov/gophermart/internal/service/auth"
 	"github.com/nkiryanov/gophermart/internal/service/auth/tokenmanager"
 	"github.com/nkiryanov/gophermart/internal/service/order"
@@ -21,71 +36,262 @@ type orderProcessor interface {
 	Process(ctx context.Context) <-chan struct{}
 }
 
+type receiptSender interface {
+	WaitReceipts()
+}
+
 type ServerApp struct {
 	ListenAddr string
 	Handler    http.Handler
 	Logger     logger.Logger
 
+	// Network to listen: "tcp" or "unix" for Unix socket at ListenAddr path
+	// If not set, address containing '/' is a socket path, other ones are TCP addresses
+	ListenNetwork string
+
+	// HTTP server connection timeouts, zero means no timeout
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
 	OrderProcessor orderProcessor
+
+	// Waited after server is stopped, so receipts of last withdrawals are sent before DB is closed
+	Receipts receiptSender
+
+	// Closed after server and processor are stopped
+	DB *pgxpool.Pool
+
+	// Maintenance mode of the handler, toggled with SIGUSR1 too. Not toggled by signal if nil
+	Maintenance *atomic.Bool
+}
+
+// Apply migrations without starting server, used if migrations are run separately from app rollout
+func RunMigrations(c *Config) error {
+	logger, err := logger.New(c.Environment, c.LogFormat, c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("error while initializing logger: %w", err)
+	}
+	return migrate(logger, c)
+}
+
+func migrate(logger logger.Logger, c *Config) error {
+	version, err := db.MigrateDir(c.DatabaseDSN, c.MigrationsDir)
+	if err != nil {
+		return fmt.Errorf("error while migrating db. Err: %w", err)
+	}
+	logger.Info("Migrations applied", "version", version)
+	return nil
 }
 
 func NewServerApp(ctx context.Context, c *Config) (*ServerApp, error) {
 	// Initialize logger
-	logger, err := logger.New(c.Environment, c.LogLevel)
+	logger, err := logger.New(c.Environment, c.LogFormat, c.LogLevel)
 	if err != nil {
 		return nil, fmt.Errorf("error while initializing logger: %w", err)
 	}
 
+	logConfig(logger, c)
+
 	// Connect to the database and run migrations
-	pool, err := db.ConnectAndMigrate(ctx, c.DatabaseDSN)
+	pool, err := db.Connect(ctx, c.DatabaseDSN)
 	if err != nil {
 		return nil, fmt.Errorf("error while connecting to db. Err: %w", err)
 	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("error while connecting to db. Err: %w", err)
+	}
+	logger.Info("Database connected")
+
+	if c.AutoMigrate {
+		if err := migrate(logger, c); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	} else {
+		logger.Info("Migrations skipped, auto migrate disabled")
+	}
 
 	// Initialize repositories
 	storage := postgres.NewStorage(pool)
 
 	// Initialize services
-	userService := user.NewService(user.DefaultHasher, storage)
-	orderService := order.NewService(storage)
-	tokenManager, err := tokenmanager.New(tokenmanager.Config{SecretKey: c.SecretKey}, storage)
+	// Balance cache is shared, so order service drops balances it credits
+	userOpts := []user.Option{
+		user.WithMaxWithdrawal(c.MaxWithdrawal),
+		user.WithWithdrawalLimit(c.WithdrawalLimit, c.WithdrawalLimitWindow),
+		user.WithAuditLogger(logger),
+	}
+	orderOpts := []order.Option{
+		order.WithAuditLogger(logger),
+		order.WithMaxOrdersPerUser(c.MaxOrdersPerUser),
+	}
+	if c.SMTPAddr != "" {
+		m, err := mailer.NewSMTP(mailer.SMTPConfig{
+			Addr:     c.SMTPAddr,
+			From:     c.SMTPFrom,
+			Username: c.SMTPUsername,
+			Password: c.SMTPPassword,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mailer initialization: %w", err)
+		}
+		userOpts = append(userOpts, user.WithMailer(m, logger))
+	}
+	if c.SortableOrderIDs {
+		orderOpts = append(orderOpts, order.WithSortableIDs())
+	}
+	if c.BalanceCacheTTL > 0 {
+		balances := cache.New[uuid.UUID, models.Balance](c.BalanceCacheTTL)
+		userOpts = append(userOpts, user.WithBalanceCache(balances))
+		orderOpts = append(orderOpts, order.WithBalanceCache(balances))
+	}
+	userService := user.NewService(user.DefaultHasher, storage, userOpts...)
+	orderService := order.NewService(storage, orderOpts...)
+	if err := tokenmanager.CheckSecretKey(c.SecretKey); err != nil && c.SecretKey != "" && c.AllowWeakSecretKey {
+		logger.Warn("Weak secret key allowed, tokens may be forged", "error", err)
+	}
+	tokenManager, err := tokenmanager.New(tokenManagerConfig(c), storage)
 	if err != nil {
 		return nil, fmt.Errorf("token manager initialization: %w", err)
 	}
-	authService, err := auth.NewService(auth.Config{}, tokenManager, userService)
+	authService, err := auth.NewService(authConfig(c), tokenManager, userService)
 	if err != nil {
 		return nil, fmt.Errorf("auth service initialization: %w", err)
 	}
 
 	// Initialize order processor
-	processor := orderprocessor.New(c.AccrualAddr, logger, orderService)
+	accrualClient, err := accrual.NewClient(accrual.Config{
+		Addr:                  c.AccrualAddr,
+		APIKey:                c.AccrualAPIKey,
+		APIKeyHeader:          c.AccrualAPIKeyHeader,
+		BasePath:              c.AccrualBasePath,
+		MaxConcurrentRequests: c.AccrualMaxConcurrentRequests,
+		MaxIdleConnsPerHost:   c.AccrualMaxIdleConns,
+		IdleConnTimeout:       c.AccrualIdleTimeout,
+	}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("accrual client initialization: %w", err)
+	}
+	// Orders are accepted even if accrual service is down, processor polls them when it's back
+	if err := accrualClient.Probe(ctx); err != nil {
+		logger.Warn("Accrual service unreachable, orders will be processed later", "error", err)
+	} else {
+		logger.Info("Accrual service reachable")
+	}
+	processor := orderprocessor.New(orderprocessor.Config{
+		MaxAttempts:    c.AccrualMaxAttempts,
+		OrderMaxAge:    c.OrderMaxAge,
+		ProcessTimeout: c.OrderProcessTimeout,
+		BatchAccruals:  c.AccrualBatch,
+	}, accrualClient, logger, orderService)
 
+	maintenance := new(atomic.Bool)
 	mux := handlers.NewRouter(
+		handlers.Config{
+			RequestTimeout:        c.RequestTimeout,
+			MaxConcurrentRequests: c.MaxConcurrentRequests,
+			RefreshRateLimit:      c.RefreshRateLimit,
+			RefreshRateWindow:     c.RefreshRateWindow,
+			AmountUnit:            c.AmountUnit,
+			IdempotencyTTL:        c.IdempotencyTTL,
+			TrustedProxies:        c.TrustedProxies,
+			Pagination: pagination.Config{
+				DefaultLimit: c.PageDefaultLimit,
+				MaxLimit:     c.PageMaxLimit,
+			},
+			AdminUsernames:        c.AdminUsernames,
+			ContentSecurityPolicy: c.ContentSecurityPolicy,
+			HSTSMaxAge:            c.HSTSMaxAge,
+			HSTSIncludeSubDomains: c.HSTSIncludeSubDomains,
+			Maintenance:           maintenance,
+			Readiness: map[string]func(context.Context) error{
+				"database": pool.Ping,
+				"order_processor": func(context.Context) error {
+					switch last := processor.LastCycleAt(); {
+					case processor.Healthy():
+						return nil
+					case last.IsZero():
+						return errors.New("no polling cycle completed")
+					default:
+						return fmt.Errorf("no polling cycle completed since %s", last.Format(time.RFC3339))
+					}
+				},
+			},
+		},
 		authService,
 		orderService,
 		userService,
 		logger,
 	)
+	logger.Info("Services initialized")
 
 	return &ServerApp{
 		ListenAddr:     c.ListenAddr,
+		ListenNetwork:  c.ListenNetwork,
 		Handler:        mux,
 		Logger:         logger,
 		OrderProcessor: processor,
+		Receipts:       userService,
+		DB:             pool,
+		Maintenance:    maintenance,
+
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
 	}, nil
 }
 
+func tokenManagerConfig(c *Config) tokenmanager.Config {
+	return tokenmanager.Config{
+		SecretKey:         c.SecretKey,
+		AllowWeakKey:      c.AllowWeakSecretKey,
+		Alg:               c.TokenAlg,
+		AcceptedAlgs:      c.TokenAcceptedAlgs,
+		AccessTTL:         c.AccessTokenTTL,
+		RefreshTTL:        c.RefreshTokenTTL,
+		MaxActiveSessions: c.MaxActiveSessions,
+		RefreshTokenBytes: c.RefreshTokenBytes,
+	}
+}
+
+func authConfig(c *Config) auth.Config {
+	return auth.Config{
+		AccessHeaderName:  c.AccessHeaderName,
+		AccessAuthScheme:  c.AccessAuthScheme,
+		RefreshCookieName: c.RefreshCookieName,
+		AccessCookieName:  c.AccessCookieName,
+	}
+}
+
 // Run starts http server and closes gracefully on context cancellation
 func (s *ServerApp) Run(ctx context.Context) error {
+	network := listenNetwork(s.ListenNetwork, s.ListenAddr)
+	ln, err := listen(network, s.ListenAddr)
+	if err != nil {
+		if s.DB != nil {
+			s.DB.Close()
+		}
+		return err
+	}
+
 	httpServer := &http.Server{
-		Addr:    s.ListenAddr,
-		Handler: s.Handler,
+		Addr:              s.ListenAddr,
+		Handler:           s.Handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
 	}
 
 	idleSrvClosed := make(chan struct{})
 	go func() {
 		<-ctx.Done()
 
+		s.Logger.Info("Shutting down HTTP server")
 		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -97,12 +303,146 @@ func (s *ServerApp) Run(ctx context.Context) error {
 		close(idleSrvClosed)
 	}()
 
+	if s.Maintenance != nil {
+		go s.toggleMaintenanceOnSignal(ctx)
+	}
+
 	idleProcessorClosed := s.OrderProcessor.Process(ctx)
+	s.Logger.Info("Order processor started")
 
-	s.Logger.Info("Listening on address", "address", s.ListenAddr)
-	err := httpServer.ListenAndServe()
+	s.Logger.Info("Listening on address", "address", s.ListenAddr, "network", network)
+	err = httpServer.Serve(ln)
 
 	<-idleSrvClosed
+	if network == "unix" {
+		// Listener removes the socket on close, it's removed explicitly in case it wasn't closed cleanly
+		if err := os.Remove(s.ListenAddr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.Logger.Warn("Failed to remove socket file", "path", s.ListenAddr, "error", err)
+		}
+	}
 	<-idleProcessorClosed
+	s.Logger.Info("Order processor stopped")
+
+	if s.Receipts != nil {
+		s.Receipts.WaitReceipts()
+	}
+
+	if s.DB != nil {
+		s.DB.Close()
+		s.Logger.Info("Database connection closed")
+	}
+
+	s.Logger.Info("Shutdown complete")
 	return err
 }
+
+func listenNetwork(network string, addr string) string {
+	switch {
+	case network != "":
+		return network
+	case strings.Contains(addr, "/"):
+		return "unix"
+	default:
+		return "tcp"
+	}
+}
+
+// Listen the address. Socket file left by previous run is removed, otherwise the path is busy
+func listen(network string, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("can't remove stale socket %s: %w", addr, err)
+			}
+		}
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen %s %s: %w", network, addr, err)
+	}
+	return ln, nil
+}
+
+// Toggle maintenance mode on every SIGUSR1 till context is done, so it's turned on even if admin API is unreachable
+func (s *ServerApp) toggleMaintenanceOnSignal(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			enabled := !s.Maintenance.Load()
+			s.Maintenance.Store(enabled)
+			s.Logger.Warn("Maintenance mode changed by signal", "enabled", enabled)
+		}
+	}
+}
+
+// Log loaded config. Secrets never logged as is
+func logConfig(l logger.Logger, c *Config) {
+	rc := c.Redacted()
+	l.Info("Config loaded",
+		"listen_addr", rc.ListenAddr,
+		"listen_network", rc.ListenNetwork,
+		"accrual_addr", rc.AccrualAddr,
+		"accrual_api_key", rc.AccrualAPIKey,
+		"accrual_api_key_header", rc.AccrualAPIKeyHeader,
+		"accrual_base_path", rc.AccrualBasePath,
+		"accrual_max_concurrent", rc.AccrualMaxConcurrentRequests,
+		"accrual_max_idle_conns", rc.AccrualMaxIdleConns,
+		"accrual_idle_timeout", rc.AccrualIdleTimeout,
+		"database_dsn", rc.DatabaseDSN,
+		"secret_key", rc.SecretKey,
+		"allow_weak_secret_key", rc.AllowWeakSecretKey,
+		"token_alg", rc.TokenAlg,
+		"token_accepted_algs", rc.TokenAcceptedAlgs,
+		"environment", rc.Environment,
+		"log_level", rc.LogLevel,
+		"log_format", rc.LogFormat,
+		"max_active_sessions", rc.MaxActiveSessions,
+		"refresh_token_bytes", rc.RefreshTokenBytes,
+		"access_token_ttl", rc.AccessTokenTTL,
+		"refresh_token_ttl", rc.RefreshTokenTTL,
+		"accrual_max_attempts", rc.AccrualMaxAttempts,
+		"order_max_age", rc.OrderMaxAge,
+		"order_process_timeout", rc.OrderProcessTimeout,
+		"accrual_batch", rc.AccrualBatch,
+		"auto_migrate", rc.AutoMigrate,
+		"migrations_dir", rc.MigrationsDir,
+		"request_timeout", rc.RequestTimeout,
+		"max_concurrent_requests", rc.MaxConcurrentRequests,
+		"read_header_timeout", rc.ReadHeaderTimeout,
+		"read_timeout", rc.ReadTimeout,
+		"write_timeout", rc.WriteTimeout,
+		"idle_timeout", rc.IdleTimeout,
+		"refresh_rate_limit", rc.RefreshRateLimit,
+		"refresh_rate_window", rc.RefreshRateWindow,
+		"balance_cache_ttl", rc.BalanceCacheTTL,
+		"amount_unit", rc.AmountUnit,
+		"access_cookie_name", rc.AccessCookieName,
+		"refresh_cookie_name", rc.RefreshCookieName,
+		"access_header_name", rc.AccessHeaderName,
+		"access_auth_scheme", rc.AccessAuthScheme,
+		"max_orders_per_user", rc.MaxOrdersPerUser,
+		"sortable_order_ids", rc.SortableOrderIDs,
+		"max_withdrawal", rc.MaxWithdrawal.String(),
+		"withdrawal_limit", rc.WithdrawalLimit.String(),
+		"withdrawal_limit_window", rc.WithdrawalLimitWindow,
+		"idempotency_ttl", rc.IdempotencyTTL,
+		"trusted_proxies", rc.TrustedProxies,
+		"page_default_limit", rc.PageDefaultLimit,
+		"page_max_limit", rc.PageMaxLimit,
+		"admin_usernames", rc.AdminUsernames,
+		"content_security_policy", rc.ContentSecurityPolicy,
+		"hsts_max_age", rc.HSTSMaxAge,
+		"hsts_include_subdomains", rc.HSTSIncludeSubDomains,
+		"smtp_addr", rc.SMTPAddr,
+		"smtp_from", rc.SMTPFrom,
+		"smtp_username", rc.SMTPUsername,
+		"smtp_password", rc.SMTPPassword,
+	)
+}
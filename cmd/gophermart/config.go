@@ -2,12 +2,19 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/pflag"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/redact"
 )
 
 const (
@@ -15,6 +22,20 @@ const (
 	defaultLoggingLevel = logger.LevelInfo
 	defaultAccrualAddr  = "localhost:3000"
 	defaultEnvironment  = logger.EnvProduction
+	defaultAmountUnit   = "points"
+
+	defaultRequestTimeout = 10 * time.Second
+
+	// Server timeouts guard against slow clients. Write timeout has to be greater than request timeout, see Validate
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 15 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 60 * time.Second
+
+	defaultWithdrawalLimitWindow = 24 * time.Hour
+
+	// HSTS is sent only over TLS, so it's safe to enable by default
+	defaultHSTSMaxAge = 365 * 24 * time.Hour
 )
 
 type Config struct {
@@ -24,9 +45,29 @@ type Config struct {
 	// Address on which the gophermart service will be run
 	ListenAddr string
 
+	// Network to listen: "tcp" or "unix" (ListenAddr is socket path then)
+	// If not set, address containing '/' is a socket path
+	ListenNetwork string
+
 	// Accrual service address to connect to
 	AccrualAddr string
 
+	// Accrual service API key and header to send it with. No key sent if empty
+	AccrualAPIKey       string
+	AccrualAPIKeyHeader string
+
+	// Max requests sent to accrual service at the same time, 0 means unlimited
+	AccrualMaxConcurrentRequests int
+
+	// Idle connections to accrual service kept for reuse and how long they are kept
+	// If not set than accrual client defaults are used
+	AccrualMaxIdleConns int
+	AccrualIdleTimeout  time.Duration
+
+	// Accrual service orders path prefix
+	// If not set than accrual client default is used
+	AccrualBasePath string
+
 	// Database to connect to
 	DatabaseDSN string
 
@@ -34,16 +75,151 @@ type Config struct {
 	// Some internal parts (like signing JWT tokens) uses symmetric encryption, so this key is used for that purpose
 	SecretKey string
 
+	// Accept secret key shorter than token manager requires, only warn about it
+	// Kept for deployments with old short keys, new ones have to be generated with 'gensecret'
+	AllowWeakSecretKey bool
+
+	// Algorithm to sign access tokens with and other ones still accepted, like the previous one while it's switched
+	// If not set than token manager default is used
+	TokenAlg          string
+	TokenAcceptedAlgs []string
+
+	// Content-Security-Policy of responses, like one allowing served docs pages
+	// If not set than nothing is allowed to load
+	ContentSecurityPolicy string
+
+	// 'Strict-Transport-Security' sent over TLS or behind trusted proxy terminating it. Zero max age disables it
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubDomains bool
+
 	// Environment
 	Environment string
+
+	// Log format (text, json). If not set, it's chosen by environment
+	LogFormat string
+
+	// Max number of active sessions (refresh tokens) per user, 0 means unlimited
+	MaxActiveSessions int
+
+	// Refresh token random bytes length
+	// If not set than token manager default is used
+	RefreshTokenBytes int
+
+	// Access and refresh token lifetimes. Access token has to expire before refresh one
+	// If not set than token manager defaults are used
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// How many times accrual service may fail for the order before it's set INVALID
+	// If not set than processor default is used
+	AccrualMaxAttempts int
+
+	// Orders waiting for accrual longer than this are set INVALID, 0 means never
+	// Order reprocessed by admin is aged from the reprocess
+	OrderMaxAge time.Duration
+
+	// Max time to get accrual of single order and apply it
+	// If not set than processor default is used
+	OrderProcessTimeout time.Duration
+
+	// Credit accruals of user's orders processed in the same cycle with single balance update
+	AccrualBatch bool
+
+	// Max time to handle http request
+	RequestTimeout time.Duration
+
+	// Max requests handled simultaneously, 0 means unlimited
+	MaxConcurrentRequests int
+
+	// HTTP server connection timeouts
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Max token refresh requests per window from the same IP, 0 disables the limit
+	RefreshRateLimit  int
+	RefreshRateWindow time.Duration
+
+	// How long user's balance is cached in memory, 0 disables caching
+	BalanceCacheTTL time.Duration
+
+	// Cookie to read access token from if auth header not set, cookie is not used if empty
+	AccessCookieName string
+
+	// Names of refresh token cookie and access token header with its auth scheme
+	// If not set than auth service defaults are used
+	RefreshCookieName string
+	AccessHeaderName  string
+	AccessAuthScheme  string
+
+	// Max orders single user may upload, zero means unlimited
+	MaxOrdersPerUser int
+
+	// Generate time sortable (UUIDv7) ids of new orders instead of random ones
+	SortableOrderIDs bool
+
+	// Max sum of single withdrawal, zero means unlimited
+	MaxWithdrawal decimal.Decimal
+
+	// Max sum of user's withdrawals within the window, zero means unlimited
+	WithdrawalLimit       decimal.Decimal
+	WithdrawalLimitWindow time.Duration
+
+	// How long response is replayed for repeated idempotency key
+	// If not set than router default is used
+	IdempotencyTTL time.Duration
+
+	// Proxies (CIDRs or IPs) allowed to pass client IP with 'X-Forwarded-For'. Peer of Unix socket is always trusted
+	TrustedProxies []netip.Prefix
+
+	// Label of amounts in balance and withdrawal responses. Omitted from responses if empty
+	AmountUnit string
+
+	// Page size of orders and transactions lists if limit not set and the max one, zero means unlimited
+	PageDefaultLimit int
+	PageMaxLimit     int
+
+	// Usernames of admins allowed to use admin API. Nobody is admin if empty
+	AdminUsernames []string
+
+	// SMTP server to send emails with, e.g. withdrawal receipts. No emails sent if empty
+	SMTPAddr string
+
+	// Sender address and SMTP credentials. No auth used if username is empty
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// Apply migrations on start. Disabled if migrations are run separately from app rollout
+	AutoMigrate bool
+
+	// Directory to read migrations from. Embedded migrations are used if not set
+	MigrationsDir string
+
+	// Apply migrations and exit without starting server. Set with flag only
+	MigrateOnly bool
 }
 
 func NewConfig() *Config {
 	return &Config{
-		LogLevel:    defaultLoggingLevel,
-		ListenAddr:  defaultListenAddr,
-		AccrualAddr: defaultAccrualAddr,
-		Environment: defaultEnvironment,
+		LogLevel:       defaultLoggingLevel,
+		ListenAddr:     defaultListenAddr,
+		AccrualAddr:    defaultAccrualAddr,
+		Environment:    defaultEnvironment,
+		RequestTimeout: defaultRequestTimeout,
+		AmountUnit:     defaultAmountUnit,
+
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		ReadTimeout:       defaultReadTimeout,
+		WriteTimeout:      defaultWriteTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+
+		WithdrawalLimitWindow: defaultWithdrawalLimitWindow,
+
+		HSTSMaxAge: defaultHSTSMaxAge,
+
+		AutoMigrate: true,
 	}
 }
 
@@ -58,10 +234,9 @@ func (c *Config) LoadDotEnv(getwd func() (string, error)) error {
 
 	switch {
 	case err == nil:
-		c.LoadEnv(func(key string) string {
+		return c.LoadEnv(func(key string) string {
 			return envMap[key]
 		})
-		return nil
 	case errors.Is(err, os.ErrNotExist):
 		return nil
 	default:
@@ -69,27 +244,188 @@ func (c *Config) LoadDotEnv(getwd func() (string, error)) error {
 	}
 }
 
-func (c *Config) LoadEnv(getenv func(string) string) {
+func (c *Config) LoadEnv(getenv func(string) string) error {
 	// Set option to value if it not empty
-	setString := func(o *string) func(value string) {
-		return func(value string) {
+	setString := func(o *string) func(value string) error {
+		return func(value string) error {
 			if value != "" {
 				*o = value
 			}
+			return nil
+		}
+	}
+	setInt := func(o *int) func(value string) error {
+		return func(value string) error {
+			if value == "" {
+				return nil
+			}
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			*o = v
+			return nil
+		}
+	}
+
+	setBool := func(o *bool) func(value string) error {
+		return func(value string) error {
+			if value == "" {
+				return nil
+			}
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			*o = v
+			return nil
+		}
+	}
+
+	setDuration := func(o *time.Duration) func(value string) error {
+		return func(value string) error {
+			if value == "" {
+				return nil
+			}
+			v, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			*o = v
+			return nil
 		}
 	}
 
-	envMap := map[string]func(string){
-		"RUN_ADDRESS":            setString(&c.ListenAddr),
-		"DATABASE_URI":           setString(&c.DatabaseDSN),
-		"SECRET_KEY":             setString(&c.SecretKey),
-		"LOG_LEVEL":              setString(&c.LogLevel),
-		"ACCRUAL_SYSTEM_ADDRESS": setString(&c.AccrualAddr),
-		"ENVIRONMENT":            setString(&c.Environment),
+	envMap := map[string]func(string) error{
+		"RUN_ADDRESS":             setString(&c.ListenAddr),
+		"LISTEN_NETWORK":          setString(&c.ListenNetwork),
+		"DATABASE_URI":            setString(&c.DatabaseDSN),
+		"SECRET_KEY":              setString(&c.SecretKey),
+		"ALLOW_WEAK_SECRET_KEY":   setBool(&c.AllowWeakSecretKey),
+		"TOKEN_ALG":               setString(&c.TokenAlg),
+		"TOKEN_ACCEPTED_ALGS":     setList(&c.TokenAcceptedAlgs),
+		"LOG_LEVEL":               setString(&c.LogLevel),
+		"LOG_FORMAT":              setString(&c.LogFormat),
+		"ACCRUAL_SYSTEM_ADDRESS":  setString(&c.AccrualAddr),
+		"ACCRUAL_API_KEY":         setString(&c.AccrualAPIKey),
+		"ACCRUAL_API_KEY_HEADER":  setString(&c.AccrualAPIKeyHeader),
+		"ACCRUAL_BASE_PATH":       setString(&c.AccrualBasePath),
+		"ACCRUAL_MAX_CONCURRENT":  setInt(&c.AccrualMaxConcurrentRequests),
+		"ACCRUAL_MAX_IDLE_CONNS":  setInt(&c.AccrualMaxIdleConns),
+		"ACCRUAL_IDLE_TIMEOUT":    setDuration(&c.AccrualIdleTimeout),
+		"ENVIRONMENT":             setString(&c.Environment),
+		"MAX_ACTIVE_SESSIONS":     setInt(&c.MaxActiveSessions),
+		"ACCRUAL_MAX_ATTEMPTS":    setInt(&c.AccrualMaxAttempts),
+		"ORDER_MAX_AGE":           setDuration(&c.OrderMaxAge),
+		"ORDER_PROCESS_TIMEOUT":   setDuration(&c.OrderProcessTimeout),
+		"ACCRUAL_BATCH":           setBool(&c.AccrualBatch),
+		"REFRESH_TOKEN_BYTES":     setInt(&c.RefreshTokenBytes),
+		"ACCESS_TOKEN_TTL":        setDuration(&c.AccessTokenTTL),
+		"REFRESH_TOKEN_TTL":       setDuration(&c.RefreshTokenTTL),
+		"REQUEST_TIMEOUT":         setDuration(&c.RequestTimeout),
+		"MAX_CONCURRENT_REQUESTS": setInt(&c.MaxConcurrentRequests),
+		"READ_HEADER_TIMEOUT":     setDuration(&c.ReadHeaderTimeout),
+		"READ_TIMEOUT":            setDuration(&c.ReadTimeout),
+		"WRITE_TIMEOUT":           setDuration(&c.WriteTimeout),
+		"IDLE_TIMEOUT":            setDuration(&c.IdleTimeout),
+		"REFRESH_RATE_LIMIT":      setInt(&c.RefreshRateLimit),
+		"REFRESH_RATE_WINDOW":     setDuration(&c.RefreshRateWindow),
+		"BALANCE_CACHE_TTL":       setDuration(&c.BalanceCacheTTL),
+		"AMOUNT_UNIT":             setString(&c.AmountUnit),
+		"ACCESS_COOKIE_NAME":      setString(&c.AccessCookieName),
+		"REFRESH_COOKIE_NAME":     setString(&c.RefreshCookieName),
+		"ACCESS_HEADER_NAME":      setString(&c.AccessHeaderName),
+		"ACCESS_AUTH_SCHEME":      setString(&c.AccessAuthScheme),
+		"MAX_ORDERS_PER_USER":     setInt(&c.MaxOrdersPerUser),
+		"SORTABLE_ORDER_IDS":      setBool(&c.SortableOrderIDs),
+		"AUTO_MIGRATE":            setBool(&c.AutoMigrate),
+		"MIGRATIONS_DIR":          setString(&c.MigrationsDir),
+		"MAX_WITHDRAWAL":          setDecimal(&c.MaxWithdrawal),
+		"WITHDRAWAL_LIMIT":        setDecimal(&c.WithdrawalLimit),
+		"WITHDRAWAL_LIMIT_WINDOW": setDuration(&c.WithdrawalLimitWindow),
+		"IDEMPOTENCY_TTL":         setDuration(&c.IdempotencyTTL),
+		"TRUSTED_PROXIES":         setPrefixes(&c.TrustedProxies),
+		"PAGE_DEFAULT_LIMIT":      setInt(&c.PageDefaultLimit),
+		"PAGE_MAX_LIMIT":          setInt(&c.PageMaxLimit),
+		"ADMIN_USERNAMES":         setList(&c.AdminUsernames),
+		"CONTENT_SECURITY_POLICY": setString(&c.ContentSecurityPolicy),
+		"HSTS_MAX_AGE":            setDuration(&c.HSTSMaxAge),
+		"HSTS_INCLUDE_SUBDOMAINS": setBool(&c.HSTSIncludeSubDomains),
+		"SMTP_ADDRESS":            setString(&c.SMTPAddr),
+		"SMTP_FROM":               setString(&c.SMTPFrom),
+		"SMTP_USERNAME":           setString(&c.SMTPUsername),
+		"SMTP_PASSWORD":           setString(&c.SMTPPassword),
 	}
 
+	var errs []error
 	for key, parseFn := range envMap {
-		parseFn(getenv(key))
+		if err := parseFn(getenv(key)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s value: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Set option to not negative decimal value if it not empty
+func setDecimal(o *decimal.Decimal) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			return nil
+		}
+		v, err := decimal.NewFromString(value)
+		if err != nil {
+			return err
+		}
+		if v.IsNegative() {
+			return fmt.Errorf("can't be negative: %s", value)
+		}
+		*o = v
+		return nil
+	}
+}
+
+// Set option to comma separated values if value not empty. Empty items are skipped
+func setList(o *[]string) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			return nil
+		}
+		var items []string
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*o = items
+		return nil
+	}
+}
+
+// Set option to comma separated CIDRs if value not empty. Single IP is treated as CIDR of one address
+func setPrefixes(o *[]netip.Prefix) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			return nil
+		}
+		var prefixes []netip.Prefix
+		for item := range strings.SplitSeq(value, ",") {
+			item = strings.TrimSpace(item)
+			if !strings.Contains(item, "/") {
+				addr, err := netip.ParseAddr(item)
+				if err != nil {
+					return err
+				}
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		*o = prefixes
+		return nil
 	}
 }
 
@@ -97,11 +433,100 @@ func (c *Config) ParseFlags(args []string) error {
 	fs := pflag.NewFlagSet("gophermart", pflag.ContinueOnError)
 
 	fs.StringVarP(&c.ListenAddr, "address", "a", c.ListenAddr, "Server listen address")
+	fs.StringVar(&c.ListenNetwork, "listen-network", c.ListenNetwork, "Network to listen (tcp, unix), unix if address is a path")
 	fs.StringVarP(&c.DatabaseDSN, "database", "d", c.DatabaseDSN, "Database connection string")
 	fs.StringVarP(&c.SecretKey, "secret-key", "s", c.SecretKey, "Secret key")
+	fs.BoolVar(&c.AllowWeakSecretKey, "allow-weak-secret-key", c.AllowWeakSecretKey, "Only warn if secret key is too short")
+	fs.StringVar(&c.TokenAlg, "token-alg", c.TokenAlg, "Algorithm to sign access tokens with (HS256, HS384, HS512)")
+	fs.Func("token-accepted-algs", "Comma separated algorithms of access tokens accepted besides the signing one", setList(&c.TokenAcceptedAlgs))
 	fs.StringVarP(&c.LogLevel, "log-level", "l", c.LogLevel, "Logging level (debug, info, warn, error)")
 	fs.StringVarP(&c.AccrualAddr, "accrual", "r", c.AccrualAddr, "Accrual service address")
+	fs.StringVar(&c.AccrualAPIKey, "accrual-api-key", c.AccrualAPIKey, "Accrual service API key")
+	fs.StringVar(&c.AccrualAPIKeyHeader, "accrual-api-key-header", c.AccrualAPIKeyHeader, "Header to send accrual service API key with")
+	fs.StringVar(&c.AccrualBasePath, "accrual-base-path", c.AccrualBasePath, "Accrual service orders path prefix")
+	fs.IntVar(&c.AccrualMaxConcurrentRequests, "accrual-max-concurrent", c.AccrualMaxConcurrentRequests, "Max requests sent to accrual service at the same time (0 is unlimited)")
+	fs.IntVar(&c.AccrualMaxIdleConns, "accrual-max-idle-conns", c.AccrualMaxIdleConns, "Idle connections to accrual service kept for reuse")
+	fs.DurationVar(&c.AccrualIdleTimeout, "accrual-idle-timeout", c.AccrualIdleTimeout, "How long idle connection to accrual service is kept")
 	fs.StringVarP(&c.Environment, "environment", "e", c.Environment, "Environment (dev, prod)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format (text, json), chosen by environment if not set")
+	fs.IntVar(&c.MaxActiveSessions, "max-sessions", c.MaxActiveSessions, "Max active sessions per user (0 is unlimited)")
+	fs.IntVar(&c.RefreshTokenBytes, "refresh-token-bytes", c.RefreshTokenBytes, "Refresh token random bytes length (at least 16)")
+	fs.DurationVar(&c.AccessTokenTTL, "access-token-ttl", c.AccessTokenTTL, "Access token lifetime (less than refresh token one)")
+	fs.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", c.RefreshTokenTTL, "Refresh token lifetime")
+	fs.IntVar(&c.AccrualMaxAttempts, "accrual-max-attempts", c.AccrualMaxAttempts, "Failed accrual requests before order is set INVALID")
+	fs.DurationVar(&c.OrderMaxAge, "order-max-age", c.OrderMaxAge, "Orders waiting for accrual longer than this since upload or reprocess are set INVALID (0 is never)")
+	fs.DurationVar(&c.OrderProcessTimeout, "order-process-timeout", c.OrderProcessTimeout, "Max time to get accrual of single order and apply it")
+	fs.BoolVar(&c.AccrualBatch, "accrual-batch", c.AccrualBatch, "Credit accruals of user's orders processed in the same cycle at once")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "Max time to handle http request")
+	fs.IntVar(&c.MaxConcurrentRequests, "max-concurrent-requests", c.MaxConcurrentRequests, "Max requests handled simultaneously (0 is unlimited)")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "Max time to read request headers")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Max time to read entire request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Max time to write response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "Max time to wait for the next request on keep-alive connection")
+	fs.IntVar(&c.RefreshRateLimit, "refresh-rate-limit", c.RefreshRateLimit, "Max token refresh requests per window from the same IP (0 disables)")
+	fs.DurationVar(&c.RefreshRateWindow, "refresh-rate-window", c.RefreshRateWindow, "Token refresh rate limit window")
+	fs.IntVar(&c.MaxOrdersPerUser, "max-orders-per-user", c.MaxOrdersPerUser, "Max orders single user may upload (0 is unlimited)")
+	fs.BoolVar(&c.SortableOrderIDs, "sortable-order-ids", c.SortableOrderIDs, "Generate time sortable (UUIDv7) ids of new orders")
+	fs.Func("max-withdrawal", "Max sum of single withdrawal (0 is unlimited)", setDecimal(&c.MaxWithdrawal))
+	fs.Func("withdrawal-limit", "Max sum of user's withdrawals within the window (0 is unlimited)", setDecimal(&c.WithdrawalLimit))
+	fs.DurationVar(&c.WithdrawalLimitWindow, "withdrawal-limit-window", c.WithdrawalLimitWindow, "Window of the user's withdrawals limit")
+	fs.Func("trusted-proxies", "Comma separated proxies (CIDRs or IPs) allowed to set X-Forwarded-For", setPrefixes(&c.TrustedProxies))
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", c.IdempotencyTTL, "How long response is replayed for repeated idempotency key")
+	fs.StringVar(&c.AccessCookieName, "access-cookie-name", c.AccessCookieName, "Cookie to read access token from if auth header not set")
+	fs.StringVar(&c.RefreshCookieName, "refresh-cookie-name", c.RefreshCookieName, "Cookie to keep refresh token in")
+	fs.StringVar(&c.AccessHeaderName, "access-header-name", c.AccessHeaderName, "Header to pass access token in")
+	fs.StringVar(&c.AccessAuthScheme, "access-auth-scheme", c.AccessAuthScheme, "Auth scheme of access token header")
+	fs.StringVar(&c.AmountUnit, "amount-unit", c.AmountUnit, "Label of amounts in balance responses (empty omits it)")
+	fs.DurationVar(&c.BalanceCacheTTL, "balance-cache-ttl", c.BalanceCacheTTL, "How long user's balance is cached (0 disables caching)")
+	fs.IntVar(&c.PageDefaultLimit, "page-default-limit", c.PageDefaultLimit, "Page size of lists if limit not set (0 is unlimited)")
+	fs.IntVar(&c.PageMaxLimit, "page-max-limit", c.PageMaxLimit, "Max page size of lists (0 is unlimited)")
+	fs.StringVar(&c.ContentSecurityPolicy, "content-security-policy", c.ContentSecurityPolicy, "Content-Security-Policy of responses (empty allows nothing)")
+	fs.DurationVar(&c.HSTSMaxAge, "hsts-max-age", c.HSTSMaxAge, "Strict-Transport-Security max age sent over TLS (0 disables)")
+	fs.BoolVar(&c.HSTSIncludeSubDomains, "hsts-include-subdomains", c.HSTSIncludeSubDomains, "Apply Strict-Transport-Security to subdomains too")
+	fs.Func("admin-usernames", "Comma separated usernames of admins allowed to use admin API", setList(&c.AdminUsernames))
+	fs.StringVar(&c.SMTPAddr, "smtp-address", c.SMTPAddr, "SMTP server address (host:port) to send emails with, no emails sent if empty")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", c.SMTPFrom, "Sender address of emails")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", c.SMTPUsername, "SMTP username")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", c.SMTPPassword, "SMTP password")
+	fs.BoolVar(&c.AutoMigrate, "auto-migrate", c.AutoMigrate, "Apply migrations on start")
+	fs.StringVar(&c.MigrationsDir, "migrations-dir", c.MigrationsDir, "Directory to read migrations from (embedded ones if empty)")
+	fs.BoolVar(&c.MigrateOnly, "migrate-only", c.MigrateOnly, "Apply migrations and exit")
 
 	return fs.Parse(args)
 }
+
+// Check options that depend on each other, so have to be checked after all sources are loaded
+func (c *Config) Validate() error {
+	// Router falls back to default request timeout if it's not set
+	requestTimeout := c.RequestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+
+	// Otherwise server closes connection before timed out request gets 503. Zero write timeout is unlimited
+	if c.WriteTimeout > 0 && c.WriteTimeout <= requestTimeout {
+		return fmt.Errorf("write timeout %s has to be greater than request timeout %s", c.WriteTimeout, requestTimeout)
+	}
+
+	// Zero window falls back to default, negative one would never let limited requests through
+	if c.RefreshRateLimit > 0 && c.RefreshRateWindow < 0 {
+		return fmt.Errorf("refresh rate window %s can't be negative", c.RefreshRateWindow)
+	}
+	return nil
+}
+
+// Return copy of config that is safe to log: DSN password and secret keys masked
+func (c *Config) Redacted() Config {
+	rc := *c
+	rc.DatabaseDSN = redact.DSN(c.DatabaseDSN)
+	if rc.SecretKey != "" {
+		rc.SecretKey = redact.Placeholder
+	}
+	if rc.AccrualAPIKey != "" {
+		rc.AccrualAPIKey = redact.Placeholder
+	}
+	if rc.SMTPPassword != "" {
+		rc.SMTPPassword = redact.Placeholder
+	}
+	return rc
+}
@@ -30,11 +30,22 @@ func run(ctx context.Context, getenv func(string) string, getwd func() (string,
 	if err != nil {
 		return fmt.Errorf("error while loading .env file: %w", err)
 	}
-	config.LoadEnv(getenv)
+	err = config.LoadEnv(getenv)
+	if err != nil {
+		return fmt.Errorf("error while loading environment: %w", err)
+	}
 	err = config.ParseFlags(args)
 	if err != nil {
 		return fmt.Errorf("error while parsing flags: %w", err)
 	}
+	err = config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if config.MigrateOnly {
+		return RunMigrations(config)
+	}
 
 	// Initialize context that cancelled on SIGTERM
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
@@ -35,6 +35,26 @@ func Test_run(t *testing.T) {
 		require.NoError(t, err, "on correct stop should not return error")
 	})
 
+	t.Run("start with unreachable accrual", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		t.Cleanup(cancel)
+
+		// Nobody listens on the port
+		accrualPort, err := testutil.RandomPort()
+		require.NoError(t, err)
+		serverPort, err := testutil.RandomPort()
+		require.NoError(t, err)
+
+		err = run(ctx, os.Getenv, os.Getwd, []string{
+			"--address", fmt.Sprintf("localhost:%d", serverPort),
+			"--accrual", fmt.Sprintf("http://127.0.0.1:%d", accrualPort),
+			"--database", pg.DSN,
+			"--secret-key", "secret",
+		})
+
+		require.NoError(t, err, "server has to start and stop even if accrual is unreachable")
+	})
+
 	t.Run("stop with srv error", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond) // Half Second
 		t.Cleanup(cancel)
@@ -43,4 +63,41 @@ func Test_run(t *testing.T) {
 		err := run(ctx, os.Getenv, os.Getwd, []string{})
 		require.Error(t, err, "on incorrect stop should return error")
 	})
+
+	t.Run("migrate only", func(t *testing.T) {
+		// Context is never canceled, so run returns only if server is not started
+		err := run(t.Context(), os.Getenv, os.Getwd, []string{
+			"--database", pg.DSN,
+			"--migrate-only",
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("migrate only from missing dir", func(t *testing.T) {
+		err := run(t.Context(), os.Getenv, os.Getwd, []string{
+			"--database", pg.DSN,
+			"--migrate-only",
+			"--migrations-dir", t.TempDir() + "/missing",
+		})
+
+		require.Error(t, err)
+	})
+
+	t.Run("start without auto migrate", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		t.Cleanup(cancel)
+		serverPort, err := testutil.RandomPort()
+		require.NoError(t, err)
+
+		err = run(ctx, os.Getenv, os.Getwd, []string{
+			"--address", fmt.Sprintf("localhost:%d", serverPort),
+			"--database", pg.DSN,
+			"--secret-key", "secret",
+			"--auto-migrate=false",
+			"--migrations-dir", t.TempDir() + "/missing",
+		})
+
+		require.NoError(t, err, "missing migrations must not be read if auto migrate disabled")
+	})
 }
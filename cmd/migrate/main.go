@@ -0,0 +1,119 @@
+// Apply, roll back or force database schema migrations
+//
+// Usage:
+//
+//	migrate [flags] up          apply all not applied migrations
+//	migrate [flags] down N      roll back N last applied migrations
+//	migrate [flags] version     print current schema version
+//	migrate [flags] force V     set schema version without running migrations, -1 means nothing applied
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/pflag"
+
+	"github.com/nkiryanov/gophermart/internal/db"
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func main() {
+	ctx := context.Background()
+	log := logger.NewDefault()
+
+	err := run(ctx, log, os.Getenv, os.Args[1:])
+	if err != nil {
+		log.Error("Migration error", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(_ context.Context, log logger.Logger, getenv func(string) string, args []string) error {
+	fs := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+	dsn := fs.StringP("database", "d", getenv("DATABASE_URI"), "Database connection string")
+	dir := fs.String("migrations-dir", getenv("MIGRATIONS_DIR"), "Directory to read migrations from (embedded ones if empty)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error while parsing flags: %w", err)
+	}
+	if *dsn == "" {
+		return errors.New("database connection string is required")
+	}
+
+	// Arguments are checked before connecting, so mistyped command never touches the schema
+	cmd, err := parseCommand(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	m, err := db.NewMigrator(*dsn, *dir, log)
+	if err != nil {
+		return err
+	}
+	defer m.Close() // nolint:errcheck
+
+	before, dirty, err := m.Version()
+	if err != nil {
+		return err
+	}
+	log.Info("Current schema version", "version", before, "dirty", dirty)
+
+	switch cmd.name {
+	case "up":
+		version, err := m.Up()
+		if err != nil {
+			return err
+		}
+		log.Info("Migrations applied", "from", before, "to", version)
+
+	case "down":
+		version, err := m.Down(cmd.arg)
+		if err != nil {
+			return err
+		}
+		log.Info("Migrations rolled back", "from", before, "to", version, "steps", cmd.arg)
+
+	case "force":
+		if err := m.Force(cmd.arg); err != nil {
+			return err
+		}
+		log.Warn("Schema version forced", "from", before, "to", cmd.arg)
+	}
+
+	return nil
+}
+
+type command struct {
+	name string
+	arg  int
+}
+
+func parseCommand(args []string) (command, error) {
+	if len(args) == 0 {
+		return command{}, errors.New("command is required: up, down N, version or force V")
+	}
+
+	cmd := command{name: args[0]}
+	switch cmd.name {
+	case "up", "version":
+		if len(args) != 1 {
+			return cmd, fmt.Errorf("%s takes no arguments", cmd.name)
+		}
+	case "down", "force":
+		// Rolling back everything is never implied, number of migrations has to be set explicitly
+		if len(args) != 2 {
+			return cmd, fmt.Errorf("%s takes exactly one number argument", cmd.name)
+		}
+		arg, err := strconv.Atoi(args[1])
+		if err != nil {
+			return cmd, fmt.Errorf("invalid %s argument %q: %w", cmd.name, args[1], err)
+		}
+		cmd.arg = arg
+	default:
+		return cmd, fmt.Errorf("unknown command %q", cmd.name)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/db"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+)
+
+func Test_run(t *testing.T) {
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	noEnv := func(string) string { return "" }
+	migrate := func(t *testing.T, args ...string) error {
+		return run(t.Context(), logger.NewNoOpLogger(), noEnv, append([]string{"--database", pg.DSN}, args...))
+	}
+	version := func(t *testing.T) (uint, bool) {
+		m, err := db.NewMigrator(pg.DSN, "", logger.NewNoOpLogger())
+		require.NoError(t, err)
+		defer m.Close() // nolint:errcheck
+		v, dirty, err := m.Version()
+		require.NoError(t, err)
+		return v, dirty
+	}
+
+	// Container is started with all migrations applied
+	latest, _ := version(t)
+	require.NotZero(t, latest)
+
+	t.Run("down and up", func(t *testing.T) {
+		err := migrate(t, "down", "1")
+		require.NoError(t, err)
+		v, _ := version(t)
+		require.Less(t, v, latest, "last migration has to be rolled back")
+
+		err = migrate(t, "up")
+		require.NoError(t, err)
+		v, _ = version(t)
+		require.Equal(t, latest, v)
+	})
+
+	t.Run("version", func(t *testing.T) {
+		err := migrate(t, "version")
+
+		require.NoError(t, err)
+	})
+
+	t.Run("down more than applied fail", func(t *testing.T) {
+		err := migrate(t, "down", "1000")
+
+		require.Error(t, err)
+		v, _ := version(t)
+		require.Equal(t, latest, v, "nothing has to be rolled back")
+	})
+
+	t.Run("force", func(t *testing.T) {
+		err := migrate(t, "force", "1")
+		require.NoError(t, err)
+		v, dirty := version(t)
+		require.EqualValues(t, 1, v)
+		require.False(t, dirty)
+
+		// Schema is not changed by force, so version is set back the same way
+		err = migrate(t, "force", strconv.FormatUint(uint64(latest), 10))
+		require.NoError(t, err)
+		v, _ = version(t)
+		require.Equal(t, latest, v)
+	})
+}
+
+func Test_parseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want command
+	}{
+		{[]string{"up"}, command{name: "up"}},
+		{[]string{"version"}, command{name: "version"}},
+		{[]string{"down", "2"}, command{name: "down", arg: 2}},
+		{[]string{"force", "-1"}, command{name: "force", arg: -1}},
+	} {
+		got, err := parseCommand(tt.args)
+
+		require.NoError(t, err, "args %v", tt.args)
+		require.Equal(t, tt.want, got)
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"sideways"},
+		{"up", "1"},
+		{"down"},
+		{"down", "all"},
+		{"force"},
+	} {
+		_, err := parseCommand(args)
+
+		require.Error(t, err, "args %v have to be rejected", args)
+	}
+}
@@ -0,0 +1,67 @@
+// Reconcile users balances with their transactions
+// Balance current and withdrawn are denormalized sums of transactions, the command finds (and optionally repairs) balances that drifted apart
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/nkiryanov/gophermart/internal/db"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/repository/postgres"
+	"github.com/nkiryanov/gophermart/internal/service/user"
+)
+
+func main() {
+	ctx := context.Background()
+	log := logger.NewDefault()
+
+	err := run(ctx, log, os.Getenv, os.Args[1:])
+	if err != nil {
+		log.Error("Reconciliation error", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, log logger.Logger, getenv func(string) string, args []string) error {
+	fs := pflag.NewFlagSet("reconcile", pflag.ContinueOnError)
+	dsn := fs.StringP("database", "d", getenv("DATABASE_URI"), "Database connection string")
+	repair := fs.Bool("repair", false, "Recalculate mismatched balances from transactions")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error while parsing flags: %w", err)
+	}
+	if *dsn == "" {
+		return errors.New("database connection string is required")
+	}
+
+	pool, err := db.Connect(ctx, *dsn)
+	if err != nil {
+		return fmt.Errorf("error while connecting to db. Err: %w", err)
+	}
+	defer pool.Close()
+
+	userService := user.NewService(user.DefaultHasher, postgres.NewStorage(pool))
+
+	mismatches, err := userService.ReconcileBalances(ctx, *repair)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		log.Warn("Balance mismatch",
+			"user_id", m.UserID,
+			"current", m.Current,
+			"expected_current", m.ExpectedCurrent,
+			"withdrawn", m.Withdrawn,
+			"expected_withdrawn", m.ExpectedWithdrawn,
+			"repaired", *repair,
+		)
+	}
+	log.Info("Reconciliation completed", "mismatches", len(mismatches), "repaired", *repair)
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Seed database with generated users, orders and transactions for load and performance testing
+// Data is inserted directly, bypassing HTTP API, rows are copied in bulk and committed in chunks of users
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/nkiryanov/gophermart/internal/db"
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func main() {
+	ctx := context.Background()
+	log := logger.NewDefault()
+
+	err := run(ctx, log, os.Getenv, os.Args[1:])
+	if err != nil {
+		log.Error("Seeding error", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, log logger.Logger, getenv func(string) string, args []string) error {
+	var cfg Config
+
+	fs := pflag.NewFlagSet("seed", pflag.ContinueOnError)
+	dsn := fs.StringP("database", "d", getenv("DATABASE_URI"), "Database connection string")
+	fs.IntVar(&cfg.Users, "users", 10, "Users to create")
+	fs.IntVar(&cfg.OrdersPerUser, "orders", 10, "Orders to create for every user")
+	fs.IntVar(&cfg.WithdrawalsPerUser, "withdrawals", 5, "Withdrawals to make for every user, skipped if balance is empty")
+	fs.IntVar(&cfg.ChunkSize, "chunk-size", defaultChunkSize, "Users committed in one transaction with their orders and transactions")
+	fs.StringVar(&cfg.UsernamePrefix, "username-prefix", "seed-user", "Prefix of created usernames, run id and index are appended")
+	fs.StringVar(&cfg.Password, "password", "password", "Password of every created user")
+	fs.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "Random seed, the same seed generates the same orders and transactions")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("error while parsing flags: %w", err)
+	}
+	if *dsn == "" {
+		return errors.New("database connection string is required")
+	}
+
+	pool, err := db.Connect(ctx, *dsn)
+	if err != nil {
+		return fmt.Errorf("error while connecting to db. Err: %w", err)
+	}
+	defer pool.Close()
+
+	started := time.Now()
+	stats, err := Seed(ctx, pool, cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Seeding completed",
+		"users", stats.Users,
+		"orders", stats.Orders,
+		"transactions", stats.Transactions,
+		"took", time.Since(started),
+	)
+	return nil
+}
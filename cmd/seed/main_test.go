@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository/postgres"
+	"github.com/nkiryanov/gophermart/internal/service/validate"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+)
+
+func Test_run(t *testing.T) {
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	err := run(t.Context(), logger.NewNoOpLogger(), func(string) string { return "" }, []string{
+		"--database", pg.DSN,
+		"--users", "3",
+		"--orders", "4",
+		"--withdrawals", "2",
+		"--seed", "42",
+		"--chunk-size", "2",
+	})
+	require.NoError(t, err)
+
+	count := func(query string) int {
+		var n int
+		err := pg.Pool.QueryRow(t.Context(), query).Scan(&n)
+		require.NoError(t, err)
+		return n
+	}
+	require.Equal(t, 3, count(`SELECT count(*) FROM users WHERE username LIKE 'seed-user-%'`))
+	require.Equal(t, 3, count(`SELECT count(*) FROM balances`))
+	require.Equal(t, 12, count(`SELECT count(*) FROM orders`))
+	require.Equal(t,
+		count(`SELECT count(*) FROM orders WHERE status = 'PROCESSED'`),
+		count(`SELECT count(*) FROM transactions WHERE type = 'ACCRUAL'`),
+		"every processed order has to be credited",
+	)
+
+	mismatches, err := postgres.NewStorage(pg.Pool).Balance().ListBalanceMismatches(t.Context(), false)
+	require.NoError(t, err)
+	require.Empty(t, mismatches, "balances have to match seeded transactions")
+}
+
+func Test_orderNumber(t *testing.T) {
+	g := newGenerator(1)
+	seen := make(map[string]bool)
+
+	for range 100 {
+		number := g.orderNumber()
+
+		require.NoError(t, validate.Luhn(number), "order number %s has to be valid", number)
+		require.False(t, seen[number], "order number %s generated twice", number)
+		seen[number] = true
+	}
+}
+
+func Test_userData(t *testing.T) {
+	g := newGenerator(1)
+	userID := uuid.New()
+
+	orders, transactions := g.userData(userID, 20, 5)
+
+	require.Len(t, orders, 20)
+	current, withdrawn := decimal.Zero, decimal.Zero
+	for _, tr := range transactions {
+		current = current.Add(tr.SignedAmount())
+		if tr.Type == models.TransactionTypeWithdrawal {
+			withdrawn = withdrawn.Add(tr.Amount)
+		}
+	}
+	require.False(t, current.IsNegative(), "withdrawals must not exceed accruals")
+
+	totalCurrent, totalWithdrawn := totals(transactions)
+	require.True(t, current.Equal(totalCurrent), "totals have to change balance as transactions do")
+	require.True(t, withdrawn.Equal(totalWithdrawn))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository/postgres"
+	"github.com/nkiryanov/gophermart/internal/service/user"
+)
+
+// Orders are uploaded within the period before now
+const ordersPeriod = 30 * 24 * time.Hour
+
+type Config struct {
+	Users              int
+	OrdersPerUser      int
+	WithdrawalsPerUser int
+
+	// Users committed in one transaction with their orders and transactions
+	// If not set than defaultChunkSize is used
+	ChunkSize int
+
+	// Usernames are unique per run: '<prefix>-<run id>-<index>'
+	UsernamePrefix string
+	Password       string
+
+	// Random seed of orders and transactions
+	Seed int64
+}
+
+const defaultChunkSize = 1000
+
+// Rows created by Seed
+type Stats struct {
+	Users        int
+	Orders       int
+	Transactions int
+}
+
+type txBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Create users with orders and transactions, every chunk of users is committed in own transaction
+// Orders get random status, processed ones are credited. Withdrawals never exceed user's balance,
+// so balances are consistent with transactions
+// If seeding fails, chunks committed before are kept and counted in returned stats
+func Seed(ctx context.Context, db txBeginner, cfg Config) (Stats, error) {
+	var stats Stats
+	if cfg.Users < 0 || cfg.OrdersPerUser < 0 || cfg.WithdrawalsPerUser < 0 || cfg.ChunkSize < 0 {
+		return stats, fmt.Errorf("counts can't be negative: users %d, orders %d, withdrawals %d, chunk %d", cfg.Users, cfg.OrdersPerUser, cfg.WithdrawalsPerUser, cfg.ChunkSize)
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = defaultChunkSize
+	}
+
+	// Hashing is slow, every user gets the same hash
+	hash, err := user.DefaultHasher.Hash(cfg.Password)
+	if err != nil {
+		return stats, fmt.Errorf("can't hash password: %w", err)
+	}
+
+	g := newGenerator(cfg.Seed)
+	for from := 0; from < cfg.Users; from += cfg.ChunkSize {
+		chunk := g.chunk(from, min(from+cfg.ChunkSize, cfg.Users), cfg, hash)
+		if err := seedChunk(ctx, db, chunk); err != nil {
+			return stats, err
+		}
+
+		stats.Users += len(chunk.users)
+		stats.Orders += len(chunk.orders)
+		stats.Transactions += len(chunk.transactions)
+	}
+
+	return stats, nil
+}
+
+// Rows of users committed together
+type chunk struct {
+	users        []models.User
+	balances     []models.Balance
+	orders       []models.Order
+	transactions []models.Transaction
+}
+
+// Users with indexes in [from, to) and their data. IDs are generated here, so rows are copied in bulk
+func (g *generator) chunk(from int, to int, cfg Config, hash string) chunk {
+	var c chunk
+	for i := from; i < to; i++ {
+		u := models.User{
+			ID:             uuid.New(),
+			CreatedAt:      g.now,
+			Username:       fmt.Sprintf("%s-%d-%d", cfg.UsernamePrefix, g.runID, i),
+			HashedPassword: hash,
+		}
+		userOrders, userTransactions := g.userData(u.ID, cfg.OrdersPerUser, cfg.WithdrawalsPerUser)
+		current, withdrawn := totals(userTransactions)
+
+		c.users = append(c.users, u)
+		c.balances = append(c.balances, models.Balance{ID: uuid.New(), UserID: u.ID, Current: current, Withdrawn: withdrawn})
+		c.orders = append(c.orders, userOrders...)
+		c.transactions = append(c.transactions, userTransactions...)
+	}
+	return c
+}
+
+func seedChunk(ctx context.Context, db txBeginner, c chunk) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("can't begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // nolint:errcheck
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"users"},
+		[]string{"id", "created_at", "username", "password_hash"},
+		pgx.CopyFromSlice(len(c.users), func(i int) ([]any, error) {
+			u := c.users[i]
+			return []any{u.ID, u.CreatedAt, u.Username, u.HashedPassword}, nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("can't copy users: %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"balances"},
+		[]string{"id", "user_id", "current", "withdrawn"},
+		pgx.CopyFromSlice(len(c.balances), func(i int) ([]any, error) {
+			b := c.balances[i]
+			return []any{b.ID, b.UserID, b.Current, b.Withdrawn}, nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("can't copy balances: %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"orders"},
+		[]string{"id", "uploaded_at", "modified_at", "number", "user_id", "status", "accrual"},
+		pgx.CopyFromSlice(len(c.orders), func(i int) ([]any, error) {
+			o := c.orders[i]
+			return []any{o.ID, o.UploadedAt, o.ModifiedAt, o.Number, o.UserID, o.Status, o.Accrual}, nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("can't copy orders: %w", err)
+	}
+
+	if err := postgres.NewStorage(tx).Balance().BulkCreateTransactions(ctx, c.transactions); err != nil {
+		return fmt.Errorf("can't create transactions: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("can't commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Balance after the transactions: current amount and withdrawn sum
+func totals(transactions []models.Transaction) (current decimal.Decimal, withdrawn decimal.Decimal) {
+	current, withdrawn = decimal.Zero, decimal.Zero
+	for _, t := range transactions {
+		current = current.Add(t.SignedAmount())
+		if t.Type == models.TransactionTypeWithdrawal {
+			withdrawn = withdrawn.Add(t.Amount)
+		}
+	}
+	return current, withdrawn
+}
+
+type generator struct {
+	rnd *rand.Rand
+	now time.Time
+
+	// Order numbers are '<run id><counter><check digit>', so they are unique across runs
+	runID   int64
+	counter int
+}
+
+func newGenerator(seed int64) *generator {
+	now := time.Now()
+	return &generator{
+		rnd:   rand.New(rand.NewPCG(uint64(seed), uint64(seed))),
+		now:   now,
+		runID: now.Unix(),
+	}
+}
+
+// Random orders of the user and transactions of them. Withdrawals are made after all accruals
+func (g *generator) userData(userID uuid.UUID, orderCount int, withdrawalCount int) ([]models.Order, []models.Transaction) {
+	orders := make([]models.Order, 0, orderCount)
+	var transactions []models.Transaction
+
+	current := decimal.Zero
+	lastAccrual := g.now.Add(-ordersPeriod)
+	for range orderCount {
+		uploadedAt := g.now.Add(-time.Duration(g.rnd.Int64N(int64(ordersPeriod))))
+		o := models.Order{
+			ID:         uuid.New(),
+			Number:     g.orderNumber(),
+			UserID:     userID,
+			Status:     models.OrderStatuses[g.rnd.IntN(len(models.OrderStatuses))],
+			UploadedAt: uploadedAt,
+			ModifiedAt: uploadedAt,
+		}
+		if o.Status == models.OrderStatusProcessed {
+			accrual := g.amount(1000)
+			o.Accrual = &accrual
+			o.ModifiedAt = uploadedAt.Add(time.Duration(g.rnd.Int64N(int64(time.Hour))))
+
+			t, _ := models.NewAccrual(userID, o.Number, accrual)
+			t.ProcessedAt = o.ModifiedAt
+			transactions = append(transactions, t)
+			current = current.Add(accrual)
+			if o.ModifiedAt.After(lastAccrual) {
+				lastAccrual = o.ModifiedAt
+			}
+		}
+		orders = append(orders, o)
+	}
+
+	for range withdrawalCount {
+		if current.LessThan(decimal.NewFromInt(1)) {
+			break
+		}
+		amount := decimal.Min(g.amount(100), current)
+		t, _ := models.NewWithdrawal(userID, g.orderNumber(), amount)
+		t.ProcessedAt = lastAccrual.Add(time.Duration(g.rnd.Int64N(int64(g.now.Sub(lastAccrual)) + 1)))
+		transactions = append(transactions, t)
+		current = current.Sub(amount)
+	}
+
+	return orders, transactions
+}
+
+// Random positive amount up to max with cents
+func (g *generator) amount(max int64) decimal.Decimal {
+	return decimal.New(g.rnd.Int64N(max*100)+1, -2)
+}
+
+// Next unique order number valid by Luhn algorithm
+func (g *generator) orderNumber() string {
+	g.counter++
+	payload := strconv.FormatInt(g.runID, 10) + fmt.Sprintf("%07d", g.counter)
+	return payload + strconv.Itoa(luhnCheckDigit(payload))
+}
+
+// Digit to append to the payload, so the number is valid by Luhn algorithm
+func luhnCheckDigit(payload string) int {
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		digit := int(payload[i] - '0')
+		// Check digit takes the rightmost position, so doubling starts from the last payload digit
+		if (len(payload)-1-i)%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return (10 - sum%10) % 10
+}
@@ -4,19 +4,96 @@ import (
 	"errors"
 )
 
+// Error codes are stable identifiers that can be passed to clients
+const (
+	CodeInternal = "internal_error"
+
+	CodeUserAlreadyExists = "user_already_exists"
+	CodeUserNotFound      = "user_not_found"
+
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeEmailInvalid       = "email_invalid"
+
+	CodeRefreshTokenNotFound = "refresh_token_not_found"
+	CodeRefreshTokenIsUsed   = "refresh_token_used"
+	CodeRefreshTokenExpired  = "refresh_token_expired"
+	CodeRefreshTokenRevoked  = "refresh_token_revoked"
+
+	CodeAccessTokenExpired = "access_token_expired"
+	CodeAccessTokenInvalid = "access_token_invalid"
+
+	CodeSessionNotFound = "session_not_found"
+
+	CodeOrderNumberTaken      = "order_number_taken"
+	CodeOrderAlreadyExists    = "order_already_exists"
+	CodeOrderNumberInvalid    = "order_number_invalid"
+	CodeOrderNotFound         = "order_not_found"
+	CodeOrderAlreadyProcessed = "order_already_processed"
+	CodeOrderLimitExceeded    = "order_limit_exceeded"
+	CodeOrderNotReprocessable = "order_not_reprocessable"
+
+	CodeBalanceInsufficient = "balance_insufficient"
+	CodeWithdrawalTooLarge  = "withdrawal_too_large"
+
+	CodeWithdrawalLimitExceeded = "withdrawal_limit_exceeded"
+)
+
 var (
-	ErrUserAlreadyExists = errors.New("user already exists")
-	ErrUserNotFound      = errors.New("user not found")
+	ErrUserAlreadyExists = New(CodeUserAlreadyExists, "user already exists")
+	ErrUserNotFound      = New(CodeUserNotFound, "user not found")
 
-	ErrRefreshTokenNotFound = errors.New("refresh token not found")
-	ErrRefreshTokenIsUsed   = errors.New("refresh token is used")
-	ErrRefreshTokenExpired  = errors.New("refresh token is expired")
+	ErrInvalidCredentials = New(CodeInvalidCredentials, "invalid credentials")
+	ErrEmailInvalid       = New(CodeEmailInvalid, "email is invalid")
 
-	ErrOrderNumberTaken      = errors.New("order number already exists for different user")
-	ErrOrderAlreadyExists    = errors.New("order already exists for this user")
-	ErrOrderNumberInvalid    = errors.New("order number is invalid")
-	ErrOrderNotFound         = errors.New("order not found")
-	ErrOrderAlreadyProcessed = errors.New("order already processed")
+	ErrRefreshTokenNotFound = New(CodeRefreshTokenNotFound, "refresh token not found")
+	ErrRefreshTokenIsUsed   = New(CodeRefreshTokenIsUsed, "refresh token is used")
+	ErrRefreshTokenExpired  = New(CodeRefreshTokenExpired, "refresh token is expired")
+	ErrRefreshTokenRevoked  = New(CodeRefreshTokenRevoked, "refresh token is revoked")
 
-	ErrBalanceInsufficient = errors.New("insufficient balance")
+	ErrAccessTokenExpired = New(CodeAccessTokenExpired, "access token is expired")
+	ErrAccessTokenInvalid = New(CodeAccessTokenInvalid, "access token is invalid")
+
+	ErrSessionNotFound = New(CodeSessionNotFound, "session not found")
+
+	ErrOrderNumberTaken      = New(CodeOrderNumberTaken, "order number already exists for different user")
+	ErrOrderAlreadyExists    = New(CodeOrderAlreadyExists, "order already exists for this user")
+	ErrOrderNumberInvalid    = New(CodeOrderNumberInvalid, "order number is invalid")
+	ErrOrderNotFound         = New(CodeOrderNotFound, "order not found")
+	ErrOrderAlreadyProcessed = New(CodeOrderAlreadyProcessed, "order already processed")
+	ErrOrderLimitExceeded    = New(CodeOrderLimitExceeded, "orders limit per user exceeded")
+	ErrOrderNotReprocessable = New(CodeOrderNotReprocessable, "only invalid order may be reprocessed")
+
+	ErrBalanceInsufficient = New(CodeBalanceInsufficient, "insufficient balance")
+	ErrWithdrawalTooLarge  = New(CodeWithdrawalTooLarge, "withdrawal exceeds max amount")
+
+	ErrWithdrawalLimitExceeded = New(CodeWithdrawalLimitExceeded, "withdrawals limit for the period exceeded")
 )
+
+// Application error with code
+// Sentinels are pointers, so errors.Is matches them even if wrapped with fmt.Errorf("...: %w", err)
+type Error struct {
+	Code    string
+	Message string
+}
+
+func New(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Return code of the first application error in the chain
+// Empty for nil error and CodeInternal for errors without code
+func Code(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+	return CodeInternal
+}
@@ -0,0 +1,45 @@
+package apperrors
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"sentinel", ErrOrderNotFound, CodeOrderNotFound},
+		{"wrapped", fmt.Errorf("get order: %w", ErrOrderNotFound), CodeOrderNotFound},
+		{"wrapped twice", fmt.Errorf("tx failed. Err: %w", fmt.Errorf("withdraw: %w", ErrBalanceInsufficient)), CodeBalanceInsufficient},
+		{"joined", errors.Join(errors.New("other"), ErrUserNotFound), CodeUserNotFound},
+		{"custom", New("custom_code", "custom"), "custom_code"},
+		{"unknown", errors.New("db error"), CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Code(tt.err))
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	t.Run("sentinels work with errors.Is", func(t *testing.T) {
+		err := fmt.Errorf("refresh: %w", ErrRefreshTokenIsUsed)
+
+		require.ErrorIs(t, err, ErrRefreshTokenIsUsed)
+		require.NotErrorIs(t, err, ErrRefreshTokenExpired)
+		require.Equal(t, "refresh: refresh token is used", err.Error(), "message has to stay the same")
+	})
+
+	t.Run("errors with same code are different", func(t *testing.T) {
+		require.NotErrorIs(t, New(CodeUserNotFound, "user not found"), ErrUserNotFound, "only sentinel itself matches")
+	})
+}
@@ -0,0 +1,93 @@
+// Package cache provides simple in-memory cache with TTL safe for concurrent use
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// In-memory cache with TTL for every entry
+//
+// Cache is filled with values read from storage, that may be changed concurrently.
+// To never cache stale value, take Generation before reading the storage and pass it to Set:
+// the value is dropped if any key was deleted meanwhile.
+type Cache[K comparable, V any] struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu         sync.Mutex
+	items      map[K]entry[V]
+	generation uint64
+	lastSweep  time.Time
+}
+
+func New[K comparable, V any](ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:   ttl,
+		now:   time.Now,
+		items: make(map[K]entry[V]),
+	}
+}
+
+// Return not expired value by the key
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok || !c.now().Before(e.expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Current generation. It changes on every Delete
+func (c *Cache[K, V]) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Set value if cache not changed since the generation was taken
+// Returns whether the value is set
+func (c *Cache[K, V]) Set(key K, value V, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return false
+	}
+
+	now := c.now()
+	c.sweep(now)
+	c.items[key] = entry[V]{value: value, expiresAt: now.Add(c.ttl)}
+	return true
+}
+
+// Delete value by the key and drop all values being set concurrently
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items, key)
+	c.generation++
+}
+
+// Drop expired entries from time to time, so cache doesn't grow forever
+func (c *Cache[K, V]) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	for k, e := range c.items {
+		if !now.Before(e.expiresAt) {
+			delete(c.items, k)
+		}
+	}
+	c.lastSweep = now
+}
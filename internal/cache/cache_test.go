@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	// Cache with controlled clock
+	newCache := func(ttl time.Duration) (*Cache[string, int], *time.Time) {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := New[string, int](ttl)
+		c.now = func() time.Time { return now }
+		return c, &now
+	}
+
+	t.Run("set and get", func(t *testing.T) {
+		c, _ := newCache(time.Minute)
+
+		ok := c.Set("key", 1, c.Generation())
+
+		require.True(t, ok)
+		got, ok := c.Get("key")
+		require.True(t, ok)
+		require.Equal(t, 1, got)
+		_, ok = c.Get("other")
+		require.False(t, ok)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c, now := newCache(time.Minute)
+		c.Set("key", 1, c.Generation())
+
+		*now = now.Add(time.Minute)
+
+		_, ok := c.Get("key")
+		require.False(t, ok, "value has to expire after ttl")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c, _ := newCache(time.Minute)
+		c.Set("key", 1, c.Generation())
+
+		c.Delete("key")
+
+		_, ok := c.Get("key")
+		require.False(t, ok)
+	})
+
+	t.Run("stale set dropped", func(t *testing.T) {
+		c, _ := newCache(time.Minute)
+		generation := c.Generation()
+
+		// Value changed and invalidated while the old one was being read
+		c.Delete("key")
+		ok := c.Set("key", 1, generation)
+
+		require.False(t, ok, "value read before delete must not be cached")
+		_, ok = c.Get("key")
+		require.False(t, ok)
+	})
+
+	t.Run("expired entries swept", func(t *testing.T) {
+		c, now := newCache(time.Minute)
+		c.Set("old", 1, c.Generation())
+
+		*now = now.Add(2 * time.Minute)
+		c.Set("new", 2, c.Generation())
+
+		require.Len(t, c.items, 1, "expired entries has to be removed")
+	})
+}
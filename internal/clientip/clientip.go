@@ -0,0 +1,20 @@
+// Package clientip keeps IP of the client the request is made by in context
+// It's set by handlers and read by services, e.g. to audit money movements, so it depends on neither of them
+package clientip
+
+import "context"
+
+type ctxKey string
+
+const ipKey ctxKey = "client_ip"
+
+// Create a new context with the client IP
+func New(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ipKey, ip)
+}
+
+// Extract the client IP from the context. Not ok if it's not set or empty
+func FromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(ipKey).(string)
+	return ip, ok && ip != ""
+}
@@ -0,0 +1,2 @@
+alter table refresh_tokens add column revoked_at timestamptz;
+create index idx_refresh_tokens_user_id on refresh_tokens(user_id);
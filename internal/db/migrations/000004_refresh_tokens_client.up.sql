@@ -0,0 +1,2 @@
+alter table refresh_tokens add column user_agent text;
+alter table refresh_tokens add column ip text;
@@ -0,0 +1,5 @@
+create table order_poll_states (
+    order_number varchar(255) primary key references orders(number) on delete cascade,
+    attempts int not null default 0,
+    next_poll_at timestamptz not null
+);
@@ -0,0 +1,4 @@
+create table order_claims (
+    order_number varchar(255) primary key references orders(number) on delete cascade,
+    claimed_until timestamptz not null
+);
@@ -0,0 +1,4 @@
+create table order_reprocesses (
+    order_number varchar(255) primary key references orders(number) on delete cascade,
+    reprocessed_at timestamptz not null
+);
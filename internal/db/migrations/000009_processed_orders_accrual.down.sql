@@ -0,0 +1 @@
+/* accrual of processed orders is kept, it was null only because nothing was accrued */
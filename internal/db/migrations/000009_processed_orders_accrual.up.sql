@@ -0,0 +1,2 @@
+/* processed order always has accrual, orders processed without one accrued nothing */
+update orders set accrual = 0 where status = 'PROCESSED' and accrual is null;
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+// Apply, roll back and force schema migrations
+// Errors never contain DSN password
+type Migrator struct {
+	m   *migrate.Migrate
+	dsn string
+
+	// Migrations source, walked to count applied migrations
+	source source.Driver
+}
+
+// Migrator of migrations from the directory. Embedded migrations are used if dir is empty
+// Every applied or rolled back migration is logged with info level. Has to be closed after use
+func NewMigrator(dsn string, dir string, l logger.Logger) (*Migrator, error) {
+	m, src, err := newMigrate(dsn, dir)
+	if err != nil {
+		return nil, redactErr(err, dsn)
+	}
+	m.Log = migrateLogger{l}
+	return &Migrator{m: m, dsn: dsn, source: src}, nil
+}
+
+func newMigrate(dsn string, dir string) (*migrate.Migrate, source.Driver, error) {
+	var fsys fs.FS = migrations
+	path := "migrations"
+	if dir != "" {
+		fsys, path = os.DirFS(dir), "."
+	}
+
+	src, err := iofs.New(fsys, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while reading migrations. Err: %w", err)
+	}
+
+	m, err := migrate.NewWithSourceInstance(
+		"iofs",
+		src,
+		strings.NewReplacer(
+			"postgres://", "pgx5://", // golang-migrate expects dsn in format 'pgx5://...' only, make it happy with 'postgres://...'
+			"postgresql://", "pgx5://", // golang-migrate expects
+		).Replace(dsn),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while preparing migrator. Err: %w", err)
+	}
+	return m, src, nil
+}
+
+// Apply all not applied migrations and return schema version
+func (m *Migrator) Up() (uint, error) {
+	err := m.m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return 0, redactErr(fmt.Errorf("error while applying migrations. Err: %w", err), m.dsn)
+	}
+	return m.current()
+}
+
+// Roll back n last applied migrations and return schema version. Zero version means nothing is applied
+// Nothing is rolled back if there are less than n applied migrations
+func (m *Migrator) Down(n int) (uint, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("number of migrations to roll back must be positive: %d", n)
+	}
+
+	version, _, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := m.applied(version)
+	if err != nil {
+		return 0, err
+	}
+	if n > applied {
+		return 0, fmt.Errorf("can't roll back %d migrations, only %d applied", n, applied)
+	}
+
+	err = m.m.Steps(-n)
+	if err != nil {
+		return 0, redactErr(fmt.Errorf("error while rolling back migrations. Err: %w", err), m.dsn)
+	}
+	return m.current()
+}
+
+// Current schema version and whether the last migration failed and left schema dirty
+// Zero version means nothing is applied
+func (m *Migrator) Version() (uint, bool, error) {
+	version, dirty, err := m.m.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, redactErr(fmt.Errorf("error while reading migrations version. Err: %w", err), m.dsn)
+	default:
+		return version, dirty, nil
+	}
+}
+
+// Set schema version without running migrations and clear dirty flag
+// Used to recover after failed migration was fixed manually. Version -1 means nothing is applied
+func (m *Migrator) Force(version int) error {
+	if version < -1 {
+		return fmt.Errorf("invalid version to force: %d", version)
+	}
+	if err := m.m.Force(version); err != nil {
+		return redactErr(fmt.Errorf("error while forcing migrations version. Err: %w", err), m.dsn)
+	}
+	return nil
+}
+
+func (m *Migrator) Close() error {
+	sourceErr, dbErr := m.m.Close()
+	return redactErr(errors.Join(sourceErr, dbErr), m.dsn)
+}
+
+func (m *Migrator) current() (uint, error) {
+	version, _, err := m.Version()
+	return version, err
+}
+
+// Number of migrations up to the version
+func (m *Migrator) applied(version uint) (int, error) {
+	if version == 0 {
+		return 0, nil
+	}
+
+	// Source is walked from the first migration, versions are not required to be sequential
+	count := 1
+	for v, err := m.source.First(); v != version; v, err = m.source.Next(v) {
+		if err != nil {
+			return 0, fmt.Errorf("applied version %d not found in migrations. Err: %w", version, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Log migrations golang-migrate reports
+type migrateLogger struct {
+	l logger.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...any) {
+	l.l.Info("Migration: " + strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+func (l migrateLogger) Verbose() bool {
+	return false
+}
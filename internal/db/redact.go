@@ -0,0 +1,33 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/nkiryanov/gophermart/internal/redact"
+)
+
+// Error that hides DSN and its password from the message
+// The original error is still available with errors.Is and errors.As
+type dsnError struct {
+	err error
+	dsn string
+}
+
+func redactErr(err error, dsn string) error {
+	if err == nil || dsn == "" {
+		return err
+	}
+	return &dsnError{err: err, dsn: dsn}
+}
+
+func (e *dsnError) Error() string {
+	msg := strings.ReplaceAll(e.err.Error(), e.dsn, redact.DSN(e.dsn))
+	for _, password := range redact.DSNPasswords(e.dsn) {
+		msg = strings.ReplaceAll(msg, password, redact.Placeholder)
+	}
+	return msg
+}
+
+func (e *dsnError) Unwrap() error {
+	return e.err
+}
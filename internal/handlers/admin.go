@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+// Create user's order in any status, e.g. to replay accrual for support. Balance is not changed
+// Accrual may be set only for PROCESSED order, it's zero if not set
+func handleAdminCreateOrder(orderService orderService, l logger.Logger) http.Handler {
+	type request struct {
+		UserID  uuid.UUID        `json:"user_id" validate:"required"`
+		Number  string           `json:"number" validate:"required"`
+		Status  string           `json:"status" validate:"omitempty,oneof=NEW PROCESSING INVALID PROCESSED"`
+		Accrual *decimal.Decimal `json:"accrual"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := render.BindAndValidate[request](w, r)
+		if err != nil {
+			return
+		}
+
+		if data.Accrual != nil && data.Status != models.OrderStatusProcessed {
+			render.Error(w, r, "Accrual may be set only for PROCESSED order", http.StatusUnprocessableEntity)
+			return
+		}
+		if data.Accrual != nil && data.Accrual.IsNegative() {
+			render.Error(w, r, "Accrual can't be negative", http.StatusUnprocessableEntity)
+			return
+		}
+		// Processed order always has accrual, as the one processed by accrual service
+		if data.Status == models.OrderStatusProcessed && data.Accrual == nil {
+			zero := decimal.Zero
+			data.Accrual = &zero
+		}
+
+		var opts []repository.CreateOrderOption
+		if data.Status != "" {
+			opts = append(opts, repository.WithOrderStatus(data.Status))
+		}
+		if data.Accrual != nil {
+			opts = append(opts, repository.WithOrderAccrual(*data.Accrual))
+		}
+
+		order, err := orderService.CreateOrder(r.Context(), data.Number, &models.User{ID: data.UserID}, opts...)
+
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		requestLogger(r, l).Info("Order created by admin", "order_number", order.Number, "owner_id", order.UserID, "status", order.Status)
+		render.JSONWithStatus(w, orderToResponse(&order, amountFormat(r)), http.StatusCreated)
+	})
+}
+
+// Reset INVALID order to NEW, so it's polled from accrual service again
+func handleAdminReprocessOrder(orderService orderService, l logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := userctx.FromContext(r.Context())
+		if !ok {
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		order, err := orderService.ReprocessOrder(r.Context(), r.PathValue("number"), admin.Username)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		render.JSON(w, orderToResponse(&order, amountFormat(r)))
+	})
+}
+
+// Enable or disable maintenance: user API answers 503 while it's enabled
+func handleAdminMaintenance(maintenance *atomic.Bool, l logger.Logger) http.Handler {
+	type request struct {
+		Enabled *bool `json:"enabled" validate:"required"`
+	}
+	type response struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := render.BindAndValidate[request](w, r)
+		if err != nil {
+			return
+		}
+
+		if maintenance.Swap(*data.Enabled) != *data.Enabled {
+			admin, _ := userctx.FromContext(r.Context())
+			requestLogger(r, l).Warn("Maintenance mode changed", "enabled", *data.Enabled, "admin", admin.Username)
+		}
+		render.JSON(w, response{Enabled: *data.Enabled})
+	})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/middleware"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+)
+
+// Auth service authenticating every request as the user
+type adminAuth models.User
+
+func (a adminAuth) GetUserFromRequest(context.Context, *http.Request) (models.User, error) {
+	return models.User(a), nil
+}
+
+func TestAdminCreateOrder(t *testing.T) {
+	h := handleAdminCreateOrder(&orderServiceMock{}, logger.NewNoOpLogger())
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("created", func(t *testing.T) {
+		w := post(`{"user_id": "` + uuid.NewString() + `", "number": "4561261212345467"}`)
+
+		require.Equal(t, http.StatusCreated, w.Code)
+	})
+
+	t.Run("user id required", func(t *testing.T) {
+		w := post(`{"number": "4561261212345467"}`)
+
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		require.JSONEq(t, `{
+			"error": "validation_failed",
+			"message": "Request validation failed",
+			"fields": {"user_id": "This field is required"}
+		}`, w.Body.String())
+	})
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	t.Run("toggle", func(t *testing.T) {
+		var maintenance atomic.Bool
+		h := handleAdminMaintenance(&maintenance, logger.NewNoOpLogger())
+		post := func(body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(body))
+			r = r.WithContext(userctx.New(r.Context(), models.User{Username: "root"}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+
+		w := post(`{"enabled": true}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"enabled": true}`, w.Body.String())
+		require.True(t, maintenance.Load())
+
+		w = post(`{"enabled": false}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.False(t, maintenance.Load())
+
+		w = post(`{}`)
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code, "enabled has to be set explicitly")
+		require.False(t, maintenance.Load())
+	})
+
+	t.Run("change logged with admin id", func(t *testing.T) {
+		var maintenance atomic.Bool
+		admin := models.User{ID: uuid.New(), Username: "root"}
+		buf := &bytes.Buffer{}
+		h := middleware.LoggerMiddleware(logger.NewWithHandler(slog.NewJSONHandler(buf, nil)))(
+			middleware.AuthMiddleware(adminAuth(admin))(
+				handleAdminMaintenance(&maintenance, logger.NewNoOpLogger()),
+			),
+		)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(`{"enabled": true}`)))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+		require.Len(t, lines, 2, "handler and access logs expected")
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(lines[0], &record))
+		require.Equal(t, "Maintenance mode changed", record["msg"])
+		require.Equal(t, admin.ID.String(), record["user_id"], "handler has to log with request scoped logger")
+	})
+
+	t.Run("user API unavailable while health is up", func(t *testing.T) {
+		var maintenance atomic.Bool
+		maintenance.Store(true)
+		// Requests under maintenance never reach services, so router can be created without them
+		router := NewRouter(Config{Maintenance: &maintenance}, nil, nil, nil, logger.NewNoOpLogger())
+		serve := func(method string, url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+			return w
+		}
+
+		for _, url := range []string{"/api/user/orders", "/api/user/balance", "/api/user/register"} {
+			w := serve(http.MethodGet, url)
+
+			require.Equal(t, http.StatusServiceUnavailable, w.Code, url)
+			require.Equal(t, "60", w.Header().Get("Retry-After"), url)
+		}
+		// Login is reached, so admin is able to get token to turn maintenance off. Empty body is rejected before service call
+		require.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/api/user/login").Code)
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/ping").Code)
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, "/health/ready").Code)
+	})
+}
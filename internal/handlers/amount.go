@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shopspring/decimal"
+)
+
+// Money amount in responses
+// Encoded as JSON number by default or as decimal string (e.g. "1000.01") if client asks '?format=string'
+// The number is exact decimal literal: it's never converted to float64 that can't represent cents precisely
+type amount struct {
+	value    decimal.Decimal
+	asString bool
+}
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	if a.asString {
+		return json.Marshal(a.value.StringFixed(2))
+	}
+	// decimal.Decimal marshals to quoted string by default, so write the literal as is
+	return []byte(a.value.String()), nil
+}
+
+// Return constructor of amounts in format requested by client
+func amountFormat(r *http.Request) func(decimal.Decimal) amount {
+	asString := r.URL.Query().Get("format") == "string"
+	return func(d decimal.Decimal) amount {
+		return amount{value: d, asString: asString}
+	}
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAmount(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		value string
+		want  string
+	}{
+		{"number by default", "/balance", "1000.5", `1000.5`},
+		{"string", "/balance?format=string", "1000.5", `"1000.50"`},
+		{"string keeps cents", "/balance?format=string", "0.01", `"0.01"`},
+		{"string keeps large values exact", "/balance?format=string", "99999999.99", `"99999999.99"`},
+		{"unknown format is number", "/balance?format=xml", "1", `1`},
+		{"number keeps value float64 can't hold", "/balance", "9007199254740993.01", `9007199254740993.01`},
+		{"number keeps negative", "/balance", "-0.01", `-0.01`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newAmount := amountFormat(httptest.NewRequest("GET", tt.url, nil))
+
+			got, err := json.Marshal(newAmount(decimal.RequireFromString(tt.value)))
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(got))
+		})
+	}
+}
@@ -3,17 +3,41 @@ package handlers
 import (
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/handlers/middleware"
 	"github.com/nkiryanov/gophermart/internal/handlers/render"
 	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
+// User agent is client provided, so it's cut to not store arbitrary long strings
+const maxUserAgentLength = 512
+
+// Save client the tokens are issued to
+func clientInfo(r *http.Request) repository.RefreshTokenOption {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return repository.WithClientInfo(userAgent, middleware.ClientIP(r))
+}
+
+// Username with surrounding whitespace dropped on decoding, so it's validated the same way as service stores it
+type login string
+
+func (l *login) UnmarshalText(text []byte) error {
+	*l = login(strings.TrimSpace(string(text)))
+	return nil
+}
+
 // Register user with username and password
 func handleRegister(as authService, l logger.Logger) http.Handler {
 	type request struct {
-		Login    string `json:"login" validate:"required,min=2,max=50"`
+		Login    login  `json:"login" validate:"required,min=2,max=50,username"`
 		Password string `json:"password" validate:"required,min=8"`
+		Email    string `json:"email" validate:"omitempty,email,max=254"`
 	}
 	type response struct {
 		Message string `json:"message"`
@@ -25,15 +49,9 @@ func handleRegister(as authService, l logger.Logger) http.Handler {
 			return
 		}
 
-		pair, err := as.Register(r.Context(), data.Login, data.Password)
+		pair, err := as.RegisterWithEmail(r.Context(), string(data.Login), data.Password, data.Email, clientInfo(r))
 		if err != nil {
-			switch {
-			case errors.Is(err, apperrors.ErrUserAlreadyExists):
-				render.ServiceError(w, "User already exists", http.StatusConflict)
-			default:
-				l.Error("Failed to register user", "error", err)
-				render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
-			}
+			render.WriteError(w, r, l, err)
 			return
 		}
 
@@ -45,7 +63,7 @@ func handleRegister(as authService, l logger.Logger) http.Handler {
 // Login user with username and password
 func handleLogin(as authService, l logger.Logger) http.Handler {
 	type request struct {
-		Login    string `json:"login" validate:"required"`
+		Login    login  `json:"login" validate:"required"`
 		Password string `json:"password" validate:"required"`
 	}
 	type response struct {
@@ -59,15 +77,13 @@ func handleLogin(as authService, l logger.Logger) http.Handler {
 			return
 		}
 
-		pair, err := as.Login(r.Context(), data.Login, data.Password)
+		pair, err := as.Login(r.Context(), string(data.Login), data.Password, clientInfo(r))
 		if err != nil {
-			switch {
-			case errors.Is(err, apperrors.ErrUserNotFound):
-				render.ServiceError(w, "User not found", http.StatusUnauthorized)
-			default:
-				l.Error("Failed to login user", "error", err)
-				render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
+			// Unknown user is answered as wrong password, so existing logins can't be enumerated
+			if errors.Is(err, apperrors.ErrUserNotFound) {
+				err = apperrors.ErrInvalidCredentials
 			}
+			render.WriteError(w, r, l, err)
 			return
 		}
 
@@ -86,18 +102,17 @@ func handleTokenRefresh(as authService, l logger.Logger) http.Handler {
 
 		refresh, err := as.GetRefreshString(r)
 		if err != nil {
-			render.ServiceError(w, "Refresh token not found", http.StatusUnauthorized)
+			render.Error(w, r, "Refresh token not found", http.StatusUnauthorized)
+			return
 		}
 
-		pair, err := as.RefreshPair(r.Context(), refresh)
+		pair, err := as.RefreshPair(r.Context(), refresh, clientInfo(r))
 		if err != nil {
-			// Consider to log errors here
-			switch {
-			case errors.Is(err, apperrors.ErrRefreshTokenExpired):
-				render.ServiceError(w, "Refresh token expired", http.StatusUnauthorized)
-			default:
-				render.ServiceError(w, "Refresh token not found", http.StatusUnauthorized)
+			// Token of deleted user is not valid anymore, it's not the user to be looked up
+			if errors.Is(err, apperrors.ErrUserNotFound) {
+				err = apperrors.ErrRefreshTokenNotFound
 			}
+			render.WriteError(w, r, l, err)
 			return
 		}
 
@@ -2,62 +2,65 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
-	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
 	"github.com/nkiryanov/gophermart/internal/handlers/render"
 	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
 	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
-func handleUserBalance(userService userService, l logger.Logger) http.Handler {
+func handleUserBalance(userService userService, unit string, l logger.Logger) http.Handler {
 	type response struct {
-		Current   float64 `json:"current"`
-		Withdrawn float64 `json:"withdrawn"`
+		Current   amount `json:"current"`
+		Withdrawn amount `json:"withdrawn"`
+		Unit      string `json:"unit,omitempty"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := userctx.FromContext(r.Context())
 		if !ok {
-			render.ServiceError(w, "Internal service error", http.StatusInternalServerError)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
 			return
 		}
 
 		// Read order number from request body
 		balance, err := userService.GetBalance(r.Context(), user.ID)
 
-		switch err {
-		case nil:
-			current, _ := balance.Current.Float64()
-			withdrawn, _ := balance.Withdrawn.Float64()
-			render.JSON(w, response{current, withdrawn})
+		if err != nil {
+			render.WriteError(w, r, l, err)
 			return
-		default:
-			l.Error("Failed to get balance", "error", err)
-			render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
 		}
+
+		newAmount := amountFormat(r)
+		render.JSON(w, response{newAmount(balance.Current), newAmount(balance.Withdrawn), unit})
 	})
 
 }
 
-func handleWithdraw(userService userService, l logger.Logger) http.Handler {
+func handleWithdraw(userService userService, unit string, l logger.Logger) http.Handler {
 	type request struct {
 		OrderNumber string          `json:"order"`
 		Sum         decimal.Decimal `json:"sum"`
 	}
 
 	type response struct {
-		Current   float64 `json:"current"`
-		Withdrawn float64 `json:"withdrawn"`
+		Current   amount `json:"current"`
+		Withdrawn amount `json:"withdrawn"`
+		Unit      string `json:"unit,omitempty"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := userctx.FromContext(r.Context())
 		if !ok {
-			render.ServiceError(w, "Internal service error", http.StatusInternalServerError)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
 			return
 		}
 
@@ -68,55 +71,251 @@ func handleWithdraw(userService userService, l logger.Logger) http.Handler {
 
 		balance, err := userService.Withdraw(r.Context(), user.ID, withdraw.OrderNumber, withdraw.Sum)
 
-		switch {
-		case err == nil:
-			current, _ := balance.Current.Float64()
-			withdrawn, _ := balance.Withdrawn.Float64()
-			render.JSON(w, response{current, withdrawn})
+		if err != nil {
+			render.WriteError(w, r, l, err)
 			return
-		case errors.Is(err, apperrors.ErrBalanceInsufficient):
-			render.ServiceError(w, "Insufficient balance", http.StatusPaymentRequired)
-		case errors.Is(err, apperrors.ErrOrderNumberInvalid):
-			render.ServiceError(w, "Invalid order number", http.StatusUnprocessableEntity)
-		default:
-			l.Error("Failed to get balance", "error", err)
-			render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
 		}
+
+		newAmount := amountFormat(r)
+		render.JSON(w, response{newAmount(balance.Current), newAmount(balance.Withdrawn), unit})
 	})
 }
 
-func handleListWithdrawals(userService userService, l logger.Logger) http.Handler {
+func handleListWithdrawals(userService userService, unit string, l logger.Logger) http.Handler {
 	type withdrawal struct {
 		Order       string    `json:"order"`
-		Sum         float64   `json:"sum"`
+		Sum         amount    `json:"sum"`
+		Unit        string    `json:"unit,omitempty"`
 		ProcessedAt time.Time `json:"processed_at"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := userctx.FromContext(r.Context())
 		if !ok {
-			render.ServiceError(w, "Internal service error", http.StatusInternalServerError)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
 			return
 		}
 
 		tr, err := userService.GetWithdrawals(r.Context(), user.ID)
 
-		switch err {
-		case nil:
-			withdrawals := make([]withdrawal, 0, len(tr))
-			for _, t := range tr {
-				sum, _ := t.Amount.Float64()
-				withdrawals = append(withdrawals, withdrawal{
-					Order:       t.OrderNumber,
-					Sum:         sum,
-					ProcessedAt: t.ProcessedAt,
-				})
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		newAmount := amountFormat(r)
+		withdrawals := make([]withdrawal, 0, len(tr))
+		for _, t := range tr {
+			withdrawals = append(withdrawals, withdrawal{
+				Order:       t.OrderNumber,
+				Sum:         newAmount(t.Amount),
+				Unit:        unit,
+				ProcessedAt: t.ProcessedAt,
+			})
+		}
+		render.JSON(w, withdrawals)
+	})
+}
+
+// Withdrawals summed per order. Multiple withdrawals may be made against the same order
+func handleWithdrawalsSummary(userService userService, unit string, l logger.Logger) http.Handler {
+	type orderWithdrawals struct {
+		Order string `json:"order"`
+		Sum   amount `json:"sum"`
+		Count int    `json:"count"`
+		Unit  string `json:"unit,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		summary, err := userService.GetWithdrawalsSummary(r.Context(), user.ID)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		newAmount := amountFormat(r)
+		orders := make([]orderWithdrawals, 0, len(summary))
+		for _, s := range summary {
+			orders = append(orders, orderWithdrawals{
+				Order: s.OrderNumber,
+				Sum:   newAmount(s.Sum),
+				Count: s.Count,
+				Unit:  unit,
+			})
+		}
+		render.JSON(w, orders)
+	})
+}
+
+// Balance after every transaction to draw it over time. Query params:
+//   - 'from' and 'to' bound the range, as RFC 3339 time or date (the 'to' date is included)
+//   - 'bucket=day' returns the balance at the end of every day instead
+func handleBalanceHistory(userService userService, unit string, l logger.Logger) http.Handler {
+	type point struct {
+		At        time.Time `json:"at"`
+		Current   amount    `json:"current"`
+		Withdrawn amount    `json:"withdrawn"`
+		Unit      string    `json:"unit,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		opts, err := parseBalanceHistoryOpts(r)
+		if err != nil {
+			render.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		history, err := userService.GetBalanceHistory(r.Context(), user.ID, opts)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		newAmount := amountFormat(r)
+		points := make([]point, 0, len(history))
+		for _, p := range history {
+			points = append(points, point{
+				At:        p.At,
+				Current:   newAmount(p.Current),
+				Withdrawn: newAmount(p.Withdrawn),
+				Unit:      unit,
+			})
+		}
+		render.JSON(w, points)
+	})
+}
+
+func parseBalanceHistoryOpts(r *http.Request) (repository.BalanceHistoryOpts, error) {
+	var opts repository.BalanceHistoryOpts
+	query := r.URL.Query()
+
+	// Parse RFC 3339 time or date. Date 'to' bound includes the whole day
+	parseBound := func(name string, endOfDay bool) (*time.Time, error) {
+		value := query.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return &t, nil
+		}
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' has to be RFC 3339 time or YYYY-MM-DD date", name)
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, nil
+	}
+
+	var err error
+	if opts.From, err = parseBound("from", false); err != nil {
+		return opts, err
+	}
+	if opts.To, err = parseBound("to", true); err != nil {
+		return opts, err
+	}
+	if opts.From != nil && opts.To != nil && !opts.From.Before(*opts.To) {
+		return opts, errors.New("'from' has to be before 'to'")
+	}
+
+	switch bucket := query.Get("bucket"); bucket {
+	case "":
+	case "day":
+		opts.ByDay = true
+	default:
+		return opts, fmt.Errorf("unknown bucket %q, only 'day' is supported", bucket)
+	}
+	return opts, nil
+}
+
+// User's ledger: accruals and withdrawals with signed amounts. Streamed as CSV file with '?format=csv'
+func handleListTransactions(userService userService, unit string, pages pagination.Config, l logger.Logger) http.Handler {
+	type transaction struct {
+		Order       string                 `json:"order"`
+		Type        models.TransactionType `json:"type"`
+		Amount      amount                 `json:"amount"`
+		Unit        string                 `json:"unit,omitempty"`
+		ProcessedAt time.Time              `json:"processed_at"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		if wantsCSV(r) {
+			exportTransactions(w, r, userService, user.ID, l)
+			return
+		}
+
+		page, err := pagination.Parse(r, pages)
+		if err != nil {
+			render.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tr, err := userService.GetTransactions(r.Context(), user.ID, page)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		newAmount := amountFormat(r)
+		transactions := make([]transaction, 0, len(tr))
+		for _, t := range tr {
+			transactions = append(transactions, transaction{
+				Order:       t.OrderNumber,
+				Type:        t.Type,
+				Amount:      newAmount(t.SignedAmount()),
+				Unit:        unit,
+				ProcessedAt: t.ProcessedAt,
+			})
+		}
+
+		if pagination.WantsEnvelope(r) {
+			total, err := userService.CountTransactions(r.Context(), user.ID)
+			if err != nil {
+				render.WriteError(w, r, l, err)
+				return
 			}
-			render.JSON(w, withdrawals)
+			render.JSON(w, render.NewPage(transactions, total, page.Limit, page.Offset))
 			return
-		default:
-			l.Error("Failed to get withdrawals", "error", err)
-			render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
 		}
+		render.JSON(w, transactions)
 	})
 }
+
+// Stream all user's transactions as CSV file
+func exportTransactions(w http.ResponseWriter, r *http.Request, userService userService, userID uuid.UUID, l logger.Logger) {
+	file := newCSVAttachment(w, "transactions.csv", []string{"order", "type", "amount", "processed_at"})
+
+	err := userService.ForEachTransaction(r.Context(), userID, func(t models.Transaction) error {
+		return file.Write([]string{t.OrderNumber, string(t.Type), t.SignedAmount().String(), t.ProcessedAt.UTC().Format(time.RFC3339)})
+	})
+	if err != nil && !file.started {
+		render.WriteError(w, r, l, err)
+		return
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		// Response is partially sent already, so client gets truncated file
+		requestLogger(r, l).Error("Failed to export transactions", "error", err)
+	}
+}
@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+// User service returning preset results, every method fails with err if it's set
+type userServiceMock struct {
+	err         error
+	balance     models.Balance
+	withdrawals []models.Transaction
+	history     []models.BalancePoint
+
+	// Options of the last GetBalanceHistory call
+	historyOpts repository.BalanceHistoryOpts
+
+	// Arguments of the last Withdraw call
+	withdrawOrder  string
+	withdrawAmount decimal.Decimal
+
+	// If set, ForEachTransaction doesn't return till it's closed
+	wait chan struct{}
+}
+
+func (s *userServiceMock) GetBalance(context.Context, uuid.UUID) (models.Balance, error) {
+	return s.balance, s.err
+}
+
+func (s *userServiceMock) Withdraw(_ context.Context, _ uuid.UUID, orderNum string, amount decimal.Decimal) (models.Balance, error) {
+	s.withdrawOrder = orderNum
+	s.withdrawAmount = amount
+	return s.balance, s.err
+}
+
+func (s *userServiceMock) GetWithdrawals(context.Context, uuid.UUID) ([]models.Transaction, error) {
+	return s.withdrawals, s.err
+}
+
+func (s *userServiceMock) GetWithdrawalsSummary(context.Context, uuid.UUID) ([]models.WithdrawalSummary, error) {
+	return nil, s.err
+}
+
+func (s *userServiceMock) GetStats(context.Context, uuid.UUID) (models.UserStats, error) {
+	return models.UserStats{}, s.err
+}
+
+func (s *userServiceMock) GetTransactions(context.Context, uuid.UUID, repository.Page) ([]models.Transaction, error) {
+	return s.withdrawals, s.err
+}
+
+func (s *userServiceMock) CountTransactions(context.Context, uuid.UUID) (int, error) {
+	return len(s.withdrawals), s.err
+}
+
+func (s *userServiceMock) GetBalanceHistory(_ context.Context, _ uuid.UUID, opts repository.BalanceHistoryOpts) ([]models.BalancePoint, error) {
+	s.historyOpts = opts
+	return s.history, s.err
+}
+
+func (s *userServiceMock) ForEachTransaction(_ context.Context, _ uuid.UUID, fn func(models.Transaction) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, t := range s.withdrawals {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	if s.wait != nil {
+		<-s.wait
+	}
+	return nil
+}
+
+func TestBalanceHandlers(t *testing.T) {
+	user := models.User{ID: uuid.New(), Username: "test-user"}
+
+	// Serve request with user in context, as auth middleware does
+	serve := func(h http.Handler, method string, body string, withUser bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if withUser {
+			r = r.WithContext(userctx.New(r.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Decoded error code from JSON error response
+	errorCode := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Code string `json:"code"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		require.NoError(t, err, "error response has to be valid json. Body: %s", w.Body.String())
+		return resp.Code
+	}
+
+	handlers := map[string]struct {
+		method string
+		body   string
+		new    func(userService) http.Handler
+	}{
+		"balance": {http.MethodGet, "", func(s userService) http.Handler {
+			return handleUserBalance(s, "", logger.NewNoOpLogger())
+		}},
+		"withdraw": {http.MethodPost, `{"order": "2377225624", "sum": 10}`, func(s userService) http.Handler {
+			return handleWithdraw(s, "", logger.NewNoOpLogger())
+		}},
+		"withdrawals": {http.MethodGet, "", func(s userService) http.Handler {
+			return handleListWithdrawals(s, "", logger.NewNoOpLogger())
+		}},
+		"history": {http.MethodGet, "", func(s userService) http.Handler {
+			return handleBalanceHistory(s, "", logger.NewNoOpLogger())
+		}},
+	}
+
+	for name, h := range handlers {
+		t.Run(name+" errors", func(t *testing.T) {
+			t.Run("no user in context", func(t *testing.T) {
+				w := serve(h.new(&userServiceMock{}), h.method, h.body, false)
+
+				require.Equal(t, http.StatusInternalServerError, w.Code)
+			})
+
+			t.Run("internal error", func(t *testing.T) {
+				s := &userServiceMock{err: errors.New("connection refused")}
+
+				w := serve(h.new(s), h.method, h.body, true)
+
+				require.Equal(t, http.StatusInternalServerError, w.Code)
+				require.NotContains(t, w.Body.String(), "connection refused", "internal error details must not leak")
+			})
+		})
+	}
+
+	t.Run("balance", func(t *testing.T) {
+		s := &userServiceMock{balance: models.Balance{
+			Current:   decimal.RequireFromString("500.5"),
+			Withdrawn: decimal.RequireFromString("42"),
+		}}
+
+		w := serve(handleUserBalance(s, "", logger.NewNoOpLogger()), http.MethodGet, "", true)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"current": 500.5, "withdrawn": 42}`, w.Body.String())
+	})
+
+	t.Run("withdraw", func(t *testing.T) {
+		withdraw := func(s userService, body string) *httptest.ResponseRecorder {
+			return serve(handleWithdraw(s, "", logger.NewNoOpLogger()), http.MethodPost, body, true)
+		}
+
+		t.Run("ok", func(t *testing.T) {
+			s := &userServiceMock{balance: models.Balance{Current: decimal.NewFromInt(90), Withdrawn: decimal.NewFromInt(10)}}
+
+			w := withdraw(s, `{"order": "2377225624", "sum": 10}`)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.JSONEq(t, `{"current": 90, "withdrawn": 10}`, w.Body.String())
+			require.Equal(t, "2377225624", s.withdrawOrder)
+			require.Equal(t, "10", s.withdrawAmount.String())
+		})
+
+		t.Run("insufficient balance", func(t *testing.T) {
+			s := &userServiceMock{err: apperrors.ErrBalanceInsufficient}
+
+			w := withdraw(s, `{"order": "2377225624", "sum": 10}`)
+
+			require.Equal(t, http.StatusPaymentRequired, w.Code)
+			require.Equal(t, apperrors.CodeBalanceInsufficient, errorCode(t, w))
+		})
+
+		t.Run("invalid order number", func(t *testing.T) {
+			s := &userServiceMock{err: apperrors.ErrOrderNumberInvalid}
+
+			w := withdraw(s, `{"order": "12345", "sum": 10}`)
+
+			require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+			require.Equal(t, apperrors.CodeOrderNumberInvalid, errorCode(t, w))
+		})
+
+		t.Run("malformed body", func(t *testing.T) {
+			s := &userServiceMock{}
+
+			w := withdraw(s, `{"order": `)
+
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.Empty(t, s.withdrawOrder, "service must not be called")
+		})
+	})
+
+	t.Run("withdrawals", func(t *testing.T) {
+		processedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		s := &userServiceMock{withdrawals: []models.Transaction{{
+			OrderNumber: "2377225624",
+			Type:        models.TransactionTypeWithdrawal,
+			Amount:      decimal.RequireFromString("12.5"),
+			ProcessedAt: processedAt,
+		}}}
+
+		w := serve(handleListWithdrawals(s, "", logger.NewNoOpLogger()), http.MethodGet, "", true)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `[{"order": "2377225624", "sum": 12.5, "processed_at": "2025-01-02T03:04:05Z"}]`, w.Body.String())
+	})
+
+	t.Run("history", func(t *testing.T) {
+		history := func(s userService, query string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+			r = r.WithContext(userctx.New(r.Context(), user))
+			w := httptest.NewRecorder()
+			handleBalanceHistory(s, "", logger.NewNoOpLogger()).ServeHTTP(w, r)
+			return w
+		}
+
+		t.Run("points", func(t *testing.T) {
+			s := &userServiceMock{history: []models.BalancePoint{
+				{At: time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC), Current: decimal.NewFromInt(100), Withdrawn: decimal.Zero},
+				{At: time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC), Current: decimal.NewFromInt(70), Withdrawn: decimal.NewFromInt(30)},
+			}}
+
+			w := history(s, "")
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.JSONEq(t, `[
+				{"at": "2025-01-01T10:00:00Z", "current": 100, "withdrawn": 0},
+				{"at": "2025-01-02T10:00:00Z", "current": 70, "withdrawn": 30}
+			]`, w.Body.String())
+			require.Equal(t, repository.BalanceHistoryOpts{}, s.historyOpts)
+		})
+
+		t.Run("no transactions", func(t *testing.T) {
+			w := history(&userServiceMock{}, "")
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.JSONEq(t, `[]`, w.Body.String())
+		})
+
+		t.Run("range by dates and day bucket", func(t *testing.T) {
+			s := &userServiceMock{}
+
+			w := history(s, "?from=2025-01-01&to=2025-01-31&bucket=day")
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.True(t, s.historyOpts.ByDay)
+			require.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), *s.historyOpts.From)
+			require.Equal(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), *s.historyOpts.To, "'to' date has to be included")
+		})
+
+		t.Run("range by time", func(t *testing.T) {
+			s := &userServiceMock{}
+
+			w := history(s, "?from=2025-01-01T12:00:00Z")
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC), *s.historyOpts.From)
+			require.Nil(t, s.historyOpts.To)
+		})
+
+		for name, query := range map[string]string{
+			"invalid from":   "?from=yesterday",
+			"invalid to":     "?to=2025-13-01",
+			"empty range":    "?from=2025-02-01&to=2025-01-01",
+			"unknown bucket": "?bucket=week",
+		} {
+			t.Run(name, func(t *testing.T) {
+				w := history(&userServiceMock{}, query)
+
+				require.Equal(t, http.StatusBadRequest, w.Code)
+			})
+		}
+	})
+
+	t.Run("transactions in envelope", func(t *testing.T) {
+		s := &userServiceMock{withdrawals: []models.Transaction{{
+			OrderNumber: "2377225624",
+			Type:        models.TransactionTypeWithdrawal,
+			Amount:      decimal.RequireFromString("12.5"),
+			ProcessedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		}}}
+		h := handleListTransactions(s, "", pagination.Config{}, logger.NewNoOpLogger())
+		r := httptest.NewRequest(http.MethodGet, "/?envelope=true&limit=1&offset=2", nil)
+		r = r.WithContext(userctx.New(r.Context(), user))
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{
+			"items": [{"order": "2377225624", "type": "WITHDRAWAL", "amount": -12.5, "processed_at": "2025-01-02T03:04:05Z"}],
+			"total": 1,
+			"limit": 1,
+			"offset": 2
+		}`, w.Body.String())
+	})
+
+	t.Run("transactions invalid page", func(t *testing.T) {
+		h := handleListTransactions(&userServiceMock{}, "", pagination.Config{}, logger.NewNoOpLogger())
+		r := httptest.NewRequest(http.MethodGet, "/?limit=-1", nil)
+		r = r.WithContext(userctx.New(r.Context(), user))
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("no withdrawals", func(t *testing.T) {
+		w := serve(handleListWithdrawals(&userServiceMock{}, "", logger.NewNoOpLogger()), http.MethodGet, "", true)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `[]`, w.Body.String())
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// Client asks for CSV with '?format=csv'
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv"
+}
+
+// CSV file streamed to client as attachment
+// Response is started and flushed with the first record, so error may still be rendered until then.
+// Records are sent as writer's buffer fills, so memory doesn't grow with the file size
+type csvAttachment struct {
+	w        http.ResponseWriter
+	csv      *csv.Writer
+	filename string
+	header   []string
+	started  bool
+}
+
+func newCSVAttachment(w http.ResponseWriter, filename string, header []string) *csvAttachment {
+	return &csvAttachment{
+		w:        w,
+		csv:      csv.NewWriter(w),
+		filename: filename,
+		header:   header,
+	}
+}
+
+// Write record. Header row is written before the first one
+func (a *csvAttachment) Write(record []string) error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	return a.csv.Write(record)
+}
+
+// Finish the file. File with header row only is written if there were no records
+func (a *csvAttachment) Close() error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	a.csv.Flush()
+	return a.csv.Error()
+}
+
+func (a *csvAttachment) start() error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	a.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	a.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.filename}))
+	if err := a.csv.Write(a.header); err != nil {
+		return err
+	}
+
+	// Flushed response is streamed by timeout middleware instead of being buffered till handler returns
+	a.csv.Flush()
+	if err := a.csv.Error(); err != nil {
+		return err
+	}
+	err := http.NewResponseController(a.w).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
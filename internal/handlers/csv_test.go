@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/middleware"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+)
+
+func TestCSVExportStreamed(t *testing.T) {
+	user := models.User{ID: uuid.New(), Username: "test-user"}
+	// Enough rows to overflow writers' buffers
+	const rows = 1000
+	processedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Serve with the same middlewares as router does, the export is blocked till release is closed
+	requireStreamed := func(t *testing.T, h http.Handler, release chan struct{}, header string, firstRow string) {
+		h = middleware.LoggerMiddleware(logger.NewNoOpLogger())(middleware.TimeoutMiddleware(time.Minute)(h))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(userctx.New(r.Context(), user)))
+		}))
+		defer srv.Close()
+		defer close(release)
+
+		got := make(chan []string, 1)
+		go func() {
+			resp, err := http.Get(srv.URL + "/?format=csv")
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close() // nolint:errcheck
+			var lines []string
+			scanner := bufio.NewScanner(resp.Body)
+			for len(lines) < 2 && scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			got <- lines
+		}()
+
+		select {
+		case lines := <-got:
+			require.Equal(t, []string{header, firstRow}, lines)
+		case <-time.After(5 * time.Second):
+			t.Fatal("rows have to be sent before handler returns")
+		}
+	}
+
+	t.Run("orders", func(t *testing.T) {
+		s := &orderServiceMock{wait: make(chan struct{})}
+		for i := range rows {
+			s.orders = append(s.orders, models.Order{Number: strconv.Itoa(i), Status: models.OrderStatusNew, UploadedAt: processedAt})
+		}
+
+		requireStreamed(t, handleListOrder(s, pagination.Config{}, logger.NewNoOpLogger()), s.wait,
+			"number,status,accrual,uploaded_at", "0,NEW,,2025-01-02T03:04:05Z")
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		s := &userServiceMock{wait: make(chan struct{})}
+		for i := range rows {
+			s.withdrawals = append(s.withdrawals, models.Transaction{
+				OrderNumber: strconv.Itoa(i),
+				Type:        models.TransactionTypeWithdrawal,
+				Amount:      decimal.RequireFromString("12.5"),
+				ProcessedAt: processedAt,
+			})
+		}
+
+		requireStreamed(t, handleListTransactions(s, "", pagination.Config{}, logger.NewNoOpLogger()), s.wait,
+			"order,type,amount,processed_at", "0,WITHDRAWAL,-12.5,2025-01-02T03:04:05Z")
+	})
+}
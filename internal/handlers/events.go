@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+// Client reconnects to events stream after the delay to get fresh order statuses
+const eventsRetry = 15 * time.Second
+
+// Issue short-lived token to open events stream. Main API token is never sent to the stream,
+// so token leaked by the stream client can't be used with the main API
+func handleIssueEventsToken(authService authService, l logger.Logger) http.Handler {
+	type response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		token, err := authService.IssueEventsToken(r.Context(), user.ID)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		render.JSON(w, response{Token: token.Value, ExpiresAt: token.ExpiresAt})
+	})
+}
+
+// Stream user's orders as server-sent events, one 'order' event per order
+// Stream ends after all orders are sent, client reconnects after retry delay
+func handleOrderEvents(orderService orderService, l logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+		if err != nil {
+			return
+		}
+		// Stream is sent as it's written, so it's not dropped by request timeout
+		err = http.NewResponseController(w).Flush()
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+
+		newAmount := amountFormat(r)
+		err = orderService.ForEachOrder(r.Context(), repository.ListOrdersOpts{UserID: &user.ID}, func(o models.Order) error {
+			data, err := json.Marshal(orderToResponse(&o, newAmount))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "event: order\ndata: %s\n\n", data)
+			return err
+		})
+		if err != nil {
+			// Response is partially sent already, so client gets truncated stream and reconnects
+			requestLogger(r, l).Error("Failed to stream order events", "error", err)
+		}
+	})
+}
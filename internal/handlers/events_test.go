@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+)
+
+func TestOrderEvents(t *testing.T) {
+	s := &orderServiceMock{orders: []models.Order{
+		{Number: "17893729974", Status: models.OrderStatusNew},
+		{Number: "2377225624", Status: models.OrderStatusInvalid},
+	}}
+	h := handleOrderEvents(s, logger.NewNoOpLogger())
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r = r.WithContext(userctx.New(r.Context(), models.User{Username: "user"}))
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	require.True(t, w.Flushed, "stream has to be sent as it's written")
+	require.Equal(t, "retry: 15000\n\n"+
+		"event: order\ndata: {\"number\":\"17893729974\",\"status\":\"NEW\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"}\n\n"+
+		"event: order\ndata: {\"number\":\"2377225624\",\"status\":\"INVALID\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"}\n\n",
+		w.Body.String())
+}
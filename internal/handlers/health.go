@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Readiness check for orchestrators. Every check has to pass, otherwise service is unavailable
+// Response lists result of every check, so failed dependency is seen without looking at logs
+func handleReady(checks map[string]func(context.Context) error) http.Handler {
+	type response struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := response{Status: "ok", Checks: make(map[string]string, len(checks))}
+		code := http.StatusOK
+
+		for name, check := range checks {
+			if err := check(r.Context()); err != nil {
+				resp.Checks[name] = err.Error()
+				resp.Status = "unavailable"
+				code = http.StatusServiceUnavailable
+				continue
+			}
+			resp.Checks[name] = "ok"
+		}
+
+		render.JSONWithStatus(w, resp, code)
+	})
+}
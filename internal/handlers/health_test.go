@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func TestReady(t *testing.T) {
+	type response struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+
+	healthy := true
+	router := NewRouter(Config{
+		Readiness: map[string]func(context.Context) error{
+			"database": func(context.Context) error { return nil },
+			"order_processor": func(context.Context) error {
+				if !healthy {
+					return errors.New("no polling cycle completed")
+				}
+				return nil
+			},
+		},
+	}, nil, nil, nil, logger.NewNoOpLogger())
+
+	ready := func(t *testing.T) (int, response) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+		var resp response
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		require.NoError(t, err)
+		return w.Code, resp
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		code, resp := ready(t)
+
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "ok", resp.Status)
+		require.Equal(t, map[string]string{"database": "ok", "order_processor": "ok"}, resp.Checks)
+	})
+
+	t.Run("processor unhealthy", func(t *testing.T) {
+		healthy = false
+		t.Cleanup(func() { healthy = true })
+
+		code, resp := ready(t)
+
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, "unavailable", resp.Status)
+		require.Equal(t, "ok", resp.Checks["database"])
+		require.Equal(t, "no polling cycle completed", resp.Checks["order_processor"])
+	})
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+// Request scoped logger set by middlewares, so handler logs carry request fields like user id
+// Falls back to the handler's logger if the request has none
+func requestLogger(r *http.Request, l logger.Logger) logger.Logger {
+	if rl, ok := logger.FromContext(r.Context()); ok {
+		return rl
+	}
+	return l
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+)
+
+// Allow request only to admins: users with listed usernames. Nobody is admin if the list is empty
+// Has to be used after AuthMiddleware, request without user is answered as unauthorized
+func AdminMiddleware(admins []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := userctx.FromContext(r.Context())
+			if !ok {
+				unauthorized(w, nil)
+				return
+			}
+			if !slices.Contains(admins, user.Username) {
+				render.Error(w, r, "Admin access required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/models"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serve := func(admins []string, username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin", nil)
+		if username != "" {
+			r = r.WithContext(userctx.New(r.Context(), models.User{Username: username}))
+		}
+		w := httptest.NewRecorder()
+		AdminMiddleware(admins)(handler).ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("admin allowed", func(t *testing.T) {
+		w := serve([]string{"root", "admin"}, "admin")
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("not admin forbidden", func(t *testing.T) {
+		w := serve([]string{"admin"}, "test-user")
+
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("nobody admin if list empty", func(t *testing.T) {
+		w := serve(nil, "admin")
+
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("no user unauthorized", func(t *testing.T) {
+		w := serve([]string{"admin"}, "")
+
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
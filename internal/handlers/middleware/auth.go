@@ -2,27 +2,60 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/handlers/render"
 	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 )
 
 type authService interface {
+	// Has to return apperrors.ErrAccessTokenExpired if access token is expired
 	GetUserFromRequest(ctx context.Context, r *http.Request) (models.User, error)
 }
 
+// Allow to use a function as auth service, e.g. to authenticate with scoped token
+type AuthFunc func(ctx context.Context, r *http.Request) (models.User, error)
+
+func (f AuthFunc) GetUserFromRequest(ctx context.Context, r *http.Request) (models.User, error) {
+	return f(ctx, r)
+}
+
 func AuthMiddleware(authService authService) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			user, err := authService.GetUserFromRequest(r.Context(), r)
 			if err != nil {
-				render.ServiceError(w, "Unauthorized", http.StatusUnauthorized)
+				unauthorized(w, err)
 				return
 			}
 			ctx := userctx.New(r.Context(), user)
+			if l, ok := logger.FromContext(ctx); ok {
+				ctx = logger.WithContext(ctx, l.With("user_id", user.ID))
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// Render the same 401 response for every auth failure
+// Expired access token is the only one distinguished: client has to refresh it and retry
+func unauthorized(w http.ResponseWriter, err error) {
+	response := render.ErrorResponse{
+		Error:   render.UnauthorizedType,
+		Message: "Authentication required",
+	}
+	challenge := "Bearer"
+
+	if errors.Is(err, apperrors.ErrAccessTokenExpired) {
+		response.Code = apperrors.CodeAccessTokenExpired
+		response.Message = "Access token expired, please refresh it"
+		challenge = `Bearer error="invalid_token", error_description="The access token expired"`
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	render.JSONWithStatus(w, response, http.StatusUnauthorized)
+}
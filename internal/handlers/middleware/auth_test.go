@@ -1,27 +1,27 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"testing"
 
 	"io"
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 )
 
-// Allow to use a function as auth service
-type authFunc func(ctx context.Context, r *http.Request) (models.User, error)
-
-func (f authFunc) GetUserFromRequest(ctx context.Context, r *http.Request) (models.User, error) {
-	return f(ctx, r)
-}
-
 func TestAuthMiddleware_Auth(t *testing.T) {
 	// Simple handler that try to get user from context
 	// If ok write it username to response
@@ -37,7 +37,7 @@ func TestAuthMiddleware_Auth(t *testing.T) {
 
 	t.Run("auth ok", func(t *testing.T) {
 		// Middleware that always return ok
-		alwaysOkService := authFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
+		alwaysOkService := AuthFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
 			return models.User{Username: "test-user"}, nil
 		})
 		middleware := AuthMiddleware(alwaysOkService)
@@ -56,28 +56,147 @@ func TestAuthMiddleware_Auth(t *testing.T) {
 	})
 
 	t.Run("auth fail", func(t *testing.T) {
-		// Middleware that always fails
-		alwaysFailAuthService := authFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
-			return models.User{}, errors.New("auth failed")
-		})
-		middleware := AuthMiddleware(alwaysFailAuthService)
+		tests := []struct {
+			name          string
+			err           error
+			wantBody      string
+			wantChallenge string
+		}{
+			{
+				name: "invalid token",
+				err:  errors.New("auth failed"),
+				wantBody: `{
+					"error": "unauthorized",
+					"message": "Authentication required"
+				}`,
+				wantChallenge: "Bearer",
+			},
+			{
+				name: "expired token",
+				err:  fmt.Errorf("token is not valid. Err: %w", apperrors.ErrAccessTokenExpired),
+				wantBody: `{
+					"error": "unauthorized",
+					"code": "access_token_expired",
+					"message": "Access token expired, please refresh it"
+				}`,
+				wantChallenge: `Bearer error="invalid_token", error_description="The access token expired"`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				failAuthService := AuthFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
+					return models.User{}, tt.err
+				})
+				middleware := AuthMiddleware(failAuthService)
+
+				srv := httptest.NewServer(middleware(handler))
+				defer srv.Close()
+
+				resp, err := http.Get(srv.URL + "/test")
+				require.NoError(t, err, "should make request to test server")
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err, "should read response body")
+				defer resp.Body.Close() // nolint:errcheck
+
+				require.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "should return status Unauthorized. Resp: %s", string(body))
+				require.Equal(t, tt.wantChallenge, resp.Header.Get("WWW-Authenticate"))
+				require.JSONEq(t, tt.wantBody, string(body))
+			})
+		}
+	})
+}
 
-		srv := httptest.NewServer(middleware(handler))
+func TestAuthMiddleware_Logger(t *testing.T) {
+	userID := uuid.New()
+	alwaysOkService := AuthFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
+		return models.User{ID: userID, Username: "test-user"}, nil
+	})
+
+	// Handler logs with request scoped logger
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := logger.FromContext(r.Context())
+		require.True(t, ok, "logger has to be set to request context")
+		l.Info("handler called")
+	})
+
+	// Serve request and return handler log record
+	serve := func(t *testing.T, h http.Handler) map[string]any {
+		buf := &bytes.Buffer{}
+		srv := httptest.NewServer(LoggerMiddleware(logger.NewWithHandler(slog.NewJSONHandler(buf, nil)))(h))
 		defer srv.Close()
 
 		resp, err := http.Get(srv.URL + "/test")
-		require.NoError(t, err, "should make request to test server")
-		body, err := io.ReadAll(resp.Body)
-		require.NoError(t, err, "should read response body")
+		require.NoError(t, err)
 		defer resp.Body.Close() // nolint:errcheck
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+		require.Len(t, lines, 2, "handler and access logs expected")
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(lines[0], &record))
+		require.Equal(t, "handler called", record["msg"])
+		return record
+	}
+
+	t.Run("authenticated request logged with user id", func(t *testing.T) {
+		record := serve(t, AuthMiddleware(alwaysOkService)(handler))
+
+		require.Equal(t, userID.String(), record["user_id"])
+	})
+
+	t.Run("unauthenticated request logged without user id", func(t *testing.T) {
+		record := serve(t, handler)
+
+		require.NotContains(t, record, "user_id")
+	})
+}
+
+// Auth service returning preset user or error and counting calls
+type authServiceMock struct {
+	user  models.User
+	err   error
+	calls int
+}
+
+func (s *authServiceMock) GetUserFromRequest(context.Context, *http.Request) (models.User, error) {
+	s.calls++
+	return s.user, s.err
+}
+
+func TestAuthMiddleware_Context(t *testing.T) {
+	// Handler that records the user it got from context
+	newHandler := func() (http.Handler, *models.User, *int) {
+		var got models.User
+		calls := 0
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			got, _ = userctx.FromContext(r.Context())
+		}), &got, &calls
+	}
+
+	t.Run("user stored in context", func(t *testing.T) {
+		user := models.User{ID: uuid.New(), Username: "test-user"}
+		s := &authServiceMock{user: user}
+		handler, got, calls := newHandler()
+
+		w := httptest.NewRecorder()
+		AuthMiddleware(s)(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, 1, s.calls, "auth service has to be called once")
+		require.Equal(t, 1, *calls)
+		require.Equal(t, user, *got, "handler has to get the same user")
+	})
+
+	t.Run("handler not called if auth failed", func(t *testing.T) {
+		s := &authServiceMock{err: apperrors.ErrAccessTokenExpired}
+		handler, _, calls := newHandler()
+
+		w := httptest.NewRecorder()
+		AuthMiddleware(s)(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
 
-		require.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "should return status Unauthorized. Resp: %s", string(body))
-		require.JSONEq(t,
-			`{
-				"error": "service_error",
-				"message": "Unauthorized"
-			}`,
-			string(body),
-		)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Zero(t, *calls, "handler must not be called")
 	})
 }
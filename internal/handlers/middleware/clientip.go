@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/nkiryanov/gophermart/internal/clientip"
+)
+
+// Resolve real client IP and keep it in request context, so it's available with ClientIP
+// The IP is passed to services the same way, so money movements made by the request are audited with it
+// 'X-Forwarded-For' is honored only if request came from trusted proxy, otherwise it may be spoofed
+// Peer of Unix socket is always trusted: only local proxy can reach the socket, and it has no IP anyway
+func ClientIPMiddleware(trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIP(r, trustedProxies)
+			next.ServeHTTP(w, r.WithContext(clientip.New(r.Context(), ip)))
+		})
+	}
+}
+
+// Client IP address resolved by ClientIPMiddleware
+// If the middleware is not used, it's the address of direct peer
+func ClientIP(r *http.Request) string {
+	if ip, ok := clientip.FromContext(r.Context()); ok {
+		return ip
+	}
+	return RemoteIP(r)
+}
+
+// Address of direct peer without port
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Walk 'X-Forwarded-For' chain from the nearest hop and return the first address that is not trusted proxy
+func resolveClientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	peer := RemoteIP(r)
+	if !isTrustedPeer(r, trustedProxies) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Malformed hop can't be trusted, so the last valid one is the client
+			break
+		}
+		client = addr.Unmap().String()
+		if !isTrusted(client, trustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// Whether the direct peer is trusted proxy
+func isTrustedPeer(r *http.Request, trustedProxies []netip.Prefix) bool {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	return isTrusted(RemoteIP(r), trustedProxies)
+}
+
+func isTrusted(ip string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/clientip"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	// Return client IP seen by handler
+	resolve := func(remoteAddr string, forwardedFor ...string) string {
+		var ip string
+		h := ClientIPMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = ClientIP(r)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		for _, v := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return ip
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"untrusted peer without header", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer header ignored", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted peer header honored", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hops skipped", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"malformed hop stops walk", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 peer", "[2001:db8::1]:1234", []string{"198.51.100.1"}, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, resolve(tt.remoteAddr, tt.forwardedFor...))
+		})
+	}
+
+	t.Run("client ip passed to services", func(t *testing.T) {
+		var ip string
+		h := ClientIPMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _ = clientip.FromContext(r.Context())
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		require.Equal(t, "198.51.100.1", ip)
+	})
+
+	t.Run("unix socket peer trusted", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "gophermart.sock")
+		ln, err := net.Listen("unix", socket)
+		require.NoError(t, err)
+		srv := &http.Server{Handler: ClientIPMiddleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ClientIP(r))) // nolint:errcheck
+		}))}
+		go srv.Serve(ln) // nolint:errcheck
+		t.Cleanup(func() {
+			srv.Close() // nolint:errcheck
+		})
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+		r, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://gophermart/", nil)
+		require.NoError(t, err)
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+		resp, err := client.Do(r)
+		require.NoError(t, err)
+		defer resp.Body.Close() // nolint:errcheck
+		ip, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, "198.51.100.1", string(ip), "local proxy behind the socket has to be trusted")
+	})
+
+	t.Run("remote ip without middleware", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.5:1234"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+		require.Equal(t, "203.0.113.5", ClientIP(r))
+	})
+}
+
+func TestRemoteIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	r.RemoteAddr = "192.168.1.1:4321"
+	require.Equal(t, "192.168.1.1", RemoteIP(r))
+
+	r.RemoteAddr = "[::1]:4321"
+	require.Equal(t, "::1", RemoteIP(r))
+
+	r.RemoteAddr = "unix"
+	require.Equal(t, "unix", RemoteIP(r))
+}
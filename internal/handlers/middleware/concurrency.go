@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Limit number of requests handled simultaneously
+// Requests over the limit are rejected with 503 and Retry-After at once. Zero or negative limit disables limiter
+// Slot is released when the handler returns, so limiter has to be placed inside TimeoutMiddleware:
+// handler of timed out request is still running and has to keep its slot
+func ConcurrencyLimitMiddleware(limit int) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	sem := make(chan struct{}, limit)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				render.Error(w, r, "Server is busy, try again later", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	serve := func(h http.Handler) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	t.Run("requests over limit rejected", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		h := ConcurrencyLimitMiddleware(2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		// Occupy all slots
+		var wg sync.WaitGroup
+		codes := make([]int, 2)
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[i] = serve(h).Code
+			}()
+			<-started
+		}
+
+		w := serve(h)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code, "request over the limit has to be rejected")
+		require.Equal(t, "1", w.Header().Get("Retry-After"))
+
+		close(release)
+		wg.Wait()
+		require.Equal(t, []int{http.StatusOK, http.StatusOK}, codes, "requests within the limit has to complete")
+
+		go func() { <-started }()
+		require.Equal(t, http.StatusOK, serve(h).Code, "slots has to be released after requests completed")
+	})
+
+	t.Run("timed out handler keeps slot till it returns", func(t *testing.T) {
+		release := make(chan struct{})
+		returned := make(chan struct{})
+		h := TimeoutMiddleware(10 * time.Millisecond)(ConcurrencyLimitMiddleware(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() { returned <- struct{}{} }()
+			<-release
+		})))
+
+		w := serve(h)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Empty(t, w.Header().Get("Retry-After"), "first request has to time out, not to be rejected")
+
+		w = serve(h)
+		require.Equal(t, "1", w.Header().Get("Retry-After"), "slot has to be held by still running handler")
+
+		close(release)
+		<-returned
+		go func() { <-returned }()
+		require.Equal(t, http.StatusOK, serve(h).Code, "slot has to be released after handler returned")
+	})
+
+	t.Run("zero limit disables limiter", func(t *testing.T) {
+		h := ConcurrencyLimitMiddleware(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		require.Equal(t, http.StatusOK, serve(h).Code)
+	})
+}
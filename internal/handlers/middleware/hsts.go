@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Set 'Strict-Transport-Security' on responses served over TLS, so browsers never use plain HTTP for the host
+// Request terminated by trusted proxy counts as TLS if proxy sets 'X-Forwarded-Proto: https'
+// Header is never set over plain HTTP, browsers ignore it there. Zero or negative max age disables it
+func HSTSMiddleware(maxAge time.Duration, includeSubDomains bool, trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if includeSubDomains {
+		value += "; includeSubDomains"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTPS(r, trustedProxies) {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isHTTPS(r *http.Request, trustedProxies []netip.Prefix) bool {
+	if r.TLS != nil {
+		return true
+	}
+	// Proxies may append own value, the nearest one is the last
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if i := strings.LastIndex(proto, ","); i >= 0 {
+		proto = proto[i+1:]
+	}
+	return isTrustedPeer(r, trustedProxies) && strings.EqualFold(strings.TrimSpace(proto), "https")
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSTSMiddleware(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	serve := func(h func(http.Handler) http.Handler, r *http.Request) string {
+		w := httptest.NewRecorder()
+		h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+		return w.Header().Get("Strict-Transport-Security")
+	}
+	request := func(remoteAddr string, tlsState *tls.ConnectionState, proto string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.TLS = tlsState
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		return r
+	}
+	hsts := HSTSMiddleware(365*24*time.Hour, true, trusted)
+
+	t.Run("set under tls", func(t *testing.T) {
+		got := serve(hsts, request("203.0.113.1:1234", &tls.ConnectionState{}, ""))
+
+		require.Equal(t, "max-age=31536000; includeSubDomains", got)
+	})
+
+	t.Run("set behind trusted proxy", func(t *testing.T) {
+		got := serve(hsts, request("10.0.0.5:1234", nil, "https"))
+
+		require.Equal(t, "max-age=31536000; includeSubDomains", got)
+	})
+
+	t.Run("omitted over plain http", func(t *testing.T) {
+		for name, r := range map[string]*http.Request{
+			"direct":                request("203.0.113.1:1234", nil, ""),
+			"untrusted proxy":       request("203.0.113.1:1234", nil, "https"),
+			"trusted proxy by http": request("10.0.0.5:1234", nil, "https, http"),
+		} {
+			require.Empty(t, serve(hsts, r), name)
+		}
+	})
+
+	t.Run("without subdomains", func(t *testing.T) {
+		got := serve(HSTSMiddleware(time.Hour, false, nil), request("203.0.113.1:1234", &tls.ConnectionState{}, ""))
+
+		require.Equal(t, "max-age=3600", got)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		got := serve(HSTSMiddleware(0, true, nil), request("203.0.113.1:1234", &tls.ConnectionState{}, ""))
+
+		require.Empty(t, got)
+	})
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize   = 1 << 20
+)
+
+// Response of the first request with idempotency key
+type idempotentResponse struct {
+	// Hash of the request body, so the key can't be reused for other request
+	fingerprint [sha256.Size]byte
+
+	// Not set until the first request is handled
+	done   bool
+	status int
+	header http.Header
+	body   []byte
+
+	expiresAt time.Time
+}
+
+// Responses by idempotency keys, every response is kept for ttl
+type idempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+// Reserve the key for the request. Returns response stored for the key if it's not the first request
+func (s *idempotencyStore) reserve(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Drop expired responses from time to time, so map doesn't grow forever
+	if now.Sub(s.lastSweep) >= s.ttl {
+		for k, resp := range s.responses {
+			if resp.done && !now.Before(resp.expiresAt) {
+				delete(s.responses, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	resp, ok := s.responses[key]
+	if ok && (!resp.done || now.Before(resp.expiresAt)) {
+		copied := *resp
+		return &copied, false
+	}
+
+	s.responses[key] = &idempotentResponse{fingerprint: fingerprint}
+	return nil, true
+}
+
+// Store response for reserved key
+func (s *idempotencyStore) save(key string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp, ok := s.responses[key]
+	if !ok {
+		return
+	}
+	resp.done = true
+	resp.status = status
+	resp.header = header
+	resp.body = body
+	resp.expiresAt = s.now().Add(s.ttl)
+}
+
+// Release reserved key, so the request can be retried with it
+func (s *idempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.responses, key)
+}
+
+// Response writer that keeps copy of the response
+type recordWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Replay response for repeated 'Idempotency-Key' instead of handling the request again
+// Keys are scoped by authenticated user, method and path. Requests without the key are handled as usual.
+// Server errors are not stored, so request may be retried with the same key.
+func IdempotencyMiddleware(ttl time.Duration) func(http.Handler) http.Handler {
+	return idempotencyMiddleware(ttl, time.Now)
+}
+
+func idempotencyMiddleware(ttl time.Duration, now func() time.Time) func(http.Handler) http.Handler {
+	store := &idempotencyStore{
+		ttl:       ttl,
+		now:       now,
+		responses: make(map[string]*idempotentResponse),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+			if idempotencyKey == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				render.Error(w, r, "Idempotency key is too long", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+			if err != nil {
+				render.Error(w, r, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := sha256.Sum256(body)
+
+			var userID string
+			if user, ok := userctx.FromContext(r.Context()); ok {
+				userID = user.ID.String()
+			}
+			key := userID + " " + r.Method + " " + r.URL.Path + " " + idempotencyKey
+
+			stored, ok := store.reserve(key, fingerprint)
+			switch {
+			case ok:
+			case stored.fingerprint != fingerprint:
+				render.Error(w, r, "Idempotency key is already used for other request", http.StatusUnprocessableEntity)
+				return
+			case !stored.done:
+				render.Error(w, r, "Request with the same idempotency key is in progress", http.StatusConflict)
+				return
+			default:
+				for k, v := range stored.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set(IdempotencyReplayedHeader, "true")
+				w.WriteHeader(stored.status)
+				_, _ = w.Write(stored.body)
+				return
+			}
+
+			rw := &recordWriter{ResponseWriter: w}
+			saved := false
+			defer func() {
+				// Handler failed or panicked: the key may be used again
+				if !saved {
+					store.release(key)
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+
+			if rw.status == 0 {
+				rw.status = http.StatusOK
+			}
+			if rw.status < http.StatusInternalServerError {
+				store.save(key, rw.status, w.Header().Clone(), rw.body.Bytes())
+				saved = true
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	// Handler that counts calls and answers with the call number
+	newHandler := func(status int) (http.Handler, *int) {
+		calls := 0
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("X-Call", fmt.Sprint(calls))
+			w.WriteHeader(status)
+			_, _ = fmt.Fprintf(w, "call %d", calls)
+		}), &calls
+	}
+	serve := func(h http.Handler, key string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/balance/withdraw", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("duplicate key replays response", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusOK)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		first := serve(h, "key-1", `{"sum": 10}`)
+		second := serve(h, "key-1", `{"sum": 10}`)
+
+		require.Equal(t, 1, *calls, "handler has to be called once for the same key")
+		require.Equal(t, http.StatusOK, second.Code)
+		require.Equal(t, first.Body.String(), second.Body.String())
+		require.Equal(t, "1", second.Header().Get("X-Call"), "headers has to be replayed too")
+		require.Equal(t, "true", second.Header().Get(IdempotencyReplayedHeader))
+		require.Empty(t, first.Header().Get(IdempotencyReplayedHeader))
+	})
+
+	t.Run("different key handled", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusOK)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		serve(h, "key-1", `{"sum": 10}`)
+		w := serve(h, "key-2", `{"sum": 10}`)
+
+		require.Equal(t, 2, *calls)
+		require.Equal(t, "call 2", w.Body.String())
+	})
+
+	t.Run("no key handled every time", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusOK)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		serve(h, "", `{"sum": 10}`)
+		serve(h, "", `{"sum": 10}`)
+
+		require.Equal(t, 2, *calls)
+	})
+
+	t.Run("key reused for other request", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusOK)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		serve(h, "key-1", `{"sum": 10}`)
+		w := serve(h, "key-1", `{"sum": 20}`)
+
+		require.Equal(t, 1, *calls)
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("key expired", func(t *testing.T) {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		handler, calls := newHandler(http.StatusOK)
+		h := idempotencyMiddleware(time.Hour, func() time.Time { return now })(handler)
+
+		serve(h, "key-1", `{"sum": 10}`)
+		now = now.Add(time.Hour)
+		w := serve(h, "key-1", `{"sum": 10}`)
+
+		require.Equal(t, 2, *calls, "request has to be handled again after ttl")
+		require.Equal(t, "call 2", w.Body.String())
+	})
+
+	t.Run("server error not stored", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusInternalServerError)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		serve(h, "key-1", `{"sum": 10}`)
+		serve(h, "key-1", `{"sum": 10}`)
+
+		require.Equal(t, 2, *calls, "failed request may be retried with the same key")
+	})
+
+	t.Run("too long key", func(t *testing.T) {
+		handler, calls := newHandler(http.StatusOK)
+		h := IdempotencyMiddleware(time.Hour)(handler)
+
+		w := serve(h, strings.Repeat("k", 256), `{"sum": 10}`)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Zero(t, *calls)
+	})
+}
@@ -3,11 +3,9 @@ package middleware
 import (
 	"net/http"
 	"time"
-)
 
-type logger interface {
-	Info(msg string, args ...any)
-}
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
 
 type logData struct {
 	responseStatus int
@@ -30,7 +28,16 @@ func (w *logWriter) WriteHeader(statusCode int) {
 	w.data.responseStatus = statusCode
 }
 
-func LoggerMiddleware(l logger) func(http.Handler) http.Handler {
+// Used by http.ResponseController to flush streamed responses
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Log every request. Request fields are grouped under 'request' key to not collide with service fields
+// The logger is also passed with request context, so handlers may enrich it with request scoped fields
+func LoggerMiddleware(l logger.Logger) func(http.Handler) http.Handler {
+	accessLogger := l.WithGroup("request")
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -40,12 +47,13 @@ func LoggerMiddleware(l logger) func(http.Handler) http.Handler {
 				data:           logData{responseStatus: http.StatusOK, responseSize: 0},
 			}
 
-			next.ServeHTTP(lw, r)
+			next.ServeHTTP(lw, r.WithContext(logger.WithContext(r.Context(), l)))
 
-			l.Info(
+			accessLogger.Info(
 				"got HTTP request",
 				"method", r.Method,
 				"uri", r.RequestURI,
+				"ip", ClientIP(r),
 				"duration", time.Since(start),
 				"status", lw.data.responseStatus,
 				"size", lw.data.responseSize,
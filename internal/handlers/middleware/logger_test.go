@@ -1,28 +1,22 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
-)
-
-type loggerFunc func(string, ...any)
 
-func (f loggerFunc) Info(msg string, v ...any) { f(msg, v...) }
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
 
 func TestLoggerMiddleware(t *testing.T) {
-	called := 0
-	var msg string
-	var args []any
-
-	logger := loggerFunc(func(m string, v ...any) {
-		called++
-		msg = m
-		args = v
-	})
+	buf := &bytes.Buffer{}
+	l := logger.NewWithHandler(slog.NewJSONHandler(buf, nil))
 
 	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusTeapot)
@@ -30,7 +24,7 @@ func TestLoggerMiddleware(t *testing.T) {
 		require.NoError(t, err, "should write response")
 	})
 
-	middleware := LoggerMiddleware(logger)
+	middleware := LoggerMiddleware(l)
 	srv := httptest.NewServer(middleware(h))
 	defer srv.Close()
 
@@ -43,17 +37,22 @@ func TestLoggerMiddleware(t *testing.T) {
 	require.Equalf(t, http.StatusTeapot, resp.StatusCode, "should return status Teapot. Resp: %s", string(body))
 	require.Equal(t, "hi", string(body), "should return 'hi' in response")
 
-	require.Equal(t, 1, called, "logger should be called once")
-	require.Equal(t, "got HTTP request", msg, "logger should log 'got HTTP request'")
-	require.Len(t, args, 10, "logger should log 10 fields")
-	require.Equal(t, "method", args[0])
-	require.Equal(t, "GET", args[1])
-	require.Equal(t, "uri", args[2])
-	require.Equal(t, "/test", args[3])
-	require.Equal(t, "duration", args[4])
-	require.NotEmpty(t, args[5], "duration should not be empty")
-	require.Equal(t, "status", args[6])
-	require.Equal(t, http.StatusTeapot, args[7])
-	require.Equal(t, "size", args[8])
-	require.Equal(t, 2, args[9], "size should be 2 (length of 'hi')")
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 1, "logger should be called once")
+
+	var record struct {
+		Msg     string         `json:"msg"`
+		Method  string         `json:"method"`
+		Request map[string]any `json:"request"`
+	}
+	err = json.Unmarshal(lines[0], &record)
+	require.NoError(t, err, "log record has to be valid json")
+
+	require.Equal(t, "got HTTP request", record.Msg)
+	require.Empty(t, record.Method, "request fields must not be logged at top level")
+	require.Equal(t, "GET", record.Request["method"])
+	require.Equal(t, "/test", record.Request["uri"])
+	require.NotEmpty(t, record.Request["duration"], "duration should not be empty")
+	require.EqualValues(t, http.StatusTeapot, record.Request["status"])
+	require.EqualValues(t, 2, record.Request["size"], "size should be 2 (length of 'hi')")
 }
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Answer requests with 503 and Retry-After while maintenance is enabled, like during migrations or incidents
+// Flag is read on every request, so maintenance is toggled without restart
+func MaintenanceMiddleware(enabled *atomic.Bool, retryAfter time.Duration) func(http.Handler) http.Handler {
+	retry := strconv.Itoa(max(int(retryAfter.Seconds()), 1))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if enabled.Load() {
+				w.Header().Set("Retry-After", retry)
+				render.Error(w, r, "Service is under maintenance, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMiddleware(t *testing.T) {
+	var enabled atomic.Bool
+	h := MaintenanceMiddleware(&enabled, 2*time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	w := serve()
+	require.Equal(t, http.StatusOK, w.Code, "requests have to be served if maintenance disabled")
+
+	enabled.Store(true)
+	w = serve()
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "120", w.Header().Get("Retry-After"))
+	require.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	require.Contains(t, w.Body.String(), "maintenance")
+
+	enabled.Store(false)
+	w = serve()
+	require.Equal(t, http.StatusOK, w.Code, "requests have to be served again after maintenance")
+}
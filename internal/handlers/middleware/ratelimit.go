@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Requests counter for the key in the current window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Fixed window rate limiter. Allows at most 'limit' requests per 'window' for the same key
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+// Check whether request with the key allowed. If not return time to wait before next attempt
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	// Drop outdated windows from time to time, so map doesn't grow forever
+	if now.Sub(l.lastSweep) >= l.window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+
+	w.count++
+	return true, 0
+}
+
+// Limit requests rate with fixed window per key
+// Return 429 with Retry-After header when limit exceeded. Zero or negative limit disables limiter
+func RateLimitMiddleware(limit int, window time.Duration, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return rateLimitMiddleware(limit, window, key, time.Now)
+}
+
+func rateLimitMiddleware(limit int, window time.Duration, key func(r *http.Request) string, now func() time.Time) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	limiter := &rateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     now,
+		windows: make(map[string]*rateWindow),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, retryAfter := limiter.allow(key(r))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				render.Error(w, r, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
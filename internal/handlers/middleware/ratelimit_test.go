@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	okHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	keyHeader := func(r *http.Request) string {
+		return r.Header.Get("X-Key")
+	}
+	serve := func(h http.Handler, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		r.Header.Set("X-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("limit exceeded", func(t *testing.T) {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		h := rateLimitMiddleware(3, time.Minute, keyHeader, func() time.Time { return now })(okHandler)
+
+		for range 3 {
+			require.Equal(t, http.StatusOK, serve(h, "client").Code, "requests under the limit has to pass")
+		}
+
+		now = now.Add(20 * time.Second)
+		w := serve(h, "client")
+
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "40", w.Header().Get("Retry-After"), "has to wait until window ends")
+		require.Equal(t, http.StatusOK, serve(h, "other").Code, "other keys are not limited")
+	})
+
+	t.Run("new window allows requests again", func(t *testing.T) {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		h := rateLimitMiddleware(1, time.Minute, keyHeader, func() time.Time { return now })(okHandler)
+
+		require.Equal(t, http.StatusOK, serve(h, "client").Code)
+		require.Equal(t, http.StatusTooManyRequests, serve(h, "client").Code)
+
+		now = now.Add(time.Minute)
+		require.Equal(t, http.StatusOK, serve(h, "client").Code)
+	})
+
+	t.Run("zero limit disables limiter", func(t *testing.T) {
+		h := RateLimitMiddleware(0, time.Minute, keyHeader)(okHandler)
+
+		for range 10 {
+			require.Equal(t, http.StatusOK, serve(h, "client").Code)
+		}
+	})
+}
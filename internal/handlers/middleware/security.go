@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// Served responses are JSON or plain text, so nothing is allowed to load by default
+const DefaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+// Set common security headers on every response
+// CSP depends on deployment (like served docs pages), default one is used if empty
+func SecurityHeadersMiddleware(csp string) func(http.Handler) http.Handler {
+	if csp == "" {
+		csp = DefaultContentSecurityPolicy
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			h.Set("Content-Security-Policy", csp)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
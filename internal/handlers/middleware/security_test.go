@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	serve := func(csp string) *httptest.ResponseRecorder {
+		h := SecurityHeadersMiddleware(csp)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	t.Run("headers set", func(t *testing.T) {
+		w := serve("")
+
+		require.Equal(t, http.StatusCreated, w.Code)
+		require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		require.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+		require.Equal(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+		require.Equal(t, DefaultContentSecurityPolicy, w.Header().Get("Content-Security-Policy"))
+	})
+
+	t.Run("configured csp", func(t *testing.T) {
+		w := serve("default-src 'self'")
+
+		require.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+	})
+}
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Buffers the response until handler finished, so it may be dropped if the handler timed out
+// If handler flushes the response, it's sent to client and the rest is streamed
+type timeoutWriter struct {
+	mu sync.Mutex
+
+	w       http.ResponseWriter
+	timeout time.Duration
+
+	header      http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+	streaming   bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	if tw.streaming {
+		if err := tw.extendWriteDeadline(); err != nil {
+			return 0, err
+		}
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	tw.wroteHeader = true
+	tw.code = code
+}
+
+// Flush sends buffered response and switches the writer to streaming, used with http.ResponseController
+// Streamed response is not dropped at the deadline, instead every write has to complete within timeout
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	if !tw.streaming {
+		tw.streaming = true
+		if err := tw.extendWriteDeadline(); err != nil {
+			return err
+		}
+		tw.writeResponseLocked()
+	}
+	return http.NewResponseController(tw.w).Flush()
+}
+
+func (tw *timeoutWriter) Flush() {
+	_ = tw.FlushError()
+}
+
+// Copy buffered response to the real writer
+func (tw *timeoutWriter) writeResponseLocked() {
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	tw.w.WriteHeader(tw.code)
+	_, _ = tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+}
+
+func (tw *timeoutWriter) extendWriteDeadline() error {
+	err := http.NewResponseController(tw.w).SetWriteDeadline(time.Now().Add(tw.timeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// Handler returned, so buffered response is sent
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.streaming {
+		tw.writeResponseLocked()
+		return
+	}
+	// Connection is reused by next requests, they must not get deadline of this one
+	_ = http.NewResponseController(tw.w).SetWriteDeadline(time.Time{})
+}
+
+// Drop the response if it's not streamed yet. Returns false if response is being streamed
+func (tw *timeoutWriter) timeOut() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.streaming {
+		return false
+	}
+	tw.timedOut = true
+	return true
+}
+
+// Drop everything the handler writes, client is gone
+func (tw *timeoutWriter) abandon() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.timedOut = true
+}
+
+// TimeoutMiddleware cancels request context at the deadline. If handler doesn't complete in time
+// client gets 503 and everything the handler writes after is dropped.
+// Services and db queries get the same context, so they are cancelled at the deadline too.
+// Handlers streaming big responses (like exports) flush them with http.ResponseController:
+// the deadline doesn't apply to them after the first flush, but every write has to complete within timeout
+func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Context has no deadline, so it's kept alive for streamed responses after timeout
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+
+			tw := &timeoutWriter{w: w, timeout: timeout, header: make(http.Header)}
+			done := make(chan struct{})
+			panicChan := make(chan any, 1)
+
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicChan <- p
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+
+			for {
+				select {
+				case p := <-panicChan:
+					panic(p)
+
+				case <-done:
+					tw.finish()
+					return
+
+				case <-timer.C:
+					if tw.timeOut() {
+						cancel(context.DeadlineExceeded)
+						render.Error(w, r, "Request timed out", http.StatusServiceUnavailable)
+						return
+					}
+					// Streamed response is limited by write deadlines, handler has to complete it
+
+				case <-ctx.Done():
+					// Nobody waits the response if client gone
+					tw.abandon()
+					return
+				}
+			}
+		})
+	}
+}
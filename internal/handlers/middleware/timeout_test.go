@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	middleware := TimeoutMiddleware(50 * time.Millisecond)
+
+	t.Run("fast handler ok", func(t *testing.T) {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "value")
+			w.WriteHeader(http.StatusTeapot)
+			_, err := w.Write([]byte("hi"))
+			require.NoError(t, err)
+		})
+		srv := httptest.NewServer(middleware(h))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err, "should make request to test server")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "should read response body")
+		defer resp.Body.Close() // nolint:errcheck
+
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+		require.Equal(t, "value", resp.Header.Get("X-Test"), "handler headers has to be copied")
+		require.Equal(t, "hi", string(body))
+	})
+
+	t.Run("slow handler cancelled", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(time.Second):
+			}
+			// Too late: must be dropped
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		srv := httptest.NewServer(middleware(h))
+		defer srv.Close()
+
+		start := time.Now()
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err, "should make request to test server")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "should read response body")
+		defer resp.Body.Close() // nolint:errcheck
+
+		require.Less(t, time.Since(start), 500*time.Millisecond, "request has to be completed at the deadline")
+		require.Equalf(t, http.StatusServiceUnavailable, resp.StatusCode, "Resp: %s", string(body))
+		require.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.JSONEq(t, `{
+			"error": "service_error",
+			"message": "Request timed out"
+		}`, string(body))
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("handler context has to be cancelled")
+		}
+	})
+
+	t.Run("flushed response streamed past deadline", func(t *testing.T) {
+		release := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("first\n"))
+			require.NoError(t, http.NewResponseController(w).Flush())
+
+			<-release
+			require.NoError(t, r.Context().Err(), "streamed response context is not cancelled at deadline")
+			_, err := w.Write([]byte("second\n"))
+			require.NoError(t, err)
+		})
+		srv := httptest.NewServer(middleware(h))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err, "response has to be started before handler returns")
+		defer resp.Body.Close() // nolint:errcheck
+		first := make([]byte, len("first\n"))
+		_, err = io.ReadFull(resp.Body, first)
+		require.NoError(t, err)
+		require.Equal(t, "first\n", string(first))
+
+		time.Sleep(100 * time.Millisecond) // past the deadline
+		close(release)
+		rest, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "second\n", string(rest))
+	})
+}
@@ -4,9 +4,15 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
 	"github.com/nkiryanov/gophermart/internal/handlers/render"
 	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
 	"github.com/nkiryanov/gophermart/internal/logger"
@@ -17,11 +23,13 @@ import (
 type orderResponse struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
-	Accrual    *float64  `json:"accrual,omitempty"`
+	Accrual    *amount   `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
-func orderToResponse(o *models.Order) orderResponse {
+// Accrual is omitted for orders not processed yet. Processed order always has accrual, even zero one,
+// so client can tell "processed, nothing accrued" from "not processed yet"
+func orderToResponse(o *models.Order, newAmount func(decimal.Decimal) amount) orderResponse {
 	r := orderResponse{
 		Number:     o.Number,
 		Status:     o.Status,
@@ -29,18 +37,31 @@ func orderToResponse(o *models.Order) orderResponse {
 		UploadedAt: o.UploadedAt,
 	}
 	if o.Accrual != nil {
-		value, _ := o.Accrual.Float64()
+		value := newAmount(*o.Accrual)
 		r.Accrual = &value
 	}
 	return r
 }
 
+// preferRespondAsync reports whether client asked for async processing with "Prefer: respond-async" (RFC 7240)
+func preferRespondAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for pref := range strings.SplitSeq(header, ",") {
+			token, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func handleCreateOrder(orderService orderService, l logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := userctx.FromContext(r.Context())
 		if !ok {
-			l.Error("Failed to get user from context", "uri", r.RequestURI)
-			render.ServiceError(w, "Internal service error", http.StatusInternalServerError)
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
 			return
 		}
 
@@ -48,52 +69,125 @@ func handleCreateOrder(orderService orderService, l logger.Logger) http.Handler
 		r.Body = http.MaxBytesReader(nil, r.Body, 512)
 		number, err := io.ReadAll(r.Body)
 		if err != nil {
-			render.ServiceError(w, "Failed to read request body", http.StatusBadRequest)
+			render.Error(w, r, "Failed to read request body", http.StatusBadRequest)
+			return
 		}
 
 		order, err := orderService.CreateOrder(r.Context(), string(number), &user)
 
 		switch {
 		case err == nil:
-			render.JSONWithStatus(w, orderToResponse(&order), http.StatusAccepted)
-		case errors.Is(err, apperrors.ErrOrderNumberInvalid):
-			render.ServiceError(w, "Invalid order number", http.StatusUnprocessableEntity)
+			// Order is processed in background, so tell the client where to poll its status
+			if preferRespondAsync(r) {
+				w.Header().Set("Location", "/api/user/orders/"+url.PathEscape(order.Number))
+				w.Header().Set("Preference-Applied", "respond-async")
+			}
+			render.JSONWithStatus(w, orderToResponse(&order, amountFormat(r)), http.StatusAccepted)
 		case errors.Is(err, apperrors.ErrOrderAlreadyExists):
-			render.JSONWithStatus(w, orderToResponse(&order), http.StatusOK)
-		case errors.Is(err, apperrors.ErrOrderNumberTaken):
-			render.ServiceError(w, "Order number already taken", http.StatusConflict)
+			render.JSONWithStatus(w, orderToResponse(&order, amountFormat(r)), http.StatusOK)
 		default:
-			l.Error("Failed to create order", "error", err)
-			render.ServiceError(w, "Internal server error", http.StatusInternalServerError)
+			render.WriteError(w, r, l, err)
 		}
 	})
 }
 
-func handleListOrder(orderService orderService, l logger.Logger) http.Handler {
+func handleGetOrder(orderService orderService, l logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := userctx.FromContext(r.Context())
 		if !ok {
-			l.Error("Failed to get user from context", "uri", r.RequestURI)
-			render.ServiceError(w, "Internal service error", http.StatusInternalServerError)
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
 			return
 		}
 
-		orders, err := orderService.ListOrders(r.Context(), repository.ListOrdersOpts{UserID: &user.ID})
+		order, err := orderService.GetOrder(r.Context(), r.PathValue("number"), user.ID)
+
 		if err != nil {
-			render.ServiceError(w, "Failed to list orders", http.StatusInternalServerError)
+			render.WriteError(w, r, l, err)
 			return
 		}
 
-		if len(orders) == 0 {
-			render.JSONWithStatus(w, []orderResponse{}, http.StatusNoContent)
+		render.JSON(w, orderToResponse(&order, amountFormat(r)))
+	})
+}
+
+func handleListOrder(orderService orderService, pages pagination.Config, l logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			requestLogger(r, l).Error("Failed to get user from context", "uri", r.RequestURI)
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		if wantsCSV(r) {
+			exportOrders(w, r, orderService, user.ID, l)
+			return
+		}
+
+		page, err := pagination.Parse(r, pages)
+		if err != nil {
+			render.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		orders, err := orderService.ListOrders(r.Context(), repository.ListOrdersOpts{
+			UserID: &user.ID,
+			Limit:  page.Limit,
+			Offset: page.Offset,
+		})
+		if err != nil {
+			render.WriteError(w, r, l, err)
 			return
 		}
 
+		newAmount := amountFormat(r)
 		resp := make([]orderResponse, len(orders))
 		for i, order := range orders {
-			resp[i] = orderToResponse(&order)
+			resp[i] = orderToResponse(&order, newAmount)
+		}
+
+		// Envelope is answered even if there are no orders, it's not part of API spec
+		if pagination.WantsEnvelope(r) {
+			total, err := orderService.CountOrders(r.Context(), user.ID)
+			if err != nil {
+				render.WriteError(w, r, l, err)
+				return
+			}
+			render.JSON(w, render.NewPage(resp, total, page.Limit, page.Offset))
+			return
+		}
+
+		// 204 must not have a body
+		if len(orders) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
 		render.JSON(w, resp)
 	})
 }
+
+// Stream all user's orders as CSV file
+func exportOrders(w http.ResponseWriter, r *http.Request, orderService orderService, userID uuid.UUID, l logger.Logger) {
+	file := newCSVAttachment(w, "orders.csv", []string{"number", "status", "accrual", "uploaded_at"})
+
+	err := orderService.ForEachOrder(r.Context(), repository.ListOrdersOpts{UserID: &userID}, func(o models.Order) error {
+		var accrual string
+		if o.Accrual != nil {
+			accrual = o.Accrual.String()
+		}
+		return file.Write([]string{o.Number, o.Status, accrual, o.UploadedAt.UTC().Format(time.RFC3339)})
+	})
+	if err != nil && !file.started {
+		render.WriteError(w, r, l, err)
+		return
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		// Response is partially sent already, so client gets truncated file
+		requestLogger(r, l).Error("Failed to export orders", "error", err)
+	}
+}
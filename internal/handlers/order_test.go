@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+// Order service returning preset orders, every method fails with err if it's set
+type orderServiceMock struct {
+	err    error
+	orders []models.Order
+
+	// If set, ForEachOrder doesn't return till it's closed
+	wait chan struct{}
+}
+
+func (s *orderServiceMock) CreateOrder(_ context.Context, number string, user *models.User, _ ...repository.CreateOrderOption) (models.Order, error) {
+	return models.Order{Number: number, UserID: user.ID, Status: models.OrderStatusNew}, s.err
+}
+
+func (s *orderServiceMock) ListOrders(context.Context, repository.ListOrdersOpts) ([]models.Order, error) {
+	return s.orders, s.err
+}
+
+func (s *orderServiceMock) CountOrders(context.Context, uuid.UUID) (int, error) {
+	return len(s.orders), s.err
+}
+
+func (s *orderServiceMock) ForEachOrder(_ context.Context, _ repository.ListOrdersOpts, fn func(models.Order) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, o := range s.orders {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	if s.wait != nil {
+		<-s.wait
+	}
+	return nil
+}
+
+func (s *orderServiceMock) GetOrder(context.Context, string, uuid.UUID) (models.Order, error) {
+	if len(s.orders) == 0 {
+		return models.Order{}, s.err
+	}
+	return s.orders[0], s.err
+}
+
+func (s *orderServiceMock) ReprocessOrder(_ context.Context, number string, _ string) (models.Order, error) {
+	return models.Order{Number: number, Status: models.OrderStatusNew}, s.err
+}
+
+func TestOrderToResponse(t *testing.T) {
+	uploadedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	accrual := decimal.RequireFromString("100.5")
+
+	tests := []struct {
+		name  string
+		order models.Order
+		want  string
+	}{
+		{
+			"new order without accrual",
+			models.Order{Number: "2377225624", Status: models.OrderStatusNew},
+			`{"number": "2377225624", "status": "NEW", "uploaded_at": "2025-01-02T03:04:05Z"}`,
+		},
+		{
+			"invalid order without accrual",
+			models.Order{Number: "2377225624", Status: models.OrderStatusInvalid},
+			`{"number": "2377225624", "status": "INVALID", "uploaded_at": "2025-01-02T03:04:05Z"}`,
+		},
+		{
+			"processed order with zero accrual",
+			models.Order{Number: "2377225624", Status: models.OrderStatusProcessed, Accrual: &decimal.Zero},
+			`{"number": "2377225624", "status": "PROCESSED", "accrual": 0, "uploaded_at": "2025-01-02T03:04:05Z"}`,
+		},
+		{
+			"processed order with accrual",
+			models.Order{Number: "2377225624", Status: models.OrderStatusProcessed, Accrual: &accrual},
+			`{"number": "2377225624", "status": "PROCESSED", "accrual": 100.5, "uploaded_at": "2025-01-02T03:04:05Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.order.UploadedAt = uploadedAt
+			newAmount := amountFormat(httptest.NewRequest("GET", "/orders", nil))
+
+			data, err := json.Marshal(orderToResponse(&tt.order, newAmount))
+
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(data))
+		})
+	}
+}
+
+func TestOrderHandlers(t *testing.T) {
+	user := models.User{ID: uuid.New(), Username: "test-user"}
+	uploadedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	accrual := decimal.RequireFromString("100.5")
+
+	// New order has NULL accrual in storage, processed one has it set
+	s := &orderServiceMock{orders: []models.Order{
+		{Number: "2377225624", Status: models.OrderStatusNew, Accrual: nil, UploadedAt: uploadedAt},
+		{Number: "17893729974", Status: models.OrderStatusProcessed, Accrual: &accrual, UploadedAt: uploadedAt},
+	}}
+
+	serve := func(h http.Handler, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r = r.WithContext(userctx.New(r.Context(), user))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("list", func(t *testing.T) {
+		w := serve(handleListOrder(s, pagination.Config{}, logger.NewNoOpLogger()), "/")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `[
+			{"number": "2377225624", "status": "NEW", "uploaded_at": "2025-01-02T03:04:05Z"},
+			{"number": "17893729974", "status": "PROCESSED", "accrual": 100.5, "uploaded_at": "2025-01-02T03:04:05Z"}
+		]`, w.Body.String())
+	})
+
+	t.Run("list in envelope", func(t *testing.T) {
+		w := serve(handleListOrder(s, pagination.Config{DefaultLimit: 10}, logger.NewNoOpLogger()), "/?envelope=true&offset=0")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{
+			"items": [
+				{"number": "2377225624", "status": "NEW", "uploaded_at": "2025-01-02T03:04:05Z"},
+				{"number": "17893729974", "status": "PROCESSED", "accrual": 100.5, "uploaded_at": "2025-01-02T03:04:05Z"}
+			],
+			"total": 2,
+			"limit": 10,
+			"offset": 0
+		}`, w.Body.String())
+	})
+
+	t.Run("no orders", func(t *testing.T) {
+		w := serve(handleListOrder(&orderServiceMock{}, pagination.Config{}, logger.NewNoOpLogger()), "/")
+
+		require.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("no orders in envelope", func(t *testing.T) {
+		w := serve(handleListOrder(&orderServiceMock{}, pagination.Config{}, logger.NewNoOpLogger()), "/?envelope=true")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"items": [], "total": 0, "limit": 0, "offset": 0}`, w.Body.String())
+	})
+
+	t.Run("list csv", func(t *testing.T) {
+		w := serve(handleListOrder(s, pagination.Config{}, logger.NewNoOpLogger()), "/?format=csv")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "number,status,accrual,uploaded_at\n"+
+			"2377225624,NEW,,2025-01-02T03:04:05Z\n"+
+			"17893729974,PROCESSED,100.5,2025-01-02T03:04:05Z\n", w.Body.String())
+	})
+
+	t.Run("create with too long body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("1", 513)))
+		r = r.WithContext(userctx.New(r.Context(), user))
+		w := httptest.NewRecorder()
+
+		handleCreateOrder(&orderServiceMock{}, logger.NewNoOpLogger()).ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.JSONEq(t, `{"error": "service_error", "message": "Failed to read request body"}`, w.Body.String())
+	})
+
+	t.Run("get order without accrual", func(t *testing.T) {
+		w := serve(handleGetOrder(&orderServiceMock{orders: s.orders[:1]}, logger.NewNoOpLogger()), "/")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"number": "2377225624", "status": "NEW", "uploaded_at": "2025-01-02T03:04:05Z"}`, w.Body.String())
+	})
+
+	t.Run("get order with accrual", func(t *testing.T) {
+		w := serve(handleGetOrder(&orderServiceMock{orders: s.orders[1:]}, logger.NewNoOpLogger()), "/")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"number": "17893729974", "status": "PROCESSED", "accrual": 100.5, "uploaded_at": "2025-01-02T03:04:05Z"}`, w.Body.String())
+	})
+}
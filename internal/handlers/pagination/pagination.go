@@ -0,0 +1,54 @@
+package pagination
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+var (
+	ErrInvalidLimit  = errors.New("limit has to be positive integer")
+	ErrInvalidOffset = errors.New("offset has to be non negative integer")
+)
+
+// Page sizes of list endpoints
+// Zero default means everything is returned if limit is not set, zero max means limit is not clamped
+type Config struct {
+	DefaultLimit int
+	MaxLimit     int
+}
+
+// Whether client asked for list wrapped into render.Page with '?envelope=true'
+// Bare list is answered otherwise, as API spec requires
+func WantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") == "true"
+}
+
+// Parse 'limit' and 'offset' query params. Limit greater than max is clamped to max
+// Returns ErrInvalidLimit or ErrInvalidOffset if params are malformed
+func Parse(r *http.Request, cfg Config) (repository.Page, error) {
+	page := repository.Page{Limit: cfg.DefaultLimit}
+	query := r.URL.Query()
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return page, ErrInvalidLimit
+		}
+		page.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return page, ErrInvalidOffset
+		}
+		page.Offset = offset
+	}
+
+	if cfg.MaxLimit > 0 && (page.Limit == 0 || page.Limit > cfg.MaxLimit) {
+		page.Limit = cfg.MaxLimit
+	}
+	return page, nil
+}
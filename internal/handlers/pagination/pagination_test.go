@@ -0,0 +1,63 @@
+package pagination
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/repository"
+)
+
+func TestParse(t *testing.T) {
+	cfg := Config{DefaultLimit: 20, MaxLimit: 100}
+
+	tests := []struct {
+		name string
+		url  string
+		cfg  Config
+		want repository.Page
+	}{
+		{"defaults", "/orders", cfg, repository.Page{Limit: 20}},
+		{"set", "/orders?limit=50&offset=10", cfg, repository.Page{Limit: 50, Offset: 10}},
+		{"clamped to max", "/orders?limit=1000", cfg, repository.Page{Limit: 100}},
+		{"max limit", "/orders?limit=100", cfg, repository.Page{Limit: 100}},
+		{"zero offset", "/orders?offset=0", cfg, repository.Page{Limit: 20}},
+		{"unlimited by default", "/orders", Config{}, repository.Page{}},
+		{"no max", "/orders?limit=1000", Config{}, repository.Page{Limit: 1000}},
+		{"no default but max", "/orders", Config{MaxLimit: 100}, repository.Page{Limit: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := Parse(httptest.NewRequest("GET", tt.url, nil), tt.cfg)
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, page)
+		})
+	}
+
+	invalid := []struct {
+		url  string
+		want error
+	}{
+		{"/orders?limit=0", ErrInvalidLimit},
+		{"/orders?limit=-1", ErrInvalidLimit},
+		{"/orders?limit=ten", ErrInvalidLimit},
+		{"/orders?limit=1.5", ErrInvalidLimit},
+		{"/orders?offset=-1", ErrInvalidOffset},
+		{"/orders?offset=abc", ErrInvalidOffset},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.url, func(t *testing.T) {
+			_, err := Parse(httptest.NewRequest("GET", tt.url, nil), cfg)
+
+			require.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+func TestWantsEnvelope(t *testing.T) {
+	require.True(t, WantsEnvelope(httptest.NewRequest("GET", "/orders?envelope=true", nil)))
+	require.False(t, WantsEnvelope(httptest.NewRequest("GET", "/orders", nil)))
+	require.False(t, WantsEnvelope(httptest.NewRequest("GET", "/orders?envelope=false", nil)))
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+)
+
+// Reachability check for clients. Never touches db or other dependencies
+func handlePing() http.Handler {
+	type response struct {
+		Pong bool   `json:"pong"`
+		Time string `json:"time"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, response{Pong: true, Time: time.Now().UTC().Format(time.RFC3339)})
+	})
+}
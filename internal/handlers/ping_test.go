@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func TestPing(t *testing.T) {
+	// Ping doesn't use any service, so router can be created without them
+	router := NewRouter(Config{}, nil, nil, nil, logger.NewNoOpLogger())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/ping", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), "security headers have to be set on every response")
+
+	var resp struct {
+		Pong bool   `json:"pong"`
+		Time string `json:"time"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	require.NoError(t, err)
+	require.True(t, resp.Pong)
+	got, err := time.Parse(time.RFC3339, resp.Time)
+	require.NoError(t, err, "time has to be RFC3339")
+	require.WithinDuration(t, time.Now(), got, 2*time.Second)
+}
@@ -0,0 +1,18 @@
+package render
+
+// Page of list items with pagination metadata, so clients don't have to guess if there are more items
+// Zero limit means all items from the offset are returned
+type Page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// Page of the items. Nil items are rendered as empty list
+func NewPage[T any](items []T, total int, limit int, offset int) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return Page[T]{Items: items, Total: total, Limit: limit, Offset: offset}
+}
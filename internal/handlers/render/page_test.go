@@ -0,0 +1,32 @@
+package render
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPage(t *testing.T) {
+	type item struct {
+		Number string `json:"number"`
+	}
+
+	t.Run("shape", func(t *testing.T) {
+		page := NewPage([]item{{"123"}, {"456"}}, 12, 2, 4)
+
+		data, err := json.Marshal(page)
+
+		require.NoError(t, err)
+		require.JSONEq(t, `{"items": [{"number": "123"}, {"number": "456"}], "total": 12, "limit": 2, "offset": 4}`, string(data))
+	})
+
+	t.Run("no items", func(t *testing.T) {
+		page := NewPage[item](nil, 0, 0, 0)
+
+		data, err := json.Marshal(page)
+
+		require.NoError(t, err)
+		require.JSONEq(t, `{"items": [], "total": 0, "limit": 0, "offset": 0}`, string(data), "items has to be empty list, not null")
+	})
+}
@@ -5,18 +5,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"mime"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/logger"
 )
 
 const (
 	ValidationErrorType = "validation_failed"
 	DecodingErrorType   = "decoding_failed"
 	ServiceErrorType    = "service_error"
+	UnauthorizedType    = "unauthorized"
 )
 
-var validate = validator.New()
+// Characters allowed in username, checked with 'username' validation tag
+const UsernamePattern = `^[a-zA-Z0-9_.-]+$`
+
+var (
+	validate = validator.New()
+	username = regexp.MustCompile(UsernamePattern)
+)
 
 func init() {
 	useJSONTagNames := func(fld reflect.StructField) string {
@@ -29,12 +42,20 @@ func init() {
 	}
 
 	validate.RegisterTagNameFunc(useJSONTagNames)
+
+	err := validate.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return username.MatchString(fl.Field().String())
+	})
+	if err != nil {
+		panic(err)
+	}
 }
 
 type Struct any
 
 type ErrorResponse struct {
 	Error   string            `json:"error"`
+	Code    string            `json:"code,omitempty"`
 	Message string            `json:"message,omitempty"`
 	Fields  map[string]string `json:"fields,omitempty"`
 }
@@ -93,6 +114,119 @@ func ServiceError(w http.ResponseWriter, error string, code int) {
 	JSONWithStatus(w, response, code)
 }
 
+// Render error message as service error in the format the client accepts
+// It's JSON by default and plain text if client prefers 'text/plain' over 'application/json'
+func Error(w http.ResponseWriter, r *http.Request, error string, code int) {
+	if prefersPlainText(r) {
+		plainText(w, error, code)
+		return
+	}
+	ServiceError(w, error, code)
+}
+
+// HTTP response for application error
+type ErrorMapping struct {
+	Status  int
+	Message string
+}
+
+// Responses for application errors by their codes
+var errorRegistry = map[string]ErrorMapping{
+	apperrors.CodeUserAlreadyExists: {http.StatusConflict, "User already exists"},
+	apperrors.CodeUserNotFound:      {http.StatusNotFound, "User not found"},
+
+	apperrors.CodeInvalidCredentials: {http.StatusUnauthorized, "Invalid login or password"},
+	apperrors.CodeEmailInvalid:       {http.StatusUnprocessableEntity, "Invalid email"},
+
+	apperrors.CodeRefreshTokenNotFound: {http.StatusUnauthorized, "Refresh token not found"},
+	apperrors.CodeRefreshTokenIsUsed:   {http.StatusUnauthorized, "Refresh token reused, please login again"},
+	apperrors.CodeRefreshTokenExpired:  {http.StatusUnauthorized, "Refresh token expired"},
+	apperrors.CodeRefreshTokenRevoked:  {http.StatusUnauthorized, "Refresh token revoked, please login again"},
+
+	apperrors.CodeSessionNotFound: {http.StatusNotFound, "Session not found"},
+
+	apperrors.CodeOrderNumberTaken:      {http.StatusConflict, "Order number already taken"},
+	apperrors.CodeOrderNumberInvalid:    {http.StatusUnprocessableEntity, "Invalid order number"},
+	apperrors.CodeOrderNotFound:         {http.StatusNotFound, "Order not found"},
+	apperrors.CodeOrderAlreadyProcessed: {http.StatusConflict, "Order already processed"},
+	apperrors.CodeOrderLimitExceeded:    {http.StatusForbidden, "Orders limit exceeded"},
+	apperrors.CodeOrderNotReprocessable: {http.StatusConflict, "Only INVALID order may be reprocessed"},
+
+	apperrors.CodeBalanceInsufficient: {http.StatusPaymentRequired, "Insufficient balance"},
+	apperrors.CodeWithdrawalTooLarge:  {http.StatusUnprocessableEntity, "Withdrawal sum exceeds max allowed amount"},
+
+	apperrors.CodeWithdrawalLimitExceeded: {http.StatusTooManyRequests, "Withdrawals limit exceeded, try later"},
+}
+
+type errorLogger interface {
+	Error(msg string, args ...any)
+}
+
+// Render application error with status and message from registry
+// Unknown errors are logged and rendered as internal server error, so their details never leak to client
+// Request scoped logger from context is preferred, so error is logged with request fields like user id
+func WriteError(w http.ResponseWriter, r *http.Request, l errorLogger, err error) {
+	code := apperrors.Code(err)
+	mapping, ok := errorRegistry[code]
+	if !ok {
+		if rl, ok := logger.FromContext(r.Context()); ok {
+			l = rl
+		}
+		l.Error("Unhandled error", "error", err, "method", r.Method, "uri", r.RequestURI)
+		Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if prefersPlainText(r) {
+		plainText(w, mapping.Message, mapping.Status)
+		return
+	}
+
+	JSONWithStatus(w, ErrorResponse{
+		Error:   ServiceErrorType,
+		Code:    code,
+		Message: mapping.Message,
+	}, mapping.Status)
+}
+
+func plainText(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_, _ = fmt.Fprintln(w, message)
+}
+
+// Check Accept header whether plain text has higher quality than json
+// Wildcards and missing header are in favor of json
+func prefersPlainText(r *http.Request) bool {
+	var jsonQ, textQ float64
+
+	for _, accept := range r.Header.Values("Accept") {
+		for part := range strings.SplitSeq(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+
+			switch mediaType {
+			case "application/json", "application/*", "*/*":
+				jsonQ = max(jsonQ, q)
+			case "text/plain", "text/*":
+				textQ = max(textQ, q)
+			}
+		}
+	}
+
+	return textQ > jsonQ
+}
+
 // Render json DecodeError
 func decodeError(w http.ResponseWriter, err error) {
 	response := ErrorResponse{
@@ -127,6 +261,8 @@ func validationErrors(w http.ResponseWriter, errs validator.ValidationErrors) {
 			message = "This field is required"
 		case "min":
 			message = fmt.Sprintf("Value is too short (minimum %s)", fieldError.Param())
+		case "username":
+			message = "Only latin letters, digits, '_', '-' and '.' are allowed"
 		case "luhn":
 			message = "Invalid value according to Luhn algorithm"
 		default:
@@ -1,14 +1,20 @@
 package render
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 )
 
 func TestRender_JSON(t *testing.T) {
@@ -137,4 +143,235 @@ func TestRender_BindAndValidate(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("username", func(t *testing.T) {
+		type request struct {
+			Login string `json:"login" validate:"required,username"`
+		}
+
+		tests := []struct {
+			login string
+			valid bool
+		}{
+			{"john", true},
+			{"John_Doe-1.0", true},
+			{"42", true},
+			{"john doe", false},
+			{`john\tdoe`, false},
+			{`john\u0000`, false},
+			{"джон", false},
+			{"john@mail.ru", false},
+			{"<script>", false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.login, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{"login": "`+tt.login+`"}`))
+
+				_, err := BindAndValidate[request](w, r)
+
+				if tt.valid {
+					require.NoError(t, err)
+					return
+				}
+				require.Error(t, err)
+				require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+				assert.JSONEq(t, `{
+					"error": "validation_failed",
+					"message": "Request validation failed",
+					"fields": {"login": "Only latin letters, digits, '_', '-' and '.' are allowed"}
+				}`, w.Body.String())
+			})
+		}
+	})
+}
+
+func TestRender_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, "something terrible happened", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "no accept header",
+			accept:      "",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"service_error","message":"something terrible happened"}` + "\n",
+		},
+		{
+			name:        "any",
+			accept:      "*/*",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"service_error","message":"something terrible happened"}` + "\n",
+		},
+		{
+			name:        "json",
+			accept:      "application/json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"service_error","message":"something terrible happened"}` + "\n",
+		},
+		{
+			name:        "plain text",
+			accept:      "text/plain",
+			contentType: "text/plain; charset=utf-8",
+			body:        "something terrible happened\n",
+		},
+		{
+			name:        "plain text preferred",
+			accept:      "application/json;q=0.5, text/plain",
+			contentType: "text/plain; charset=utf-8",
+			body:        "something terrible happened\n",
+		},
+		{
+			name:        "json preferred",
+			accept:      "text/plain;q=0.8, application/json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"service_error","message":"something terrible happened"}` + "\n",
+		},
+		{
+			name:        "plain text and wildcard",
+			accept:      "text/plain, */*",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"service_error","message":"something terrible happened"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+			require.NoError(t, err)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			defer resp.Body.Close() //nolint:errcheck
+
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+// Logger that keeps logged errors
+type errorsRecorder struct {
+	logged []string
+}
+
+func (l *errorsRecorder) Error(msg string, args ...any) {
+	l.logged = append(l.logged, msg)
+}
+
+func TestRender_WriteError(t *testing.T) {
+	t.Run("known errors", func(t *testing.T) {
+		tests := []struct {
+			err     error
+			status  int
+			message string
+		}{
+			{apperrors.ErrUserAlreadyExists, http.StatusConflict, "User already exists"},
+			{apperrors.ErrUserNotFound, http.StatusNotFound, "User not found"},
+			{apperrors.ErrInvalidCredentials, http.StatusUnauthorized, "Invalid login or password"},
+			{apperrors.ErrEmailInvalid, http.StatusUnprocessableEntity, "Invalid email"},
+			{apperrors.ErrRefreshTokenNotFound, http.StatusUnauthorized, "Refresh token not found"},
+			{apperrors.ErrRefreshTokenIsUsed, http.StatusUnauthorized, "Refresh token reused, please login again"},
+			{apperrors.ErrRefreshTokenExpired, http.StatusUnauthorized, "Refresh token expired"},
+			{apperrors.ErrRefreshTokenRevoked, http.StatusUnauthorized, "Refresh token revoked, please login again"},
+			{apperrors.ErrOrderNumberTaken, http.StatusConflict, "Order number already taken"},
+			{apperrors.ErrOrderNumberInvalid, http.StatusUnprocessableEntity, "Invalid order number"},
+			{apperrors.ErrOrderNotFound, http.StatusNotFound, "Order not found"},
+			{apperrors.ErrOrderAlreadyProcessed, http.StatusConflict, "Order already processed"},
+			{apperrors.ErrOrderLimitExceeded, http.StatusForbidden, "Orders limit exceeded"},
+			{apperrors.ErrBalanceInsufficient, http.StatusPaymentRequired, "Insufficient balance"},
+		}
+
+		for _, tt := range tests {
+			t.Run(apperrors.Code(tt.err), func(t *testing.T) {
+				l := &errorsRecorder{}
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+				WriteError(w, r, l, fmt.Errorf("wrapped: %w", tt.err))
+
+				require.Equal(t, tt.status, w.Code)
+				require.JSONEq(t, fmt.Sprintf(`{
+					"error": "service_error",
+					"code": %q,
+					"message": %q
+				}`, apperrors.Code(tt.err), tt.message), w.Body.String())
+				require.Empty(t, l.logged, "known errors are not logged")
+			})
+		}
+	})
+
+	t.Run("unknown error", func(t *testing.T) {
+		l := &errorsRecorder{}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		WriteError(w, r, l, errors.New("db error: connection refused"))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.JSONEq(t, `{
+			"error": "service_error",
+			"message": "Internal server error"
+		}`, w.Body.String(), "error details must not leak")
+		require.Len(t, l.logged, 1, "unknown errors has to be logged")
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", "text/plain")
+
+		WriteError(w, r, &errorsRecorder{}, apperrors.ErrOrderNotFound)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		require.Equal(t, "Order not found\n", w.Body.String())
+	})
+}
+
+func BenchmarkRender_JSON(b *testing.B) {
+	// Shaped as transactions list response, the largest one rendered
+	type transaction struct {
+		Order       string          `json:"order"`
+		Type        string          `json:"type"`
+		Amount      decimal.Decimal `json:"amount"`
+		ProcessedAt time.Time       `json:"processed_at"`
+	}
+
+	items := make([]transaction, 100)
+	for i := range items {
+		items[i] = transaction{
+			Order:       "4561261212345467",
+			Type:        "ACCRUAL",
+			Amount:      decimal.RequireFromString("500.50"),
+			ProcessedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+	}
+
+	b.Run("list", func(b *testing.B) {
+		for b.Loop() {
+			JSON(httptest.NewRecorder(), items)
+		}
+	})
+
+	b.Run("page", func(b *testing.B) {
+		page := NewPage(items, 1000, 100, 0)
+		for b.Loop() {
+			JSON(httptest.NewRecorder(), page)
+		}
+	})
 }
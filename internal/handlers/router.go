@@ -3,11 +3,15 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
 	"github.com/nkiryanov/gophermart/internal/handlers/middleware"
+	"github.com/nkiryanov/gophermart/internal/handlers/pagination"
 	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository"
@@ -21,53 +25,176 @@ func chain(h http.Handler, mds ...func(next http.Handler) http.Handler) http.Han
 	return h
 }
 
+const (
+	defaultRequestTimeout    = 10 * time.Second
+	defaultRefreshRateWindow = time.Minute
+	defaultIdempotencyTTL    = 24 * time.Hour
+
+	// Clients are asked to retry after this while maintenance is enabled
+	maintenanceRetryAfter = time.Minute
+)
+
+// Router config with sensible defaults
+// All fields are optional: if not set, default values will be used
+type Config struct {
+	// Max time to handle request. Request context is cancelled after it
+	RequestTimeout time.Duration
+
+	// Max requests handled simultaneously, zero means unlimited
+	MaxConcurrentRequests int
+
+	// Max refresh requests from the same client IP per window. Zero or negative disables the limit
+	RefreshRateLimit  int
+	RefreshRateWindow time.Duration
+
+	// Label of balance amounts (like "points") added to balance and withdrawal responses
+	// Omitted from responses if empty
+	AmountUnit string
+
+	// How long response is replayed for repeated 'Idempotency-Key'
+	IdempotencyTTL time.Duration
+
+	// Proxies allowed to set client IP with 'X-Forwarded-For'. Peer of Unix socket is always trusted
+	TrustedProxies []netip.Prefix
+
+	// Page sizes of orders and transactions lists. Zero default returns everything if limit not set,
+	// zero max doesn't clamp the limit
+	Pagination pagination.Config
+
+	// Usernames of admins allowed to use '/admin/' API. Nobody is admin if empty
+	AdminUsernames []string
+
+	// Content-Security-Policy of responses. Nothing is allowed to load if empty
+	ContentSecurityPolicy string
+
+	// 'Strict-Transport-Security' of responses served over TLS. Zero max age disables it
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubDomains bool
+
+	// User API answers 503 while set. Toggled by admins with 'POST /admin/maintenance'
+	// Admin API, login, token refresh and health checks stay up. Disabled maintenance is created if nil
+	Maintenance *atomic.Bool
+
+	// Named checks of '/health/ready', like database or order processor. Always ready if empty
+	Readiness map[string]func(context.Context) error
+}
+
 func NewRouter(
+	cfg Config,
 	authService authService,
 	orderService orderService,
 	userService userService,
 	logger logger.Logger,
 ) http.Handler {
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.RefreshRateWindow == 0 {
+		cfg.RefreshRateWindow = defaultRefreshRateWindow
+	}
+	if cfg.IdempotencyTTL == 0 {
+		cfg.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	if cfg.Maintenance == nil {
+		cfg.Maintenance = new(atomic.Bool)
+	}
+
 	authMiddleware := middleware.AuthMiddleware(authService)
 	withAuth := func(h http.Handler) http.Handler {
 		return authMiddleware(h)
 	}
 
+	// Events stream accepts only tokens scoped to it, main API tokens are rejected there and vice versa
+	eventsAuthMiddleware := middleware.AuthMiddleware(middleware.AuthFunc(func(ctx context.Context, r *http.Request) (models.User, error) {
+		return authService.GetUserFromEventsRequest(ctx, r)
+	}))
+
+	adminMiddleware := middleware.AdminMiddleware(cfg.AdminUsernames)
+	withAdmin := func(h http.Handler) http.Handler {
+		return authMiddleware(adminMiddleware(h))
+	}
+
+	// Refresh token changes on every refresh, so client IP is the only stable key
+	refreshRateLimit := middleware.RateLimitMiddleware(cfg.RefreshRateLimit, cfg.RefreshRateWindow, middleware.ClientIP)
+
+	// Retried order uploads and withdrawals must not be performed twice
+	idempotent := middleware.IdempotencyMiddleware(cfg.IdempotencyTTL)
+
 	apiuser := http.NewServeMux()
 
 	apiuser.Handle("/login", handleLogin(authService, logger))
 	apiuser.Handle("/register", handleRegister(authService, logger))
-	apiuser.Handle("/refresh", handleTokenRefresh(authService, logger))
-
-	apiuser.Handle("POST /orders", withAuth(handleCreateOrder(orderService, logger)))
-	apiuser.Handle("GET /orders", withAuth(handleListOrder(orderService, logger)))
-	apiuser.Handle("GET /balance", withAuth(handleUserBalance(userService, logger)))
-	apiuser.Handle("POST /balance/withdraw", withAuth(handleWithdraw(userService, logger)))
-	apiuser.Handle("GET /withdrawals", withAuth(handleListWithdrawals(userService, logger)))
+	apiuser.Handle("/refresh", refreshRateLimit(handleTokenRefresh(authService, logger)))
+
+	apiuser.Handle("POST /orders", withAuth(idempotent(handleCreateOrder(orderService, logger))))
+	apiuser.Handle("GET /orders", withAuth(handleListOrder(orderService, cfg.Pagination, logger)))
+	apiuser.Handle("GET /orders/{number}", withAuth(handleGetOrder(orderService, logger)))
+	apiuser.Handle("GET /balance", withAuth(handleUserBalance(userService, cfg.AmountUnit, logger)))
+	apiuser.Handle("POST /balance/withdraw", withAuth(idempotent(handleWithdraw(userService, cfg.AmountUnit, logger))))
+	apiuser.Handle("GET /withdrawals", withAuth(handleListWithdrawals(userService, cfg.AmountUnit, logger)))
+	apiuser.Handle("GET /balance/history", withAuth(handleBalanceHistory(userService, cfg.AmountUnit, logger)))
+	apiuser.Handle("GET /transactions", withAuth(handleListTransactions(userService, cfg.AmountUnit, cfg.Pagination, logger)))
+	apiuser.Handle("GET /balance/withdrawals/summary", withAuth(handleWithdrawalsSummary(userService, cfg.AmountUnit, logger)))
 	apiuser.Handle("GET /me", withAuth(handleUserMe()))
+	apiuser.Handle("GET /stats", withAuth(handleUserStats(userService, cfg.AmountUnit, logger)))
+	apiuser.Handle("GET /sessions", withAuth(handleListSessions(authService, logger)))
+	apiuser.Handle("DELETE /sessions/{id}", withAuth(handleRevokeSession(authService, logger)))
+	apiuser.Handle("POST /events/token", withAuth(handleIssueEventsToken(authService, logger)))
+	apiuser.Handle("GET /events", eventsAuthMiddleware(handleOrderEvents(orderService, logger)))
+
+	admin := http.NewServeMux()
+	admin.Handle("POST /orders", withAdmin(handleAdminCreateOrder(orderService, logger)))
+	admin.Handle("POST /orders/{number}/reprocess", withAdmin(handleAdminReprocessOrder(orderService, logger)))
+	admin.Handle("POST /maintenance", withAdmin(handleAdminMaintenance(cfg.Maintenance, logger)))
+
+	// Admin API is kept up in maintenance, so admins are able to turn it off
+	// Login and refresh are kept up too, so admin with expired token is able to get a new one
+	maintenance := middleware.MaintenanceMiddleware(cfg.Maintenance, maintenanceRetryAfter)
 
 	root := http.NewServeMux()
-	root.Handle("/api/user/", http.StripPrefix("/api/user", apiuser))
+	root.Handle("/api/user/", maintenance(http.StripPrefix("/api/user", apiuser)))
+	root.Handle("/api/user/login", http.StripPrefix("/api/user", apiuser))
+	root.Handle("/api/user/refresh", http.StripPrefix("/api/user", apiuser))
+	root.Handle("/admin/", http.StripPrefix("/admin", admin))
 
 	handler := chain(root,
+		middleware.ClientIPMiddleware(cfg.TrustedProxies),
 		middleware.LoggerMiddleware(logger),
+		middleware.TimeoutMiddleware(cfg.RequestTimeout),
+		// Inside timeout, so timed out handler keeps its slot till it really returns
+		middleware.ConcurrencyLimitMiddleware(cfg.MaxConcurrentRequests),
 	)
 
-	return handler
+	// Ping and readiness are polled often, so they are served before middlewares to keep them out of access logs
+	top := http.NewServeMux()
+	top.Handle("GET /api/ping", handlePing())
+	top.Handle("GET /health/ready", handleReady(cfg.Readiness))
+	top.Handle("/", handler)
+
+	return chain(top,
+		middleware.SecurityHeadersMiddleware(cfg.ContentSecurityPolicy),
+		middleware.HSTSMiddleware(cfg.HSTSMaxAge, cfg.HSTSIncludeSubDomains, cfg.TrustedProxies),
+	)
 }
 
 type authService interface {
 	// Register user with username and password
 	// Has to return apperrors.ErrUserAlreadyExists if user already exists
-	Register(ctx context.Context, username string, password string) (models.TokenPair, error)
+	// Options are applied to issued refresh token
+	Register(ctx context.Context, username string, password string, opts ...repository.RefreshTokenOption) (models.TokenPair, error)
+
+	// Register user with optional email, it's not stored if empty
+	RegisterWithEmail(ctx context.Context, username string, password string, email string, opts ...repository.RefreshTokenOption) (models.TokenPair, error)
 
 	// Login user with username and password
-	// Has to return apperrors.ErrUserNotFound if user not found
-	Login(ctx context.Context, username string, password string) (models.TokenPair, error)
+	// Has to return apperrors.ErrUserNotFound if user not found and apperrors.ErrInvalidCredentials if password is wrong
+	Login(ctx context.Context, username string, password string, opts ...repository.RefreshTokenOption) (models.TokenPair, error)
 
 	// Refresh tokens using refresh token
 	// If token expired: has to return apperrors.ErrRefreshTokenExpired
 	// If token not found: has to return apperrors.ErrRefreshTokenNotFound
-	RefreshPair(ctx context.Context, refresh string) (models.TokenPair, error)
+	// If token reused: has to return apperrors.ErrRefreshTokenIsUsed
+	RefreshPair(ctx context.Context, refresh string, opts ...repository.RefreshTokenOption) (models.TokenPair, error)
 
 	// Set auth tokens (access, refresh) to response
 	SetTokenPairToResponse(w http.ResponseWriter, pair models.TokenPair)
@@ -77,15 +204,46 @@ type authService interface {
 
 	// Get request and return user if it authenticated or error
 	GetUserFromRequest(ctx context.Context, r *http.Request) (models.User, error)
+
+	// List user's active sessions (refresh tokens)
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error)
+
+	// Revoke user's session
+	// Has to return apperrors.ErrSessionNotFound if session not found or belongs to other user
+	RevokeSession(ctx context.Context, userID uuid.UUID, sessionID uuid.UUID) error
+
+	// Issue short-lived token accepted only by events stream
+	IssueEventsToken(ctx context.Context, userID uuid.UUID) (models.IssuedToken, error)
+
+	// Get user from events stream request, it has to be authenticated with events token
+	GetUserFromEventsRequest(ctx context.Context, r *http.Request) (models.User, error)
 }
 
 type orderService interface {
 	CreateOrder(ctx context.Context, number string, user *models.User, opts ...repository.CreateOrderOption) (models.Order, error)
 	ListOrders(ctx context.Context, opts repository.ListOrdersOpts) ([]models.Order, error)
+	CountOrders(ctx context.Context, userID uuid.UUID) (int, error)
+
+	// Call fn for every order as they are read from storage
+	ForEachOrder(ctx context.Context, opts repository.ListOrdersOpts, fn func(models.Order) error) error
+
+	// Get user's order by number
+	// Has to return apperrors.ErrOrderNotFound if order not exists or belongs to other user
+	GetOrder(ctx context.Context, number string, userID uuid.UUID) (models.Order, error)
+
+	// Reset INVALID order to be processed again
+	// Has to return apperrors.ErrOrderNotReprocessable if order is in other status
+	ReprocessOrder(ctx context.Context, number string, admin string) (models.Order, error)
 }
 
 type userService interface {
 	GetBalance(ctx context.Context, userID uuid.UUID) (models.Balance, error)
 	Withdraw(ctx context.Context, userID uuid.UUID, orderNum string, amount decimal.Decimal) (models.Balance, error)
 	GetWithdrawals(ctx context.Context, userID uuid.UUID) ([]models.Transaction, error)
+	GetWithdrawalsSummary(ctx context.Context, userID uuid.UUID) ([]models.WithdrawalSummary, error)
+	GetStats(ctx context.Context, userID uuid.UUID) (models.UserStats, error)
+	GetTransactions(ctx context.Context, userID uuid.UUID, page repository.Page) ([]models.Transaction, error)
+	CountTransactions(ctx context.Context, userID uuid.UUID) (int, error)
+	GetBalanceHistory(ctx context.Context, userID uuid.UUID, opts repository.BalanceHistoryOpts) ([]models.BalancePoint, error)
+	ForEachTransaction(ctx context.Context, userID uuid.UUID, fn func(models.Transaction) error) error
 }
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/handlers/render"
+	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func handleListSessions(authService authService, l logger.Logger) http.Handler {
+	// Session is identified by refresh token ID only, no part of the token is ever returned
+	type session struct {
+		ID        uuid.UUID `json:"id"`
+		UserAgent string    `json:"user_agent,omitempty"`
+		IP        string    `json:"ip,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := authService.ListSessions(r.Context(), user.ID)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		sessions := make([]session, 0, len(tokens))
+		for _, t := range tokens {
+			sessions = append(sessions, session{
+				ID:        t.ID,
+				UserAgent: t.UserAgent,
+				IP:        t.IP,
+				CreatedAt: t.CreatedAt,
+				ExpiresAt: t.ExpiresAt,
+			})
+		}
+		render.JSON(w, sessions)
+	})
+}
+
+func handleRevokeSession(authService authService, l logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		sessionID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			render.WriteError(w, r, l, apperrors.ErrSessionNotFound)
+			return
+		}
+
+		err = authService.RevokeSession(r.Context(), user.ID, sessionID)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -6,16 +6,65 @@ import (
 
 	"github.com/nkiryanov/gophermart/internal/handlers/render"
 	"github.com/nkiryanov/gophermart/internal/handlers/userctx"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
 )
 
 func handleUserMe() http.Handler {
 	type response struct {
 		ID       uuid.UUID `json:"id"`
 		Username string    `json:"username"`
+		Email    string    `json:"email,omitempty"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, _ := userctx.FromContext(r.Context())
-		render.JSON(w, response{ID: user.ID, Username: user.Username})
+		render.JSON(w, response{ID: user.ID, Username: user.Username, Email: user.Email})
+	})
+}
+
+func handleUserStats(userService userService, unit string, l logger.Logger) http.Handler {
+	type orders struct {
+		Total    int            `json:"total"`
+		ByStatus map[string]int `json:"by_status"`
+	}
+	type response struct {
+		Orders    orders `json:"orders"`
+		Accrued   amount `json:"accrued"`
+		Withdrawn amount `json:"withdrawn"`
+		Current   amount `json:"current"`
+		Unit      string `json:"unit,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userctx.FromContext(r.Context())
+		if !ok {
+			render.Error(w, r, "Internal service error", http.StatusInternalServerError)
+			return
+		}
+
+		stats, err := userService.GetStats(r.Context(), user.ID)
+		if err != nil {
+			render.WriteError(w, r, l, err)
+			return
+		}
+
+		// Every status is present, so client doesn't have to know them in advance
+		byStatus := make(map[string]int, len(models.OrderStatuses))
+		for _, status := range models.OrderStatuses {
+			byStatus[status] = 0
+		}
+		for status, count := range stats.OrdersByStatus {
+			byStatus[status] = count
+		}
+
+		newAmount := amountFormat(r)
+		render.JSON(w, response{
+			Orders:    orders{Total: stats.OrdersTotal, ByStatus: byStatus},
+			Accrued:   newAmount(stats.Accrued),
+			Withdrawn: newAmount(stats.Withdrawn),
+			Current:   newAmount(stats.Current),
+			Unit:      unit,
+		})
 	})
 }
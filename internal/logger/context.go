@@ -0,0 +1,18 @@
+package logger
+
+import "context"
+
+type ctxKey string
+
+const loggerKey ctxKey = "logger"
+
+// Create a new context with the request scoped logger
+func WithContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// Extract the request scoped logger from the context
+func FromContext(ctx context.Context) (Logger, bool) {
+	l, ok := ctx.Value(loggerKey).(Logger)
+	return l, ok
+}
@@ -20,6 +20,9 @@ const (
 
 	EnvDevelopment = "dev"
 	EnvProduction  = "prod"
+
+	FormatText = "text"
+	FormatJSON = "json"
 )
 
 // Logger interface defines the logging contract
@@ -38,7 +41,18 @@ type slogLogger struct {
 	logger *slog.Logger
 }
 
-func New(environment string, level string) (Logger, error) {
+// Creates logger of the format. If format is empty, it's chosen by environment: text for dev and json for prod
+func New(environment string, format string, level string) (Logger, error) {
+	switch format {
+	case FormatText:
+		return NewTextLogger(level)
+	case FormatJSON:
+		return NewJSONLogger(level)
+	case "":
+	default:
+		return nil, errors.New("unknown log format")
+	}
+
 	switch environment {
 	case EnvDevelopment:
 		return NewDevLogger(level)
@@ -102,6 +116,12 @@ func NewJSONLogger(level string) (Logger, error) {
 	return &slogLogger{logger: logger}, nil
 }
 
+// Creates logger that writes records to the handler
+// Useful to capture logs in tests
+func NewWithHandler(handler slog.Handler) Logger {
+	return &slogLogger{logger: slog.New(handler)}
+}
+
 // NewNoOpLogger creates a logger that discards all log messages
 func NewNoOpLogger() Logger {
 	logger := slog.New(slog.DiscardHandler)
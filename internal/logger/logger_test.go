@@ -123,6 +123,34 @@ func TestLogger_NewJSONLogger(t *testing.T) {
 	require.Equal(t, "value", entry["key"], "JSON log should contain key-value pairs")
 }
 
+func TestLogger_New(t *testing.T) {
+	isJSON := func(t *testing.T, environment string, format string) bool {
+		_, stderr := capture(t, func() {
+			logger, err := New(environment, format, LevelInfo)
+			require.NoError(t, err)
+
+			logger.Info("test message")
+		})
+		return json.Valid([]byte(stderr))
+	}
+
+	t.Run("format chosen by environment", func(t *testing.T) {
+		require.False(t, isJSON(t, EnvDevelopment, ""), "dev logger has to be text")
+		require.True(t, isJSON(t, EnvProduction, ""), "prod logger has to be json")
+	})
+
+	t.Run("format overrides environment", func(t *testing.T) {
+		require.True(t, isJSON(t, EnvDevelopment, FormatJSON))
+		require.False(t, isJSON(t, EnvProduction, FormatText))
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := New(EnvProduction, "xml", LevelInfo)
+
+		require.Error(t, err)
+	})
+}
+
 func TestLogger_NewNoOpLogger(t *testing.T) {
 	stdout, stderr := capture(t, func() {
 		logger := NewNoOpLogger()
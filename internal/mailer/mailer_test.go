@@ -0,0 +1,104 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMTP(t *testing.T) {
+	// Mailer that records sent message instead of sending it
+	newMailer := func(t *testing.T, cfg SMTPConfig) (*SMTP, *[]byte, *[]string) {
+		m, err := NewSMTP(cfg)
+		require.NoError(t, err)
+
+		var msg []byte
+		var to []string
+		m.sendMail = func(_ context.Context, addr string, _ smtp.Auth, from string, rcpt []string, data []byte) error {
+			require.Equal(t, cfg.Addr, addr)
+			require.Equal(t, "noreply@example.com", from)
+			msg, to = data, rcpt
+			return nil
+		}
+		m.now = func() time.Time { return time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC) }
+		return m, &msg, &to
+	}
+
+	cfg := SMTPConfig{Addr: "smtp.example.com:587", From: "Gophermart <noreply@example.com>"}
+
+	t.Run("send", func(t *testing.T) {
+		m, msg, to := newMailer(t, cfg)
+
+		err := m.Send(t.Context(), "user@example.com", "Withdrawal receipt", "line 1\nline 2")
+
+		require.NoError(t, err)
+		require.Equal(t, []string{"user@example.com"}, *to)
+		require.Equal(t, "From: \"Gophermart\" <noreply@example.com>\r\n"+
+			"To: <user@example.com>\r\n"+
+			"Subject: Withdrawal receipt\r\n"+
+			"Date: Thu, 02 Jan 2025 03:04:05 +0000\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"\r\n"+
+			"line 1\r\nline 2", string(*msg))
+	})
+
+	t.Run("header injection rejected", func(t *testing.T) {
+		m, msg, _ := newMailer(t, cfg)
+
+		err := m.Send(t.Context(), "user@example.com", "Hi\r\nBcc: other@example.com", "body")
+		require.Error(t, err)
+		err = m.Send(t.Context(), "user@example.com\r\nBcc: other@example.com", "Hi", "body")
+		require.Error(t, err)
+
+		require.Nil(t, *msg, "nothing has to be sent")
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		m, msg, _ := newMailer(t, cfg)
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		err := m.Send(ctx, "user@example.com", "Hi", "body")
+
+		require.ErrorIs(t, err, context.Canceled)
+		require.Nil(t, *msg)
+	})
+
+	t.Run("stuck server interrupted by deadline", func(t *testing.T) {
+		// Server accepts connections but never greets the client
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err == nil {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}
+		}()
+		m, err := NewSMTP(SMTPConfig{Addr: ln.Addr().String(), From: "noreply@example.com"})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+		err = m.Send(ctx, "user@example.com", "Hi", "body")
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(started), 5*time.Second)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := NewSMTP(SMTPConfig{Addr: "smtp.example.com", From: "noreply@example.com"})
+		require.Error(t, err, "port is required")
+
+		_, err = NewSMTP(SMTPConfig{Addr: "smtp.example.com:587", From: "noreply"})
+		require.Error(t, err)
+	})
+}
@@ -1,16 +1,25 @@
 package models
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
-	"time"
 )
 
+// Kind of balance change, only the declared ones are stored
+type TransactionType string
+
 const (
-	TransactionTypeAccrual    = "ACCRUAL"
-	TransactionTypeWithdrawal = "WITHDRAWAL"
+	TransactionTypeAccrual    TransactionType = "ACCRUAL"
+	TransactionTypeWithdrawal TransactionType = "WITHDRAWAL"
 )
 
+func (t TransactionType) Valid() bool {
+	return t == TransactionTypeAccrual || t == TransactionTypeWithdrawal
+}
+
 type Balance struct {
 	ID        uuid.UUID
 	UserID    uuid.UUID
@@ -18,11 +27,81 @@ type Balance struct {
 	Withdrawn decimal.Decimal
 }
 
+// Balance that doesn't match sums of the user's transactions
+type BalanceMismatch struct {
+	// Stored balance
+	Balance
+
+	// Balance computed from transactions
+	ExpectedCurrent   decimal.Decimal
+	ExpectedWithdrawn decimal.Decimal
+}
+
 type Transaction struct {
 	ID          uuid.UUID
 	ProcessedAt time.Time
 	UserID      uuid.UUID
 	OrderNumber string
-	Type        string
+	Type        TransactionType
 	Amount      decimal.Decimal
 }
+
+// New accrual to user's balance for the order. Amount has to be positive
+func NewAccrual(userID uuid.UUID, orderNumber string, amount decimal.Decimal) (Transaction, error) {
+	return newTransaction(TransactionTypeAccrual, userID, orderNumber, amount)
+}
+
+// New withdrawal from user's balance against the order. Amount has to be positive
+func NewWithdrawal(userID uuid.UUID, orderNumber string, amount decimal.Decimal) (Transaction, error) {
+	return newTransaction(TransactionTypeWithdrawal, userID, orderNumber, amount)
+}
+
+func newTransaction(typ TransactionType, userID uuid.UUID, orderNumber string, amount decimal.Decimal) (Transaction, error) {
+	if !amount.IsPositive() {
+		return Transaction{}, fmt.Errorf("transaction amount must be positive: %s", amount)
+	}
+	return Transaction{
+		ID:          uuid.New(),
+		ProcessedAt: time.Now(),
+		UserID:      userID,
+		OrderNumber: orderNumber,
+		Type:        typ,
+		Amount:      amount,
+	}, nil
+}
+
+// Amount as it changes the balance: withdrawals are negative
+func (t Transaction) SignedAmount() decimal.Decimal {
+	if t.Type == TransactionTypeWithdrawal {
+		return t.Amount.Neg()
+	}
+	return t.Amount
+}
+
+// Withdrawals made against the same order summed up
+type WithdrawalSummary struct {
+	OrderNumber string
+	Sum         decimal.Decimal
+	Count       int
+}
+
+// User's balance right after the transaction processed at the time
+type BalancePoint struct {
+	At        time.Time
+	Current   decimal.Decimal
+	Withdrawn decimal.Decimal
+}
+
+// Sums of user's transactions by type
+type TransactionTotals struct {
+	Accrued   decimal.Decimal
+	Withdrawn decimal.Decimal
+}
+
+// Aggregated user's activity
+type UserStats struct {
+	OrdersTotal    int
+	OrdersByStatus map[string]int
+	TransactionTotals
+	Current decimal.Decimal
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransaction(t *testing.T) {
+	userID := uuid.New()
+
+	t.Run("accrual", func(t *testing.T) {
+		tr, err := NewAccrual(userID, "2377225624", decimal.RequireFromString("10.5"))
+
+		require.NoError(t, err)
+		require.NotEqual(t, uuid.Nil, tr.ID)
+		require.WithinDuration(t, time.Now(), tr.ProcessedAt, time.Second)
+		require.Equal(t, userID, tr.UserID)
+		require.Equal(t, "2377225624", tr.OrderNumber)
+		require.Equal(t, TransactionTypeAccrual, tr.Type)
+		require.Equal(t, "10.5", tr.Amount.String())
+	})
+
+	t.Run("withdrawal", func(t *testing.T) {
+		tr, err := NewWithdrawal(userID, "2377225624", decimal.NewFromInt(7))
+
+		require.NoError(t, err)
+		require.Equal(t, TransactionTypeWithdrawal, tr.Type)
+		require.Equal(t, "-7", tr.SignedAmount().String())
+	})
+
+	t.Run("not positive amount fail", func(t *testing.T) {
+		for _, amount := range []decimal.Decimal{decimal.Zero, decimal.NewFromInt(-1)} {
+			_, err := NewAccrual(userID, "2377225624", amount)
+			require.Error(t, err, "accrual of %s has to be rejected", amount)
+
+			_, err = NewWithdrawal(userID, "2377225624", amount)
+			require.Error(t, err, "withdrawal of %s has to be rejected", amount)
+		}
+	})
+}
+
+func TestTransactionType_Valid(t *testing.T) {
+	require.True(t, TransactionTypeAccrual.Valid())
+	require.True(t, TransactionTypeWithdrawal.Valid())
+	require.False(t, TransactionType("WITHDRAWN").Valid())
+	require.False(t, TransactionType("").Valid())
+}
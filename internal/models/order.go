@@ -1,9 +1,11 @@
 package models
 
 import (
+	"slices"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
-	"time"
 )
 
 const (
@@ -13,6 +15,34 @@ const (
 	OrderStatusProcessed  = "PROCESSED"
 )
 
+// All order statuses in processing order
+var OrderStatuses = []string{OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed}
+
+func IsValidOrderStatus(s string) bool {
+	return slices.Contains(OrderStatuses, s)
+}
+
+// Order in terminal status is never changed again
+func IsTerminalStatus(s string) bool {
+	return s == OrderStatusInvalid || s == OrderStatusProcessed
+}
+
+// Allowed order status moves: NEW -> PROCESSING -> PROCESSED or INVALID
+// Order may skip PROCESSING or stay in non terminal status, but never moves backward
+func CanTransition(from, to string) bool {
+	if !IsValidOrderStatus(from) || !IsValidOrderStatus(to) || IsTerminalStatus(from) {
+		return false
+	}
+	return !(from == OrderStatusProcessing && to == OrderStatusNew)
+}
+
+// Only INVALID order may be reset to NEW to be polled again, e.g. if it was invalidated by accrual service bug
+// It's done by admins only, usual processing never moves order out of terminal status
+// PROCESSED order is never reprocessed, its accrual is credited already
+func CanReprocess(from string) bool {
+	return from == OrderStatusInvalid
+}
+
 type Order struct {
 	ID         uuid.UUID
 	Number     string
@@ -22,3 +52,21 @@ type Order struct {
 	UploadedAt time.Time
 	ModifiedAt time.Time
 }
+
+// Result of accrual service for the order to apply to it
+type AccrualResult struct {
+	OrderNumber string
+	Status      string
+	Accrual     decimal.Decimal
+}
+
+// Order polling state kept by order processor between restarts
+type OrderPollState struct {
+	OrderNumber string
+
+	// Failed attempts to get order accrual
+	Attempts int
+
+	// Order is not polled till the time
+	NextPollAt time.Time
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status   string
+		valid    bool
+		terminal bool
+	}{
+		{OrderStatusNew, true, false},
+		{OrderStatusProcessing, true, false},
+		{OrderStatusInvalid, true, true},
+		{OrderStatusProcessed, true, true},
+		{"REGISTERED", false, false},
+		{"new", false, false},
+		{"", false, false},
+	} {
+		t.Run(tc.status, func(t *testing.T) {
+			require.Equal(t, tc.valid, IsValidOrderStatus(tc.status))
+			require.Equal(t, tc.terminal, IsTerminalStatus(tc.status))
+		})
+	}
+
+	t.Run("all statuses valid", func(t *testing.T) {
+		require.Len(t, OrderStatuses, 4)
+		for _, status := range OrderStatuses {
+			require.True(t, IsValidOrderStatus(status))
+		}
+	})
+}
+
+func TestCanTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{OrderStatusNew, OrderStatusNew, true},
+		{OrderStatusNew, OrderStatusProcessing, true},
+		{OrderStatusNew, OrderStatusProcessed, true},
+		{OrderStatusNew, OrderStatusInvalid, true},
+		{OrderStatusProcessing, OrderStatusProcessing, true},
+		{OrderStatusProcessing, OrderStatusProcessed, true},
+		{OrderStatusProcessing, OrderStatusInvalid, true},
+
+		{OrderStatusProcessing, OrderStatusNew, false},
+		{OrderStatusProcessed, OrderStatusNew, false},
+		{OrderStatusProcessed, OrderStatusProcessing, false},
+		{OrderStatusProcessed, OrderStatusProcessed, false},
+		{OrderStatusProcessed, OrderStatusInvalid, false},
+		{OrderStatusInvalid, OrderStatusNew, false},
+		{OrderStatusInvalid, OrderStatusProcessing, false},
+		{OrderStatusInvalid, OrderStatusProcessed, false},
+		{OrderStatusInvalid, OrderStatusInvalid, false},
+		{OrderStatusNew, "REGISTERED", false},
+		{"REGISTERED", OrderStatusProcessed, false},
+	} {
+		t.Run(tc.from+" to "+tc.to, func(t *testing.T) {
+			require.Equal(t, tc.allowed, CanTransition(tc.from, tc.to))
+		})
+	}
+}
+
+func TestCanReprocess(t *testing.T) {
+	require.True(t, CanReprocess(OrderStatusInvalid))
+	for _, status := range []string{OrderStatusNew, OrderStatusProcessing, OrderStatusProcessed, "REGISTERED"} {
+		require.False(t, CanReprocess(status), "%s order must not be reprocessed", status)
+	}
+}
@@ -9,10 +9,16 @@ import (
 type RefreshToken struct {
 	ID        uuid.UUID
 	UserID    uuid.UUID
+	FamilyID  uuid.UUID // tokens issued by rotating each other share the same family
 	Token     string
 	CreatedAt time.Time
 	ExpiresAt time.Time
 	UsedAt    *time.Time // nil if token not used
+	RevokedAt *time.Time // nil if token not revoked
+
+	// Client the token issued to, empty if unknown
+	UserAgent string
+	IP        string
 }
 
 type IssuedToken struct {
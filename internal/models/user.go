@@ -11,4 +11,7 @@ type User struct {
 	CreatedAt      time.Time
 	Username       string
 	HashedPassword string
+
+	// Optional, empty if not set
+	Email string
 }
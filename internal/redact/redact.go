@@ -0,0 +1,35 @@
+// Package redact hides secrets in values that are logged or returned in errors
+package redact
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// Placeholder for secrets, same as url.URL.Redacted uses
+const Placeholder = "xxxxx"
+
+// Matches password in key-value DSN (host=localhost password=secret) or in url query (?password=secret)
+var dsnPasswordRe = regexp.MustCompile(`(password=)([^\s&]+)`)
+
+// Return DSN that safe to log: password replaced with placeholder
+func DSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		dsn = u.Redacted()
+	}
+	return dsnPasswordRe.ReplaceAllString(dsn, "${1}"+Placeholder)
+}
+
+// Passwords from DSN in every supported form, so they can be hidden wherever they are echoed
+func DSNPasswords(dsn string) []string {
+	var passwords []string
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if p, ok := u.User.Password(); ok && p != "" {
+			passwords = append(passwords, p, url.QueryEscape(p))
+		}
+	}
+	for _, m := range dsnPasswordRe.FindAllStringSubmatch(dsn, -1) {
+		passwords = append(passwords, m[2])
+	}
+	return passwords
+}
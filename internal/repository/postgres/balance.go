@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgerrcode"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
 type BalanceRepo struct {
@@ -122,6 +124,10 @@ func (r *BalanceRepo) CreateTransaction(ctx context.Context, t models.Transactio
 	VALUES ($1, $2, $3, $4, $5, $6)
 	RETURNING id, processed_at, user_id, order_number, type, amount
 	`
+	if !t.Type.Valid() {
+		return t, fmt.Errorf("unknown transaction type %q", t.Type)
+	}
+
 	rows, _ := r.DB.Query(ctx, creteTransaction,
 		t.ID,
 		t.ProcessedAt,
@@ -131,11 +137,7 @@ func (r *BalanceRepo) CreateTransaction(ctx context.Context, t models.Transactio
 		t.Amount,
 	)
 
-	t, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (models.Transaction, error) {
-		var tr models.Transaction
-		err := row.Scan(&tr.ID, &tr.ProcessedAt, &tr.UserID, &tr.OrderNumber, &tr.Type, &tr.Amount)
-		return tr, err
-	})
+	t, err := pgx.CollectOneRow(rows, rowToTransaction)
 
 	var pgErr *pgconn.PgError
 
@@ -149,29 +151,275 @@ func (r *BalanceRepo) CreateTransaction(ctx context.Context, t models.Transactio
 	}
 }
 
-func (r *BalanceRepo) ListTransactions(ctx context.Context, userID uuid.UUID, types []string) ([]models.Transaction, error) {
-	const listTransactions = `
-	SELECT id, processed_at, user_id, order_number, type, amount
-	FROM transactions
-	WHERE user_id = $1 and type = any($2::text[])
-	ORDER BY processed_at DESC
-	`
+func (r *BalanceRepo) BulkCreateTransactions(ctx context.Context, ts []models.Transaction) error {
+	for i, t := range ts {
+		if !t.Type.Valid() {
+			return fmt.Errorf("unknown type %q of transaction %d", t.Type, i)
+		}
+	}
+
+	_, err := r.DB.CopyFrom(ctx,
+		pgx.Identifier{"transactions"},
+		[]string{"id", "processed_at", "user_id", "order_number", "type", "amount"},
+		pgx.CopyFromSlice(len(ts), func(i int) ([]any, error) {
+			t := ts[i]
+			return []any{t.ID, t.ProcessedAt, t.UserID, t.OrderNumber, string(t.Type), t.Amount}, nil
+		}),
+	)
+
+	var pgErr *pgconn.PgError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation:
+		return apperrors.ErrUserNotFound
+	default:
+		return fmt.Errorf("db error: %w", err)
+	}
+}
+
+const listTransactions = `
+SELECT id, processed_at, user_id, order_number, type, amount
+FROM transactions
+WHERE user_id = $1 and type = any($2::text[])
+ORDER BY processed_at DESC
+`
+
+func (r *BalanceRepo) ListTransactions(ctx context.Context, userID uuid.UUID, types []models.TransactionType, page repository.Page) ([]models.Transaction, error) {
+	if len(types) == 0 {
+		types = []models.TransactionType{models.TransactionTypeWithdrawal, models.TransactionTypeAccrual}
+	}
+
+	// NULL limit means no limit
+	const paged = listTransactions + "LIMIT NULLIF($3, 0) OFFSET $4\n"
+	rows, _ := r.DB.Query(ctx, paged, userID, types, page.Limit, page.Offset)
+	ts, err := pgx.CollectRows(rows, rowToTransaction)
+
+	switch err {
+	case nil:
+		return ts, nil
+	default:
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+}
 
+func (r *BalanceRepo) CountTransactions(ctx context.Context, userID uuid.UUID, types []models.TransactionType) (int, error) {
+	const countTransactions = `SELECT count(*) FROM transactions WHERE user_id = $1 and type = any($2::text[])`
+
+	if len(types) == 0 {
+		types = []models.TransactionType{models.TransactionTypeWithdrawal, models.TransactionTypeAccrual}
+	}
+
+	var count int
+	err := r.DB.QueryRow(ctx, countTransactions, userID, types).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+	return count, nil
+}
+
+func (r *BalanceRepo) ForEachTransaction(ctx context.Context, userID uuid.UUID, types []models.TransactionType, fn func(models.Transaction) error) error {
 	if len(types) == 0 {
-		types = []string{models.TransactionTypeWithdrawal, models.TransactionTypeAccrual}
+		types = []models.TransactionType{models.TransactionTypeWithdrawal, models.TransactionTypeAccrual}
 	}
 
 	rows, _ := r.DB.Query(ctx, listTransactions, userID, types)
-	ts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Transaction, error) {
-		var tr models.Transaction
-		err := row.Scan(&tr.ID, &tr.ProcessedAt, &tr.UserID, &tr.OrderNumber, &tr.Type, &tr.Amount)
-		return tr, err
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, err := rowToTransaction(rows)
+		if err != nil {
+			return fmt.Errorf("db error: %w", err)
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+	return nil
+}
+
+func rowToTransaction(row pgx.CollectableRow) (models.Transaction, error) {
+	var t models.Transaction
+	err := row.Scan(&t.ID, &t.ProcessedAt, &t.UserID, &t.OrderNumber, &t.Type, &t.Amount)
+	return t, err
+}
+
+func (r *BalanceRepo) SumTransactions(ctx context.Context, userID uuid.UUID, typ models.TransactionType, since time.Time) (decimal.Decimal, error) {
+	const sumTransactions = `
+	SELECT coalesce(sum(amount), 0)
+	FROM transactions
+	WHERE user_id = $1 and type = $2 and processed_at >= $3
+	`
+
+	var sum decimal.Decimal
+	err := r.DB.QueryRow(ctx, sumTransactions, userID, typ, since).Scan(&sum)
+	if err != nil {
+		return sum, fmt.Errorf("db error: %w", err)
+	}
+	return sum, nil
+}
+
+func (r *BalanceRepo) SumTransactionsByType(ctx context.Context, userID uuid.UUID) (models.TransactionTotals, error) {
+	const sumByType = `
+	SELECT
+		coalesce(sum(amount) FILTER (WHERE type = 'ACCRUAL'), 0),
+		coalesce(sum(amount) FILTER (WHERE type = 'WITHDRAWAL'), 0)
+	FROM transactions
+	WHERE user_id = $1
+	`
+
+	var totals models.TransactionTotals
+	err := r.DB.QueryRow(ctx, sumByType, userID).Scan(&totals.Accrued, &totals.Withdrawn)
+	if err != nil {
+		return totals, fmt.Errorf("db error: %w", err)
+	}
+	return totals, nil
+}
+
+// Running sums are computed over all user's transactions first, so the range only bounds returned points
+const balanceHistory = `
+WITH running AS (
+	SELECT
+		id,
+		processed_at,
+		sum(CASE WHEN type = 'WITHDRAWAL' THEN -amount ELSE amount END) OVER w AS current,
+		coalesce(sum(amount) FILTER (WHERE type = 'WITHDRAWAL') OVER w, 0) AS withdrawn
+	FROM transactions
+	WHERE user_id = $1
+	WINDOW w AS (ORDER BY processed_at, id ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW)
+), bounded AS (
+	SELECT * FROM running
+	WHERE ($2::timestamptz IS NULL OR processed_at >= $2) AND ($3::timestamptz IS NULL OR processed_at < $3)
+)
+`
+
+func (r *BalanceRepo) BalanceHistory(ctx context.Context, userID uuid.UUID, opts repository.BalanceHistoryOpts) ([]models.BalancePoint, error) {
+	const points = balanceHistory + `
+	SELECT processed_at, current, withdrawn FROM bounded
+	ORDER BY processed_at, id
+	`
+	// The last point of the day is the balance at the end of the day
+	const daily = balanceHistory + `
+	SELECT day, current, withdrawn FROM (
+		SELECT DISTINCT ON (date_trunc('day', processed_at, 'UTC'))
+			date_trunc('day', processed_at, 'UTC') AS day, current, withdrawn
+		FROM bounded
+		ORDER BY date_trunc('day', processed_at, 'UTC'), processed_at DESC, id DESC
+	) d
+	ORDER BY day
+	`
+
+	query := points
+	if opts.ByDay {
+		query = daily
+	}
+
+	rows, _ := r.DB.Query(ctx, query, userID, opts.From, opts.To)
+	ps, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.BalancePoint, error) {
+		var p models.BalancePoint
+		err := row.Scan(&p.At, &p.Current, &p.Withdrawn)
+		return p, err
 	})
 
 	switch err {
 	case nil:
-		return ts, nil
+		return ps, nil
+	default:
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+}
+
+func (r *BalanceRepo) SumWithdrawalsByOrder(ctx context.Context, userID uuid.UUID) ([]models.WithdrawalSummary, error) {
+	const sumWithdrawals = `
+	SELECT order_number, sum(amount), count(*)
+	FROM transactions
+	WHERE user_id = $1 and type = 'WITHDRAWAL'
+	GROUP BY order_number
+	ORDER BY max(processed_at) DESC
+	`
+
+	rows, _ := r.DB.Query(ctx, sumWithdrawals, userID)
+	ss, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.WithdrawalSummary, error) {
+		var s models.WithdrawalSummary
+		err := row.Scan(&s.OrderNumber, &s.Sum, &s.Count)
+		return s, err
+	})
+
+	switch err {
+	case nil:
+		return ss, nil
 	default:
 		return nil, fmt.Errorf("db error: %w", err)
 	}
 }
+
+func (r *BalanceRepo) ListBalanceMismatches(ctx context.Context, lock bool) ([]models.BalanceMismatch, error) {
+	const listMismatches = `
+	SELECT b.id, b.user_id, b.current, b.withdrawn, s.accrued - s.withdrawn, s.withdrawn
+	FROM balances b
+	CROSS JOIN LATERAL (
+		SELECT
+			coalesce(sum(amount) FILTER (WHERE type = 'ACCRUAL'), 0) AS accrued,
+			coalesce(sum(amount) FILTER (WHERE type = 'WITHDRAWAL'), 0) AS withdrawn
+		FROM transactions t
+		WHERE t.user_id = b.user_id
+	) s
+	WHERE b.current <> s.accrued - s.withdrawn OR b.withdrawn <> s.withdrawn
+	ORDER BY b.user_id
+	`
+
+	query := listMismatches
+	if lock {
+		query += "FOR UPDATE OF b"
+	}
+
+	rows, _ := r.DB.Query(ctx, query)
+	ms, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.BalanceMismatch, error) {
+		var m models.BalanceMismatch
+		err := row.Scan(&m.ID, &m.UserID, &m.Current, &m.Withdrawn, &m.ExpectedCurrent, &m.ExpectedWithdrawn)
+		return m, err
+	})
+
+	switch err {
+	case nil:
+		return ms, nil
+	default:
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+}
+
+func (r *BalanceRepo) SetBalance(ctx context.Context, userID uuid.UUID, current decimal.Decimal, withdrawn decimal.Decimal) (models.Balance, error) {
+	const setBalance = `
+	UPDATE balances
+	SET current = $2, withdrawn = $3
+	WHERE user_id = $1
+	RETURNING id, user_id, current, withdrawn
+	`
+
+	rows, _ := r.DB.Query(ctx, setBalance, userID, current, withdrawn)
+	balance, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (models.Balance, error) {
+		var b models.Balance
+		err := row.Scan(&b.ID, &b.UserID, &b.Current, &b.Withdrawn)
+		return b, err
+	})
+
+	var pgErr *pgconn.PgError
+
+	switch {
+	case err == nil:
+		return balance, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return balance, apperrors.ErrUserNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == pgerrcode.CheckViolation:
+		return balance, apperrors.ErrBalanceInsufficient
+	default:
+		return balance, fmt.Errorf("db error: %w", err)
+	}
+}
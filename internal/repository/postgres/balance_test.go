@@ -1,6 +1,8 @@
 package postgres
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
@@ -229,6 +231,79 @@ func TestTransactions(t *testing.T) {
 		})
 	})
 
+	t.Run("BulkCreateTransactions", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "testuser", "hashedpassword")
+			require.NoError(t, err)
+
+			// Transactions of the user, every third one is withdrawal
+			transactions := func(userID uuid.UUID, n int) []models.Transaction {
+				ts := make([]models.Transaction, n)
+				for i := range ts {
+					typ := models.TransactionTypeAccrual
+					if i%3 == 0 {
+						typ = models.TransactionTypeWithdrawal
+					}
+					ts[i] = models.Transaction{
+						ID:          uuid.New(),
+						ProcessedAt: time.Now().Add(-time.Duration(i) * time.Minute),
+						UserID:      userID,
+						OrderNumber: strconv.Itoa(10000 + i),
+						Type:        typ,
+						Amount:      decimal.RequireFromString("10.5"),
+					}
+				}
+				return ts
+			}
+
+			t.Run("create many ok", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					err := storage.Balance().BulkCreateTransactions(t.Context(), transactions(user.ID, 300))
+
+					require.NoError(t, err)
+					count, err := storage.Balance().CountTransactions(t.Context(), user.ID, nil)
+					require.NoError(t, err)
+					require.Equal(t, 300, count)
+					withdrawals, err := storage.Balance().CountTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeWithdrawal})
+					require.NoError(t, err)
+					require.Equal(t, 100, withdrawals)
+				})
+			})
+
+			t.Run("nothing to create ok", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					err := storage.Balance().BulkCreateTransactions(t.Context(), nil)
+
+					require.NoError(t, err)
+				})
+			})
+
+			t.Run("not existed user fail", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					ts := append(transactions(user.ID, 10), transactions(uuid.New(), 1)...)
+
+					err := storage.Balance().BulkCreateTransactions(t.Context(), ts)
+
+					require.ErrorIs(t, err, apperrors.ErrUserNotFound)
+				})
+			})
+
+			t.Run("unknown type fail", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					ts := transactions(user.ID, 10)
+					ts[5].Type = "BONUS"
+
+					err := storage.Balance().BulkCreateTransactions(t.Context(), ts)
+
+					require.Error(t, err)
+					count, err := storage.Balance().CountTransactions(t.Context(), user.ID, nil)
+					require.NoError(t, err)
+					require.Zero(t, count, "nothing has to be created")
+				})
+			})
+		})
+	})
+
 	t.Run("ListTransactions", func(t *testing.T) {
 		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
 			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
@@ -260,7 +335,7 @@ func TestTransactions(t *testing.T) {
 
 			t.Run("list all transactions", func(t *testing.T) {
 				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
-					transactions, err := storage.Balance().ListTransactions(t.Context(), user.ID, nil)
+					transactions, err := storage.Balance().ListTransactions(t.Context(), user.ID, nil, repository.Page{})
 
 					require.NoError(t, err, "listing all transactions should not fail")
 					require.Len(t, transactions, 2, "should return all transactions")
@@ -273,7 +348,7 @@ func TestTransactions(t *testing.T) {
 
 			t.Run("list withdrawals transactions only", func(t *testing.T) {
 				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
-					transactions, err := storage.Balance().ListTransactions(t.Context(), user.ID, []string{models.TransactionTypeWithdrawal})
+					transactions, err := storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeWithdrawal}, repository.Page{})
 
 					require.NoError(t, err, "listing withdrawn transactions should not fail")
 					require.Len(t, transactions, 1, "should return only withdrawn transactions")
@@ -282,9 +357,52 @@ func TestTransactions(t *testing.T) {
 				})
 			})
 
+			t.Run("paged", func(t *testing.T) {
+				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
+					transactions, err := storage.Balance().ListTransactions(t.Context(), user.ID, nil, repository.Page{Limit: 1, Offset: 1})
+
+					require.NoError(t, err)
+					require.Len(t, transactions, 1)
+					require.Equal(t, accrualTx.ID, transactions[0].ID)
+				})
+			})
+
+			t.Run("count transactions", func(t *testing.T) {
+				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
+					count, err := storage.Balance().CountTransactions(t.Context(), user.ID, nil)
+					require.NoError(t, err)
+					require.Equal(t, 2, count)
+
+					count, err = storage.Balance().CountTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeWithdrawal})
+					require.NoError(t, err)
+					require.Equal(t, 1, count)
+
+					count, err = storage.Balance().CountTransactions(t.Context(), uuid.New(), nil)
+					require.NoError(t, err)
+					require.Zero(t, count)
+				})
+			})
+
+			t.Run("iteration stopped when context canceled", func(t *testing.T) {
+				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
+					ctx, cancel := context.WithCancel(t.Context())
+					defer cancel()
+
+					calls := 0
+					err := storage.Balance().ForEachTransaction(ctx, user.ID, nil, func(models.Transaction) error {
+						calls++
+						cancel()
+						return nil
+					})
+
+					require.ErrorIs(t, err, context.Canceled)
+					require.Equal(t, 1, calls)
+				})
+			})
+
 			t.Run("list transactions for nonexistent user", func(t *testing.T) {
 				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
-					transactions, err := storage.Balance().ListTransactions(t.Context(), uuid.New(), nil)
+					transactions, err := storage.Balance().ListTransactions(t.Context(), uuid.New(), nil, repository.Page{})
 
 					require.NoError(t, err, "listing transactions for nonexistent user should not fail")
 					require.Empty(t, transactions, "should return empty list for nonexistent user")
@@ -292,4 +410,293 @@ func TestTransactions(t *testing.T) {
 			})
 		})
 	})
+	t.Run("SumWithdrawalsByOrder", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+
+			create := func(number string, typ models.TransactionType, amount int64, processedAt time.Time) {
+				_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+					ID:          uuid.New(),
+					ProcessedAt: processedAt,
+					UserID:      user.ID,
+					OrderNumber: number,
+					Type:        typ,
+					Amount:      decimal.NewFromInt(amount),
+				})
+				require.NoError(t, err)
+			}
+			create("2377225624", models.TransactionTypeWithdrawal, 100, time.Now().Add(-3*time.Hour))
+			create("2377225624", models.TransactionTypeWithdrawal, 50, time.Now().Add(-2*time.Hour))
+			create("12345678903", models.TransactionTypeWithdrawal, 10, time.Now().Add(-1*time.Hour))
+			create("2377225624", models.TransactionTypeAccrual, 500, time.Now())
+
+			summary, err := storage.Balance().SumWithdrawalsByOrder(t.Context(), user.ID)
+
+			require.NoError(t, err)
+			require.Len(t, summary, 2, "withdrawals has to be grouped by order")
+			require.Equal(t, "12345678903", summary[0].OrderNumber, "most recently withdrawn order has to be first")
+			require.Equal(t, "2377225624", summary[1].OrderNumber)
+			require.True(t, summary[1].Sum.Equal(decimal.NewFromInt(150)), "accruals must not be summed")
+			require.Equal(t, 2, summary[1].Count)
+
+			summary, err = storage.Balance().SumWithdrawalsByOrder(t.Context(), uuid.New())
+			require.NoError(t, err)
+			require.Empty(t, summary)
+		})
+	})
+
+	t.Run("SumTransactions", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+			now := time.Now()
+			for _, tr := range []struct {
+				typ    models.TransactionType
+				amount int64
+				at     time.Time
+			}{
+				{models.TransactionTypeWithdrawal, 100, now.Add(-1 * time.Hour)},
+				{models.TransactionTypeWithdrawal, 50, now.Add(-3 * time.Hour)},
+				{models.TransactionTypeAccrual, 500, now.Add(-1 * time.Hour)},
+			} {
+				_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+					ID:          uuid.New(),
+					ProcessedAt: tr.at,
+					UserID:      user.ID,
+					OrderNumber: "12345",
+					Type:        tr.typ,
+					Amount:      decimal.NewFromInt(tr.amount),
+				})
+				require.NoError(t, err)
+			}
+
+			sum, err := storage.Balance().SumTransactions(t.Context(), user.ID, models.TransactionTypeWithdrawal, now.Add(-2*time.Hour))
+
+			require.NoError(t, err)
+			require.True(t, sum.Equal(decimal.NewFromInt(100)), "only withdrawals since the time has to be summed")
+
+			sum, err = storage.Balance().SumTransactions(t.Context(), uuid.New(), models.TransactionTypeWithdrawal, now.Add(-2*time.Hour))
+			require.NoError(t, err)
+			require.True(t, sum.IsZero())
+		})
+	})
+
+	t.Run("BalanceHistory", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+			day := func(d int, hour int) time.Time {
+				return time.Date(2025, 1, d, hour, 0, 0, 0, time.UTC)
+			}
+			for _, tr := range []struct {
+				at     time.Time
+				typ    models.TransactionType
+				amount string
+			}{
+				{day(1, 10), models.TransactionTypeAccrual, "500"},
+				{day(1, 12), models.TransactionTypeWithdrawal, "100"},
+				{day(2, 9), models.TransactionTypeAccrual, "20.5"},
+				{day(3, 18), models.TransactionTypeWithdrawal, "50"},
+			} {
+				_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+					ID:          uuid.New(),
+					ProcessedAt: tr.at,
+					UserID:      user.ID,
+					OrderNumber: "12345",
+					Type:        tr.typ,
+					Amount:      decimal.RequireFromString(tr.amount),
+				})
+				require.NoError(t, err)
+			}
+
+			// Compare points as strings, so decimals of different exponents are equal
+			format := func(ps []models.BalancePoint) []string {
+				var out []string
+				for _, p := range ps {
+					out = append(out, p.At.UTC().Format(time.RFC3339)+" "+p.Current.String()+" "+p.Withdrawn.String())
+				}
+				return out
+			}
+
+			t.Run("running totals", func(t *testing.T) {
+				points, err := storage.Balance().BalanceHistory(t.Context(), user.ID, repository.BalanceHistoryOpts{})
+
+				require.NoError(t, err)
+				require.Equal(t, []string{
+					"2025-01-01T10:00:00Z 500 0",
+					"2025-01-01T12:00:00Z 400 100",
+					"2025-01-02T09:00:00Z 420.5 100",
+					"2025-01-03T18:00:00Z 370.5 150",
+				}, format(points))
+			})
+
+			t.Run("range keeps earlier transactions in totals", func(t *testing.T) {
+				from, to := day(1, 11), day(3, 0)
+
+				points, err := storage.Balance().BalanceHistory(t.Context(), user.ID, repository.BalanceHistoryOpts{From: &from, To: &to})
+
+				require.NoError(t, err)
+				require.Equal(t, []string{
+					"2025-01-01T12:00:00Z 400 100",
+					"2025-01-02T09:00:00Z 420.5 100",
+				}, format(points))
+			})
+
+			t.Run("by day", func(t *testing.T) {
+				points, err := storage.Balance().BalanceHistory(t.Context(), user.ID, repository.BalanceHistoryOpts{ByDay: true})
+
+				require.NoError(t, err)
+				require.Equal(t, []string{
+					"2025-01-01T00:00:00Z 400 100",
+					"2025-01-02T00:00:00Z 420.5 100",
+					"2025-01-03T00:00:00Z 370.5 150",
+				}, format(points))
+			})
+
+			t.Run("no transactions", func(t *testing.T) {
+				points, err := storage.Balance().BalanceHistory(t.Context(), uuid.New(), repository.BalanceHistoryOpts{})
+
+				require.NoError(t, err)
+				require.Empty(t, points)
+			})
+		})
+	})
+
+	t.Run("SumTransactionsByType", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+			for _, tr := range []struct {
+				typ    models.TransactionType
+				amount string
+			}{
+				{models.TransactionTypeAccrual, "500"},
+				{models.TransactionTypeAccrual, "20.5"},
+				{models.TransactionTypeWithdrawal, "100"},
+			} {
+				_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+					ID:          uuid.New(),
+					ProcessedAt: time.Now(),
+					UserID:      user.ID,
+					OrderNumber: "12345",
+					Type:        tr.typ,
+					Amount:      decimal.RequireFromString(tr.amount),
+				})
+				require.NoError(t, err)
+			}
+
+			totals, err := storage.Balance().SumTransactionsByType(t.Context(), user.ID)
+
+			require.NoError(t, err)
+			require.Equal(t, "520.5", totals.Accrued.String())
+			require.Equal(t, "100", totals.Withdrawn.String())
+
+			totals, err = storage.Balance().SumTransactionsByType(t.Context(), uuid.New())
+			require.NoError(t, err)
+			require.True(t, totals.Accrued.IsZero(), "user without transactions has zero totals")
+			require.True(t, totals.Withdrawn.IsZero())
+		})
+	})
+
+	t.Run("ListBalanceMismatches", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+			err = storage.Balance().CreateBalance(t.Context(), user.ID)
+			require.NoError(t, err)
+
+			// Consistent balance: transaction and balance update together
+			transaction, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+				ID:          uuid.New(),
+				ProcessedAt: time.Now(),
+				UserID:      user.ID,
+				OrderNumber: "12345",
+				Type:        models.TransactionTypeAccrual,
+				Amount:      decimal.NewFromInt(100),
+			})
+			require.NoError(t, err)
+			_, err = storage.Balance().UpdateBalance(t.Context(), transaction)
+			require.NoError(t, err)
+
+			t.Run("consistent balances", func(t *testing.T) {
+				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
+					mismatches, err := storage.Balance().ListBalanceMismatches(t.Context(), false)
+
+					require.NoError(t, err)
+					require.Empty(t, mismatches)
+				})
+			})
+
+			t.Run("transaction without balance update", func(t *testing.T) {
+				inTx(t, tx, func(ttx pgx.Tx, storage repository.Storage) {
+					_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+						ID:          uuid.New(),
+						ProcessedAt: time.Now(),
+						UserID:      user.ID,
+						OrderNumber: "67890",
+						Type:        models.TransactionTypeWithdrawal,
+						Amount:      decimal.NewFromInt(30),
+					})
+					require.NoError(t, err)
+
+					mismatches, err := storage.Balance().ListBalanceMismatches(t.Context(), true)
+
+					require.NoError(t, err)
+					require.Len(t, mismatches, 1)
+					require.Equal(t, user.ID, mismatches[0].UserID)
+					require.True(t, mismatches[0].Current.Equal(decimal.NewFromInt(100)), "stored current has to be returned")
+					require.True(t, mismatches[0].ExpectedCurrent.Equal(decimal.NewFromInt(70)), "expected current has to be computed from transactions")
+					require.True(t, mismatches[0].ExpectedWithdrawn.Equal(decimal.NewFromInt(30)), "expected withdrawn has to be computed from transactions")
+				})
+			})
+		})
+	})
+
+	t.Run("SetBalance", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "test-user", "hashedpassword")
+			require.NoError(t, err)
+			err = storage.Balance().CreateBalance(t.Context(), user.ID)
+			require.NoError(t, err)
+
+			balance, err := storage.Balance().SetBalance(t.Context(), user.ID, decimal.NewFromInt(70), decimal.NewFromInt(30))
+
+			require.NoError(t, err)
+			require.True(t, balance.Current.Equal(decimal.NewFromInt(70)))
+			require.True(t, balance.Withdrawn.Equal(decimal.NewFromInt(30)))
+
+			_, err = storage.Balance().SetBalance(t.Context(), uuid.New(), decimal.Zero, decimal.Zero)
+			require.ErrorIs(t, err, apperrors.ErrUserNotFound)
+		})
+	})
+}
+
+func BenchmarkListTransactions(b *testing.B) {
+	const count = 10_000
+
+	pg := testutil.StartPostgresContainer(b)
+	b.Cleanup(pg.Terminate)
+
+	testutil.InTx(pg.Pool, b, func(tx pgx.Tx) {
+		storage := NewStorage(tx)
+		user, err := storage.User().CreateUser(b.Context(), "testuser", "hashedpassword")
+		require.NoError(b, err)
+		_, err = tx.Exec(b.Context(), `
+		INSERT INTO transactions (processed_at, user_id, order_number, type, amount)
+		SELECT now() - make_interval(secs => i), $1, i::text, 'ACCRUAL', 100.50
+		FROM generate_series(1, $2) AS i
+		`, user.ID, count)
+		require.NoError(b, err)
+
+		for b.Loop() {
+			ts, err := storage.Balance().ListTransactions(b.Context(), user.ID, nil, repository.Page{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(ts) != count {
+				b.Fatalf("expected %d transactions, got %d", count, len(ts))
+			}
+		}
+	})
 }
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"iter"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/nkiryanov/gophermart/internal/repository"
 
@@ -52,11 +55,17 @@ func (r *OrderRepo) CreateOrder(ctx context.Context, number string, userID uuid.
 	for _, option := range opts {
 		option(&o)
 	}
+	// Order id may be set with option
+	orderID = o.ID
 
 	rows, _ := r.DB.Query(ctx, createOrder, o.ID, o.UploadedAt, o.ModifiedAt, o.Number, o.UserID, o.Status, o.Accrual)
 	o, err := pgx.CollectOneRow(rows, rowToOrder)
 
+	var pgErr *pgconn.PgError
+
 	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation:
+		return o, apperrors.ErrUserNotFound
 	case err != nil:
 		return o, fmt.Errorf("db error: %w", err)
 	case o.ID == orderID && o.UserID == userID:
@@ -72,6 +81,59 @@ func (r *OrderRepo) CreateOrder(ctx context.Context, number string, userID uuid.
 }
 
 func (r *OrderRepo) ListOrders(ctx context.Context, opts repository.ListOrdersOpts) ([]models.Order, error) {
+	query, args := listOrdersQuery(opts)
+	rows, _ := r.DB.Query(ctx, query, args...)
+	orders, err := pgx.CollectRows(rows, rowToOrder)
+
+	switch err {
+	case nil:
+		return orders, nil
+	default:
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+}
+
+func (r *OrderRepo) ForEachOrder(ctx context.Context, opts repository.ListOrdersOpts, fn func(models.Order) error) error {
+	for order, err := range r.IterOrders(ctx, opts) {
+		if err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OrderRepo) IterOrders(ctx context.Context, opts repository.ListOrdersOpts) iter.Seq2[models.Order, error] {
+	return func(yield func(models.Order, error) bool) {
+		query, args := listOrdersQuery(opts)
+		rows, _ := r.DB.Query(ctx, query, args...)
+		defer rows.Close()
+
+		for rows.Next() {
+			// Rows may be buffered already, so cancellation is checked explicitly to abort long export
+			if err := ctx.Err(); err != nil {
+				yield(models.Order{}, err)
+				return
+			}
+			order, err := rowToOrder(rows)
+			if err != nil {
+				yield(models.Order{}, fmt.Errorf("db error: %w", err))
+				return
+			}
+			if !yield(order, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(models.Order{}, fmt.Errorf("db error: %w", err))
+		}
+	}
+}
+
+// Build query to select orders matching the options
+func listOrdersQuery(opts repository.ListOrdersOpts) (string, []any) {
 	args := []any{}
 	argPos := 1
 	whereParams := 0
@@ -95,6 +157,18 @@ func (r *OrderRepo) ListOrders(ctx context.Context, opts repository.ListOrdersOp
 		fmt.Fprintf(b, "status = ANY($%d)\n", argPos)
 		args = append(args, opts.Statuses)
 		argPos++
+		whereParams++
+	}
+
+	if opts.UploadedAfter != nil {
+		if whereParams > 0 {
+			fmt.Fprint(b, "AND ")
+		} else {
+			fmt.Fprint(b, "WHERE ")
+		}
+		fmt.Fprintf(b, "uploaded_at > $%d\n", argPos)
+		args = append(args, *opts.UploadedAfter)
+		argPos++
 	}
 
 	fmt.Fprint(b, "ORDER BY uploaded_at DESC\n")
@@ -110,15 +184,11 @@ func (r *OrderRepo) ListOrders(ctx context.Context, opts repository.ListOrdersOp
 		args = append(args, opts.Offset)
 	}
 
-	rows, _ := r.DB.Query(ctx, b.String(), args...)
-	orders, err := pgx.CollectRows(rows, rowToOrder)
-
-	switch err {
-	case nil:
-		return orders, nil
-	default:
-		return nil, fmt.Errorf("db error: %w", err)
+	if opts.SkipLocked {
+		fmt.Fprint(b, "FOR UPDATE SKIP LOCKED\n")
 	}
+
+	return b.String(), args
 }
 
 func (r OrderRepo) GetOrder(ctx context.Context, number string, lock bool) (models.Order, error) {
@@ -187,3 +257,177 @@ func rowToOrder(row pgx.CollectableRow) (models.Order, error) {
 	err := row.Scan(&o.ID, &o.UploadedAt, &o.ModifiedAt, &o.Number, &o.UserID, &o.Status, &o.Accrual)
 	return o, err
 }
+
+func (r *OrderRepo) ClaimOrdersForProcessing(ctx context.Context, limit int, lease time.Duration) ([]models.Order, error) {
+	// Orders being claimed are locked, so concurrent claims skip them
+	// Expired claim is taken over only if it's still expired, so claim committed concurrently is not overwritten
+	const claimOrders = `
+	WITH claimable AS (
+		SELECT o.number FROM orders o
+		LEFT JOIN order_claims c ON c.order_number = o.number
+		WHERE o.status = ANY($1) AND (c.claimed_until IS NULL OR c.claimed_until <= $3)
+		ORDER BY o.uploaded_at
+		LIMIT $2
+		FOR UPDATE OF o SKIP LOCKED
+	), claimed AS (
+		INSERT INTO order_claims (order_number, claimed_until)
+		SELECT number, $4 FROM claimable
+		ON CONFLICT (order_number) DO UPDATE SET claimed_until = excluded.claimed_until
+		WHERE order_claims.claimed_until <= $3
+		RETURNING order_number
+	)
+	SELECT o.* FROM orders o
+	JOIN claimed c ON c.order_number = o.number
+	ORDER BY o.uploaded_at
+	`
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("claim limit must be positive: %d", limit)
+	}
+	if lease <= 0 {
+		return nil, fmt.Errorf("claim lease must be positive: %s", lease)
+	}
+
+	now := time.Now()
+	rows, _ := r.DB.Query(ctx, claimOrders, []string{models.OrderStatusNew, models.OrderStatusProcessing}, limit, now, now.Add(lease))
+	orders, err := pgx.CollectRows(rows, rowToOrder)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+	return orders, nil
+}
+
+func (r *OrderRepo) ReleaseOrderClaims(ctx context.Context, numbers []string) error {
+	_, err := r.DB.Exec(ctx, `DELETE FROM order_claims WHERE order_number = ANY($1)`, numbers)
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepo) RetireOrders(ctx context.Context, statuses []string, uploadedBefore time.Time, newStatus string) ([]models.Order, error) {
+	const retireOrders = `
+	UPDATE orders
+	SET status = $3, modified_at = $4
+	WHERE status = ANY($1) AND uploaded_at < $2
+	AND NOT EXISTS (
+		SELECT 1 FROM order_reprocesses r
+		WHERE r.order_number = orders.number AND r.reprocessed_at >= $2
+	)
+	RETURNING *
+	`
+
+	rows, _ := r.DB.Query(ctx, retireOrders, statuses, uploadedBefore, newStatus, time.Now())
+	orders, err := pgx.CollectRows(rows, rowToOrder)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+	return orders, nil
+}
+
+func (r *OrderRepo) SetOrderReprocessed(ctx context.Context, number string, at time.Time) error {
+	const setReprocessed = `
+	INSERT INTO order_reprocesses (order_number, reprocessed_at)
+	VALUES ($1, $2)
+	ON CONFLICT (order_number) DO UPDATE SET reprocessed_at = excluded.reprocessed_at
+	`
+
+	_, err := r.DB.Exec(ctx, setReprocessed, number, at)
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation:
+		return apperrors.ErrOrderNotFound
+	case err != nil:
+		return fmt.Errorf("db error: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepo) CountOrders(ctx context.Context, userID uuid.UUID) (int, error) {
+	const countOrders = `SELECT count(*) FROM orders WHERE user_id = $1`
+
+	var count int
+	err := r.DB.QueryRow(ctx, countOrders, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+	return count, nil
+}
+
+func (r *OrderRepo) CountOrdersByStatus(ctx context.Context, userID uuid.UUID) (map[string]int, error) {
+	const countOrders = `
+	SELECT status, count(*)
+	FROM orders
+	WHERE user_id = $1
+	GROUP BY status
+	`
+
+	rows, _ := r.DB.Query(ctx, countOrders, userID)
+	counts := make(map[string]int)
+	var status string
+	var count int
+	_, err := pgx.ForEachRow(rows, []any{&status, &count}, func() error {
+		counts[status] = count
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+	return counts, nil
+}
+
+func (r *OrderRepo) ListPollStates(ctx context.Context) ([]models.OrderPollState, error) {
+	const listPollStates = `
+	SELECT order_number, attempts, next_poll_at
+	FROM order_poll_states
+	ORDER BY next_poll_at
+	`
+
+	rows, _ := r.DB.Query(ctx, listPollStates)
+	states, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.OrderPollState, error) {
+		var s models.OrderPollState
+		err := row.Scan(&s.OrderNumber, &s.Attempts, &s.NextPollAt)
+		return s, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+	return states, nil
+}
+
+func (r *OrderRepo) SavePollStates(ctx context.Context, states []models.OrderPollState) error {
+	const savePollStates = `
+	INSERT INTO order_poll_states (order_number, attempts, next_poll_at)
+	SELECT s.order_number, s.attempts, s.next_poll_at
+	FROM unnest($1::varchar[], $2::int[], $3::timestamptz[]) AS s(order_number, attempts, next_poll_at)
+	JOIN orders o ON o.number = s.order_number
+	ON CONFLICT (order_number) DO UPDATE
+	SET attempts = excluded.attempts, next_poll_at = excluded.next_poll_at
+	`
+	if len(states) == 0 {
+		return nil
+	}
+
+	numbers := make([]string, len(states))
+	attempts := make([]int, len(states))
+	nextPollAt := make([]time.Time, len(states))
+	for i, s := range states {
+		numbers[i] = s.OrderNumber
+		attempts[i] = s.Attempts
+		nextPollAt[i] = s.NextPollAt
+	}
+
+	_, err := r.DB.Exec(ctx, savePollStates, numbers, attempts, nextPollAt)
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepo) DeletePollStates(ctx context.Context) error {
+	_, err := r.DB.Exec(ctx, `DELETE FROM order_poll_states`)
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+	return nil
+}
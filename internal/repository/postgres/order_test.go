@@ -1,6 +1,11 @@
 package postgres
 
 import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -77,6 +82,45 @@ func TestOrders(t *testing.T) {
 				})
 			})
 
+			t.Run("read back without accrual", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					_, err := storage.Order().CreateOrder(t.Context(), "123", user.ID)
+					require.NoError(t, err)
+
+					order, err := storage.Order().GetOrder(t.Context(), "123", false)
+					require.NoError(t, err, "NULL accrual has to be scanned ok")
+					require.Nil(t, order.Accrual, "NULL accrual has to be read as nil")
+
+					orders, err := storage.Order().ListOrders(t.Context(), repository.ListOrdersOpts{UserID: &user.ID})
+					require.NoError(t, err)
+					require.Len(t, orders, 1)
+					require.Nil(t, orders[0].Accrual)
+				})
+			})
+
+			t.Run("read back with accrual", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					_, err := storage.Order().CreateOrder(t.Context(), "123", user.ID,
+						repository.WithOrderStatus(models.OrderStatusProcessed),
+						repository.WithOrderAccrual(decimal.RequireFromString("0")),
+					)
+					require.NoError(t, err)
+
+					order, err := storage.Order().GetOrder(t.Context(), "123", false)
+					require.NoError(t, err)
+					require.NotNil(t, order.Accrual, "zero accrual differs from NULL one")
+					require.True(t, order.Accrual.IsZero())
+				})
+			})
+
+			t.Run("create for nonexistent user", func(t *testing.T) {
+				inTx(t, tx, func(_ pgx.Tx, storage repository.Storage) {
+					_, err := storage.Order().CreateOrder(t.Context(), "123", uuid.New())
+
+					require.ErrorIs(t, err, apperrors.ErrUserNotFound)
+				})
+			})
+
 		})
 	})
 
@@ -141,6 +185,349 @@ func TestOrders(t *testing.T) {
 		})
 	})
 
+	t.Run("ListOrders skip locked", func(t *testing.T) {
+		// Storage over pool, so the order is locked by a real transaction on other connection
+		s := NewStorage(pg.Pool)
+		user, err := s.User().CreateUser(t.Context(), "skip-locked-user", "hashed")
+		require.NoError(t, err)
+		locked, err := s.Order().CreateOrder(t.Context(), "5551", user.ID)
+		require.NoError(t, err)
+		free, err := s.Order().CreateOrder(t.Context(), "5552", user.ID)
+		require.NoError(t, err)
+		opts := repository.ListOrdersOpts{UserID: &user.ID, SkipLocked: true}
+
+		err = s.InTx(t.Context(), func(storage repository.Storage) error {
+			_, err := storage.Order().GetOrder(t.Context(), locked.Number, true)
+			require.NoError(t, err)
+
+			orders, err := s.Order().ListOrders(t.Context(), opts)
+
+			require.NoError(t, err)
+			require.Len(t, orders, 1, "locked order has to be skipped")
+			require.Equal(t, free.ID, orders[0].ID)
+			return nil
+		})
+		require.NoError(t, err)
+
+		orders, err := s.Order().ListOrders(t.Context(), opts)
+		require.NoError(t, err)
+		require.Len(t, orders, 2, "order has to be listed after lock is released")
+	})
+
+	t.Run("ClaimOrdersForProcessing", func(t *testing.T) {
+		// Storage over pool, so claims are made by real transactions on different connections
+		s := NewStorage(pg.Pool)
+		user, err := s.User().CreateUser(t.Context(), "claim-user", "hashed")
+		require.NoError(t, err)
+		// Orders are the oldest ones, so they are claimed before orders of other tests
+		created := make(map[string]bool)
+		for i, number := range []string{"6661", "6662", "6663", "6664"} {
+			_, err := s.Order().CreateOrder(t.Context(), number, user.ID, repository.WithUploadedAt(time.Now().Add(-time.Duration(24+i)*time.Hour)))
+			require.NoError(t, err)
+			created[number] = true
+		}
+		_, err = s.Order().CreateOrder(t.Context(), "6665", user.ID, repository.WithOrderStatus(models.OrderStatusProcessed))
+		require.NoError(t, err)
+
+		numbers := func(orders []models.Order) []string {
+			var numbers []string
+			for _, o := range orders {
+				if created[o.Number] {
+					numbers = append(numbers, o.Number)
+				}
+			}
+			return numbers
+		}
+
+		// Claims are committed, so they are kept without transaction
+		claimed, err := s.Order().ClaimOrdersForProcessing(t.Context(), 2, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, numbers(claimed), 2)
+
+		other, err := s.Order().ClaimOrdersForProcessing(t.Context(), 100, time.Minute)
+		require.NoError(t, err)
+
+		require.NotContains(t, numbers(other), "6665", "processed order must not be claimed")
+		for _, o := range claimed {
+			require.NotContains(t, numbers(other), o.Number, "claimed order has to be skipped")
+		}
+		require.ElementsMatch(t, slices.Collect(maps.Keys(created)), append(numbers(claimed), numbers(other)...))
+
+		t.Run("released order claimed again", func(t *testing.T) {
+			err := s.Order().ReleaseOrderClaims(t.Context(), []string{claimed[0].Number})
+			require.NoError(t, err)
+
+			again, err := s.Order().ClaimOrdersForProcessing(t.Context(), 100, time.Minute)
+
+			require.NoError(t, err)
+			require.Equal(t, []string{claimed[0].Number}, numbers(again))
+		})
+
+		t.Run("expired claim taken over", func(t *testing.T) {
+			_, err := pg.Pool.Exec(t.Context(), `UPDATE order_claims SET claimed_until = now() - interval '1 second' WHERE order_number = $1`, claimed[1].Number)
+			require.NoError(t, err)
+
+			again, err := s.Order().ClaimOrdersForProcessing(t.Context(), 100, time.Minute)
+
+			require.NoError(t, err)
+			require.Equal(t, []string{claimed[1].Number}, numbers(again))
+		})
+
+		t.Run("locked order skipped", func(t *testing.T) {
+			err := s.Order().ReleaseOrderClaims(t.Context(), slices.Collect(maps.Keys(created)))
+			require.NoError(t, err)
+
+			err = s.InTx(t.Context(), func(tx repository.Storage) error {
+				_, err := tx.Order().GetOrder(t.Context(), "6661", true)
+				require.NoError(t, err)
+
+				other, err := s.Order().ClaimOrdersForProcessing(t.Context(), 100, time.Minute)
+				require.NoError(t, err)
+				require.NotContains(t, numbers(other), "6661", "order accrual is applied to has to be skipped")
+				return nil
+			})
+			require.NoError(t, err)
+			err = s.Order().ReleaseOrderClaims(t.Context(), slices.Collect(maps.Keys(created)))
+			require.NoError(t, err)
+		})
+
+		t.Run("not positive limit or lease fail", func(t *testing.T) {
+			_, err := s.Order().ClaimOrdersForProcessing(t.Context(), 0, time.Minute)
+			require.Error(t, err)
+
+			_, err = s.Order().ClaimOrdersForProcessing(t.Context(), 1, 0)
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("ForEachOrder", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "111", user.ID)
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "222", user.ID)
+			require.NoError(t, err)
+
+			var numbers []string
+			err = storage.Order().ForEachOrder(t.Context(), repository.ListOrdersOpts{UserID: &user.ID}, func(o models.Order) error {
+				numbers = append(numbers, o.Number)
+				return nil
+			})
+
+			require.NoError(t, err)
+			require.Equal(t, []string{"222", "111"}, numbers, "orders has to be iterated newest first")
+
+			stop := errors.New("stop")
+			calls := 0
+			err = storage.Order().ForEachOrder(t.Context(), repository.ListOrdersOpts{UserID: &user.ID}, func(o models.Order) error {
+				calls++
+				return stop
+			})
+			require.ErrorIs(t, err, stop)
+			require.Equal(t, 1, calls, "iteration has to stop on error")
+
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			calls = 0
+			err = storage.Order().ForEachOrder(ctx, repository.ListOrdersOpts{UserID: &user.ID}, func(o models.Order) error {
+				calls++
+				cancel()
+				return nil
+			})
+			require.ErrorIs(t, err, context.Canceled)
+			require.Equal(t, 1, calls, "iteration has to stop when context canceled")
+		})
+	})
+
+	t.Run("IterOrders", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
+			require.NoError(t, err)
+			other, err := storage.User().CreateUser(t.Context(), "user2", "hashedpassword")
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "999", other.ID)
+			require.NoError(t, err)
+
+			started := time.Now().Add(-time.Hour)
+			var want []string
+			for i := range 25 {
+				number := strconv.Itoa(1000 + i)
+				_, err := storage.Order().CreateOrder(t.Context(), number, user.ID, repository.WithUploadedAt(started.Add(time.Duration(i)*time.Minute)))
+				require.NoError(t, err)
+				want = append([]string{number}, want...)
+			}
+
+			var numbers []string
+			for o, err := range storage.Order().IterOrders(t.Context(), repository.ListOrdersOpts{UserID: &user.ID}) {
+				require.NoError(t, err)
+				require.Equal(t, user.ID, o.UserID)
+				numbers = append(numbers, o.Number)
+			}
+
+			require.Equal(t, want, numbers, "every user's order has to be yielded once, newest first")
+
+			numbers = nil
+			for o, err := range storage.Order().IterOrders(t.Context(), repository.ListOrdersOpts{UserID: &user.ID}) {
+				require.NoError(t, err)
+				numbers = append(numbers, o.Number)
+				if len(numbers) == 3 {
+					break
+				}
+			}
+			require.Equal(t, want[:3], numbers, "iteration has to stop on break")
+		})
+	})
+
+	t.Run("RetireOrders", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
+			require.NoError(t, err)
+			old := time.Now().Add(-31 * 24 * time.Hour)
+			_, err = storage.Order().CreateOrder(t.Context(), "111", user.ID, repository.WithUploadedAt(old))
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "222", user.ID, repository.WithUploadedAt(old), repository.WithOrderStatus(models.OrderStatusProcessed))
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "333", user.ID)
+			require.NoError(t, err)
+
+			threshold := time.Now().Add(-30 * 24 * time.Hour)
+			statuses := []string{models.OrderStatusNew, models.OrderStatusProcessing}
+
+			waiting, err := storage.Order().ListOrders(t.Context(), repository.ListOrdersOpts{Statuses: statuses, UploadedAfter: &threshold})
+			require.NoError(t, err)
+			require.Len(t, waiting, 1, "old order has to be excluded from the list")
+			require.Equal(t, "333", waiting[0].Number)
+
+			retired, err := storage.Order().RetireOrders(t.Context(), statuses, threshold, models.OrderStatusInvalid)
+
+			require.NoError(t, err)
+			require.Len(t, retired, 1, "only old orders in the statuses has to be retired")
+			require.Equal(t, "111", retired[0].Number)
+			require.Equal(t, models.OrderStatusInvalid, retired[0].Status)
+
+			order, err := storage.Order().GetOrder(t.Context(), "222", false)
+			require.NoError(t, err)
+			require.Equal(t, models.OrderStatusProcessed, order.Status, "order in other status must not be changed")
+		})
+	})
+
+	t.Run("RetireOrders reprocessed", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
+			require.NoError(t, err)
+			old := time.Now().Add(-31 * 24 * time.Hour)
+			for _, number := range []string{"111", "222"} {
+				_, err = storage.Order().CreateOrder(t.Context(), number, user.ID, repository.WithUploadedAt(old))
+				require.NoError(t, err)
+			}
+			threshold := time.Now().Add(-30 * 24 * time.Hour)
+			err = storage.Order().SetOrderReprocessed(t.Context(), "111", time.Now())
+			require.NoError(t, err)
+			err = storage.Order().SetOrderReprocessed(t.Context(), "222", threshold.Add(-time.Hour))
+			require.NoError(t, err)
+
+			retired, err := storage.Order().RetireOrders(t.Context(), []string{models.OrderStatusNew}, threshold, models.OrderStatusInvalid)
+
+			require.NoError(t, err)
+			require.Len(t, retired, 1, "order reprocessed after the time has to be kept")
+			require.Equal(t, "222", retired[0].Number)
+		})
+	})
+
+	t.Run("SetOrderReprocessed not existed order", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			err := storage.Order().SetOrderReprocessed(t.Context(), "404", time.Now())
+
+			require.ErrorIs(t, err, apperrors.ErrOrderNotFound)
+		})
+	})
+
+	t.Run("CountOrders", func(t *testing.T) {
+		inTx(t, pg.Pool, func(_ pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "testuser", "hashedpassword")
+			require.NoError(t, err)
+			other, err := storage.User().CreateUser(t.Context(), "otheruser", "hashedpassword")
+			require.NoError(t, err)
+
+			count, err := storage.Order().CountOrders(t.Context(), user.ID)
+			require.NoError(t, err)
+			require.Zero(t, count)
+
+			for _, number := range []string{"111", "222"} {
+				_, err = storage.Order().CreateOrder(t.Context(), number, user.ID)
+				require.NoError(t, err)
+			}
+			_, err = storage.Order().CreateOrder(t.Context(), "333", other.ID)
+			require.NoError(t, err)
+
+			count, err = storage.Order().CountOrders(t.Context(), user.ID)
+
+			require.NoError(t, err)
+			require.Equal(t, 2, count, "only user's orders have to be counted")
+		})
+	})
+
+	t.Run("CountOrdersByStatus", func(t *testing.T) {
+		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "111", user.ID)
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "222", user.ID)
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "333", user.ID, repository.WithOrderStatus(models.OrderStatusProcessed))
+			require.NoError(t, err)
+
+			counts, err := storage.Order().CountOrdersByStatus(t.Context(), user.ID)
+
+			require.NoError(t, err)
+			require.Equal(t, map[string]int{models.OrderStatusNew: 2, models.OrderStatusProcessed: 1}, counts)
+
+			counts, err = storage.Order().CountOrdersByStatus(t.Context(), uuid.New())
+			require.NoError(t, err)
+			require.Empty(t, counts)
+		})
+	})
+
+	t.Run("PollStates", func(t *testing.T) {
+		inTx(t, pg.Pool, func(_ pgx.Tx, storage repository.Storage) {
+			user, err := storage.User().CreateUser(t.Context(), "testuser", "hashedpassword")
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "111", user.ID)
+			require.NoError(t, err)
+			_, err = storage.Order().CreateOrder(t.Context(), "222", user.ID)
+			require.NoError(t, err)
+			nextPollAt := time.Now().Add(time.Minute).Truncate(time.Microsecond)
+
+			err = storage.Order().SavePollStates(t.Context(), []models.OrderPollState{
+				{OrderNumber: "111", Attempts: 1, NextPollAt: nextPollAt},
+				{OrderNumber: "222", Attempts: 2, NextPollAt: nextPollAt.Add(time.Minute)},
+				{OrderNumber: "333", Attempts: 1, NextPollAt: nextPollAt},
+			})
+			require.NoError(t, err)
+			err = storage.Order().SavePollStates(t.Context(), []models.OrderPollState{
+				{OrderNumber: "111", Attempts: 3, NextPollAt: nextPollAt},
+			})
+			require.NoError(t, err)
+
+			states, err := storage.Order().ListPollStates(t.Context())
+
+			require.NoError(t, err)
+			require.Len(t, states, 2, "state of not existing order has to be skipped")
+			require.Equal(t, "111", states[0].OrderNumber)
+			require.Equal(t, 3, states[0].Attempts, "state has to be overwritten")
+			require.True(t, nextPollAt.Equal(states[0].NextPollAt))
+			require.Equal(t, "222", states[1].OrderNumber)
+
+			err = storage.Order().DeletePollStates(t.Context())
+			require.NoError(t, err)
+			states, err = storage.Order().ListPollStates(t.Context())
+			require.NoError(t, err)
+			require.Empty(t, states)
+		})
+	})
+
 	t.Run("UpdateOrder", func(t *testing.T) {
 		inTx(t, pg.Pool, func(tx pgx.Tx, storage repository.Storage) {
 			user, err := storage.User().CreateUser(t.Context(), "user1", "hashedpassword")
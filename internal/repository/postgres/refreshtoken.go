@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/nkiryanov/gophermart/internal/apperrors"
@@ -17,13 +18,19 @@ type RefreshTokenRepo struct {
 }
 
 const saveToken = `-- name: Save Refresh Token
-INSERT INTO refresh_tokens (id, user_id, token, created_at, expires_at, used_at)
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, user_id, token, created_at, expires_at, used_at`
+INSERT INTO refresh_tokens (id, user_id, family_id, token, created_at, expires_at, used_at, user_agent, ip)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))
+RETURNING id, user_id, family_id, token, created_at, expires_at, used_at, revoked_at, COALESCE(user_agent, ''), COALESCE(ip, '')`
 
+// Save token
+// If token family is not set the token starts new family
 func (r *RefreshTokenRepo) Save(ctx context.Context, token models.RefreshToken) (models.RefreshToken, error) {
 	var usedAt pgtype.Timestamptz
 
+	if token.FamilyID == uuid.Nil {
+		token.FamilyID = uuid.New()
+	}
+
 	if token.UsedAt != nil {
 		usedAt.Valid = true
 		usedAt.Time = token.UsedAt.Truncate(time.Microsecond)
@@ -33,16 +40,15 @@ func (r *RefreshTokenRepo) Save(ctx context.Context, token models.RefreshToken)
 		saveToken,
 		token.ID,
 		token.UserID,
+		token.FamilyID,
 		token.Token,
 		token.CreatedAt.Truncate(time.Microsecond),
 		token.ExpiresAt.Truncate(time.Microsecond),
 		usedAt,
+		token.UserAgent,
+		token.IP,
 	)
-	token, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (models.RefreshToken, error) {
-		var t models.RefreshToken
-		err := row.Scan(&t.ID, &t.UserID, &t.Token, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
-		return t, err
-	})
+	token, err := pgx.CollectOneRow(rows, scanRefreshToken)
 	if err != nil {
 		return token, fmt.Errorf("db error: %w", err)
 	}
@@ -50,7 +56,7 @@ func (r *RefreshTokenRepo) Save(ctx context.Context, token models.RefreshToken)
 }
 
 const getToken = `-- name: GetToken by string itself
-SELECT id, user_id, created_at, expires_at, used_at
+SELECT id, user_id, family_id, token, created_at, expires_at, used_at, revoked_at, COALESCE(user_agent, ''), COALESCE(ip, '')
 FROM refresh_tokens
 WHERE token = $1
 `
@@ -59,11 +65,27 @@ WHERE token = $1
 // It should return result even it expired or used already
 func (r *RefreshTokenRepo) Get(ctx context.Context, tokenString string) (models.RefreshToken, error) {
 	rows, _ := r.DB.Query(ctx, getToken, tokenString)
-	token, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (models.RefreshToken, error) {
-		var t = models.RefreshToken{Token: tokenString}
-		err := row.Scan(&t.ID, &t.UserID, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
-		return t, err
-	})
+	token, err := pgx.CollectOneRow(rows, scanRefreshToken)
+
+	switch {
+	case err == nil:
+		return token, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return token, fmt.Errorf("repo error: %w", apperrors.ErrRefreshTokenNotFound)
+	default:
+		return token, fmt.Errorf("db error: %w", err)
+	}
+}
+
+const getTokenByID = `-- name: GetToken by id
+SELECT id, user_id, family_id, token, created_at, expires_at, used_at, revoked_at, COALESCE(user_agent, ''), COALESCE(ip, '')
+FROM refresh_tokens
+WHERE id = $1
+`
+
+func (r *RefreshTokenRepo) GetByID(ctx context.Context, id uuid.UUID) (models.RefreshToken, error) {
+	rows, _ := r.DB.Query(ctx, getTokenByID, id)
+	token, err := pgx.CollectOneRow(rows, scanRefreshToken)
 
 	switch {
 	case err == nil:
@@ -75,27 +97,48 @@ func (r *RefreshTokenRepo) Get(ctx context.Context, tokenString string) (models.
 	}
 }
 
-const markTokenUsed = `-- name: Mark token used if it not used
+const listUserTokens = `-- name: List user's active tokens
+SELECT id, user_id, family_id, token, created_at, expires_at, used_at, revoked_at, COALESCE(user_agent, ''), COALESCE(ip, '')
+FROM refresh_tokens
+WHERE user_id = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $2
+ORDER BY created_at DESC
+`
+
+func (r *RefreshTokenRepo) ListByUser(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error) {
+	rows, _ := r.DB.Query(ctx, listUserTokens, userID, time.Now())
+	tokens, err := pgx.CollectRows(rows, scanRefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %w", err)
+	}
+	return tokens, nil
+}
+
+func scanRefreshToken(row pgx.CollectableRow) (models.RefreshToken, error) {
+	var t models.RefreshToken
+	err := row.Scan(&t.ID, &t.UserID, &t.FamilyID, &t.Token, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt, &t.UserAgent, &t.IP)
+	return t, err
+}
+
+const markTokenUsed = `-- name: Mark token used if it not used and not revoked
 UPDATE refresh_tokens
-SET used_at = COALESCE(used_at, $2)
+SET used_at = CASE WHEN revoked_at IS NULL THEN COALESCE(used_at, $2) ELSE used_at END
 WHERE token = $1
-RETURNING id, user_id, created_at, expires_at, used_at
+RETURNING id, user_id, family_id, token, created_at, expires_at, used_at, revoked_at, COALESCE(user_agent, ''), COALESCE(ip, '')
 `
 
 // Mark token as used
+// If token is revoked it must return 'apperrors.ErrRefreshTokenRevoked' error
 // If token is already used it must return 'apperrors.ErrRefreshTokenIsUsed' error
 // If token is not found it must return 'apperrors.ErrRefreshTokenNotFound' error
 func (r *RefreshTokenRepo) GetAndMarkUsed(ctx context.Context, tokenString string) (models.RefreshToken, error) {
 	now := time.Now().Truncate(time.Microsecond)
 	rows, _ := r.DB.Query(ctx, markTokenUsed, tokenString, now)
 
-	token, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (models.RefreshToken, error) {
-		var t = models.RefreshToken{Token: tokenString}
-		err := row.Scan(&t.ID, &t.UserID, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
-		return t, err
-	})
+	token, err := pgx.CollectOneRow(rows, scanRefreshToken)
 
 	switch {
+	case err == nil && token.RevokedAt != nil:
+		return token, fmt.Errorf("repo error: %w", apperrors.ErrRefreshTokenRevoked)
 	case err == nil && now.Equal(*token.UsedAt): // UsedAt != nil cause token marked used
 		return token, nil
 	case err == nil: // token.usedAt != now == token is used
@@ -106,3 +149,53 @@ func (r *RefreshTokenRepo) GetAndMarkUsed(ctx context.Context, tokenString strin
 		return token, fmt.Errorf("db error: %w", err)
 	}
 }
+
+const countActiveTokens = `-- name: Count user's active tokens
+SELECT count(*)
+FROM refresh_tokens
+WHERE user_id = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $2
+`
+
+func (r *RefreshTokenRepo) CountActive(ctx context.Context, userID uuid.UUID) (int, error) {
+	var count int
+	err := r.DB.QueryRow(ctx, countActiveTokens, userID, time.Now()).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+	return count, nil
+}
+
+const pruneActiveTokens = `-- name: Revoke user's active tokens except the newest ones
+UPDATE refresh_tokens
+SET revoked_at = $3
+WHERE id IN (
+	SELECT id
+	FROM refresh_tokens
+	WHERE user_id = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $3
+	ORDER BY created_at DESC
+	OFFSET $2
+)
+`
+
+// Revoke the oldest active tokens so only 'keep' newest remain active
+func (r *RefreshTokenRepo) PruneActive(ctx context.Context, userID uuid.UUID, keep int) (int, error) {
+	tag, err := r.DB.Exec(ctx, pruneActiveTokens, userID, keep, time.Now().Truncate(time.Microsecond))
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+const revokeFamily = `-- name: Revoke all tokens of the family
+UPDATE refresh_tokens
+SET revoked_at = $2
+WHERE family_id = $1 AND revoked_at IS NULL
+`
+
+func (r *RefreshTokenRepo) RevokeFamily(ctx context.Context, familyID uuid.UUID) (int, error) {
+	tag, err := r.DB.Exec(ctx, revokeFamily, familyID, time.Now().Truncate(time.Microsecond))
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
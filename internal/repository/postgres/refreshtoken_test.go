@@ -52,6 +52,23 @@ func Test_RefreshTokenRepo(t *testing.T) {
 		})
 	})
 
+	t.Run("create token with client info", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			withClient := token
+			withClient.UserAgent = "Mozilla/5.0"
+			withClient.IP = "192.0.2.1"
+
+			_, err := repo.Save(t.Context(), withClient)
+			require.NoError(t, err)
+
+			got, err := repo.Get(t.Context(), token.Token)
+			require.NoError(t, err)
+			require.Equal(t, "Mozilla/5.0", got.UserAgent)
+			require.Equal(t, "192.0.2.1", got.IP)
+		})
+	})
+
 	t.Run("get token ok", func(t *testing.T) {
 		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
 			repo := RefreshTokenRepo{DB: tx}
@@ -115,4 +132,151 @@ func Test_RefreshTokenRepo(t *testing.T) {
 			assert.WithinDuration(t, *tokenFirst.UsedAt, *tokenSecond.UsedAt, 0, "should return same time for already used token")
 		})
 	})
+
+	t.Run("mark used revoked token", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			_, err := repo.Save(t.Context(), token)
+			require.NoError(t, err)
+			_, err = tx.Exec(t.Context(), "UPDATE refresh_tokens SET revoked_at = now() WHERE token = $1", token.Token)
+			require.NoError(t, err)
+
+			got, err := repo.GetAndMarkUsed(t.Context(), token.Token)
+
+			require.ErrorIs(t, err, apperrors.ErrRefreshTokenRevoked)
+			require.Nil(t, got.UsedAt, "revoked token must not be marked used")
+		})
+	})
+
+	t.Run("count and prune active tokens", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			userID := uuid.New()
+			usedAt := mustParseTime("2024-01-02 00:00:00Z")
+
+			tokens := []models.RefreshToken{
+				{Token: "oldest", CreatedAt: mustParseTime("2024-01-01 00:00:01Z"), ExpiresAt: mustParseTime("2200-01-01 00:00:00Z")},
+				{Token: "middle", CreatedAt: mustParseTime("2024-01-01 00:00:02Z"), ExpiresAt: mustParseTime("2200-01-01 00:00:00Z")},
+				{Token: "newest", CreatedAt: mustParseTime("2024-01-01 00:00:03Z"), ExpiresAt: mustParseTime("2200-01-01 00:00:00Z")},
+				{Token: "used", CreatedAt: mustParseTime("2024-01-01 00:00:04Z"), ExpiresAt: mustParseTime("2200-01-01 00:00:00Z"), UsedAt: &usedAt},
+				{Token: "expired", CreatedAt: mustParseTime("2024-01-01 00:00:05Z"), ExpiresAt: mustParseTime("2024-01-02 00:00:00Z")},
+			}
+			for _, tk := range tokens {
+				tk.ID = uuid.New()
+				tk.UserID = userID
+				_, err := repo.Save(t.Context(), tk)
+				require.NoError(t, err)
+			}
+
+			count, err := repo.CountActive(t.Context(), userID)
+			require.NoError(t, err)
+			require.Equal(t, 3, count, "used and expired tokens are not active")
+
+			revoked, err := repo.PruneActive(t.Context(), userID, 2)
+			require.NoError(t, err)
+			require.Equal(t, 1, revoked, "only the oldest active token has to be revoked")
+
+			count, err = repo.CountActive(t.Context(), userID)
+			require.NoError(t, err)
+			require.Equal(t, 2, count)
+
+			oldest, err := repo.Get(t.Context(), "oldest")
+			require.NoError(t, err)
+			require.NotNil(t, oldest.RevokedAt, "oldest token has to be revoked")
+			newest, err := repo.Get(t.Context(), "newest")
+			require.NoError(t, err)
+			require.Nil(t, newest.RevokedAt, "newest token has to stay active")
+		})
+	})
+
+	t.Run("revoke family", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			familyID := uuid.New()
+
+			for _, value := range []string{"first", "second"} {
+				_, err := repo.Save(t.Context(), models.RefreshToken{
+					ID:        uuid.New(),
+					UserID:    token.UserID,
+					FamilyID:  familyID,
+					Token:     value,
+					CreatedAt: token.CreatedAt,
+					ExpiresAt: token.ExpiresAt,
+				})
+				require.NoError(t, err)
+			}
+			other, err := repo.Save(t.Context(), token)
+			require.NoError(t, err)
+			require.NotEqual(t, uuid.Nil, other.FamilyID, "token without family has to start new family")
+
+			revoked, err := repo.RevokeFamily(t.Context(), familyID)
+
+			require.NoError(t, err)
+			require.Equal(t, 2, revoked, "all family tokens has to be revoked")
+			got, err := repo.Get(t.Context(), "second")
+			require.NoError(t, err)
+			require.Equal(t, familyID, got.FamilyID)
+			require.NotNil(t, got.RevokedAt)
+			got, err = repo.Get(t.Context(), token.Token)
+			require.NoError(t, err)
+			require.Nil(t, got.RevokedAt, "tokens of other families must not be revoked")
+		})
+	})
+	t.Run("get token by id", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			_, err := repo.Save(t.Context(), token)
+			require.NoError(t, err)
+
+			got, err := repo.GetByID(t.Context(), token.ID)
+
+			require.NoError(t, err)
+			require.Equal(t, token.Token, got.Token)
+			require.Equal(t, token.UserID, got.UserID)
+
+			_, err = repo.GetByID(t.Context(), uuid.New())
+			require.ErrorIs(t, err, apperrors.ErrRefreshTokenNotFound)
+		})
+	})
+
+	t.Run("list user tokens", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			repo := RefreshTokenRepo{DB: tx}
+			save := func(value string, createdAt time.Time, expiresAt time.Time) models.RefreshToken {
+				saved, err := repo.Save(t.Context(), models.RefreshToken{
+					ID:        uuid.New(),
+					UserID:    token.UserID,
+					Token:     value,
+					CreatedAt: createdAt,
+					ExpiresAt: expiresAt,
+				})
+				require.NoError(t, err)
+				return saved
+			}
+			older := save("older", mustParseTime("2024-01-01 10:00:00Z"), token.ExpiresAt)
+			newer := save("newer", mustParseTime("2024-01-02 10:00:00Z"), token.ExpiresAt)
+			save("expired", mustParseTime("2024-01-03 10:00:00Z"), mustParseTime("2024-01-04 10:00:00Z"))
+			revoked := save("revoked", mustParseTime("2024-01-03 10:00:00Z"), token.ExpiresAt)
+			_, err := repo.RevokeFamily(t.Context(), revoked.FamilyID)
+			require.NoError(t, err)
+			used := save("used", mustParseTime("2024-01-03 10:00:00Z"), token.ExpiresAt)
+			_, err = repo.GetAndMarkUsed(t.Context(), used.Token)
+			require.NoError(t, err)
+			_, err = repo.Save(t.Context(), models.RefreshToken{
+				ID:        uuid.New(),
+				UserID:    uuid.New(),
+				Token:     "other-user",
+				CreatedAt: token.CreatedAt,
+				ExpiresAt: token.ExpiresAt,
+			})
+			require.NoError(t, err)
+
+			tokens, err := repo.ListByUser(t.Context(), token.UserID)
+
+			require.NoError(t, err)
+			require.Len(t, tokens, 2, "expired, revoked, used and other user's tokens must not be listed")
+			require.Equal(t, newer.ID, tokens[0].ID, "newest token has to be first")
+			require.Equal(t, older.ID, tokens[1].ID)
+		})
+	})
 }
@@ -2,11 +2,20 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
+// Delay before the first retry of conflicted transaction, doubled on every next one
+const retryBaseDelay = 10 * time.Millisecond
+
 type Storage struct {
 	db DBTX
 }
@@ -31,8 +40,8 @@ func (s *Storage) Balance() repository.BalanceRepo {
 	return &BalanceRepo{DB: s.db}
 }
 
-func (s *Storage) InTx(ctx context.Context, fn func(repository.Storage) error) (err error) {
-	tx, err := s.db.Begin(ctx)
+func (s *Storage) InTx(ctx context.Context, fn func(repository.Storage) error, opts ...repository.TxOption) (err error) {
+	tx, err := s.begin(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("db tx error: %w", err)
 	}
@@ -50,3 +59,51 @@ func (s *Storage) InTx(ctx context.Context, fn func(repository.Storage) error) (
 
 	return err
 }
+
+func (s *Storage) InTxWithRetry(ctx context.Context, maxRetries int, fn func(repository.Storage) error, opts ...repository.TxOption) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := s.InTx(ctx, fn, opts...)
+		if err == nil || attempt >= maxRetries || !isTxConflict(err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("tx retry canceled: %w", errors.Join(ctx.Err(), err))
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// Begin transaction with options if db is able to (pool or connection)
+// Within transaction new one is savepoint, so it runs with outer transaction options
+func (s *Storage) begin(ctx context.Context, opts []repository.TxOption) (pgx.Tx, error) {
+	var o repository.TxOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db, ok := s.db.(txBeginner)
+	if !ok || o == (repository.TxOptions{}) {
+		return s.db.Begin(ctx)
+	}
+
+	txOpts := pgx.TxOptions{IsoLevel: pgx.TxIsoLevel(o.Isolation)}
+	if o.ReadOnly {
+		txOpts.AccessMode = pgx.ReadOnly
+	}
+	return db.BeginTx(ctx, txOpts)
+}
+
+// Whether transaction failed due to concurrent transactions and may succeed if run again
+func isTxConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == pgerrcode.SerializationFailure || pgErr.Code == pgerrcode.DeadlockDetected
+}
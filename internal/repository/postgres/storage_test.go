@@ -0,0 +1,139 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/repository"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+)
+
+func Test_Storage(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	t.Run("InTx isolation", func(t *testing.T) {
+		// Storage over pool, so transactions are real and concurrent ones run on other connections
+		s := NewStorage(pg.Pool)
+		user, err := s.User().CreateUser(t.Context(), "isolation-user", "hashed")
+		require.NoError(t, err)
+		err = s.Balance().CreateBalance(t.Context(), user.ID)
+		require.NoError(t, err)
+
+		// Read balance, let concurrent transaction change it and write balance based on the read one
+		readModifyWrite := func(opts ...repository.TxOption) error {
+			return s.InTx(t.Context(), func(storage repository.Storage) error {
+				balance, err := storage.Balance().GetBalance(t.Context(), user.ID, false)
+				if err != nil {
+					return err
+				}
+
+				err = s.InTx(t.Context(), func(concurrent repository.Storage) error {
+					_, err := concurrent.Balance().SetBalance(t.Context(), user.ID, decimal.NewFromInt(100), decimal.Zero)
+					return err
+				})
+				require.NoError(t, err, "concurrent transaction has to be committed")
+
+				_, err = storage.Balance().SetBalance(t.Context(), user.ID, balance.Current.Add(decimal.NewFromInt(10)), decimal.Zero)
+				return err
+			}, opts...)
+		}
+
+		t.Run("default loses concurrent update", func(t *testing.T) {
+			err := readModifyWrite()
+
+			require.NoError(t, err)
+			balance, err := s.Balance().GetBalance(t.Context(), user.ID, false)
+			require.NoError(t, err)
+			require.True(t, balance.Current.LessThan(decimal.NewFromInt(100)), "concurrent update is overwritten on read committed")
+		})
+
+		t.Run("serializable rejects conflicting update", func(t *testing.T) {
+			err := readModifyWrite(repository.WithIsolation(repository.IsolationSerializable))
+
+			require.Error(t, err)
+			require.True(t, isTxConflict(err), "serialization failure expected, got: %v", err)
+			balance, err := s.Balance().GetBalance(t.Context(), user.ID, false)
+			require.NoError(t, err)
+			require.Equal(t, "100", balance.Current.String(), "concurrent update has to be kept")
+		})
+
+		t.Run("read only rejects write", func(t *testing.T) {
+			err := s.InTx(t.Context(), func(storage repository.Storage) error {
+				_, err := storage.Balance().SetBalance(t.Context(), user.ID, decimal.Zero, decimal.Zero)
+				return err
+			}, repository.WithReadOnly())
+
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("InTxWithRetry", func(t *testing.T) {
+		t.Run("retry on conflict", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				s := NewStorage(tx)
+				attempts := 0
+
+				err := s.InTxWithRetry(t.Context(), 3, func(storage repository.Storage) error {
+					attempts++
+					_, err := storage.User().CreateUser(t.Context(), "retried", "hashed")
+					require.NoError(t, err, "user of failed attempt has to be rolled back")
+					if attempts == 1 {
+						return &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+					}
+					return nil
+				})
+
+				require.NoError(t, err)
+				require.Equal(t, 2, attempts, "function has to be run again after conflict")
+				_, err = s.User().GetUserByUsername(t.Context(), "retried")
+				require.NoError(t, err, "second attempt has to be committed")
+			})
+		})
+
+		t.Run("retries exhausted", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				attempts := 0
+
+				err := NewStorage(tx).InTxWithRetry(t.Context(), 2, func(storage repository.Storage) error {
+					attempts++
+					return fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: pgerrcode.DeadlockDetected})
+				})
+
+				require.Error(t, err)
+				require.Equal(t, 3, attempts, "first attempt and 2 retries expected")
+			})
+		})
+
+		t.Run("other error not retried", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				attempts := 0
+				errFailed := errors.New("failed")
+
+				err := NewStorage(tx).InTxWithRetry(t.Context(), 3, func(storage repository.Storage) error {
+					attempts++
+					return errFailed
+				})
+
+				require.ErrorIs(t, err, errFailed)
+				require.Equal(t, 1, attempts)
+			})
+		})
+	})
+}
+
+func Test_isTxConflict(t *testing.T) {
+	require.True(t, isTxConflict(&pgconn.PgError{Code: pgerrcode.SerializationFailure}))
+	require.True(t, isTxConflict(fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: pgerrcode.DeadlockDetected})))
+	require.False(t, isTxConflict(&pgconn.PgError{Code: pgerrcode.UniqueViolation}))
+	require.False(t, isTxConflict(errors.New("not pg error")))
+}
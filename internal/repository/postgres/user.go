@@ -11,20 +11,26 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
 type UserRepo struct {
 	DB DBTX
 }
 
-func (r *UserRepo) CreateUser(ctx context.Context, username string, hashedPassword string) (models.User, error) {
+func (r *UserRepo) CreateUser(ctx context.Context, username string, hashedPassword string, opts ...repository.CreateUserOption) (models.User, error) {
 	const createUser = `
-	INSERT INTO users (username, password_hash)
-	VALUES ($1, $2)
-	RETURNING id, created_at, username, password_hash
+	INSERT INTO users (username, password_hash, email)
+	VALUES ($1, $2, NULLIF($3, ''))
+	RETURNING id, created_at, username, password_hash, COALESCE(email, '')
 	`
 
-	rows, _ := r.DB.Query(ctx, createUser, username, hashedPassword)
+	var u models.User
+	for _, opt := range opts {
+		opt(&u)
+	}
+
+	rows, _ := r.DB.Query(ctx, createUser, username, hashedPassword, u.Email)
 	user, err := pgx.CollectOneRow(rows, rowToUser)
 
 	if err != nil {
@@ -41,7 +47,7 @@ func (r *UserRepo) CreateUser(ctx context.Context, username string, hashedPasswo
 
 func (r *UserRepo) GetUserByID(ctx context.Context, id uuid.UUID) (models.User, error) {
 	const getUserByID = `
-	SELECT * FROM users
+	SELECT id, created_at, username, password_hash, COALESCE(email, '') FROM users
 	WHERE id = $1
 	`
 
@@ -60,7 +66,7 @@ func (r *UserRepo) GetUserByID(ctx context.Context, id uuid.UUID) (models.User,
 
 func (r *UserRepo) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
 	const getUserByUsername = `
-	SELECT * FROM users
+	SELECT id, created_at, username, password_hash, COALESCE(email, '') FROM users
 	WHERE username = $1
 	`
 	rows, _ := r.DB.Query(ctx, getUserByUsername, username)
@@ -76,8 +82,27 @@ func (r *UserRepo) GetUserByUsername(ctx context.Context, username string) (mode
 	}
 }
 
+func (r *UserRepo) SetEmail(ctx context.Context, userID uuid.UUID, email string) (models.User, error) {
+	const setEmail = `
+	UPDATE users SET email = NULLIF($2, '')
+	WHERE id = $1
+	RETURNING id, created_at, username, password_hash, COALESCE(email, '')
+	`
+	rows, _ := r.DB.Query(ctx, setEmail, userID, email)
+	user, err := pgx.CollectOneRow(rows, rowToUser)
+
+	switch {
+	case err == nil:
+		return user, nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return user, apperrors.ErrUserNotFound
+	default:
+		return user, fmt.Errorf("db error: %w", err)
+	}
+}
+
 func rowToUser(row pgx.CollectableRow) (models.User, error) {
 	var u models.User
-	err := row.Scan(&u.ID, &u.CreatedAt, &u.Username, &u.HashedPassword)
+	err := row.Scan(&u.ID, &u.CreatedAt, &u.Username, &u.HashedPassword, &u.Email)
 	return u, err
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 )
 
@@ -32,6 +33,40 @@ func Test_UserRepo(t *testing.T) {
 		})
 	})
 
+	t.Run("create user with email", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			r := UserRepo{DB: tx}
+
+			user, err := r.CreateUser(t.Context(), "testuser", "hashedpassword123", repository.WithEmail("test@example.com"))
+
+			require.NoError(t, err)
+			assert.Equal(t, "test@example.com", user.Email)
+			got, err := r.GetUserByID(t.Context(), user.ID)
+			require.NoError(t, err)
+			assert.Equal(t, "test@example.com", got.Email)
+		})
+	})
+
+	t.Run("set email", func(t *testing.T) {
+		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+			r := UserRepo{DB: tx}
+			created, err := r.CreateUser(t.Context(), "testuser", "hashedpassword123")
+			require.NoError(t, err)
+			require.Empty(t, created.Email)
+
+			user, err := r.SetEmail(t.Context(), created.ID, "test@example.com")
+			require.NoError(t, err)
+			assert.Equal(t, "test@example.com", user.Email)
+
+			user, err = r.SetEmail(t.Context(), created.ID, "")
+			require.NoError(t, err)
+			assert.Empty(t, user.Email, "empty email unsets it")
+
+			_, err = r.SetEmail(t.Context(), uuid.New(), "test@example.com")
+			assert.ErrorIs(t, err, apperrors.ErrUserNotFound)
+		})
+	})
+
 	t.Run("get user by id ok", func(t *testing.T) {
 		testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
 			r := UserRepo{DB: tx}
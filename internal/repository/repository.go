@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"iter"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,12 +14,16 @@ import (
 type UserRepo interface {
 	// Create user
 	// If user with username exists already has to return error apperrors.ErrUserAlreadyExists
-	CreateUser(ctx context.Context, username string, hashedPassword string) (models.User, error)
+	CreateUser(ctx context.Context, username string, hashedPassword string, opts ...CreateUserOption) (models.User, error)
 
 	// Get user by it's id or username
 	// If user not found must return apperrors.ErrUserNotExists
 	GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error)
 	GetUserByUsername(ctx context.Context, username string) (models.User, error)
+
+	// Set user's email, empty email unsets it
+	// If user not found must return apperrors.ErrUserNotExists
+	SetEmail(ctx context.Context, userID uuid.UUID, email string) (models.User, error)
 }
 
 // RefreshToken repository interface
@@ -29,13 +34,53 @@ type RefreshTokenRepo interface {
 	// Return the token if it exists in the database
 	Get(ctx context.Context, tokenString string) (models.RefreshToken, error)
 
+	// Return the token by its ID
+	// If token not found, must return apperrors.ErrRefreshTokenNotFound
+	GetByID(ctx context.Context, id uuid.UUID) (models.RefreshToken, error)
+
+	// List user's active tokens: not used, not revoked and not expired, the newest first
+	// Used token is rotated already, so only the latest token of every family is listed
+	ListByUser(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error)
+
 	// Mark token as used
 	// If the token is already used, must return apperrors.ErrTokenAlreadyUsed and time when token was used
+	// If the token is revoked, must return apperrors.ErrRefreshTokenRevoked
 	GetAndMarkUsed(ctx context.Context, tokenString string) (models.RefreshToken, error)
 
+	// Count user's active tokens: not used, not revoked and not expired
+	CountActive(ctx context.Context, userID uuid.UUID) (int, error)
+
+	// Revoke the oldest active user's tokens so only 'keep' newest ones stay active
+	// Returns number of revoked tokens
+	PruneActive(ctx context.Context, userID uuid.UUID, keep int) (int, error)
+
+	// Revoke all not revoked yet tokens of the family
+	// Returns number of revoked tokens
+	RevokeFamily(ctx context.Context, familyID uuid.UUID) (int, error)
+
 	// It would be good idea to add methods
 	// Delete expired tokens
-	// Set tokens revoked for user (or something like that)
+}
+
+type RefreshTokenOption func(*models.RefreshToken)
+
+// Issue token within existing family (on rotation)
+func WithFamilyID(id uuid.UUID) func(*models.RefreshToken) {
+	return func(t *models.RefreshToken) { t.FamilyID = id }
+}
+
+// Remember client the token is issued to
+func WithClientInfo(userAgent string, ip string) func(*models.RefreshToken) {
+	return func(t *models.RefreshToken) {
+		t.UserAgent = userAgent
+		t.IP = ip
+	}
+}
+
+type CreateUserOption func(*models.User)
+
+func WithEmail(email string) CreateUserOption {
+	return func(u *models.User) { u.Email = email }
 }
 
 type CreateOrderOption func(*models.Order)
@@ -46,15 +91,32 @@ func WithOrderStatus(s string) func(*models.Order) {
 func WithOrderAccrual(d decimal.Decimal) func(o *models.Order) {
 	return func(o *models.Order) { o.Accrual = &d }
 }
+func WithOrderID(id uuid.UUID) func(*models.Order) {
+	return func(o *models.Order) { o.ID = id }
+}
 func WithUploadedAt(t time.Time) func(*models.Order) {
 	return func(o *models.Order) { o.UploadedAt = t }
 }
 
+// Page of list results. Zero limit means no limit
+type Page struct {
+	Limit  int
+	Offset int
+}
+
 type ListOrdersOpts struct {
 	UserID   *uuid.UUID
 	Statuses []string
-	Limit    int
-	Offset   int
+
+	// List only orders uploaded after the time if set
+	UploadedAfter *time.Time
+
+	Limit  int
+	Offset int
+
+	// Lock listed orders and skip ones locked by other transactions, like orders accrual is being applied to
+	// Locks are held till the end of the transaction, so without transaction it only skips locked orders
+	SkipLocked bool
 }
 
 type UpdateOrderOpts struct {
@@ -63,10 +125,60 @@ type UpdateOrderOpts struct {
 }
 
 type OrderRepo interface {
+	// Has to return apperrors.ErrUserNotFound if user doesn't exist
 	CreateOrder(ctx context.Context, number string, userID uuid.UUID, opts ...CreateOrderOption) (models.Order, error)
 	ListOrders(ctx context.Context, opts ListOrdersOpts) ([]models.Order, error)
+
+	// Call fn for every order matching the options as they are read, without loading all of them to memory
+	// Iteration stops on the first error returned by fn or when ctx is done, ctx error is returned then
+	ForEachOrder(ctx context.Context, opts ListOrdersOpts, fn func(models.Order) error) error
+
+	// Orders matching the options yielded one by one as they are read
+	// Read error is yielded with zero order and ends the iteration
+	IterOrders(ctx context.Context, opts ListOrdersOpts) iter.Seq2[models.Order, error]
 	GetOrder(ctx context.Context, number string, lock bool) (models.Order, error)
 	UpdateOrder(ctx context.Context, number string, opts UpdateOrderOpts) (models.Order, error)
+
+	// Claim up to limit not processed orders (NEW or PROCESSING), the oldest first, for the lease and return them
+	// Orders claimed already and not released or expired are skipped, so concurrent claims get disjoint batches
+	// Claim is stored, so it's kept after the call even without transaction
+	ClaimOrdersForProcessing(ctx context.Context, limit int, lease time.Duration) ([]models.Order, error)
+
+	// Release claims of the orders, so they may be claimed again before the lease expires
+	ReleaseOrderClaims(ctx context.Context, numbers []string) error
+
+	// Set orders in the statuses uploaded before the time to the new status
+	// Orders reprocessed at or after the time are kept. Returns updated orders
+	RetireOrders(ctx context.Context, statuses []string, uploadedBefore time.Time, newStatus string) ([]models.Order, error)
+
+	// Remember the order is reprocessed at the time, so it's not retired till it's old since then
+	SetOrderReprocessed(ctx context.Context, number string, at time.Time) error
+
+	// Count all user's orders
+	CountOrders(ctx context.Context, userID uuid.UUID) (int, error)
+
+	// Count user's orders by status. Statuses without orders are not included
+	CountOrdersByStatus(ctx context.Context, userID uuid.UUID) (map[string]int, error)
+
+	// List saved order polling states
+	ListPollStates(ctx context.Context) ([]models.OrderPollState, error)
+
+	// Save order polling states, existing ones for the same orders are overwritten
+	// States of not existing orders are skipped
+	SavePollStates(ctx context.Context, states []models.OrderPollState) error
+
+	// Delete all saved order polling states
+	DeletePollStates(ctx context.Context) error
+}
+
+type BalanceHistoryOpts struct {
+	// Return only points of transactions processed within [From, To) if set
+	// Balance still accumulates all earlier transactions
+	From *time.Time
+	To   *time.Time
+
+	// Return single point per UTC day with the balance at the end of the day
+	ByDay bool
 }
 
 type BalanceRepo interface {
@@ -74,7 +186,38 @@ type BalanceRepo interface {
 	GetBalance(ctx context.Context, userID uuid.UUID, lock bool) (models.Balance, error)
 	UpdateBalance(ctx context.Context, t models.Transaction) (models.Balance, error)
 	CreateTransaction(ctx context.Context, t models.Transaction) (models.Transaction, error)
-	ListTransactions(ctx context.Context, userID uuid.UUID, types []string) ([]models.Transaction, error)
+
+	// Insert transactions in bulk, much faster than one by one for large batches. Nothing is inserted on error
+	// Returns apperrors.ErrUserNotFound if any transaction belongs to not existed user
+	BulkCreateTransactions(ctx context.Context, ts []models.Transaction) error
+
+	ListTransactions(ctx context.Context, userID uuid.UUID, types []models.TransactionType, page Page) ([]models.Transaction, error)
+
+	// Count user's transactions of the types. All types if empty
+	CountTransactions(ctx context.Context, userID uuid.UUID, types []models.TransactionType) (int, error)
+
+	// Call fn for every user's transaction of the types as they are read, newest first. All types if empty
+	// Iteration stops on the first error returned by fn or when ctx is done, ctx error is returned then
+	ForEachTransaction(ctx context.Context, userID uuid.UUID, types []models.TransactionType, fn func(models.Transaction) error) error
+
+	// Sum amounts of user's transactions of the type processed since the time
+	SumTransactions(ctx context.Context, userID uuid.UUID, typ models.TransactionType, since time.Time) (decimal.Decimal, error)
+
+	// Sum all user's accruals and withdrawals
+	SumTransactionsByType(ctx context.Context, userID uuid.UUID) (models.TransactionTotals, error)
+
+	// Replay user's transactions in chronological order into running balance points, the oldest first
+	BalanceHistory(ctx context.Context, userID uuid.UUID, opts BalanceHistoryOpts) ([]models.BalancePoint, error)
+
+	// Sum user's withdrawals per order, the most recently withdrawn order first
+	SumWithdrawalsByOrder(ctx context.Context, userID uuid.UUID) ([]models.WithdrawalSummary, error)
+
+	// List balances that don't match sums of user's transactions
+	// If lock set to true mismatched balances are locked for update
+	ListBalanceMismatches(ctx context.Context, lock bool) ([]models.BalanceMismatch, error)
+
+	// Overwrite user's balance with the values
+	SetBalance(ctx context.Context, userID uuid.UUID, current decimal.Decimal, withdrawn decimal.Decimal) (models.Balance, error)
 }
 
 type Storage interface {
@@ -84,5 +227,34 @@ type Storage interface {
 	Balance() BalanceRepo
 
 	// InTx starts a transaction, executes the provided function, and commits or rolls back based on the function's error.
-	InTx(ctx context.Context, fn func(Storage) error) error
+	// Options are applied to top level transaction only: nested one runs within outer transaction isolation
+	InTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error
+
+	// InTxWithRetry is the same as InTx, but the function is run again in new transaction
+	// if the transaction failed on serialization conflict or deadlock, up to maxRetries times
+	// The function has to be safe to run more than once
+	InTxWithRetry(ctx context.Context, maxRetries int, fn func(Storage) error, opts ...TxOption) error
+}
+
+// Transaction isolation level. Empty one is database default (read committed for postgres)
+type IsolationLevel string
+
+const (
+	IsolationReadCommitted  IsolationLevel = "read committed"
+	IsolationRepeatableRead IsolationLevel = "repeatable read"
+	IsolationSerializable   IsolationLevel = "serializable"
+)
+
+type TxOptions struct {
+	Isolation IsolationLevel
+	ReadOnly  bool
+}
+
+type TxOption func(*TxOptions)
+
+func WithIsolation(level IsolationLevel) func(*TxOptions) {
+	return func(o *TxOptions) { o.Isolation = level }
+}
+func WithReadOnly() func(*TxOptions) {
+	return func(o *TxOptions) { o.ReadOnly = true }
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -15,9 +16,16 @@ import (
 )
 
 const (
-	CodeRetryAfter = "retry-after"
-	CodeNoContent  = "no-content"
-	CodeUnknown    = "unknown"
+	CodeRetryAfter  = "retry-after"
+	CodeNoContent   = "no-content"
+	CodeUnavailable = "unavailable" // Service unreachable, request never got response
+	CodeUnknown     = "unknown"
+
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultBasePath     = "/api/orders/"
+
+	defaultMaxIdleConnsPerHost = 10               // Enough for every processor worker to keep its connection
+	defaultIdleConnTimeout     = 90 * time.Second // Idle connection is closed after that
 )
 
 type Error struct {
@@ -39,45 +47,186 @@ func NewAccrualError(code string, retryAfter int, err error) *Error {
 	}
 }
 
+// Order statuses returned by accrual service
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+)
+
 type OrderAccrual struct {
 	OrderNumber string           `json:"order"`
 	Status      string           `json:"status"`
 	Accrual     *decimal.Decimal `json:"accrual,omitempty"`
 }
 
+// Accrual client config
+type Config struct {
+	// Accrual service address. Scheme is optional, http is used if not set
+	Addr string
+
+	// API key attached to every request. No key sent if empty
+	APIKey string
+
+	// Header to send API key with, e.g. 'Authorization' or 'X-API-Key'
+	// If not set than default is used
+	APIKeyHeader string
+
+	// Path prefix the order number is appended to, e.g. '/accrual/v1/orders/'
+	// If not set than default is used
+	BasePath string
+
+	// Max requests sent to accrual service at the same time, others wait for their turn
+	// Unlimited if not set
+	MaxConcurrentRequests int
+
+	// Idle connections kept open to accrual service to be reused by next requests
+	// If not set than default is used
+	MaxIdleConnsPerHost int
+
+	// How long idle connection is kept open
+	// If not set than default is used
+	IdleConnTimeout time.Duration
+}
+
 type Client struct {
-	addr string
+	// Accrual service address with base path, order number is appended to it
+	baseURL *url.URL
+
+	apiKey       string
+	apiKeyHeader string
+
+	// Semaphore to bound outbound requests, nil if unlimited
+	sem chan struct{}
 
 	client *http.Client
 	logger logger.Logger
 }
 
-func NewClient(addr string, logger logger.Logger) *Client {
+func NewClient(cfg Config, logger logger.Logger) (*Client, error) {
 	// Address has to have scheme. Add it manually if not set
+	addr := cfg.Addr
 	if !strings.Contains(addr, "://") {
 		addr = "http://" + addr
 	}
 
+	if cfg.APIKeyHeader == "" {
+		cfg.APIKeyHeader = defaultAPIKeyHeader
+	}
+
+	basePath, err := normalizeBasePath(cfg.BasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accrual address: %w", err)
+	}
+	baseURL = baseURL.JoinPath(basePath)
+
+	if cfg.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("accrual max concurrent requests can't be negative: %d", cfg.MaxConcurrentRequests)
+	}
+	var sem chan struct{}
+	if cfg.MaxConcurrentRequests > 0 {
+		sem = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
-		addr:   addr,
-		logger: logger,
-		client: &http.Client{},
+		baseURL:      baseURL,
+		apiKey:       cfg.APIKey,
+		apiKeyHeader: cfg.APIKeyHeader,
+		sem:          sem,
+		logger:       logger,
+		client:       &http.Client{Transport: transport},
+	}, nil
+}
+
+// Transport keeping enough idle connections to accrual service, so polling under load doesn't open new ones
+// Default transport keeps only 2 idle connections per host, the rest are closed after every request
+func newTransport(cfg Config) (*http.Transport, error) {
+	if cfg.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("accrual max idle connections can't be negative: %d", cfg.MaxIdleConnsPerHost)
+	}
+	if cfg.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("accrual idle connection timeout can't be negative: %s", cfg.IdleConnTimeout)
 	}
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+
+	// Proxy and dial settings are kept from the default transport
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxIdleConns = max(t.MaxIdleConns, cfg.MaxIdleConnsPerHost)
+	t.IdleConnTimeout = cfg.IdleConnTimeout
+	t.ForceAttemptHTTP2 = true
+	return t, nil
+}
+
+// Return base path with exactly one leading and one trailing slash
+// Path with query, fragment or empty segments is not allowed: order number has to be the last path segment
+func normalizeBasePath(path string) (string, error) {
+	if path == "" {
+		return defaultBasePath, nil
+	}
+
+	if strings.ContainsAny(path, "?#") {
+		return "", fmt.Errorf("accrual base path must not contain query or fragment: %q", path)
+	}
+
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return "/", nil
+	}
+	if strings.Contains(trimmed, "//") {
+		return "", fmt.Errorf("accrual base path must not contain empty segments: %q", path)
+	}
+
+	return "/" + trimmed + "/", nil
 }
 
 func (c *Client) GetOrderAccrual(ctx context.Context, number string) (OrderAccrual, error) {
 	var accrual OrderAccrual
 
+	// Wait for the turn before request timeout starts
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			return accrual, NewAccrualError(CodeUnknown, 0, fmt.Errorf("waiting for request slot: %w", ctx.Err()))
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr+"/api/orders/"+number, nil)
+	orderURL, err := c.orderURL(number)
+	if err != nil {
+		return accrual, NewAccrualError(CodeUnknown, 0, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderURL, nil)
 	if err != nil {
 		return accrual, NewAccrualError(CodeUnknown, 0, fmt.Errorf("failed to create request: %w", err))
 	}
+	if c.apiKey != "" {
+		req.Header.Set(c.apiKeyHeader, c.apiKey)
+	}
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return accrual, NewAccrualError(CodeUnknown, 0, fmt.Errorf("failed to send request: %w", err))
+		return accrual, NewAccrualError(CodeUnavailable, 0, fmt.Errorf("failed to send request: %w", err))
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
@@ -94,6 +243,31 @@ func (c *Client) GetOrderAccrual(ctx context.Context, number string) (OrderAccru
 	}
 }
 
+// Check accrual service is reachable. Any HTTP response counts, only transport errors are returned
+func (c *Client) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("accrual service unreachable: %w", err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Build order url. Number is escaped as single path segment, so it never changes the rest of url
+func (c *Client) orderURL(number string) (string, error) {
+	if number == "" || number == "." || number == ".." {
+		return "", fmt.Errorf("invalid order number %q", number)
+	}
+	return c.baseURL.JoinPath(url.PathEscape(number)).String(), nil
+}
+
 func (c *Client) processSuccess(resp *http.Response) (OrderAccrual, error) {
 	var a OrderAccrual
 	err := json.NewDecoder(resp.Body).Decode(&a)
@@ -0,0 +1,293 @@
+package accrual
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+)
+
+func TestNewClient(t *testing.T) {
+	t.Run("base path normalized", func(t *testing.T) {
+		tests := []struct {
+			path string
+			want string
+		}{
+			{"", "/api/orders/"},
+			{"/api/orders/", "/api/orders/"},
+			{"api/orders", "/api/orders/"},
+			{"/accrual/v1/orders//", "/accrual/v1/orders/"},
+			{"/", "/"},
+		}
+
+		for _, tt := range tests {
+			c, err := NewClient(Config{Addr: "localhost:8080", BasePath: tt.path}, logger.NewNoOpLogger())
+			require.NoError(t, err)
+			require.Equal(t, "http://localhost:8080"+tt.want, c.baseURL.String())
+		}
+	})
+
+	t.Run("negative max concurrent requests", func(t *testing.T) {
+		_, err := NewClient(Config{Addr: "localhost:8080", MaxConcurrentRequests: -1}, logger.NewNoOpLogger())
+		require.Error(t, err)
+	})
+
+	t.Run("invalid base path", func(t *testing.T) {
+		for _, path := range []string{"/api/orders?x=1", "/api/orders#", "/api//orders/"} {
+			_, err := NewClient(Config{Addr: "localhost:8080", BasePath: path}, logger.NewNoOpLogger())
+			require.Error(t, err, "base path %q should be rejected", path)
+		}
+	})
+}
+
+func TestClient_GetOrderAccrual(t *testing.T) {
+	// Request seen by accrual server
+	type seen struct {
+		path    string
+		headers http.Header
+	}
+
+	// Start accrual server that returns processed order and records last request
+	serve := func(t *testing.T, cfg Config) (*Client, *seen) {
+		var last seen
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			last = seen{path: r.URL.EscapedPath(), headers: r.Header.Clone()}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order": "2377225624", "status": "PROCESSED", "accrual": 500}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		cfg.Addr = srv.URL
+		c, err := NewClient(cfg, logger.NewNoOpLogger())
+		require.NoError(t, err)
+		return c, &last
+	}
+
+	t.Run("default base path", func(t *testing.T) {
+		c, last := serve(t, Config{})
+
+		got, err := c.GetOrderAccrual(t.Context(), "2377225624")
+
+		require.NoError(t, err)
+		require.Equal(t, "PROCESSED", got.Status)
+		require.Equal(t, "/api/orders/2377225624", last.path)
+	})
+
+	t.Run("custom base path", func(t *testing.T) {
+		c, last := serve(t, Config{BasePath: "/accrual/v1/orders"})
+
+		_, err := c.GetOrderAccrual(t.Context(), "2377225624")
+
+		require.NoError(t, err)
+		require.Equal(t, "/accrual/v1/orders/2377225624", last.path)
+	})
+
+	t.Run("order number escaped", func(t *testing.T) {
+		tests := []struct {
+			number string
+			want   string
+		}{
+			{"12/34 5", "/api/orders/12%2F34%205"},
+			{"1?x=2#f", "/api/orders/1%3Fx=2%23f"},
+			{"%2F", "/api/orders/%252F"},
+			{"../admin", "/api/orders/..%2Fadmin"},
+		}
+
+		for _, tt := range tests {
+			c, last := serve(t, Config{})
+
+			_, err := c.GetOrderAccrual(t.Context(), tt.number)
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, last.path, "number %q has to be single escaped path segment", tt.number)
+		}
+	})
+
+	t.Run("dot segments rejected", func(t *testing.T) {
+		c, _ := serve(t, Config{})
+
+		for _, number := range []string{"", ".", ".."} {
+			_, err := c.GetOrderAccrual(t.Context(), number)
+			require.Error(t, err, "number %q must not be requested", number)
+		}
+	})
+
+	t.Run("api key header sent", func(t *testing.T) {
+		c, last := serve(t, Config{APIKey: "secret", APIKeyHeader: "Authorization"})
+
+		_, err := c.GetOrderAccrual(t.Context(), "2377225624")
+
+		require.NoError(t, err)
+		require.Equal(t, "secret", last.headers.Get("Authorization"))
+	})
+
+	t.Run("default api key header", func(t *testing.T) {
+		c, last := serve(t, Config{APIKey: "secret"})
+
+		_, err := c.GetOrderAccrual(t.Context(), "2377225624")
+
+		require.NoError(t, err)
+		require.Equal(t, "secret", last.headers.Get("X-API-Key"))
+	})
+
+	t.Run("no api key header if not set", func(t *testing.T) {
+		c, last := serve(t, Config{})
+
+		_, err := c.GetOrderAccrual(t.Context(), "2377225624")
+
+		require.NoError(t, err)
+		require.Empty(t, last.headers.Get("X-API-Key"))
+		require.Empty(t, last.headers.Get("Authorization"))
+	})
+}
+
+func TestClient_Probe(t *testing.T) {
+	newClient := func(t *testing.T, addr string) *Client {
+		c, err := NewClient(Config{Addr: addr}, logger.NewNoOpLogger())
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("any response is reachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(srv.Close)
+
+		err := newClient(t, srv.URL).Probe(t.Context())
+
+		require.NoError(t, err)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+		c := newClient(t, srv.URL)
+
+		err := c.Probe(t.Context())
+		require.Error(t, err)
+
+		_, err = c.GetOrderAccrual(t.Context(), "2377225624")
+		var accErr *Error
+		require.ErrorAs(t, err, &accErr)
+		require.Equal(t, CodeUnavailable, accErr.Code, "unreachable service has to be reported as unavailable")
+	})
+}
+
+func TestClient_MaxConcurrentRequests(t *testing.T) {
+	const limit = 2
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		// Keep request in flight, so others have a chance to overlap
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order": "2377225624", "status": "PROCESSED", "accrual": 500}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(Config{Addr: srv.URL, MaxConcurrentRequests: limit}, logger.NewNoOpLogger())
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.GetOrderAccrual(t.Context(), "2377225624")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, maxInFlight, limit, "concurrent requests must not exceed the limit")
+	require.Equal(t, limit, maxInFlight, "requests has to be sent concurrently up to the limit")
+}
+
+func TestClient_ConnectionReuse(t *testing.T) {
+	// Accrual server counting opened connections
+	serve := func(t *testing.T, h http.HandlerFunc) (*Client, *atomic.Int32) {
+		var opened atomic.Int32
+		srv := httptest.NewUnstartedServer(h)
+		srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				opened.Add(1)
+			}
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		c, err := NewClient(Config{Addr: srv.URL}, logger.NewNoOpLogger())
+		require.NoError(t, err)
+		return c, &opened
+	}
+
+	for name, h := range map[string]http.HandlerFunc{
+		"processed": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"order": "2377225624", "status": "PROCESSED", "accrual": 500}` + "\n\n"))
+		},
+		"no content": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"unknown status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, opened := serve(t, h)
+
+			for range 50 {
+				_, _ = c.GetOrderAccrual(t.Context(), "2377225624")
+			}
+
+			require.EqualValues(t, 1, opened.Load(), "sequential requests have to reuse the connection")
+		})
+	}
+}
+
+func TestClient_Transport(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		c, err := NewClient(Config{Addr: "localhost:8080"}, logger.NewNoOpLogger())
+		require.NoError(t, err)
+
+		transport := c.client.Transport.(*http.Transport)
+		require.Equal(t, defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+		require.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+		require.True(t, transport.ForceAttemptHTTP2)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		c, err := NewClient(Config{Addr: "localhost:8080", MaxIdleConnsPerHost: 200, IdleConnTimeout: time.Minute}, logger.NewNoOpLogger())
+		require.NoError(t, err)
+
+		transport := c.client.Transport.(*http.Transport)
+		require.Equal(t, 200, transport.MaxIdleConnsPerHost)
+		require.GreaterOrEqual(t, transport.MaxIdleConns, 200, "total idle connections must not limit per host ones")
+		require.Equal(t, time.Minute, transport.IdleConnTimeout)
+	})
+
+	t.Run("negative settings", func(t *testing.T) {
+		_, err := NewClient(Config{Addr: "localhost:8080", MaxIdleConnsPerHost: -1}, logger.NewNoOpLogger())
+		require.Error(t, err)
+
+		_, err = NewClient(Config{Addr: "localhost:8080", IdleConnTimeout: -time.Second}, logger.NewNoOpLogger())
+		require.Error(t, err)
+	})
+}
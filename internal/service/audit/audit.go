@@ -0,0 +1,42 @@
+// Package audit logs money movements separately from access and application logs
+package audit
+
+import (
+	"context"
+
+	"github.com/nkiryanov/gophermart/internal/clientip"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+)
+
+// Log order reset by admin to be processed again
+func OrderReprocessed(l logger.Logger, o models.Order, previousStatus string, admin string) {
+	l.Info("Order reprocessed",
+		"audit", true,
+		"user_id", o.UserID,
+		"order_number", o.Number,
+		"previous_status", previousStatus,
+		"status", o.Status,
+		"admin", admin,
+	)
+}
+
+// Log committed transaction with the balance it resulted in
+// Every record has 'audit=true' attribute, so audit logs could be easily filtered
+// Client IP is logged if the transaction is made by client request, accruals of order processor have none
+func Transaction(ctx context.Context, l logger.Logger, t models.Transaction, balance models.Balance) {
+	args := []any{
+		"audit", true,
+		"user_id", t.UserID,
+		"order_number", t.OrderNumber,
+		"type", t.Type,
+		"amount", t.Amount.String(),
+		"balance_current", balance.Current.String(),
+		"balance_withdrawn", balance.Withdrawn.String(),
+		"processed_at", t.ProcessedAt,
+	}
+	if ip, ok := clientip.FromContext(ctx); ok {
+		args = append(args, "client_ip", ip)
+	}
+	l.Info("Money movement", args...)
+}
@@ -11,31 +11,55 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
 const (
 	defaultAccessHeaderName  = "Authorization"
 	defaultAccessAuthScheme  = "Bearer"
 	defaultRefreshCookieName = "refreshtoken"
+
+	// Events stream token is only presented to open the stream, so it's short-lived
+	eventsTokenTTL = time.Minute
 )
 
+// Audience of tokens accepted by events stream only
+const EventsAudience = "events"
+
 type TokenManager interface {
 	// GeneratePair generates access and refresh tokens for user
-	GeneratePair(ctx context.Context, user models.User) (models.TokenPair, error)
+	// New refresh token family is started unless it set with repository.WithFamilyID
+	GeneratePair(ctx context.Context, user models.User, opts ...repository.RefreshTokenOption) (models.TokenPair, error)
 
 	// UseRefresh marks refresh token as used and returns it
+	// If token is used already has to revoke its family and return apperrors.ErrRefreshTokenIsUsed
 	UseRefresh(ctx context.Context, refresh string) (models.RefreshToken, error)
 
 	// ParseAccess parses access token and returns user ID
+	// Has to return apperrors.ErrAccessTokenExpired if token is expired, so client could be asked to refresh it
 	ParseAccess(ctx context.Context, access string) (userID uuid.UUID, err error)
+
+	// IssueScoped generates short-lived access token valid only for the audience
+	IssueScoped(ctx context.Context, userID uuid.UUID, audience string, ttl time.Duration) (models.IssuedToken, error)
+
+	// ParseScoped parses token issued for the audience and returns user ID
+	// Has to reject main API access tokens and tokens of other audiences
+	ParseScoped(ctx context.Context, token string, audience string) (userID uuid.UUID, err error)
+
+	// List user's not revoked and not expired refresh tokens
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error)
+
+	// Revoke user's session by refresh token ID
+	// Has to return apperrors.ErrSessionNotFound if token not found or belongs to other user
+	RevokeSession(ctx context.Context, userID uuid.UUID, tokenID uuid.UUID) error
 }
 
 type userService interface {
 	// Create user with username and password
-	CreateUser(ctx context.Context, username string, password string) (models.User, error)
+	CreateUser(ctx context.Context, username string, password string, opts ...repository.CreateUserOption) (models.User, error)
 
 	// Login user with username and password
-	// Has to return apperrors.ErrUserNotFound if user not found
+	// Has to return apperrors.ErrUserNotFound if user not found and apperrors.ErrInvalidCredentials if password is wrong
 	Login(ctx context.Context, username string, password string) (models.User, error)
 
 	// Get user by ID
@@ -48,6 +72,12 @@ type Config struct {
 	AccessHeaderName  string
 	AccessAuthScheme  string
 	RefreshCookieName string
+
+	// Cookie to read access token from if auth header is not set. Cookie is not used if empty
+	//
+	// It's for browser clients that can't set header. Cookies are sent by browser automatically, so it's CSRF prone,
+	// but the cookie is SameSite=Strict as refresh cookie is: cross-site requests go without it
+	AccessCookieName string
 }
 
 // Auth service
@@ -55,6 +85,7 @@ type AuthService struct {
 	accessHeaderName  string
 	accessAuthScheme  string
 	refreshCookieName string
+	accessCookieName  string
 
 	// Manager to issue token pairs (access and refresh)
 	tokenManager TokenManager
@@ -77,20 +108,27 @@ func NewService(cfg Config, tokenManager TokenManager, userService userService)
 		accessHeaderName:  cfg.AccessHeaderName,
 		accessAuthScheme:  cfg.AccessAuthScheme,
 		refreshCookieName: cfg.RefreshCookieName,
+		accessCookieName:  cfg.AccessCookieName,
 		tokenManager:      tokenManager,
 		userService:       userService,
 	}, nil
 }
 
-func (s *AuthService) Register(ctx context.Context, username string, password string) (models.TokenPair, error) {
+// Register user and issue token pair. Options are applied to issued refresh token (e.g. to save client info)
+func (s *AuthService) Register(ctx context.Context, username string, password string, opts ...repository.RefreshTokenOption) (models.TokenPair, error) {
+	return s.RegisterWithEmail(ctx, username, password, "", opts...)
+}
+
+// Register user with optional email and issue token pair. Email is not stored if empty
+func (s *AuthService) RegisterWithEmail(ctx context.Context, username string, password string, email string, opts ...repository.RefreshTokenOption) (models.TokenPair, error) {
 	var pair models.TokenPair
 
-	user, err := s.userService.CreateUser(ctx, username, password)
+	user, err := s.userService.CreateUser(ctx, username, password, repository.WithEmail(email))
 	if err != nil {
 		return pair, fmt.Errorf("can't register user. Err: %w", err)
 	}
 
-	pair, err = s.tokenManager.GeneratePair(ctx, user)
+	pair, err = s.tokenManager.GeneratePair(ctx, user, opts...)
 	if err != nil {
 		return pair, fmt.Errorf("token could not generated, sorry. Err: %w", err)
 	}
@@ -98,7 +136,8 @@ func (s *AuthService) Register(ctx context.Context, username string, password st
 	return pair, nil
 }
 
-func (s *AuthService) Login(ctx context.Context, username string, password string) (models.TokenPair, error) {
+// Login user and issue token pair. Options are applied to issued refresh token
+func (s *AuthService) Login(ctx context.Context, username string, password string, opts ...repository.RefreshTokenOption) (models.TokenPair, error) {
 	var pair models.TokenPair
 
 	user, err := s.userService.Login(ctx, username, password)
@@ -106,7 +145,7 @@ func (s *AuthService) Login(ctx context.Context, username string, password strin
 		return pair, fmt.Errorf("can't login user. Err: %w", err)
 	}
 
-	pair, err = s.tokenManager.GeneratePair(ctx, user)
+	pair, err = s.tokenManager.GeneratePair(ctx, user, opts...)
 	if err != nil {
 		return pair, fmt.Errorf("token could not be generated, sorry. Err: %w", err)
 	}
@@ -114,8 +153,8 @@ func (s *AuthService) Login(ctx context.Context, username string, password strin
 	return pair, nil
 }
 
-// Refresh token pair with valid refresh token
-func (s *AuthService) RefreshPair(ctx context.Context, refresh string) (models.TokenPair, error) {
+// Refresh token pair with valid refresh token. Options are applied to issued refresh token
+func (s *AuthService) RefreshPair(ctx context.Context, refresh string, opts ...repository.RefreshTokenOption) (models.TokenPair, error) {
 	var pair models.TokenPair
 
 	// Mark token as used
@@ -131,7 +170,9 @@ func (s *AuthService) RefreshPair(ctx context.Context, refresh string) (models.T
 		return pair, fmt.Errorf("token could not be refreshed. Err: %w", err)
 	}
 
-	pair, err = s.tokenManager.GeneratePair(ctx, user)
+	// Rotated token stays in the same family
+	opts = append([]repository.RefreshTokenOption{repository.WithFamilyID(token.FamilyID)}, opts...)
+	pair, err = s.tokenManager.GeneratePair(ctx, user, opts...)
 	if err != nil {
 		return pair, fmt.Errorf("token could not generated, sorry. Err: %w", err)
 	}
@@ -139,10 +180,32 @@ func (s *AuthService) RefreshPair(ctx context.Context, refresh string) (models.T
 	return pair, nil
 }
 
+// List user's active sessions
+func (s *AuthService) ListSessions(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error) {
+	return s.tokenManager.ListSessions(ctx, userID)
+}
+
+// Revoke user's session, it's refresh token can't be used anymore
+func (s *AuthService) RevokeSession(ctx context.Context, userID uuid.UUID, sessionID uuid.UUID) error {
+	return s.tokenManager.RevokeSession(ctx, userID, sessionID)
+}
+
 // Set valid token pair to response
-// It actually sets access token to header and refresh token to cookie
+// It actually sets access token to header (and to cookie if enabled) and refresh token to cookie
 func (s *AuthService) SetTokenPairToResponse(w http.ResponseWriter, pair models.TokenPair) {
 	w.Header().Set(s.accessHeaderName, fmt.Sprintf("%s %s", s.accessAuthScheme, pair.Access.Value))
+	if s.accessCookieName != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.accessCookieName,
+			Value:    pair.Access.Value,
+			Path:     "/",
+			MaxAge:   int(time.Until(pair.Access.ExpiresAt).Seconds()),
+			Expires:  pair.Access.ExpiresAt,
+			HttpOnly: true,
+			Secure:   false,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     s.refreshCookieName,
 		Value:    pair.Refresh.Value,
@@ -183,22 +246,31 @@ func (s *AuthService) GetRefreshString(r *http.Request) (string, error) {
 
 // Authenticate and get user from request or return error
 func (s *AuthService) GetUserFromRequest(ctx context.Context, r *http.Request) (models.User, error) {
+	return s.userFromRequest(ctx, r, s.tokenManager.ParseAccess)
+}
+
+// Issue token to open user's events stream, it's not accepted by the main API
+func (s *AuthService) IssueEventsToken(ctx context.Context, userID uuid.UUID) (models.IssuedToken, error) {
+	return s.tokenManager.IssueScoped(ctx, userID, EventsAudience, eventsTokenTTL)
+}
+
+// Authenticate events stream request with token issued by IssueEventsToken
+// Main API access tokens are rejected, so they are never sent to the stream
+func (s *AuthService) GetUserFromEventsRequest(ctx context.Context, r *http.Request) (models.User, error) {
+	return s.userFromRequest(ctx, r, func(ctx context.Context, token string) (uuid.UUID, error) {
+		return s.tokenManager.ParseScoped(ctx, token, EventsAudience)
+	})
+}
+
+func (s *AuthService) userFromRequest(ctx context.Context, r *http.Request, parse func(ctx context.Context, token string) (uuid.UUID, error)) (models.User, error) {
 	var u models.User
-	var scheme = fmt.Sprintf("%s ", s.accessAuthScheme)
 
-	auth := r.Header.Get(s.accessHeaderName)
-	if auth == "" {
-		return u, errors.New("auth header doesn't set")
-	}
-	if !strings.HasPrefix(auth, scheme) {
-		return u, errors.New("invalid auth header scheme")
-	}
-	token := strings.TrimSpace(strings.TrimPrefix(auth, scheme))
-	if token == "" {
-		return u, errors.New("empty auth token")
+	token, err := s.getAccessString(r)
+	if err != nil {
+		return u, err
 	}
 
-	userID, err := s.tokenManager.ParseAccess(ctx, token)
+	userID, err := parse(ctx, token)
 	if err != nil {
 		return u, fmt.Errorf("token is not valid. Err: %w", err)
 	}
@@ -210,3 +282,30 @@ func (s *AuthService) GetUserFromRequest(ctx context.Context, r *http.Request) (
 
 	return u, err
 }
+
+// Get access token from auth header
+// Cookie is used only if header is not set, so broken header never falls back to cookie
+func (s *AuthService) getAccessString(r *http.Request) (string, error) {
+	var scheme = fmt.Sprintf("%s ", s.accessAuthScheme)
+
+	auth := r.Header.Get(s.accessHeaderName)
+	if auth == "" {
+		if s.accessCookieName == "" {
+			return "", errors.New("auth header doesn't set")
+		}
+		cookie, err := r.Cookie(s.accessCookieName)
+		if err != nil || cookie.Value == "" {
+			return "", errors.New("neither auth header nor cookie set")
+		}
+		return cookie.Value, nil
+	}
+
+	if !strings.HasPrefix(auth, scheme) {
+		return "", errors.New("invalid auth header scheme")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, scheme))
+	if token == "" {
+		return "", errors.New("empty auth token")
+	}
+	return token, nil
+}
@@ -32,7 +32,7 @@ func Test_Auth(t *testing.T) {
 
 			tokenManager, err := tokenmanager.New(
 				tokenmanager.Config{
-					SecretKey:  "test-secret-key",
+					SecretKey:  "test-secret-key-32-bytes-minimum",
 					AccessTTL:  accessTTL,
 					RefreshTTL: refreshTTL,
 				},
@@ -106,7 +106,7 @@ func Test_Auth(t *testing.T) {
 				name:        "login fail if wrong password",
 				login:       "nkiryanov",
 				password:    "wrong",
-				expectedErr: apperrors.ErrUserNotFound,
+				expectedErr: apperrors.ErrInvalidCredentials,
 			},
 			{
 				name:        "login fail if user not exists",
@@ -165,8 +165,45 @@ func Test_Auth(t *testing.T) {
 			})
 		})
 
+		t.Run("refresh rotated token ok", func(t *testing.T) {
+			inTx(pg.Pool, 15*time.Minute, 24*time.Hour, t, func(s *AuthService) {
+				initialPair, err := s.Register(t.Context(), "nkiryanov", "pwd")
+				require.NoError(t, err)
+				secondPair, err := s.RefreshPair(t.Context(), initialPair.Refresh.Value)
+				require.NoError(t, err)
+
+				// Normal rotation path: rotated token is usable
+				thirdPair, err := s.RefreshPair(t.Context(), secondPair.Refresh.Value)
+				require.NoError(t, err, "rotated token has to be usable")
+				require.NotEqual(t, secondPair.Refresh.Value, thirdPair.Refresh.Value)
+			})
+		})
+
+		t.Run("reuse revokes family", func(t *testing.T) {
+			inTx(pg.Pool, 15*time.Minute, 24*time.Hour, t, func(s *AuthService) {
+				initialPair, err := s.Register(t.Context(), "nkiryanov", "pwd")
+				require.NoError(t, err)
+				otherSession, err := s.Login(t.Context(), "nkiryanov", "pwd")
+				require.NoError(t, err)
+				rotatedPair, err := s.RefreshPair(t.Context(), initialPair.Refresh.Value)
+				require.NoError(t, err)
+
+				// Attacker replays the stolen (already used) token
+				_, err = s.RefreshPair(t.Context(), initialPair.Refresh.Value)
+				require.ErrorIs(t, err, apperrors.ErrRefreshTokenIsUsed)
+
+				// Legitimate client's rotated token is revoked as well
+				_, err = s.RefreshPair(t.Context(), rotatedPair.Refresh.Value)
+				require.ErrorIs(t, err, apperrors.ErrRefreshTokenRevoked, "whole family has to be revoked on reuse")
+
+				// Other sessions are not affected
+				_, err = s.RefreshPair(t.Context(), otherSession.Refresh.Value)
+				require.NoError(t, err, "other families must stay active")
+			})
+		})
+
 		t.Run("fail if expired", func(t *testing.T) {
-			inTx(pg.Pool, 1*time.Second, 1*time.Second, t, func(s *AuthService) {
+			inTx(pg.Pool, 500*time.Millisecond, 1*time.Second, t, func(s *AuthService) {
 				// Register user and get token pair
 				initialPair, err := s.Register(t.Context(), "nkiryanov", "pwd")
 				require.NoError(t, err)
@@ -330,6 +367,50 @@ func Test_Auth(t *testing.T) {
 				require.Equal(t, "fuck off\n", string(body))
 			})
 
+			t.Run("access cookie", func(t *testing.T) {
+				s.accessCookieName = "accesstoken"
+				defer func() { s.accessCookieName = "" }()
+
+				pair, err := s.Login(t.Context(), "nk", "pwd")
+				require.NoError(t, err)
+
+				// Send request and return status code
+				send := func(t *testing.T, header string, cookie string) int {
+					req, err := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+					require.NoError(t, err)
+					if header != "" {
+						req.Header.Set("Authorization", header)
+					}
+					if cookie != "" {
+						req.AddCookie(&http.Cookie{Name: "accesstoken", Value: cookie})
+					}
+
+					resp, err := http.DefaultClient.Do(req)
+					require.NoError(t, err)
+					_ = resp.Body.Close()
+					return resp.StatusCode
+				}
+
+				t.Run("header only", func(t *testing.T) {
+					require.Equal(t, http.StatusOK, send(t, "Bearer "+pair.Access.Value, ""))
+				})
+
+				t.Run("cookie only", func(t *testing.T) {
+					require.Equal(t, http.StatusOK, send(t, "", pair.Access.Value))
+				})
+
+				t.Run("both present header used", func(t *testing.T) {
+					require.Equal(t, http.StatusOK, send(t, "Bearer "+pair.Access.Value, "not-a-token"))
+					require.Equal(t, http.StatusBadRequest, send(t, "Bearer not-a-token", pair.Access.Value), "invalid header must not fall back to cookie")
+				})
+
+				t.Run("cookie ignored if disabled", func(t *testing.T) {
+					s.accessCookieName = ""
+					defer func() { s.accessCookieName = "accesstoken" }()
+
+					require.Equal(t, http.StatusBadRequest, send(t, "", pair.Access.Value))
+				})
+			})
 		})
 	})
 
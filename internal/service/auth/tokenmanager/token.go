@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -18,8 +20,18 @@ const (
 	defaultAccessTokenTTL  = 15 * time.Minute
 	defaultSigningMethod   = "HS256"
 	defaultRefreshTokenTTL = 24 * time.Hour
+
+	// Refresh token random part length in bytes. Stored hex encoded in varchar(255)
+	defaultRefreshTokenBytes = 16
+	minRefreshTokenBytes     = 16
+	maxRefreshTokenBytes     = 127
+
+	// Shorter HMAC key is guessable. Keys generated with 'gensecret' are long enough
+	MinSecretKeyLen = 32
 )
 
+var ErrWeakSecretKey = errors.New("secret key is too short")
+
 type AccessTokenClaims struct {
 	jwt.RegisteredClaims
 	UserID uuid.UUID `json:"uid"`
@@ -27,31 +39,57 @@ type AccessTokenClaims struct {
 
 // Token manager with sensible default
 type Config struct {
-	// Secret key to sign access token
-	// Required to be set
+	// Secret key to sign access token, at least MinSecretKeyLen bytes
+	// Hex encoded key of at least MinSecretKeyLen bytes (like 'gensecret' output) is decoded, other keys are used as is
+	// Random one is generated if not set, so tokens don't survive restart
 	SecretKey string
 
+	// Accept secret key shorter than MinSecretKeyLen for backward compatibility
+	// Caller is expected to warn about it, see CheckSecretKey
+	AllowWeakKey bool
+
 	// JWT MAC (Message Authentication Code) algorithm
 	// If not set than default is used
 	Alg string
 
+	// Algorithms of access tokens accepted besides Alg, like the previous one while algorithms are switched
+	// Tokens are signed with the same key whatever algorithm is. Only Alg is accepted if empty
+	AcceptedAlgs []string
+
 	// Access and refresh token lifetimes
 	// If not set than default is used
 	AccessTTL  time.Duration
 	RefreshTTL time.Duration
+
+	// Max number of active refresh tokens (sessions) per user
+	// The oldest sessions are revoked when exceeded. Zero means unlimited
+	MaxActiveSessions int
+
+	// Number of random bytes in refresh token, at least 16
+	// If not set than default is used
+	RefreshTokenBytes int
 }
 
 type TokenManager struct {
 	// Secret key to sign access token
-	key string
+	key []byte
 
 	// JWT MAC (Message Authentication Code) algorithm
 	alg jwt.SigningMethod
 
+	// Algorithms of access tokens accepted by parsing, the active one included
+	validAlgs []string
+
 	// Access and refresh token lifetimes
 	accessTTL  time.Duration
 	refreshTTL time.Duration
 
+	// Max active sessions per user, zero means unlimited
+	maxActiveSessions int
+
+	// Refresh token random bytes length
+	refreshTokenBytes int
+
 	// Refresh token repo
 	storage repository.Storage
 }
@@ -61,6 +99,21 @@ func New(cfg Config, storage repository.Storage) (*TokenManager, error) {
 		cfg.Alg = defaultSigningMethod
 	}
 
+	alg, err := hmacMethod(cfg.Alg)
+	if err != nil {
+		return nil, err
+	}
+	validAlgs := []string{alg.Alg()}
+	for _, name := range cfg.AcceptedAlgs {
+		accepted, err := hmacMethod(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(validAlgs, accepted.Alg()) {
+			validAlgs = append(validAlgs, accepted.Alg())
+		}
+	}
+
 	if cfg.SecretKey == "" {
 		key := make([]byte, 32)
 		_, err := rand.Read(key)
@@ -69,6 +122,9 @@ func New(cfg Config, storage repository.Storage) (*TokenManager, error) {
 		}
 		cfg.SecretKey = hex.EncodeToString(key)
 	}
+	if err := CheckSecretKey(cfg.SecretKey); err != nil && !cfg.AllowWeakKey {
+		return nil, err
+	}
 
 	setDefaultDuration := func(field *time.Duration, def time.Duration) {
 		if *field == 0 {
@@ -78,56 +134,127 @@ func New(cfg Config, storage repository.Storage) (*TokenManager, error) {
 	setDefaultDuration(&cfg.AccessTTL, defaultAccessTokenTTL)
 	setDefaultDuration(&cfg.RefreshTTL, defaultRefreshTokenTTL)
 
+	// Access token is renewed with refresh token, so it's useless if it outlives the refresh one
+	if cfg.AccessTTL < 0 || cfg.AccessTTL >= cfg.RefreshTTL {
+		return nil, fmt.Errorf("access token ttl must be positive and less than refresh token ttl: %s, %s", cfg.AccessTTL, cfg.RefreshTTL)
+	}
+
+	if cfg.MaxActiveSessions < 0 {
+		return nil, fmt.Errorf("max active sessions can't be negative: %d", cfg.MaxActiveSessions)
+	}
+
+	if cfg.RefreshTokenBytes == 0 {
+		cfg.RefreshTokenBytes = defaultRefreshTokenBytes
+	}
+	if cfg.RefreshTokenBytes < minRefreshTokenBytes || cfg.RefreshTokenBytes > maxRefreshTokenBytes {
+		return nil, fmt.Errorf("refresh token bytes must be between %d and %d: %d", minRefreshTokenBytes, maxRefreshTokenBytes, cfg.RefreshTokenBytes)
+	}
+
 	return &TokenManager{
-		key:        cfg.SecretKey,
-		alg:        jwt.GetSigningMethod(cfg.Alg),
-		accessTTL:  cfg.AccessTTL,
-		refreshTTL: cfg.RefreshTTL,
-		storage:    storage,
+		key:               decodeSecretKey(cfg.SecretKey),
+		alg:               alg,
+		validAlgs:         validAlgs,
+		accessTTL:         cfg.AccessTTL,
+		refreshTTL:        cfg.RefreshTTL,
+		maxActiveSessions: cfg.MaxActiveSessions,
+		refreshTokenBytes: cfg.RefreshTokenBytes,
+		storage:           storage,
 	}, nil
 }
 
-func (m *TokenManager) GeneratePair(ctx context.Context, user models.User) (models.TokenPair, error) {
+// Check the key is long enough to sign tokens. Returns error wrapping ErrWeakSecretKey otherwise
+func CheckSecretKey(key string) error {
+	if len(key) < MinSecretKeyLen {
+		return fmt.Errorf("%w: %d bytes, at least %d required, generate one with 'gensecret'", ErrWeakSecretKey, len(key), MinSecretKeyLen)
+	}
+	return nil
+}
+
+// Signing method by name. Only HMAC ones are supported as tokens are signed with symmetric key
+func hmacMethod(name string) (jwt.SigningMethod, error) {
+	method, ok := jwt.GetSigningMethod(name).(*jwt.SigningMethodHMAC)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing method %q, HMAC one required (HS256, HS384, HS512)", name)
+	}
+	return method, nil
+}
+
+// Raw bytes of hex encoded key, so all the key entropy is used. Not hex or too short key is used as is
+func decodeSecretKey(key string) []byte {
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) < MinSecretKeyLen {
+		return []byte(key)
+	}
+	return decoded
+}
+
+// Generate access and refresh tokens pair
+// Every pair starts new refresh token family unless family is set with options
+// Nothing is generated or saved if context is already done, so cancelled login leaves no orphan token
+func (m *TokenManager) GeneratePair(ctx context.Context, user models.User, opts ...repository.RefreshTokenOption) (models.TokenPair, error) {
 	var pair models.TokenPair
+	if err := ctx.Err(); err != nil {
+		return pair, fmt.Errorf("token pair generation canceled: %w", err)
+	}
+
 	now := time.Now().Truncate(time.Second)
 	accessExpiresAt := now.Add(m.accessTTL)
 	refreshExpiresAt := now.Add(m.refreshTTL)
 
-	// Generate JWT access token decoded as string
-	accessToken := jwt.NewWithClaims(
-		m.alg,
-		AccessTokenClaims{
-			RegisteredClaims: jwt.RegisteredClaims{
-				ID:        uuid.NewString(),
-				IssuedAt:  jwt.NewNumericDate(now),
-				ExpiresAt: jwt.NewNumericDate(accessExpiresAt),
-			},
-			UserID: user.ID,
-		},
-	)
-	access, err := accessToken.SignedString([]byte(m.key))
+	access, err := m.signAccess(user.ID, now, accessExpiresAt)
 	if err != nil {
-		return pair, fmt.Errorf("error while signing access token. Err: %w", err)
+		return pair, err
 	}
 
-	// Generate random refresh token 16 bytes length
-	b := make([]byte, 16)
+	// Generate random refresh token
+	b := make([]byte, m.refreshTokenBytes)
 	_, err = rand.Read(b)
 	if err != nil {
 		return pair, fmt.Errorf("error while generate refresh token. Err: %w", err)
 	}
 	refresh := hex.EncodeToString(b)
 
-	_, err = m.storage.Refresh().Save(ctx, models.RefreshToken{
+	token := models.RefreshToken{
 		ID:        uuid.New(),
 		UserID:    user.ID,
+		FamilyID:  uuid.New(),
 		Token:     refresh,
-		CreatedAt: now,
+		CreatedAt: time.Now(), // not truncated: sessions are pruned by creation order
 		ExpiresAt: refreshExpiresAt,
 		UsedAt:    nil,
+	}
+	for _, opt := range opts {
+		opt(&token)
+	}
+
+	err = m.storage.InTx(ctx, func(storage repository.Storage) error {
+		_, err := storage.Refresh().Save(ctx, token)
+		if err != nil {
+			return fmt.Errorf("error while saving refresh token. Err: %w", err)
+		}
+
+		if m.maxActiveSessions <= 0 {
+			return nil
+		}
+
+		// Sessions are pruned only over the cap, so usual login doesn't update user's tokens
+		active, err := storage.Refresh().CountActive(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("error while counting active sessions. Err: %w", err)
+		}
+		if active <= m.maxActiveSessions {
+			return nil
+		}
+
+		// Newly created token is the newest one, so only older sessions are revoked
+		_, err = storage.Refresh().PruneActive(ctx, user.ID, m.maxActiveSessions)
+		if err != nil {
+			return fmt.Errorf("error while pruning active sessions. Err: %w", err)
+		}
+		return nil
 	})
 	if err != nil {
-		return pair, fmt.Errorf("error while saving refresh token. Err: %w", err)
+		return pair, err
 	}
 
 	return models.TokenPair{
@@ -136,9 +263,60 @@ func (m *TokenManager) GeneratePair(ctx context.Context, user models.User) (mode
 	}, nil
 }
 
+// Generate short-lived access token valid only for the audience, like "events" stream
+// Scoped token is rejected by ParseAccess, so leaked one can't be used on the main API, and vice versa
+// TTL can't exceed access token one
+func (m *TokenManager) IssueScoped(ctx context.Context, userID uuid.UUID, audience string, ttl time.Duration) (models.IssuedToken, error) {
+	var token models.IssuedToken
+	if audience == "" {
+		return token, errors.New("scoped token audience is required")
+	}
+	if ttl <= 0 || ttl > m.accessTTL {
+		return token, fmt.Errorf("scoped token ttl must be positive and not greater than access token ttl: %s, %s", ttl, m.accessTTL)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	expiresAt := now.Add(ttl)
+	value, err := m.signAccess(userID, now, expiresAt, audience)
+	if err != nil {
+		return token, err
+	}
+	return models.IssuedToken{Value: value, ExpiresAt: expiresAt}, nil
+}
+
+// Generate JWT access token decoded as string
+// Token without audience is the main API one, scoped tokens have it
+func (m *TokenManager) signAccess(userID uuid.UUID, issuedAt time.Time, expiresAt time.Time, audience ...string) (string, error) {
+	accessToken := jwt.NewWithClaims(
+		m.alg,
+		AccessTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        uuid.NewString(),
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+				Audience:  audience,
+			},
+			UserID: userID,
+		},
+	)
+	access, err := accessToken.SignedString(m.key)
+	if err != nil {
+		return "", fmt.Errorf("error while signing access token. Err: %w", err)
+	}
+	return access, nil
+}
+
 // Use token: return if it valid and mark as used
+// Used token presented again means it was likely stolen, so the whole token family is revoked
+// and the user has to login again
 func (m *TokenManager) UseRefresh(ctx context.Context, refresh string) (models.RefreshToken, error) {
 	token, err := m.storage.Refresh().GetAndMarkUsed(ctx, refresh)
+	if errors.Is(err, apperrors.ErrRefreshTokenIsUsed) {
+		if _, revokeErr := m.storage.Refresh().RevokeFamily(ctx, token.FamilyID); revokeErr != nil {
+			return token, fmt.Errorf("error while revoking token family. Err: %w", errors.Join(revokeErr, err))
+		}
+		return token, fmt.Errorf("refresh token reuse detected, family revoked. Err: %w", err)
+	}
 	if err != nil {
 		return token, fmt.Errorf("error while marking token used. Err: %w", err)
 	}
@@ -150,21 +328,74 @@ func (m *TokenManager) UseRefresh(ctx context.Context, refresh string) (models.R
 	return token, nil
 }
 
-// Parse and validate access token
+// List user's sessions: active refresh tokens, the newest first
+func (m *TokenManager) ListSessions(ctx context.Context, userID uuid.UUID) ([]models.RefreshToken, error) {
+	return m.storage.Refresh().ListByUser(ctx, userID)
+}
+
+// Revoke user's session by its refresh token ID
+// The whole token family is revoked, so the session can't be continued with rotated tokens
+// Returns apperrors.ErrSessionNotFound if token not exists or belongs to other user
+func (m *TokenManager) RevokeSession(ctx context.Context, userID uuid.UUID, tokenID uuid.UUID) error {
+	token, err := m.storage.Refresh().GetByID(ctx, tokenID)
+	switch {
+	case errors.Is(err, apperrors.ErrRefreshTokenNotFound):
+		return apperrors.ErrSessionNotFound
+	case err != nil:
+		return fmt.Errorf("error while getting session. Err: %w", err)
+	case token.UserID != userID:
+		return apperrors.ErrSessionNotFound
+	}
+
+	_, err = m.storage.Refresh().RevokeFamily(ctx, token.FamilyID)
+	if err != nil {
+		return fmt.Errorf("error while revoking session. Err: %w", err)
+	}
+	return nil
+}
+
+// Parse and validate access token of the main API. Scoped tokens are rejected
+// Returns apperrors.ErrAccessTokenExpired if token is expired and apperrors.ErrAccessTokenInvalid for any other failure
 func (m *TokenManager) ParseAccess(ctx context.Context, access string) (userID uuid.UUID, err error) {
+	claims, err := m.parse(access)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if len(claims.Audience) > 0 {
+		return uuid.Nil, fmt.Errorf("%w: token is scoped to %v", apperrors.ErrAccessTokenInvalid, claims.Audience)
+	}
+
+	return claims.UserID, nil
+}
+
+// Parse and validate token issued by IssueScoped for the audience
+// Main API access tokens and tokens of other audiences are rejected with apperrors.ErrAccessTokenInvalid
+func (m *TokenManager) ParseScoped(ctx context.Context, token string, audience string) (userID uuid.UUID, err error) {
+	claims, err := m.parse(token, jwt.WithAudience(audience))
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return claims.UserID, nil
+}
+
+func (m *TokenManager) parse(token string, opts ...jwt.ParserOption) (*AccessTokenClaims, error) {
 	claims := &AccessTokenClaims{}
 
-	_, err = jwt.ParseWithClaims(
-		access,
+	_, err := jwt.ParseWithClaims(
+		token,
 		claims,
 		func(t *jwt.Token) (any, error) {
-			return []byte(m.key), nil
+			return m.key, nil
 		},
-		jwt.WithValidMethods([]string{m.alg.Alg()}),
+		append(opts, jwt.WithValidMethods(m.validAlgs))...,
 	)
-	if err != nil {
-		return uuid.Nil, fmt.Errorf("error while parsing or validating token. Err: %w", err)
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, fmt.Errorf("%w: %w", apperrors.ErrAccessTokenExpired, err)
+	case err != nil:
+		return nil, fmt.Errorf("%w: %w", apperrors.ErrAccessTokenInvalid, err)
 	}
 
-	return claims.UserID, nil
+	return claims, nil
 }
@@ -1,6 +1,10 @@
 package tokenmanager
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,7 +15,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/repository/postgres"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 )
@@ -40,7 +46,7 @@ func Test_TokenManager(t *testing.T) {
 	withTx := func(dbpool *pgxpool.Pool, t *testing.T, accessTTL time.Duration, refreshTTL time.Duration, fn func(m *TokenManager)) {
 		testutil.InTx(dbpool, t, func(tx pgx.Tx) {
 			cfg := Config{
-				SecretKey:  "test-secret-key",
+				SecretKey:  "test-secret-key-32-bytes-minimum",
 				AccessTTL:  accessTTL,
 				RefreshTTL: refreshTTL,
 			}
@@ -54,13 +60,73 @@ func Test_TokenManager(t *testing.T) {
 	}
 
 	t.Run("new defaults", func(t *testing.T) {
-		m, err := New(Config{SecretKey: "secret"}, nil)
+		m, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, nil)
 		require.NoError(t, err, "token manager should be created without errors")
 
-		require.Equal(t, "secret", m.key, "secret key should be set")
+		require.Equal(t, []byte("test-secret-key-32-bytes-minimum"), m.key, "secret key should be set")
 		require.Equal(t, defaultAccessTokenTTL, m.accessTTL, "default access token TTL should be set")
 		require.Equal(t, defaultRefreshTokenTTL, m.refreshTTL, "default refresh token TTL")
 		require.Equal(t, defaultSigningMethod, m.alg.Alg(), "default signing method should be set")
+		require.Equal(t, 0, m.maxActiveSessions, "sessions are unlimited by default")
+		require.Equal(t, defaultRefreshTokenBytes, m.refreshTokenBytes, "default refresh token length should be set")
+	})
+
+	t.Run("new secret key length", func(t *testing.T) {
+		m, err := New(Config{}, nil)
+		require.NoError(t, err, "random key has to be generated if not set")
+		require.GreaterOrEqual(t, len(m.key), MinSecretKeyLen)
+
+		_, err = New(Config{SecretKey: "short-secret"}, nil)
+		require.ErrorIs(t, err, ErrWeakSecretKey)
+
+		m, err = New(Config{SecretKey: "short-secret", AllowWeakKey: true}, nil)
+		require.NoError(t, err, "weak key has to be accepted if allowed")
+		require.Equal(t, []byte("short-secret"), m.key)
+
+		_, err = New(Config{SecretKey: strings.Repeat("k", MinSecretKeyLen)}, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("new hex secret key decoded", func(t *testing.T) {
+		// Key is generated the way 'gensecret' does
+		raw := make([]byte, 32)
+		_, err := rand.Read(raw)
+		require.NoError(t, err)
+
+		m, err := New(Config{SecretKey: hex.EncodeToString(raw)}, nil)
+
+		require.NoError(t, err)
+		require.Equal(t, raw, m.key, "hex key has to be decoded to 32 bytes")
+
+		// Hex key decoded to less than min length is used as is
+		short := hex.EncodeToString(raw[:MinSecretKeyLen/2])
+		m, err = New(Config{SecretKey: short}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte(short), m.key)
+	})
+
+	t.Run("new negative max sessions fail", func(t *testing.T) {
+		_, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum", MaxActiveSessions: -1}, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("new refresh token bytes out of range fail", func(t *testing.T) {
+		for _, n := range []int{-1, minRefreshTokenBytes - 1, maxRefreshTokenBytes + 1} {
+			_, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum", RefreshTokenBytes: n}, nil)
+			require.Error(t, err, "refresh token bytes %d should be rejected", n)
+		}
+	})
+
+	t.Run("new access ttl not less than refresh ttl fail", func(t *testing.T) {
+		for _, cfg := range []Config{
+			{SecretKey: "test-secret-key-32-bytes-minimum", AccessTTL: time.Hour, RefreshTTL: time.Hour},
+			{SecretKey: "test-secret-key-32-bytes-minimum", AccessTTL: 2 * time.Hour, RefreshTTL: time.Hour},
+			{SecretKey: "test-secret-key-32-bytes-minimum", AccessTTL: defaultRefreshTokenTTL},
+			{SecretKey: "test-secret-key-32-bytes-minimum", AccessTTL: -time.Minute},
+		} {
+			_, err := New(cfg, nil)
+			require.Error(t, err, "access ttl %s and refresh ttl %s should be rejected", cfg.AccessTTL, cfg.RefreshTTL)
+		}
 	})
 
 	t.Run("GeneratePair", func(t *testing.T) {
@@ -87,7 +153,7 @@ func Test_TokenManager(t *testing.T) {
 
 					// Parse and verify the access token
 					token, err := jwt.ParseWithClaims(pair.Access.Value, &AccessTokenClaims{}, func(token *jwt.Token) (any, error) {
-						return []byte("test-secret-key"), nil
+						return []byte("test-secret-key-32-bytes-minimum"), nil
 					})
 					require.NoError(t, err)
 					require.True(t, token.Valid, "access token should be valid")
@@ -104,6 +170,87 @@ func Test_TokenManager(t *testing.T) {
 			)
 		})
 
+		t.Run("revoke oldest sessions over limit", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				storage := postgres.NewStorage(tx)
+				tokenManager, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum", MaxActiveSessions: 3}, storage)
+				require.NoError(t, err)
+
+				pairs := make([]models.TokenPair, 4)
+				for i := range pairs {
+					pairs[i], err = tokenManager.GeneratePair(t.Context(), testUser)
+					require.NoError(t, err)
+				}
+
+				count, err := storage.Refresh().CountActive(t.Context(), testUser.ID)
+				require.NoError(t, err)
+				require.Equal(t, 3, count, "only max active sessions has to stay active")
+
+				_, err = tokenManager.UseRefresh(t.Context(), pairs[0].Refresh.Value)
+				require.ErrorIs(t, err, apperrors.ErrRefreshTokenRevoked, "the oldest session has to be revoked")
+
+				_, err = tokenManager.UseRefresh(t.Context(), pairs[3].Refresh.Value)
+				require.NoError(t, err, "the newest session has to be active")
+			})
+		})
+
+		t.Run("new family by default or passed one", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				storage := postgres.NewStorage(tx)
+				tokenManager, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, storage)
+				require.NoError(t, err)
+
+				first, err := tokenManager.GeneratePair(t.Context(), testUser)
+				require.NoError(t, err)
+				firstToken, err := storage.Refresh().Get(t.Context(), first.Refresh.Value)
+				require.NoError(t, err)
+
+				rotated, err := tokenManager.GeneratePair(t.Context(), testUser, repository.WithFamilyID(firstToken.FamilyID))
+				require.NoError(t, err)
+				rotatedToken, err := storage.Refresh().Get(t.Context(), rotated.Refresh.Value)
+				require.NoError(t, err)
+				require.Equal(t, firstToken.FamilyID, rotatedToken.FamilyID, "rotated token has to stay in the family")
+
+				other, err := tokenManager.GeneratePair(t.Context(), testUser)
+				require.NoError(t, err)
+				otherToken, err := storage.Refresh().Get(t.Context(), other.Refresh.Value)
+				require.NoError(t, err)
+				require.NotEqual(t, firstToken.FamilyID, otherToken.FamilyID, "new pair has to start new family")
+			})
+		})
+
+		t.Run("refresh token length", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				tokenManager, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum", RefreshTokenBytes: 32}, postgres.NewStorage(tx))
+				require.NoError(t, err)
+
+				pair, err := tokenManager.GeneratePair(t.Context(), testUser)
+				require.NoError(t, err)
+
+				decoded, err := hex.DecodeString(pair.Refresh.Value)
+				require.NoError(t, err, "refresh token has to be hex encoded")
+				require.Len(t, decoded, 32, "refresh token has to be configured bytes length")
+			})
+		})
+
+		t.Run("canceled context saves nothing", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				storage := postgres.NewStorage(tx)
+				tokenManager, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, storage)
+				require.NoError(t, err)
+				ctx, cancel := context.WithCancel(t.Context())
+				cancel()
+
+				pair, err := tokenManager.GeneratePair(ctx, testUser)
+
+				require.ErrorIs(t, err, context.Canceled)
+				require.Empty(t, pair.Refresh.Value)
+				count, err := storage.Refresh().CountActive(t.Context(), testUser.ID)
+				require.NoError(t, err)
+				require.Zero(t, count, "refresh token must not be saved")
+			})
+		})
+
 		t.Run("generate different tokens", func(t *testing.T) {
 			withTx(pg.Pool, t, 15*time.Minute, 24*time.Hour,
 				func(tokenManager *TokenManager) {
@@ -153,8 +300,28 @@ func Test_TokenManager(t *testing.T) {
 			)
 		})
 
+		t.Run("reuse revokes family", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				storage := postgres.NewStorage(tx)
+				tokenManager, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, storage)
+				require.NoError(t, err)
+				pair, err := tokenManager.GeneratePair(t.Context(), testUser)
+				require.NoError(t, err)
+				token, err := tokenManager.UseRefresh(t.Context(), pair.Refresh.Value)
+				require.NoError(t, err)
+				rotated, err := tokenManager.GeneratePair(t.Context(), testUser, repository.WithFamilyID(token.FamilyID))
+				require.NoError(t, err)
+
+				_, err = tokenManager.UseRefresh(t.Context(), pair.Refresh.Value)
+				require.ErrorIs(t, err, apperrors.ErrRefreshTokenIsUsed)
+
+				_, err = tokenManager.UseRefresh(t.Context(), rotated.Refresh.Value)
+				require.ErrorIs(t, err, apperrors.ErrRefreshTokenRevoked, "rotated token has to be revoked with its family")
+			})
+		})
+
 		t.Run("use expired token", func(t *testing.T) {
-			withTx(pg.Pool, t, 1*time.Second, 1*time.Second,
+			withTx(pg.Pool, t, 500*time.Millisecond, 1*time.Second,
 				func(tokenManager *TokenManager) {
 					pair, err := tokenManager.GeneratePair(t.Context(), testUser)
 					require.NoError(t, err)
@@ -170,6 +337,49 @@ func Test_TokenManager(t *testing.T) {
 		})
 	})
 
+	t.Run("RevokeSession", func(t *testing.T) {
+		t.Run("revoke session family", func(t *testing.T) {
+			withTx(pg.Pool, t, 15*time.Minute, 24*time.Hour,
+				func(tokenManager *TokenManager) {
+					pair, err := tokenManager.GeneratePair(t.Context(), testUser)
+					require.NoError(t, err)
+					other, err := tokenManager.GeneratePair(t.Context(), testUser)
+					require.NoError(t, err)
+					sessions, err := tokenManager.ListSessions(t.Context(), testUser.ID)
+					require.NoError(t, err)
+					require.Len(t, sessions, 2)
+					require.Equal(t, other.Refresh.Value, sessions[0].Token, "newest session has to be first")
+
+					err = tokenManager.RevokeSession(t.Context(), testUser.ID, sessions[1].ID)
+
+					require.NoError(t, err)
+					_, err = tokenManager.UseRefresh(t.Context(), pair.Refresh.Value)
+					require.ErrorIs(t, err, apperrors.ErrRefreshTokenRevoked)
+					sessions, err = tokenManager.ListSessions(t.Context(), testUser.ID)
+					require.NoError(t, err)
+					require.Len(t, sessions, 1, "only not revoked session has to stay")
+				},
+			)
+		})
+
+		t.Run("other user session not found", func(t *testing.T) {
+			withTx(pg.Pool, t, 15*time.Minute, 24*time.Hour,
+				func(tokenManager *TokenManager) {
+					pair, err := tokenManager.GeneratePair(t.Context(), testUser)
+					require.NoError(t, err)
+					token, err := tokenManager.storage.Refresh().Get(t.Context(), pair.Refresh.Value)
+					require.NoError(t, err)
+
+					err = tokenManager.RevokeSession(t.Context(), uuid.New(), token.ID)
+					require.ErrorIs(t, err, apperrors.ErrSessionNotFound)
+
+					err = tokenManager.RevokeSession(t.Context(), testUser.ID, uuid.New())
+					require.ErrorIs(t, err, apperrors.ErrSessionNotFound)
+				},
+			)
+		})
+	})
+
 	t.Run("ParseAccess", func(t *testing.T) {
 		t.Run("valid token", func(t *testing.T) {
 			withTx(pg.Pool, t, 15*time.Minute, 24*time.Hour,
@@ -190,12 +400,14 @@ func Test_TokenManager(t *testing.T) {
 					// Parse the valid token
 					_, err := tokenManager.ParseAccess(t.Context(), "invalid token")
 					require.Error(t, err, "parsing even not a token should return an error")
+					require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid)
+					require.NotErrorIs(t, err, apperrors.ErrAccessTokenExpired)
 				},
 			)
 		})
 
 		t.Run("expired token", func(t *testing.T) {
-			withTx(pg.Pool, t, 1*time.Second, 1*time.Second,
+			withTx(pg.Pool, t, 1*time.Second, 2*time.Second,
 				func(tokenManager *TokenManager) {
 					pair, err := tokenManager.GeneratePair(t.Context(), testUser)
 					require.NoError(t, err)
@@ -205,6 +417,8 @@ func Test_TokenManager(t *testing.T) {
 
 					_, err = tokenManager.ParseAccess(t.Context(), pair.Access.Value)
 					require.Error(t, err, "token has to become expired")
+					require.ErrorIs(t, err, apperrors.ErrAccessTokenExpired, "expiry has to be distinguished")
+					require.NotErrorIs(t, err, apperrors.ErrAccessTokenInvalid)
 				},
 			)
 		})
@@ -229,8 +443,132 @@ func Test_TokenManager(t *testing.T) {
 
 					_, err = tokenManager.ParseAccess(t.Context(), access)
 					require.Error(t, err, "Valid token with empty alg must fail")
+					require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid)
 				},
 			)
 		})
 	})
 }
+
+func Test_TokenManager_AcceptedAlgs(t *testing.T) {
+	const key = "test-secret-key-32-bytes-minimum"
+	userID := uuid.New()
+	sign := func(t *testing.T, alg string) string {
+		m, err := New(Config{SecretKey: key, Alg: alg}, nil)
+		require.NoError(t, err)
+		access, err := m.signAccess(userID, time.Now(), time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		return access
+	}
+
+	t.Run("only active alg by default", func(t *testing.T) {
+		m, err := New(Config{SecretKey: key, Alg: "HS512"}, nil)
+		require.NoError(t, err)
+
+		_, err = m.ParseAccess(t.Context(), sign(t, "HS512"))
+		require.NoError(t, err)
+		_, err = m.ParseAccess(t.Context(), sign(t, "HS256"))
+		require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid)
+	})
+
+	t.Run("previous alg accepted while switching", func(t *testing.T) {
+		m, err := New(Config{SecretKey: key, Alg: "HS512", AcceptedAlgs: []string{"HS256"}}, nil)
+		require.NoError(t, err)
+
+		for _, alg := range []string{"HS256", "HS512"} {
+			got, err := m.ParseAccess(t.Context(), sign(t, alg))
+
+			require.NoError(t, err, "token signed with %s has to be accepted", alg)
+			require.Equal(t, userID, got)
+		}
+		_, err = m.ParseAccess(t.Context(), sign(t, "HS384"))
+		require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid, "not listed alg has to be rejected")
+	})
+
+	t.Run("not HMAC alg fail", func(t *testing.T) {
+		for _, cfg := range []Config{
+			{SecretKey: key, Alg: "RS256"},
+			{SecretKey: key, Alg: "unknown"},
+			{SecretKey: key, AcceptedAlgs: []string{"none"}},
+		} {
+			_, err := New(cfg, nil)
+
+			require.Error(t, err, "alg %q, accepted %v has to be rejected", cfg.Alg, cfg.AcceptedAlgs)
+		}
+	})
+}
+
+func Test_TokenManager_Scoped(t *testing.T) {
+	m, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, nil)
+	require.NoError(t, err)
+	userID := uuid.New()
+
+	t.Run("scoped token accepted by its audience only", func(t *testing.T) {
+		scoped, err := m.IssueScoped(t.Context(), userID, "events", time.Minute)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(time.Minute), scoped.ExpiresAt, time.Second)
+
+		got, err := m.ParseScoped(t.Context(), scoped.Value, "events")
+		require.NoError(t, err)
+		require.Equal(t, userID, got)
+
+		_, err = m.ParseScoped(t.Context(), scoped.Value, "other")
+		require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid, "token of other audience has to be rejected")
+
+		_, err = m.ParseAccess(t.Context(), scoped.Value)
+		require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid, "scoped token has to be rejected by main API")
+	})
+
+	t.Run("main API token rejected by audience", func(t *testing.T) {
+		access, err := m.signAccess(userID, time.Now(), time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		_, err = m.ParseScoped(t.Context(), access, "events")
+
+		require.ErrorIs(t, err, apperrors.ErrAccessTokenInvalid)
+	})
+
+	t.Run("invalid scope fail", func(t *testing.T) {
+		for _, tc := range []struct {
+			audience string
+			ttl      time.Duration
+		}{
+			{"", time.Minute},
+			{"events", 0},
+			{"events", m.accessTTL + time.Second},
+		} {
+			_, err := m.IssueScoped(t.Context(), userID, tc.audience, tc.ttl)
+
+			require.Error(t, err, "audience %q and ttl %s have to be rejected", tc.audience, tc.ttl)
+		}
+	})
+}
+
+func BenchmarkTokenManager(b *testing.B) {
+	m, err := New(Config{SecretKey: "test-secret-key-32-bytes-minimum"}, nil)
+	require.NoError(b, err)
+	userID := uuid.New()
+
+	b.Run("sign access", func(b *testing.B) {
+		now := time.Now()
+		for b.Loop() {
+			_, err := m.signAccess(userID, now, now.Add(m.accessTTL))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("parse access", func(b *testing.B) {
+		now := time.Now()
+		access, err := m.signAccess(userID, now, now.Add(m.accessTTL))
+		require.NoError(b, err)
+
+		for b.Loop() {
+			_, err := m.ParseAccess(b.Context(), access)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
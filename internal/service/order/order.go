@@ -3,28 +3,97 @@ package order
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/cache"
+	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository"
+	"github.com/nkiryanov/gophermart/internal/service/audit"
 	"github.com/nkiryanov/gophermart/internal/service/validate"
 )
 
 type OrderService struct {
 	// Repository to access long term data
 	storage repository.Storage
+
+	// Balances cache to invalidate on accrual, nil if caching disabled
+	balances *cache.Cache[uuid.UUID, models.Balance]
+
+	// Logger to audit money movements
+	audit logger.Logger
+
+	// Max orders user may upload, zero means unlimited
+	maxOrdersPerUser int
+
+	// Generate id of new order. Storage default (random UUIDv4) is used if nil
+	newID func() (uuid.UUID, error)
+
+	// How long claimed order is not given to other processors, unless accrual is applied to it earlier
+	claimLease time.Duration
+}
+
+// Long enough for a processor to poll claimed batch usually. Claim of failed poll is not released,
+// so it's also the shortest pause before the order is polled again
+const defaultClaimLease = time.Minute
+
+type Option func(*OrderService)
+
+// Invalidate user's cached balance when accrual is credited
+func WithBalanceCache(c *cache.Cache[uuid.UUID, models.Balance]) Option {
+	return func(s *OrderService) {
+		s.balances = c
+	}
+}
+
+// Log every committed accrual to audit logger
+func WithAuditLogger(l logger.Logger) Option {
+	return func(s *OrderService) {
+		s.audit = l
+	}
+}
+
+// Limit orders user may upload, zero means unlimited
+func WithMaxOrdersPerUser(n int) Option {
+	return func(s *OrderService) {
+		s.maxOrdersPerUser = n
+	}
+}
+
+// Generate time sortable UUIDv7 ids of new orders, so index on ids grows in order of uploads
+// Existing random ids are kept, so it's safe to switch on for existing data
+func WithSortableIDs() Option {
+	return func(s *OrderService) {
+		s.newID = uuid.NewV7
+	}
 }
 
-func NewService(storage repository.Storage) *OrderService {
-	return &OrderService{
-		storage: storage,
+// Set how long claimed order is not given to other processors. Orders of crashed processor are polled after it
+func WithClaimLease(lease time.Duration) Option {
+	return func(s *OrderService) {
+		s.claimLease = lease
 	}
 }
 
+func NewService(storage repository.Storage, opts ...Option) *OrderService {
+	s := &OrderService{
+		storage:    storage,
+		audit:      logger.NewNoOpLogger(),
+		claimLease: defaultClaimLease,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
 type OrderOption func(*models.Order)
 
 func (s *OrderService) CreateOrder(ctx context.Context, number string, user *models.User, opts ...repository.CreateOrderOption) (models.Order, error) {
@@ -32,20 +101,280 @@ func (s *OrderService) CreateOrder(ctx context.Context, number string, user *mod
 	if err != nil {
 		return models.Order{}, apperrors.ErrOrderNumberInvalid
 	}
+
+	if s.maxOrdersPerUser > 0 {
+		count, err := s.storage.Order().CountOrders(ctx, user.ID)
+		if err != nil {
+			return models.Order{}, fmt.Errorf("can't count user orders: %w", err)
+		}
+		// Uploaded already order is reported as usual even if the limit is reached
+		if count >= s.maxOrdersPerUser {
+			_, err := s.storage.Order().GetOrder(ctx, number, false)
+			if errors.Is(err, apperrors.ErrOrderNotFound) {
+				return models.Order{}, apperrors.ErrOrderLimitExceeded
+			}
+		}
+	}
+
+	if s.newID != nil {
+		id, err := s.newID()
+		if err != nil {
+			return models.Order{}, fmt.Errorf("can't generate order id: %w", err)
+		}
+		// Id goes first, so options of caller may still override it
+		opts = append([]repository.CreateOrderOption{repository.WithOrderID(id)}, opts...)
+	}
+
 	return s.storage.Order().CreateOrder(ctx, number, user.ID, opts...)
 }
 
+// GetOrder returns order by its number if it belongs to the user
+// Orders of other users are reported as not found to not leak their existence
+func (s *OrderService) GetOrder(ctx context.Context, number string, userID uuid.UUID) (models.Order, error) {
+	order, err := s.storage.Order().GetOrder(ctx, number, false)
+	if err != nil {
+		return models.Order{}, err
+	}
+	if order.UserID != userID {
+		return models.Order{}, apperrors.ErrOrderNotFound
+	}
+	return order, nil
+}
+
 func (s *OrderService) ListOrders(ctx context.Context, opts repository.ListOrdersOpts) ([]models.Order, error) {
 	return s.storage.Order().ListOrders(ctx, opts)
 }
 
-func (s *OrderService) SetProcessed(ctx context.Context, number string, newStatus string, accrual *decimal.Decimal) (models.Order, error) {
+// Get up to limit orders waiting for accrual, the oldest first, and claim them for the lease
+// Orders claimed by other processors are skipped till accrual is applied to them or the lease expires
+func (s *OrderService) ClaimOrders(ctx context.Context, limit int) ([]models.Order, error) {
+	return s.storage.Order().ClaimOrdersForProcessing(ctx, limit, s.claimLease)
+}
+
+// Count all user's orders
+func (s *OrderService) CountOrders(ctx context.Context, userID uuid.UUID) (int, error) {
+	return s.storage.Order().CountOrders(ctx, userID)
+}
+
+func (s *OrderService) ForEachOrder(ctx context.Context, opts repository.ListOrdersOpts, fn func(models.Order) error) error {
+	return s.storage.Order().ForEachOrder(ctx, opts, fn)
+}
+
+// Set orders that are still waiting for accrual but uploaded before the time to INVALID
+// Reprocessed orders are aged from the last reprocess instead, so they are not retired right after it
+// Retired orders are never credited, so user's balance is not touched
+func (s *OrderService) RetireOrders(ctx context.Context, uploadedBefore time.Time) ([]models.Order, error) {
+	return s.storage.Order().RetireOrders(ctx,
+		[]string{models.OrderStatusNew, models.OrderStatusProcessing},
+		uploadedBefore,
+		models.OrderStatusInvalid,
+	)
+}
+
+// List order polling states saved by SavePollStates
+func (s *OrderService) ListPollStates(ctx context.Context) ([]models.OrderPollState, error) {
+	return s.storage.Order().ListPollStates(ctx)
+}
+
+// Replace saved order polling states with the ones, so only the latest checkpoint is kept
+func (s *OrderService) SavePollStates(ctx context.Context, states []models.OrderPollState) error {
+	return s.storage.InTx(ctx, func(storage repository.Storage) error {
+		if err := storage.Order().DeletePollStates(ctx); err != nil {
+			return err
+		}
+		return storage.Order().SavePollStates(ctx, states)
+	})
+}
+
+// Reset INVALID order to NEW, so order processor polls it again. It's admin only action, so it's audited
+// Returns apperrors.ErrOrderNotReprocessable if the order is in any other status
+func (s *OrderService) ReprocessOrder(ctx context.Context, number string, admin string) (models.Order, error) {
 	var order models.Order
+	var previousStatus string
+
+	err := s.storage.InTx(ctx, func(storage repository.Storage) error {
+		var err error
+
+		order, err = storage.Order().GetOrder(ctx, number, true)
+		if err != nil {
+			return err
+		}
+		if !models.CanReprocess(order.Status) {
+			return apperrors.ErrOrderNotReprocessable
+		}
 
+		previousStatus = order.Status
+		newStatus := models.OrderStatusNew
+		order, err = storage.Order().UpdateOrder(ctx, number, repository.UpdateOrderOpts{Status: &newStatus})
+		if err != nil {
+			return err
+		}
+		// Order is typically old, so it would be retired by the next cycle otherwise
+		if err := storage.Order().SetOrderReprocessed(ctx, number, time.Now()); err != nil {
+			return err
+		}
+		// Claim left by the processor that gave up the order must not delay polling it again
+		return storage.Order().ReleaseOrderClaims(ctx, []string{number})
+	})
+	if err != nil {
+		return order, err
+	}
+
+	audit.OrderReprocessed(s.audit, order, previousStatus, admin)
+	return order, nil
+}
+
+// Apply accrual service result to the order atomically: update order status and accrual and credit user's balance
+// Only positive accrual of PROCESSED order is credited. Returns apperrors.ErrOrderAlreadyProcessed if the order is in final status already
+func (s *OrderService) ApplyAccrual(ctx context.Context, number string, status string, accrual decimal.Decimal) error {
+	if accrual.IsNegative() {
+		return errors.New("accrual can't be negative")
+	}
+
+	_, err := s.applyStatus(ctx, number, status, accrualOf(status, accrual))
+	return err
+}
+
+// Accrual to store with the order for the accrual service result, nil if the order has none yet
+// Accrual is final only for PROCESSED order, so order is credited once. Accrual reported with any other status is ignored
+// Processed order always has accrual, even zero one, but only positive one is credited
+func accrualOf(status string, accrual decimal.Decimal) *decimal.Decimal {
+	if status != models.OrderStatusProcessed {
+		return nil
+	}
+	return &accrual
+}
+
+// Apply accrual results of user's orders in one transaction. Every order is updated and credited with own ledger
+// transaction, but user's balance is locked and updated only once with the sum of accruals
+// Orders in final status already are skipped. The whole batch fails if any order belongs to other user
+func (s *OrderService) ApplyAccruals(ctx context.Context, userID uuid.UUID, results []models.AccrualResult) error {
+	for _, r := range results {
+		if r.Accrual.IsNegative() {
+			return fmt.Errorf("accrual of order %s can't be negative", r.OrderNumber)
+		}
+		if !models.IsValidOrderStatus(r.Status) {
+			return fmt.Errorf("unknown order status %q", r.Status)
+		}
+	}
+	// Orders are locked in the same order by every batch, so concurrent batches don't deadlock
+	results = slices.SortedFunc(slices.Values(results), func(a, b models.AccrualResult) int {
+		return strings.Compare(a.OrderNumber, b.OrderNumber)
+	})
+
+	// Credited transactions with balances they resulted in, so every one is audited with own balance
+	var credited []models.Transaction
+	var balances []models.Balance
+
+	err := s.storage.InTx(ctx, func(storage repository.Storage) error {
+		credited = credited[:0]
+		balances = balances[:0]
+
+		// Orders are locked before balance, the same as single accrual is applied
+		orders := make([]models.Order, len(results))
+		for i, r := range results {
+			order, err := storage.Order().GetOrder(ctx, r.OrderNumber, true)
+			if err != nil {
+				return err
+			}
+			if order.UserID != userID {
+				return fmt.Errorf("order %s belongs to other user", r.OrderNumber)
+			}
+			orders[i] = order
+		}
+		balance, err := storage.Balance().GetBalance(ctx, userID, true)
+		if err != nil {
+			return err
+		}
+
+		total := decimal.Zero
+		for i, r := range results {
+			if models.IsTerminalStatus(orders[i].Status) {
+				continue
+			}
+			if !models.CanTransition(orders[i].Status, r.Status) {
+				return fmt.Errorf("order status can't change from %s to %s", orders[i].Status, r.Status)
+			}
+
+			accrual := accrualOf(r.Status, r.Accrual)
+			_, err = storage.Order().UpdateOrder(ctx, r.OrderNumber, repository.UpdateOrderOpts{
+				Status:  &r.Status,
+				Accrual: accrual,
+			})
+			if err != nil {
+				return err
+			}
+			if accrual == nil || !accrual.IsPositive() {
+				continue
+			}
+
+			t, err := models.NewAccrual(userID, r.OrderNumber, *accrual)
+			if err != nil {
+				return err
+			}
+			t, err = storage.Balance().CreateTransaction(ctx, t)
+			if err != nil {
+				return err
+			}
+			total = total.Add(t.Amount)
+			balance.Current = balance.Current.Add(t.Amount)
+			credited = append(credited, t)
+			balances = append(balances, balance)
+		}
+
+		// Orders are polled again by the next cycle if they are still waiting for accrual
+		numbers := make([]string, len(results))
+		for i, r := range results {
+			numbers[i] = r.OrderNumber
+		}
+		if err := storage.Order().ReleaseOrderClaims(ctx, numbers); err != nil {
+			return err
+		}
+
+		if total.IsZero() {
+			return nil
+		}
+		// Ledger has transaction per order already, balance only needs their sum
+		_, err = storage.Balance().UpdateBalance(ctx, models.Transaction{
+			UserID: userID,
+			Type:   models.TransactionTypeAccrual,
+			Amount: total,
+		})
+		return err
+	})
+	if s.balances != nil && len(credited) > 0 {
+		s.balances.Delete(userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, t := range credited {
+		audit.Transaction(ctx, s.audit, t, balances[i])
+	}
+	return nil
+}
+
+func (s *OrderService) SetProcessed(ctx context.Context, number string, newStatus string, accrual *decimal.Decimal) (models.Order, error) {
 	if accrual != nil && accrual.IsNegative() {
-		return order, errors.New("accrual can't be negative")
+		return models.Order{}, errors.New("accrual can't be negative")
 	}
 
+	return s.applyStatus(ctx, number, newStatus, accrual)
+}
+
+// Lock order and user's balance, update order and credit the balance with accrual if set
+// Zero accrual is stored with the order, but nothing is credited
+func (s *OrderService) applyStatus(ctx context.Context, number string, newStatus string, accrual *decimal.Decimal) (models.Order, error) {
+	if !models.IsValidOrderStatus(newStatus) {
+		return models.Order{}, fmt.Errorf("unknown order status %q", newStatus)
+	}
+	credit := accrual != nil && accrual.IsPositive()
+
+	var order models.Order
+	var t models.Transaction
+	var balance models.Balance
+
 	err := s.storage.InTx(ctx, func(storage repository.Storage) error {
 		var err error
 
@@ -59,9 +388,12 @@ func (s *OrderService) SetProcessed(ctx context.Context, number string, newStatu
 			return err
 		}
 
-		if order.Status == models.OrderStatusProcessed || order.Status == models.OrderStatusInvalid {
+		if models.IsTerminalStatus(order.Status) {
 			return apperrors.ErrOrderAlreadyProcessed
 		}
+		if !models.CanTransition(order.Status, newStatus) {
+			return fmt.Errorf("order status can't change from %s to %s", order.Status, newStatus)
+		}
 
 		// Update order status and accrual
 		order, err = storage.Order().UpdateOrder(ctx, number, repository.UpdateOrderOpts{
@@ -71,21 +403,22 @@ func (s *OrderService) SetProcessed(ctx context.Context, number string, newStatu
 		if err != nil {
 			return err
 		}
+		// Order is polled again by the next cycle if it's still waiting for accrual
+		if err := storage.Order().ReleaseOrderClaims(ctx, []string{number}); err != nil {
+			return err
+		}
 
-		// Update user balance if accrual is set
-		if accrual != nil {
-			t, err := storage.Balance().CreateTransaction(ctx, models.Transaction{
-				ID:          uuid.New(),
-				ProcessedAt: time.Now(),
-				UserID:      order.UserID,
-				OrderNumber: order.Number,
-				Type:        models.TransactionTypeAccrual,
-				Amount:      *accrual,
-			})
+		// Update user balance if there is something to credit
+		if credit {
+			t, err = models.NewAccrual(order.UserID, order.Number, *accrual)
 			if err != nil {
 				return err
 			}
-			_, err = storage.Balance().UpdateBalance(ctx, t)
+			t, err = storage.Balance().CreateTransaction(ctx, t)
+			if err != nil {
+				return err
+			}
+			balance, err = storage.Balance().UpdateBalance(ctx, t)
 			if err != nil {
 				return err
 			}
@@ -93,9 +426,17 @@ func (s *OrderService) SetProcessed(ctx context.Context, number string, newStatu
 
 		return nil
 	})
+	if s.balances != nil && credit && order.UserID != uuid.Nil {
+		s.balances.Delete(order.UserID)
+	}
 	if err != nil {
 		return order, err
 	}
 
+	// Only committed accruals are audited
+	if credit {
+		audit.Transaction(ctx, s.audit, t, balance)
+	}
+
 	return order, nil
 }
@@ -1,20 +1,74 @@
 package order
 
 import (
+	"bytes"
+	"context"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/cache"
+	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/repository/postgres"
+	"github.com/nkiryanov/gophermart/internal/service/accrual"
+	"github.com/nkiryanov/gophermart/internal/service/orderprocessor"
 	"github.com/nkiryanov/gophermart/internal/service/user"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 )
 
+// Storage counting balance updates, including ones made in transactions
+type countingBalanceStorage struct {
+	repository.Storage
+	updates *int
+}
+
+func (s countingBalanceStorage) Balance() repository.BalanceRepo {
+	return countingBalanceRepo{s.Storage.Balance(), s.updates}
+}
+
+func (s countingBalanceStorage) InTx(ctx context.Context, fn func(repository.Storage) error, opts ...repository.TxOption) error {
+	return s.Storage.InTx(ctx, func(storage repository.Storage) error {
+		return fn(countingBalanceStorage{storage, s.updates})
+	}, opts...)
+}
+
+type countingBalanceRepo struct {
+	repository.BalanceRepo
+	updates *int
+}
+
+func (r countingBalanceRepo) UpdateBalance(ctx context.Context, t models.Transaction) (models.Balance, error) {
+	*r.updates++
+	return r.BalanceRepo.UpdateBalance(ctx, t)
+}
+
+// Logger that keeps attributes of info records
+type auditLogger struct {
+	records []map[string]any
+}
+
+func (l *auditLogger) Info(msg string, args ...any) {
+	record := map[string]any{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		record[args[i].(string)] = args[i+1]
+	}
+	l.records = append(l.records, record)
+}
+func (l *auditLogger) Debug(msg string, args ...any)       {}
+func (l *auditLogger) Warn(msg string, args ...any)        {}
+func (l *auditLogger) Error(msg string, args ...any)       {}
+func (l *auditLogger) With(args ...any) logger.Logger      { return l }
+func (l *auditLogger) WithGroup(name string) logger.Logger { return l }
+
 func TestOrder(t *testing.T) {
 	t.Parallel()
 
@@ -88,6 +142,92 @@ func TestOrder(t *testing.T) {
 		})
 	})
 
+	t.Run("CreateOrder sortable ids", func(t *testing.T) {
+		withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+			s = NewService(s.storage, WithSortableIDs())
+
+			var ids []uuid.UUID
+			for _, number := range []string{"17893729974", "2377225624", "4561261212345467"} {
+				order, err := s.CreateOrder(t.Context(), number, user)
+				require.NoError(t, err)
+
+				stored, err := s.GetOrder(t.Context(), number, user.ID)
+				require.NoError(t, err)
+				require.Equal(t, order.ID, stored.ID, "generated id has to be stored")
+				require.Equal(t, uuid.Version(7), stored.ID.Version())
+				ids = append(ids, stored.ID)
+			}
+
+			require.True(t, slices.IsSortedFunc(ids, func(a, b uuid.UUID) int {
+				return bytes.Compare(a[:], b[:])
+			}), "ids have to grow in order of creation: %v", ids)
+
+			// Repeated upload is reported as usual though new id is generated for it
+			_, err := s.CreateOrder(t.Context(), "17893729974", user)
+			require.ErrorIs(t, err, apperrors.ErrOrderAlreadyExists)
+		})
+	})
+
+	t.Run("CreateOrder limited", func(t *testing.T) {
+		t.Run("create up to limit", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, yaUser *models.User) {
+				WithMaxOrdersPerUser(2)(s)
+
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				_, err = s.CreateOrder(t.Context(), "2377225624", user)
+				require.NoError(t, err, "order within limit has to be created")
+
+				_, err = s.CreateOrder(t.Context(), "4561261212345467", user)
+
+				require.ErrorIs(t, err, apperrors.ErrOrderLimitExceeded)
+				_, err = s.CreateOrder(t.Context(), "4561261212345467", yaUser)
+				require.NoError(t, err, "limit is per user")
+			})
+		})
+
+		t.Run("uploaded order reported as usual", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, yaUser *models.User) {
+				WithMaxOrdersPerUser(1)(s)
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				_, err = s.CreateOrder(t.Context(), "2377225624", yaUser)
+				require.NoError(t, err)
+
+				_, err = s.CreateOrder(t.Context(), "17893729974", user)
+				require.ErrorIs(t, err, apperrors.ErrOrderAlreadyExists)
+
+				_, err = s.CreateOrder(t.Context(), "2377225624", user)
+				require.ErrorIs(t, err, apperrors.ErrOrderNumberTaken)
+			})
+		})
+	})
+
+	t.Run("GetOrder", func(t *testing.T) {
+		t.Run("get own order ok", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				created, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err, "creating order should not fail")
+
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+
+				require.NoError(t, err, "getting own order should not fail")
+				require.Equal(t, created.ID, order.ID, "order has to be the same")
+			})
+		})
+
+		t.Run("order of other user not found", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, yaUser *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err, "creating order should not fail")
+
+				_, err = s.GetOrder(t.Context(), "17893729974", yaUser.ID)
+
+				require.ErrorIs(t, err, apperrors.ErrOrderNotFound, "order of other user has to be hidden")
+			})
+		})
+	})
+
 	t.Run("SetProcessed", func(t *testing.T) {
 		t.Run("order can be set to processed", func(t *testing.T) {
 			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
@@ -106,6 +246,26 @@ func TestOrder(t *testing.T) {
 			})
 		})
 
+		t.Run("zero accrual not credited", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				updatedOrder, err := s.SetProcessed(t.Context(), "17893729974", models.OrderStatusProcessed, &decimal.Zero)
+
+				require.NoError(t, err, "order without accrual has to be processed")
+				require.Equal(t, models.OrderStatusProcessed, updatedOrder.Status)
+				require.NotNil(t, updatedOrder.Accrual)
+				require.True(t, updatedOrder.Accrual.IsZero(), "zero accrual has to be stored")
+				balance, err := s.storage.Balance().GetBalance(t.Context(), user.ID, false)
+				require.NoError(t, err)
+				require.True(t, balance.Current.IsZero())
+				ts, err := s.storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeAccrual}, repository.Page{})
+				require.NoError(t, err)
+				require.Empty(t, ts, "nothing has to be credited")
+			})
+		})
+
 		t.Run("order in invalid status cannot be updated", func(t *testing.T) {
 			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
 				// Create order first
@@ -118,5 +278,482 @@ func TestOrder(t *testing.T) {
 				require.ErrorIs(t, err, apperrors.ErrOrderAlreadyProcessed, "should return ErrOrderAlreadyProcessed error")
 			})
 		})
+
+		t.Run("order status cannot move backward", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				order, err := s.CreateOrder(t.Context(), "17893729974", user, repository.WithOrderStatus(models.OrderStatusProcessing))
+				require.NoError(t, err)
+
+				_, err = s.SetProcessed(t.Context(), order.Number, models.OrderStatusNew, nil)
+
+				require.Error(t, err)
+				order, err = s.GetOrder(t.Context(), order.Number, user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusProcessing, order.Status, "order status must not be changed")
+			})
+		})
+	})
+	t.Run("ReprocessOrder", func(t *testing.T) {
+		t.Run("invalid order polled again", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user, repository.WithOrderStatus(models.OrderStatusInvalid))
+				require.NoError(t, err)
+				amount := decimal.RequireFromString("100")
+				client := testutil.AccrualClientMap(map[string]accrual.OrderAccrual{
+					"17893729974": {OrderNumber: "17893729974", Status: accrual.StatusProcessed, Accrual: &amount},
+				})
+				processor := orderprocessor.New(orderprocessor.Config{}, client, logger.NewNoOpLogger(), s)
+
+				err = processor.RunOnce(t.Context())
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusInvalid, order.Status, "invalid order must not be polled")
+
+				order, err = s.ReprocessOrder(t.Context(), "17893729974", "admin")
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusNew, order.Status)
+
+				err = processor.RunOnce(t.Context())
+				require.NoError(t, err)
+				order, err = s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusProcessed, order.Status, "reprocessed order has to be polled again")
+				require.NotNil(t, order.Accrual)
+				require.Equal(t, "100", order.Accrual.String())
+			})
+		})
+
+		t.Run("old reprocessed order not retired", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user,
+					repository.WithOrderStatus(models.OrderStatusInvalid),
+					repository.WithUploadedAt(time.Now().Add(-40*24*time.Hour)),
+				)
+				require.NoError(t, err)
+				amount := decimal.RequireFromString("100")
+				client := testutil.AccrualClientMap(map[string]accrual.OrderAccrual{
+					"17893729974": {OrderNumber: "17893729974", Status: accrual.StatusProcessed, Accrual: &amount},
+				})
+				processor := orderprocessor.New(orderprocessor.Config{OrderMaxAge: 30 * 24 * time.Hour}, client, logger.NewNoOpLogger(), s)
+
+				_, err = s.ReprocessOrder(t.Context(), "17893729974", "admin")
+				require.NoError(t, err)
+				err = processor.RunOnce(t.Context())
+
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusProcessed, order.Status, "reprocessed order has to be polled instead of retired")
+
+				// Reprocessed order is retired once it's old since the reprocess
+				_, err = s.CreateOrder(t.Context(), "2377225624", user,
+					repository.WithOrderStatus(models.OrderStatusInvalid),
+					repository.WithUploadedAt(time.Now().Add(-40*24*time.Hour)),
+				)
+				require.NoError(t, err)
+				_, err = s.ReprocessOrder(t.Context(), "2377225624", "admin")
+				require.NoError(t, err)
+				retired, err := s.RetireOrders(t.Context(), time.Now().Add(time.Minute))
+				require.NoError(t, err)
+				require.Len(t, retired, 1)
+				require.Equal(t, "2377225624", retired[0].Number)
+			})
+		})
+
+		t.Run("not invalid order fail", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				for number, status := range map[string]string{
+					"17893729974": models.OrderStatusProcessed,
+					"2377225624":  models.OrderStatusProcessing,
+				} {
+					_, err := s.CreateOrder(t.Context(), number, user, repository.WithOrderStatus(status))
+					require.NoError(t, err)
+
+					_, err = s.ReprocessOrder(t.Context(), number, "admin")
+
+					require.ErrorIs(t, err, apperrors.ErrOrderNotReprocessable)
+					order, err := s.GetOrder(t.Context(), number, user.ID)
+					require.NoError(t, err)
+					require.Equal(t, status, order.Status, "order status must not be changed")
+				}
+			})
+		})
+
+		t.Run("not existed order fail", func(t *testing.T) {
+			withTx(t, func(s *OrderService, _ *models.User, _ *models.User) {
+				_, err := s.ReprocessOrder(t.Context(), "17893729974", "admin")
+
+				require.ErrorIs(t, err, apperrors.ErrOrderNotFound)
+			})
+		})
+	})
+
+	t.Run("RetireOrders", func(t *testing.T) {
+		withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+			_, err := s.CreateOrder(t.Context(), "17893729974", user,
+				repository.WithOrderStatus(models.OrderStatusProcessing),
+				repository.WithUploadedAt(time.Now().Add(-40*24*time.Hour)),
+			)
+			require.NoError(t, err)
+			_, err = s.CreateOrder(t.Context(), "2377225624", user)
+			require.NoError(t, err)
+
+			retired, err := s.RetireOrders(t.Context(), time.Now().Add(-30*24*time.Hour))
+
+			require.NoError(t, err)
+			require.Len(t, retired, 1)
+			require.Equal(t, "17893729974", retired[0].Number)
+			require.Equal(t, models.OrderStatusInvalid, retired[0].Status, "old order has to be set to terminal status")
+
+			fresh, err := s.GetOrder(t.Context(), "2377225624", user.ID)
+			require.NoError(t, err)
+			require.Equal(t, models.OrderStatusNew, fresh.Status, "fresh order has to be polled further")
+		})
+	})
+
+	t.Run("ClaimOrders", func(t *testing.T) {
+		withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+			_, err := s.CreateOrder(t.Context(), "17893729974", user, repository.WithUploadedAt(time.Now().Add(-time.Hour)))
+			require.NoError(t, err)
+			_, err = s.CreateOrder(t.Context(), "2377225624", user, repository.WithOrderStatus(models.OrderStatusProcessed))
+			require.NoError(t, err)
+
+			claimed, err := s.ClaimOrders(t.Context(), 10)
+
+			require.NoError(t, err)
+			require.Len(t, claimed, 1, "only orders waiting for accrual have to be claimed")
+			require.Equal(t, "17893729974", claimed[0].Number)
+		})
+	})
+
+	t.Run("ClaimOrders by concurrent processors", func(t *testing.T) {
+		// Services over pool, so every claim is committed on its own like processors in different instances do
+		first := NewService(postgres.NewStorage(pg.Pool))
+		second := NewService(postgres.NewStorage(pg.Pool))
+		u, err := user.NewService(user.DefaultHasher, postgres.NewStorage(pg.Pool)).CreateUser(t.Context(), "claim-user", "password123")
+		require.NoError(t, err)
+		// Orders are committed, so their numbers differ from ones of other tests
+		numbers := []string{"77700000001", "77700000019", "77700000027"}
+		for _, number := range numbers {
+			_, err := first.CreateOrder(t.Context(), number, &u)
+			require.NoError(t, err)
+		}
+		amount := decimal.NewFromInt(100)
+		processed := accrual.OrderAccrual{Status: accrual.StatusProcessed, Accrual: &amount}
+
+		// First processor is stuck polling its batch till the second one completes its cycle
+		polling := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+		firstPolled := make(chan string, len(numbers))
+		firstClient := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			once.Do(func() {
+				close(polling)
+				<-release
+			})
+			firstPolled <- number
+			return processed, nil
+		})
+		var secondPolled []string
+		secondClient := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			secondPolled = append(secondPolled, number)
+			return processed, nil
+		})
+
+		firstDone := make(chan error)
+		go func() {
+			firstDone <- orderprocessor.New(orderprocessor.Config{}, firstClient, logger.NewNoOpLogger(), first).RunOnce(t.Context())
+		}()
+		<-polling
+		err = orderprocessor.New(orderprocessor.Config{}, secondClient, logger.NewNoOpLogger(), second).RunOnce(t.Context())
+		require.NoError(t, err)
+		close(release)
+		require.NoError(t, <-firstDone)
+		close(firstPolled)
+
+		require.Empty(t, secondPolled, "orders claimed by other processor must not be polled")
+		var polled []string
+		for number := range firstPolled {
+			polled = append(polled, number)
+		}
+		require.ElementsMatch(t, numbers, polled)
+		for _, number := range numbers {
+			order, err := first.GetOrder(t.Context(), number, u.ID)
+			require.NoError(t, err)
+			require.Equal(t, models.OrderStatusProcessed, order.Status)
+		}
+	})
+
+	t.Run("ApplyAccrual", func(t *testing.T) {
+		// Get user's current balance and number of accrual transactions
+		balanceOf := func(t *testing.T, s *OrderService, user *models.User) (decimal.Decimal, int) {
+			balance, err := s.storage.Balance().GetBalance(t.Context(), user.ID, false)
+			require.NoError(t, err)
+			ts, err := s.storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeAccrual}, repository.Page{})
+			require.NoError(t, err)
+			return balance.Current, len(ts)
+		}
+
+		t.Run("order updated and balance credited", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.RequireFromString("100.50"))
+
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusProcessed, order.Status)
+				require.True(t, order.Accrual.Equal(decimal.RequireFromString("100.50")))
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.Equal(decimal.RequireFromString("100.50")), "balance has to be credited")
+				require.Equal(t, 1, count, "accrual transaction has to be created")
+			})
+		})
+
+		t.Run("zero accrual not credited", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessing, decimal.Zero)
+
+				require.NoError(t, err)
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.IsZero())
+				require.Equal(t, 0, count, "no transaction for zero accrual")
+			})
+		})
+
+		t.Run("processed order with zero accrual", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.Zero)
+
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.NotNil(t, order.Accrual, "processed order has to store accrual even if it's zero")
+				require.True(t, order.Accrual.IsZero())
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.IsZero())
+				require.Equal(t, 0, count, "zero accrual must not be credited")
+			})
+		})
+
+		t.Run("accrual of processing order credited once processed", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessing, decimal.NewFromInt(100))
+				require.NoError(t, err)
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.IsZero(), "accrual of not processed order must not be credited")
+				require.Equal(t, 0, count)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(100))
+
+				require.NoError(t, err)
+				current, count = balanceOf(t, s, user)
+				require.True(t, current.Equal(decimal.NewFromInt(100)), "balance must be credited only once")
+				require.Equal(t, 1, count)
+			})
+		})
+
+		t.Run("accrual of invalid order not credited", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusInvalid, decimal.NewFromInt(100))
+
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusInvalid, order.Status)
+				require.Nil(t, order.Accrual)
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.IsZero())
+				require.Equal(t, 0, count)
+			})
+		})
+
+		t.Run("already processed order is not changed", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(100))
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(100))
+
+				require.ErrorIs(t, err, apperrors.ErrOrderAlreadyProcessed)
+				current, count := balanceOf(t, s, user)
+				require.True(t, current.Equal(decimal.NewFromInt(100)), "balance must be credited only once")
+				require.Equal(t, 1, count)
+			})
+		})
+
+		t.Run("cached balance invalidated", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				balances := cache.New[uuid.UUID, models.Balance](time.Hour)
+				WithBalanceCache(balances)(s)
+				balances.Set(user.ID, models.Balance{UserID: user.ID}, balances.Generation())
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(100))
+
+				require.NoError(t, err)
+				_, ok := balances.Get(user.ID)
+				require.False(t, ok, "credited balance has to be dropped from cache")
+			})
+		})
+
+		t.Run("negative accrual fail", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(-1))
+
+				require.Error(t, err)
+			})
+		})
+	})
+
+	t.Run("ApplyAccruals", func(t *testing.T) {
+		t.Run("balance credited once with sum", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				updates := 0
+				s.storage = countingBalanceStorage{s.storage, &updates}
+				for _, number := range []string{"17893729974", "2377225624", "4561261212345467"} {
+					_, err := s.CreateOrder(t.Context(), number, user)
+					require.NoError(t, err)
+				}
+
+				err := s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: decimal.RequireFromString("100.5")},
+					{OrderNumber: "2377225624", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(50)},
+					{OrderNumber: "4561261212345467", Status: models.OrderStatusProcessing},
+				})
+
+				require.NoError(t, err)
+				require.Equal(t, 1, updates, "balance has to be updated once for the batch")
+				balance, err := s.storage.Balance().GetBalance(t.Context(), user.ID, false)
+				require.NoError(t, err)
+				require.True(t, balance.Current.Equal(decimal.RequireFromString("150.5")), "balance has to be credited with sum, got %s", balance.Current)
+				ts, err := s.storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeAccrual}, repository.Page{})
+				require.NoError(t, err)
+				require.Len(t, ts, 2, "every credited order has to get own transaction")
+				order, err := s.GetOrder(t.Context(), "4561261212345467", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusProcessing, order.Status)
+			})
+		})
+
+		t.Run("every transaction audited with own balance", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				l := &auditLogger{}
+				WithAuditLogger(l)(s)
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				_, err = s.CreateOrder(t.Context(), "2377225624", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(100)},
+					{OrderNumber: "2377225624", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(50)},
+				})
+
+				require.NoError(t, err)
+				require.Len(t, l.records, 2)
+				// Batch is applied in order of numbers
+				require.Equal(t, "17893729974", l.records[0]["order_number"])
+				require.Equal(t, "100", l.records[0]["balance_current"])
+				require.Equal(t, "2377225624", l.records[1]["order_number"])
+				require.Equal(t, "150", l.records[1]["balance_current"])
+			})
+		})
+
+		t.Run("processed order with zero accrual", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+
+				err = s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: decimal.Zero},
+				})
+
+				require.NoError(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.NotNil(t, order.Accrual, "processed order has to store accrual even if it's zero")
+				ts, err := s.storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeAccrual}, repository.Page{})
+				require.NoError(t, err)
+				require.Empty(t, ts, "zero accrual must not be credited")
+			})
+		})
+
+		t.Run("only processed orders credited", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				for _, number := range []string{"17893729974", "2377225624"} {
+					_, err := s.CreateOrder(t.Context(), number, user)
+					require.NoError(t, err)
+				}
+
+				err := s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessing, Accrual: decimal.NewFromInt(100)},
+					{OrderNumber: "2377225624", Status: models.OrderStatusInvalid, Accrual: decimal.NewFromInt(50)},
+				})
+
+				require.NoError(t, err)
+				balance, err := s.storage.Balance().GetBalance(t.Context(), user.ID, false)
+				require.NoError(t, err)
+				require.True(t, balance.Current.IsZero(), "not processed and invalid orders must not be credited")
+			})
+		})
+
+		t.Run("processed orders skipped", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, _ *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				err = s.ApplyAccrual(t.Context(), "17893729974", models.OrderStatusProcessed, decimal.NewFromInt(100))
+				require.NoError(t, err)
+
+				err = s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(100)},
+				})
+
+				require.NoError(t, err)
+				balance, err := s.storage.Balance().GetBalance(t.Context(), user.ID, false)
+				require.NoError(t, err)
+				require.True(t, balance.Current.Equal(decimal.NewFromInt(100)), "balance must be credited only once")
+			})
+		})
+
+		t.Run("order of other user fail whole batch", func(t *testing.T) {
+			withTx(t, func(s *OrderService, user *models.User, yaUser *models.User) {
+				_, err := s.CreateOrder(t.Context(), "17893729974", user)
+				require.NoError(t, err)
+				_, err = s.CreateOrder(t.Context(), "2377225624", yaUser)
+				require.NoError(t, err)
+
+				err = s.ApplyAccruals(t.Context(), user.ID, []models.AccrualResult{
+					{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(100)},
+					{OrderNumber: "2377225624", Status: models.OrderStatusProcessed, Accrual: decimal.NewFromInt(100)},
+				})
+
+				require.Error(t, err)
+				order, err := s.GetOrder(t.Context(), "17893729974", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusNew, order.Status, "batch has to be rolled back")
+			})
+		})
 	})
 }
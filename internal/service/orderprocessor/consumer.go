@@ -3,10 +3,16 @@ package orderprocessor
 import (
 	"context"
 	"errors"
+	"maps"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/service/accrual"
@@ -15,13 +21,44 @@ import (
 type Consumer struct {
 	countWorkers int
 
+	// Failed attempts to get order accrual by order number
+	// Order is set INVALID when attempts reach maxAttempts
+	maxAttempts int
+	attemptsMu  sync.Mutex
+	attempts    map[string]int
+
+	// Failed order is not polled again till the time. Guarded by attemptsMu
+	// Backoff doubles with every failed attempt, zero disables it
+	nextPoll    map[string]time.Time
+	pollBackoff time.Duration
+
 	// Accrual client may return rate-limit errors
 	// If the client is rate-limited, workers will wait until the time is up
 	waitUntil atomic.Int64
 
-	client       accrualClient
-	orderService orderService
-	logger       logger.Logger
+	// Workers pause if accrual service is unreachable. Orders are not blamed for that
+	unavailableWait time.Duration
+
+	// Max time to process single order, so hung accrual service or database doesn't pin the worker
+	// Zero means no timeout
+	processTimeout time.Duration
+
+	// Accruals are collected and credited per user by flush instead of one by one, if set
+	// Pending results are keyed by user id and order number, so the order polled twice is applied once
+	batchAccruals bool
+	pendingMu     sync.Mutex
+	pending       map[uuid.UUID]map[string]models.AccrualResult
+
+	// Numbers of orders being processed by workers. Order fetched again by the next cycle
+	// while it's still processed is skipped, so accrual service is not polled twice for it
+	inFlight sync.Map
+
+	client AccrualClient
+	source OrderSource
+	logger logger.Logger
+
+	// Applies collected accruals if batching is enabled
+	batcher accrualBatcher
 }
 
 func (c *Consumer) Consume(ctx context.Context, in <-chan models.Order) <-chan struct{} {
@@ -54,7 +91,7 @@ func (c *Consumer) worker(ctx context.Context, in <-chan models.Order) {
 
 			select {
 			case <-ctx.Done():
-				continue
+				return
 			case <-time.After(time.Until(waitUntil)):
 				c.logger.Debug("Worker finished waiting for rate limit to reset")
 				continue
@@ -71,36 +108,196 @@ func (c *Consumer) worker(ctx context.Context, in <-chan models.Order) {
 				return
 			}
 
-			a, err := c.client.GetOrderAccrual(ctx, order.Number)
-			var accErr *accrual.Error
-
-			switch {
-			case err == nil:
-				order, err := c.orderService.SetProcessed(ctx, a.OrderNumber, a.Status, a.Accrual)
-				if err != nil {
-					c.logger.Error("Failed to set order as processed", "error", err, "order_number", order.Number)
-				}
-
-			case errors.As(err, &accErr):
-				switch accErr.Code {
-				case accrual.CodeRetryAfter:
-					c.logger.Info("Rate limit exceeded, waiting", "retry_after", accErr.RetryAfter)
-					c.waitUntil.Store(time.Now().Add(accErr.RetryAfter).Unix())
-
-				case accrual.CodeNoContent:
-					c.logger.Info("No content for order", "order_number", order.Number)
-					order, err := c.orderService.SetProcessed(ctx, order.Number, models.OrderStatusInvalid, nil)
-					if err != nil {
-						c.logger.Error("Failed to set order as invalid", "error", err, "order_number", order.Number)
-					}
-
-				default:
-					c.logger.Error("Unknown error from accrual service", "error", err, "order_number", order.Number)
-				}
-
-			default:
-				c.logger.Error("unexpected error from accrual service", "error", err, "order_number", order.Number)
-			}
+			c.process(ctx, order)
+		}
+	}
+}
+
+// Get order accrual and apply it to the order
+func (c *Consumer) process(ctx context.Context, order models.Order) {
+	if _, busy := c.inFlight.LoadOrStore(order.Number, struct{}{}); busy {
+		c.logger.Debug("Order is already being processed", "order_number", order.Number)
+		return
+	}
+	defer c.inFlight.Delete(order.Number)
+
+	if nextPoll, ok := c.pollDue(order.Number); !ok {
+		c.logger.Debug("Order is backing off", "order_number", order.Number, "next_poll_at", nextPoll)
+		return
+	}
+
+	if c.processTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.processTimeout)
+		defer cancel()
+	}
+
+	a, err := c.client.GetOrderAccrual(ctx, order.Number)
+	var accErr *accrual.Error
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Neither order nor accrual service is blamed, the order is left for the next cycle
+		c.logger.Warn("Order processing timed out or canceled", "error", err, "order_number", order.Number)
+
+	case err == nil:
+		status, ok := orderStatus(a.Status)
+		if !ok {
+			c.logger.Error("Unknown order status from accrual service", "status", a.Status, "order_number", order.Number)
+			c.attemptFailed(ctx, order)
+			return
+		}
+
+		c.resetAttempts(order.Number)
+		amount := decimal.Zero
+		if a.Accrual != nil {
+			amount = *a.Accrual
+		}
+		if c.batchAccruals {
+			c.addPending(order.UserID, models.AccrualResult{OrderNumber: order.Number, Status: status, Accrual: amount})
+			return
+		}
+		err := c.source.ApplyAccrual(ctx, order.Number, status, amount)
+		switch {
+		case errors.Is(err, apperrors.ErrOrderAlreadyProcessed):
+			c.logger.Debug("Order already processed", "order_number", order.Number)
+		case err != nil:
+			c.logger.Error("Failed to apply order accrual", "error", err, "order_number", order.Number)
+		}
+
+	case errors.As(err, &accErr):
+		switch accErr.Code {
+		case accrual.CodeRetryAfter:
+			c.logger.Info("Rate limit exceeded, waiting", "retry_after", accErr.RetryAfter)
+			c.waitUntil.Store(time.Now().Add(accErr.RetryAfter).Unix())
+
+		case accrual.CodeUnavailable:
+			c.logger.Warn("Accrual service unavailable, waiting", "error", err, "wait", c.unavailableWait)
+			c.waitUntil.Store(time.Now().Add(c.unavailableWait).Unix())
+
+		case accrual.CodeNoContent:
+			c.logger.Info("No content for order", "order_number", order.Number)
+			c.attemptFailed(ctx, order)
+
+		default:
+			c.logger.Error("Unknown error from accrual service", "error", err, "order_number", order.Number)
+			c.attemptFailed(ctx, order)
+		}
+
+	default:
+		c.logger.Error("unexpected error from accrual service", "error", err, "order_number", order.Number)
+	}
+}
+
+func (c *Consumer) addPending(userID uuid.UUID, r models.AccrualResult) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	if c.pending[userID] == nil {
+		c.pending[userID] = make(map[string]models.AccrualResult)
+	}
+	c.pending[userID][r.OrderNumber] = r
+}
+
+// Apply collected accrual results, every user's results in one transaction
+// Results of failed batch are dropped, their orders are still waiting and polled again by the next cycle
+func (c *Consumer) flush(ctx context.Context) {
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = make(map[uuid.UUID]map[string]models.AccrualResult)
+	c.pendingMu.Unlock()
+
+	for userID, byNumber := range pending {
+		results := slices.Collect(maps.Values(byNumber))
+		if err := c.batcher.ApplyAccruals(ctx, userID, results); err != nil {
+			c.logger.Error("Failed to apply order accruals", "error", err, "user_id", userID, "count", len(results))
+			continue
+		}
+		c.logger.Debug("Order accruals applied", "user_id", userID, "count", len(results))
+	}
+}
+
+// Map accrual service order status to the local one
+// Registered order is accepted by accrual service but not processed yet, so it's kept processing and polled further
+func orderStatus(status string) (string, bool) {
+	switch status {
+	case accrual.StatusRegistered, accrual.StatusProcessing:
+		return models.OrderStatusProcessing, true
+	case accrual.StatusInvalid:
+		return models.OrderStatusInvalid, true
+	case accrual.StatusProcessed:
+		return models.OrderStatusProcessed, true
+	default:
+		return "", false
+	}
+}
+
+// Count failed attempt and give up the order if it failed too many times
+func (c *Consumer) attemptFailed(ctx context.Context, order models.Order) {
+	c.attemptsMu.Lock()
+	c.attempts[order.Number]++
+	attempts := c.attempts[order.Number]
+	if c.pollBackoff > 0 {
+		c.nextPoll[order.Number] = time.Now().Add(c.pollBackoff << (attempts - 1))
+	}
+	c.attemptsMu.Unlock()
+
+	if attempts < c.maxAttempts {
+		return
+	}
+
+	c.logger.Warn("Giving up order after failed attempts", "order_number", order.Number, "attempts", attempts)
+	err := c.source.ApplyAccrual(ctx, order.Number, models.OrderStatusInvalid, decimal.Zero)
+	if err != nil && !errors.Is(err, apperrors.ErrOrderAlreadyProcessed) {
+		c.logger.Error("Failed to set order as invalid", "error", err, "order_number", order.Number)
+		return
+	}
+	c.resetAttempts(order.Number)
+}
+
+func (c *Consumer) resetAttempts(number string) {
+	c.attemptsMu.Lock()
+	delete(c.attempts, number)
+	delete(c.nextPoll, number)
+	c.attemptsMu.Unlock()
+}
+
+// Whether the order may be polled now. Returns time of the next poll otherwise
+func (c *Consumer) pollDue(number string) (time.Time, bool) {
+	c.attemptsMu.Lock()
+	defer c.attemptsMu.Unlock()
+	nextPoll := c.nextPoll[number]
+	return nextPoll, !nextPoll.After(time.Now())
+}
+
+// Polling states of failed orders, so they can be restored after restart
+func (c *Consumer) pollStates() []models.OrderPollState {
+	c.attemptsMu.Lock()
+	defer c.attemptsMu.Unlock()
+
+	states := make([]models.OrderPollState, 0, len(c.attempts))
+	for number, attempts := range c.attempts {
+		states = append(states, models.OrderPollState{
+			OrderNumber: number,
+			Attempts:    attempts,
+			NextPollAt:  c.nextPoll[number],
+		})
+	}
+	return states
+}
+
+// Restore polling states saved before restart. States of known orders are kept
+func (c *Consumer) restorePollStates(states []models.OrderPollState) {
+	c.attemptsMu.Lock()
+	defer c.attemptsMu.Unlock()
+
+	for _, s := range states {
+		if _, ok := c.attempts[s.OrderNumber]; ok {
+			continue
+		}
+		c.attempts[s.OrderNumber] = s.Attempts
+		if !s.NextPollAt.IsZero() {
+			c.nextPoll[s.OrderNumber] = s.NextPollAt
 		}
 	}
 }
@@ -0,0 +1,307 @@
+package orderprocessor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/service/accrual"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+)
+
+// Order source with every optional capability, that only records status updates
+type orderServiceMock struct {
+	mu      sync.Mutex
+	updates map[string][]string
+
+	// Orders returned by ClaimOrders
+	orders []models.Order
+
+	// Polling states saved by processor
+	pollStates []models.OrderPollState
+
+	// Results of every ApplyAccruals call by user id
+	batches map[uuid.UUID][][]models.AccrualResult
+}
+
+func (s *orderServiceMock) ApplyAccrual(_ context.Context, number string, status string, _ decimal.Decimal) error {
+	s.record(number, status)
+	return nil
+}
+
+func (s *orderServiceMock) ApplyAccruals(_ context.Context, userID uuid.UUID, results []models.AccrualResult) error {
+	for _, r := range results {
+		s.record(r.OrderNumber, r.Status)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batches == nil {
+		s.batches = make(map[uuid.UUID][][]models.AccrualResult)
+	}
+	s.batches[userID] = append(s.batches[userID], results)
+	return nil
+}
+
+func (s *orderServiceMock) record(number string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.updates == nil {
+		s.updates = make(map[string][]string)
+	}
+	s.updates[number] = append(s.updates[number], status)
+}
+
+func (s *orderServiceMock) ClaimOrders(context.Context, int) ([]models.Order, error) {
+	return s.orders, nil
+}
+
+func (s *orderServiceMock) RetireOrders(context.Context, time.Time) ([]models.Order, error) {
+	return nil, nil
+}
+
+func (s *orderServiceMock) ListPollStates(context.Context) ([]models.OrderPollState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pollStates, nil
+}
+
+func (s *orderServiceMock) SavePollStates(_ context.Context, states []models.OrderPollState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pollStates = states
+	return nil
+}
+
+func (s *orderServiceMock) statuses(number string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updates[number]
+}
+
+func TestConsumer(t *testing.T) {
+	// Feed the order to consumer several times and wait until all of them processed
+	consume := func(c *Consumer, order models.Order, times int) {
+		in := make(chan models.Order)
+		stopped := c.Consume(t.Context(), in)
+		for range times {
+			in <- order
+		}
+		close(in)
+		<-stopped
+	}
+
+	newConsumer := func(client AccrualClient, s OrderSource) *Consumer {
+		return &Consumer{
+			countWorkers:    1,
+			maxAttempts:     3,
+			attempts:        make(map[string]int),
+			nextPoll:        make(map[string]time.Time),
+			unavailableWait: time.Second,
+			client:          client,
+			source:          s,
+			logger:          logger.NewNoOpLogger(),
+		}
+	}
+
+	t.Run("give up after max attempts", func(t *testing.T) {
+		s := &orderServiceMock{}
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeNoContent, 0, fmt.Errorf("no content for %s", number))
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 2)
+		require.Empty(t, s.statuses(order.Number), "order has to be polled again before max attempts reached")
+
+		consume(c, order, 1)
+		require.Equal(t, []string{models.OrderStatusInvalid}, s.statuses(order.Number), "order has to be invalid after max attempts")
+	})
+
+	t.Run("unknown errors counted too", func(t *testing.T) {
+		s := &orderServiceMock{}
+		client := testutil.AccrualClientFunc(func(context.Context, string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeUnknown, 0, fmt.Errorf("bad gateway"))
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 3)
+
+		require.Equal(t, []string{models.OrderStatusInvalid}, s.statuses(order.Number))
+	})
+
+	t.Run("unavailable service not counted", func(t *testing.T) {
+		s := &orderServiceMock{}
+		client := testutil.AccrualClientFunc(func(context.Context, string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeUnavailable, 0, fmt.Errorf("connection refused"))
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 1)
+
+		require.Empty(t, s.statuses(order.Number), "order must not be given up while service is unavailable")
+		require.Empty(t, c.attempts, "failed attempt must not be counted")
+		require.NotZero(t, c.waitUntil.Load(), "workers have to wait before next request")
+	})
+
+	t.Run("failed order backs off", func(t *testing.T) {
+		s := &orderServiceMock{}
+		calls := 0
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			calls++
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeNoContent, 0, fmt.Errorf("no content for %s", number))
+		})
+		c := newConsumer(client, s)
+		c.pollBackoff = time.Minute
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 3)
+
+		require.Equal(t, 1, calls, "order must not be polled till backoff is over")
+		require.WithinDuration(t, time.Now().Add(time.Minute), c.nextPoll[order.Number], time.Second)
+
+		c.nextPoll[order.Number] = time.Now().Add(-time.Second)
+		consume(c, order, 1)
+
+		require.Equal(t, 2, calls, "order has to be polled after backoff")
+		require.WithinDuration(t, time.Now().Add(2*time.Minute), c.nextPoll[order.Number], time.Second, "backoff has to double")
+	})
+
+	t.Run("stopped while waiting", func(t *testing.T) {
+		c := newConsumer(testutil.AccrualClientFunc(func(context.Context, string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{}, nil
+		}), &orderServiceMock{})
+		c.countWorkers = 3
+		c.waitUntil.Store(time.Now().Add(time.Minute).Unix())
+		ctx, cancel := context.WithCancel(t.Context())
+
+		stopped := c.Consume(ctx, make(chan models.Order))
+		cancel()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("consumer has to stop without waiting out the pause")
+		}
+	})
+
+	t.Run("slow order timed out", func(t *testing.T) {
+		s := &orderServiceMock{}
+		// Client hangs till request context is done, as http client does
+		client := testutil.AccrualClientFunc(func(ctx context.Context, number string) (accrual.OrderAccrual, error) {
+			select {
+			case <-ctx.Done():
+				return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeUnavailable, 0, ctx.Err())
+			case <-time.After(time.Minute):
+				return accrual.OrderAccrual{OrderNumber: number, Status: models.OrderStatusProcessed}, nil
+			}
+		})
+		c := newConsumer(client, s)
+		c.processTimeout = 50 * time.Millisecond
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		started := time.Now()
+		consume(c, order, 2)
+
+		require.Less(t, time.Since(started), time.Second, "worker has to move on after timeout")
+		require.Empty(t, s.statuses(order.Number))
+		require.Empty(t, c.attempts, "timed out order must not be blamed")
+		require.Zero(t, c.waitUntil.Load(), "timed out order must not pause workers")
+	})
+
+	t.Run("registered order polled further", func(t *testing.T) {
+		s := &orderServiceMock{}
+		calls := 0
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			calls++
+			return accrual.OrderAccrual{OrderNumber: number, Status: accrual.StatusRegistered}, nil
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 2)
+
+		require.Equal(t, 2, calls, "registered order has to be polled again")
+		require.Equal(t, []string{models.OrderStatusProcessing, models.OrderStatusProcessing}, s.statuses(order.Number))
+		require.Empty(t, c.attempts, "registered order is not a failure")
+	})
+
+	t.Run("unknown status counted as failure", func(t *testing.T) {
+		s := &orderServiceMock{}
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{OrderNumber: number, Status: "CANCELED"}, nil
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 3)
+
+		require.Equal(t, []string{models.OrderStatusInvalid}, s.statuses(order.Number))
+	})
+
+	t.Run("success resets attempts", func(t *testing.T) {
+		s := &orderServiceMock{}
+		fail := true
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			if fail {
+				return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeNoContent, 0, fmt.Errorf("no content"))
+			}
+			return accrual.OrderAccrual{OrderNumber: number, Status: models.OrderStatusProcessing}, nil
+		})
+		c := newConsumer(client, s)
+		order := models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+
+		consume(c, order, 2)
+		fail = false
+		consume(c, order, 1)
+		fail = true
+		consume(c, order, 2)
+
+		require.Equal(t, []string{models.OrderStatusProcessing}, s.statuses(order.Number), "attempts has to be counted from the last success")
+	})
+
+	t.Run("order in flight not polled twice", func(t *testing.T) {
+		s := &orderServiceMock{}
+		var mu sync.Mutex
+		polls := make(map[string]int)
+		release := make(chan struct{})
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			mu.Lock()
+			polls[number]++
+			mu.Unlock()
+			if number != "4561261212345467" {
+				<-release
+			}
+			return accrual.OrderAccrual{OrderNumber: number, Status: models.OrderStatusProcessing}, nil
+		})
+		c := newConsumer(client, s)
+		c.countWorkers = 3
+		numbers := []string{"17893729974", "2377225624"}
+
+		// Every order is sent by overlapping cycles while workers still poll it
+		in := make(chan models.Order)
+		stopped := c.Consume(t.Context(), in)
+		for range 3 {
+			for _, number := range numbers {
+				in <- models.Order{Number: number, Status: models.OrderStatusNew}
+			}
+		}
+		// Two workers are blocked by polls, so the last one has skipped all the duplicates once it takes not blocked order
+		in <- models.Order{Number: "4561261212345467", Status: models.OrderStatusNew}
+		close(release)
+		close(in)
+		<-stopped
+
+		require.Equal(t, map[string]int{"17893729974": 1, "2377225624": 1, "4561261212345467": 1}, polls, "every order has to be polled once")
+	})
+}
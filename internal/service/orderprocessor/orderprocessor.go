@@ -2,13 +2,15 @@ package orderprocessor
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
 	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
-	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/service/accrual"
 )
 
@@ -16,43 +18,148 @@ const (
 	defaultCountWorkers     = 10               // Number of workers to process orders
 	defaultProduceInterval  = 10 * time.Second // Interval for producing orders
 	defaultProduceBatchSize = 100              // Default batch size for processing orders
+	defaultMaxAttempts      = 5                // Failed accrual requests before order is given up
+	defaultUnavailableWait  = 10 * time.Second // Pause of workers if accrual service is unreachable
+	defaultPollBackoff      = 10 * time.Second // Pause before failed order is polled again, doubled with every attempt
+	defaultProcessTimeout   = 30 * time.Second // Max time to get accrual of single order and apply it
+	defaultCheckpointPeriod = 30 * time.Second // Interval for saving polling states
+	checkpointTimeout       = 5 * time.Second  // Max time to save polling states on shutdown
+	defaultHealthThreshold  = 60 * time.Second // Processor without completed cycle for this long is unhealthy
 )
 
-type accrualClient interface {
+// Client to get order accrual from accrual service
+// Implemented by *accrual.Client
+type AccrualClient interface {
+	// Has to return *accrual.Error with codes for rate limited and not registered orders
 	GetOrderAccrual(ctx context.Context, number string) (accrual.OrderAccrual, error)
 }
 
-type orderService interface {
-	SetProcessed(ctx context.Context, number string, newStatus string, accrual *decimal.Decimal) (models.Order, error)
-	ListOrders(ctx context.Context, opts repository.ListOrdersOpts) ([]models.Order, error)
+// Orders waiting for accrual and the place accrual results are applied to
+// Implemented by *order.OrderService. Orders may come from elsewhere too, e.g. a message queue
+type OrderSource interface {
+	// Up to limit orders waiting for accrual. Orders being applied by other processors are not returned
+	ClaimOrders(ctx context.Context, limit int) ([]models.Order, error)
+
+	// Apply accrual result to the order and credit user's balance in one transaction
+	// Has to return apperrors.ErrOrderAlreadyProcessed if the order is in final status already
+	ApplyAccrual(ctx context.Context, number string, status string, accrual decimal.Decimal) error
+}
+
+// Optional capabilities of the order source. Processor uses them if the source implements them
+
+// Apply accrual results of user's orders and credit user's balance once in one transaction
+// Accruals are applied one by one without it, even if batching is enabled
+type accrualBatcher interface {
+	ApplyAccruals(ctx context.Context, userID uuid.UUID, results []models.AccrualResult) error
+}
+
+// Set orders waiting for accrual and uploaded before the time to terminal status
+// Orders are polled regardless of their age without it
+type orderRetirer interface {
+	RetireOrders(ctx context.Context, uploadedBefore time.Time) ([]models.Order, error)
+}
+
+// Load and replace polling states kept between processor restarts
+// Backoff of failed orders is lost on restart without it
+type pollStateStore interface {
+	ListPollStates(ctx context.Context) ([]models.OrderPollState, error)
+	SavePollStates(ctx context.Context, states []models.OrderPollState) error
+}
+
+// Order processor config with sensible defaults
+type Config struct {
+	// How many times accrual service may answer 'no content' or fail for the order
+	// before the order is set to terminal INVALID status
+	// If not set than default is used
+	MaxAttempts int
+
+	// Orders older than this are not polled anymore and set to terminal INVALID status
+	// The age of reprocessed order is counted by the order source from the reprocess
+	// Zero means orders are polled until accrual service answers
+	OrderMaxAge time.Duration
+
+	// Max time to get accrual of single order and apply it. Timed out order is left for the next cycle
+	// If not set than default is used
+	ProcessTimeout time.Duration
+
+	// Credit accruals of user's orders processed in the same cycle at once, so user's balance is locked once per cycle
+	// Every order still gets own ledger transaction
+	BatchAccruals bool
+
+	// Processor is unhealthy if it hasn't completed polling cycle for this long, e.g. workers are stuck
+	// If not set than default is used
+	HealthThreshold time.Duration
 }
 
 type Processor struct {
 	consumer *Consumer
 	producer *Producer
+
+	// Polling states are saved periodically and on shutdown, so backoff survives restart
+	// Nothing is saved if the order source can't keep them
+	checkpointPeriod time.Duration
+	pollStates       pollStateStore
+
+	// Collected accruals are applied with this period if batching is enabled
+	flushPeriod time.Duration
+
+	// Unix nano time processing started, zero if not started
+	startedAt       atomic.Int64
+	healthThreshold time.Duration
 }
 
-func New(accrualAddr string, logger logger.Logger, orderService orderService) *Processor {
-	client := accrual.NewClient(accrualAddr, logger)
+func New(cfg Config, client AccrualClient, logger logger.Logger, source OrderSource) *Processor {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.ProcessTimeout <= 0 {
+		cfg.ProcessTimeout = defaultProcessTimeout
+	}
+	if cfg.HealthThreshold <= 0 {
+		cfg.HealthThreshold = defaultHealthThreshold
+	}
+
+	batcher, _ := source.(accrualBatcher)
+	retirer, _ := source.(orderRetirer)
+	pollStates, _ := source.(pollStateStore)
 
 	return &Processor{
 		consumer: &Consumer{
-			countWorkers: defaultCountWorkers,
-			client:       client,
-			orderService: orderService,
-			logger:       logger,
+			countWorkers:    defaultCountWorkers,
+			maxAttempts:     cfg.MaxAttempts,
+			attempts:        make(map[string]int),
+			nextPoll:        make(map[string]time.Time),
+			pollBackoff:     defaultPollBackoff,
+			unavailableWait: defaultUnavailableWait,
+			processTimeout:  cfg.ProcessTimeout,
+			batchAccruals:   cfg.BatchAccruals && batcher != nil,
+			pending:         make(map[uuid.UUID]map[string]models.AccrualResult),
+			client:          client,
+			source:          source,
+			batcher:         batcher,
+			logger:          logger,
 		},
 		producer: &Producer{
-			interval:     defaultProduceInterval,
-			batchSize:    defaultProduceBatchSize,
-			orderService: orderService,
-			logger:       logger,
+			interval:  defaultProduceInterval,
+			batchSize: defaultProduceBatchSize,
+			maxAge:    cfg.OrderMaxAge,
+			source:    source,
+			retirer:   retirer,
+			logger:    logger,
 		},
+		checkpointPeriod: defaultCheckpointPeriod,
+		pollStates:       pollStates,
+		flushPeriod:      defaultProduceInterval,
+		healthThreshold:  cfg.HealthThreshold,
 	}
 }
 
 func (op *Processor) Process(ctx context.Context) <-chan struct{} {
 	idleStopped := make(chan struct{})
+	op.startedAt.Store(time.Now().UnixNano())
+
+	// Orders that failed before restart are not polled till their backoff is over
+	op.restore(ctx)
 
 	orderChan := make(chan models.Order)
 
@@ -65,10 +172,122 @@ func (op *Processor) Process(ctx context.Context) <-chan struct{} {
 	go func() {
 		defer close(idleStopped)
 		defer close(orderChan)
+
+		ticker := time.NewTicker(op.checkpointPeriod)
+		defer ticker.Stop()
+
+		// Flush ticker is never fired if accruals are not batched
+		var flush <-chan time.Time
+		if op.consumer.batchAccruals {
+			flushTicker := time.NewTicker(op.flushPeriod)
+			defer flushTicker.Stop()
+			flush = flushTicker.C
+		}
+
+		for stopped := false; !stopped; {
+			select {
+			case <-ticker.C:
+				op.checkpoint(ctx)
+			case <-flush:
+				op.consumer.flush(ctx)
+			case <-ctx.Done():
+				stopped = true
+			}
+		}
+
 		<-producerStopped
 		<-consumerStopped
+
+		// Context is canceled already, but accruals and states of drained workers have to be saved anyway
+		checkpointCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkpointTimeout)
+		defer cancel()
+		op.consumer.flush(checkpointCtx)
+		op.checkpoint(checkpointCtx)
 		op.consumer.logger.Debug("OrderProcessor stopped")
 	}()
 
 	return idleStopped
 }
+
+// Time of the last completed polling cycle: orders are fetched and handed to workers
+// Zero if no cycle completed yet
+func (op *Processor) LastCycleAt() time.Time {
+	return unixNano(op.producer.lastCycleAt.Load())
+}
+
+// Processor is healthy if it completed polling cycle within the threshold
+// Just started processor is given the threshold to complete the first one. Not started processor is never healthy
+// Waiting for accrual service that asked to retry later or is unavailable counts as progress,
+// so the threshold is counted from the end of the wait
+func (op *Processor) Healthy() bool {
+	last := op.LastCycleAt()
+	if last.IsZero() {
+		last = unixNano(op.startedAt.Load())
+	}
+	if last.IsZero() {
+		return false
+	}
+	if waitUntil := time.Unix(op.consumer.waitUntil.Load(), 0); waitUntil.After(last) {
+		last = waitUntil
+	}
+	return time.Since(last) <= op.healthThreshold
+}
+
+func unixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Save polling states of failed orders
+func (op *Processor) checkpoint(ctx context.Context) {
+	if op.pollStates == nil {
+		return
+	}
+	states := op.consumer.pollStates()
+	if err := op.pollStates.SavePollStates(ctx, states); err != nil {
+		op.consumer.logger.Error("Failed to save order polling states", "error", err)
+		return
+	}
+	op.consumer.logger.Debug("Order polling states saved", "count", len(states))
+}
+
+// Load polling states saved before restart
+func (op *Processor) restore(ctx context.Context) {
+	if op.pollStates == nil {
+		return
+	}
+	states, err := op.pollStates.ListPollStates(ctx)
+	if err != nil {
+		op.consumer.logger.Error("Failed to load order polling states", "error", err)
+		return
+	}
+	op.consumer.restorePollStates(states)
+	op.consumer.logger.Debug("Order polling states restored", "count", len(states))
+}
+
+// Run single polling cycle synchronously: fetch batch of orders and process them one by one
+// Cycle stops early if accrual service asks to wait. Useful to drive the processor deterministically
+// Batched accruals are applied at the end of the cycle
+func (op *Processor) RunOnce(ctx context.Context) error {
+	orders, err := op.producer.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list orders: %w", err)
+	}
+	defer op.consumer.flush(ctx)
+
+	for _, order := range orders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if time.Unix(op.consumer.waitUntil.Load(), 0).After(time.Now()) {
+			op.consumer.logger.Debug("Processor cycle stopped, accrual service asked to wait")
+			return nil
+		}
+		op.consumer.process(ctx, order)
+	}
+	op.producer.lastCycleAt.Store(time.Now().UnixNano())
+
+	return nil
+}
@@ -0,0 +1,293 @@
+package orderprocessor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/service/accrual"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+)
+
+// Order source without optional capabilities, that keeps orders in memory like a queue
+// Order is claimed until accrual applied to it is final
+type orderSourceMock struct {
+	mu     sync.Mutex
+	orders []models.Order
+}
+
+func (s *orderSourceMock) ClaimOrders(_ context.Context, limit int) ([]models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed []models.Order
+	for _, o := range s.orders {
+		if len(claimed) == limit {
+			break
+		}
+		if o.Status == models.OrderStatusNew || o.Status == models.OrderStatusProcessing {
+			claimed = append(claimed, o)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *orderSourceMock) ApplyAccrual(_ context.Context, number string, status string, accrual decimal.Decimal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.orders {
+		if o.Number != number {
+			continue
+		}
+		if o.Status == models.OrderStatusProcessed || o.Status == models.OrderStatusInvalid {
+			return apperrors.ErrOrderAlreadyProcessed
+		}
+		s.orders[i].Status = status
+		if accrual.IsPositive() {
+			s.orders[i].Accrual = &accrual
+		}
+		return nil
+	}
+	return apperrors.ErrOrderNotFound
+}
+
+func (s *orderSourceMock) order(number string) models.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.orders {
+		if o.Number == number {
+			return o
+		}
+	}
+	return models.Order{}
+}
+
+func TestProcessor(t *testing.T) {
+	t.Run("new defaults", func(t *testing.T) {
+		p := New(Config{}, testutil.AccrualClientMap(nil), logger.NewNoOpLogger(), &orderServiceMock{})
+
+		require.Equal(t, defaultMaxAttempts, p.consumer.maxAttempts)
+		require.Equal(t, defaultCountWorkers, p.consumer.countWorkers)
+		require.Equal(t, defaultProduceInterval, p.producer.interval)
+		require.Equal(t, defaultProduceBatchSize, p.producer.batchSize)
+		require.Equal(t, defaultProcessTimeout, p.consumer.processTimeout)
+	})
+
+	t.Run("uses injected accrual client", func(t *testing.T) {
+		s := &orderServiceMock{}
+		amount := decimal.RequireFromString("500")
+		client := testutil.AccrualClientMap(map[string]accrual.OrderAccrual{
+			"17893729974": {OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: &amount},
+		})
+		p := New(Config{}, client, logger.NewNoOpLogger(), s)
+
+		in := make(chan models.Order)
+		stopped := p.consumer.Consume(t.Context(), in)
+		in <- models.Order{Number: "17893729974", Status: models.OrderStatusNew}
+		close(in)
+		<-stopped
+
+		require.Equal(t, []string{models.OrderStatusProcessed}, s.statuses("17893729974"))
+	})
+	t.Run("run once", func(t *testing.T) {
+		amount := decimal.RequireFromString("500")
+		client := testutil.AccrualClientMap(map[string]accrual.OrderAccrual{
+			"17893729974": {OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: &amount},
+			"2377225624":  {OrderNumber: "2377225624", Status: models.OrderStatusProcessing},
+		})
+		s := &orderServiceMock{orders: []models.Order{
+			{Number: "17893729974", Status: models.OrderStatusNew},
+			{Number: "2377225624", Status: models.OrderStatusNew},
+		}}
+		p := New(Config{}, client, logger.NewNoOpLogger(), s)
+
+		err := p.RunOnce(t.Context())
+
+		require.NoError(t, err)
+		require.Equal(t, []string{models.OrderStatusProcessed}, s.statuses("17893729974"))
+		require.Equal(t, []string{models.OrderStatusProcessing}, s.statuses("2377225624"), "every fetched order has to be processed in the cycle")
+	})
+
+	t.Run("run once batches accruals by user", func(t *testing.T) {
+		amount := decimal.RequireFromString("500")
+		client := testutil.AccrualClientMap(map[string]accrual.OrderAccrual{
+			"17893729974":      {OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: &amount},
+			"2377225624":       {OrderNumber: "2377225624", Status: models.OrderStatusProcessed, Accrual: &amount},
+			"4561261212345467": {OrderNumber: "4561261212345467", Status: models.OrderStatusProcessing},
+		})
+		user, other := uuid.New(), uuid.New()
+		s := &orderServiceMock{orders: []models.Order{
+			{Number: "17893729974", UserID: user, Status: models.OrderStatusNew},
+			{Number: "2377225624", UserID: user, Status: models.OrderStatusNew},
+			{Number: "4561261212345467", UserID: other, Status: models.OrderStatusNew},
+		}}
+		p := New(Config{BatchAccruals: true}, client, logger.NewNoOpLogger(), s)
+
+		err := p.RunOnce(t.Context())
+
+		require.NoError(t, err)
+		require.Len(t, s.batches[user], 1, "user's accruals have to be applied at once")
+		require.ElementsMatch(t, []models.AccrualResult{
+			{OrderNumber: "17893729974", Status: models.OrderStatusProcessed, Accrual: amount},
+			{OrderNumber: "2377225624", Status: models.OrderStatusProcessed, Accrual: amount},
+		}, s.batches[user][0])
+		require.Equal(t, [][]models.AccrualResult{
+			{{OrderNumber: "4561261212345467", Status: models.OrderStatusProcessing, Accrual: decimal.Zero}},
+		}, s.batches[other])
+	})
+
+	t.Run("run once stops if accrual asks to wait", func(t *testing.T) {
+		calls := 0
+		client := testutil.AccrualClientFunc(func(context.Context, string) (accrual.OrderAccrual, error) {
+			calls++
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeRetryAfter, 60, fmt.Errorf("too many requests"))
+		})
+		s := &orderServiceMock{orders: []models.Order{{Number: "17893729974"}, {Number: "2377225624"}}}
+		p := New(Config{}, client, logger.NewNoOpLogger(), s)
+
+		err := p.RunOnce(t.Context())
+
+		require.NoError(t, err)
+		require.Equal(t, 1, calls, "rest of orders has to wait for the next cycle")
+	})
+	t.Run("backoff restored after restart", func(t *testing.T) {
+		calls := 0
+		client := testutil.AccrualClientFunc(func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+			calls++
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeNoContent, 0, fmt.Errorf("no content for %s", number))
+		})
+		s := &orderServiceMock{orders: []models.Order{{Number: "17893729974", Status: models.OrderStatusNew}}}
+
+		// Order fails once and processor is shut down while it's backing off
+		first := New(Config{}, client, logger.NewNoOpLogger(), s)
+		err := first.RunOnce(t.Context())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(t.Context())
+		stopped := first.Process(ctx)
+		cancel()
+		<-stopped
+
+		require.Len(t, s.pollStates, 1, "polling state has to be saved on shutdown")
+		require.Equal(t, "17893729974", s.pollStates[0].OrderNumber)
+		require.Equal(t, 1, s.pollStates[0].Attempts)
+		require.True(t, s.pollStates[0].NextPollAt.After(time.Now()))
+
+		// Restarted processor keeps the backoff and failed attempts
+		ctx, cancel = context.WithCancel(t.Context())
+		second := New(Config{}, client, logger.NewNoOpLogger(), s)
+		stopped = second.Process(ctx)
+		cancel()
+		<-stopped
+		err = second.RunOnce(t.Context())
+
+		require.NoError(t, err)
+		require.Equal(t, 1, calls, "order must not be polled again till backoff is over")
+		require.Equal(t, 1, second.consumer.attempts["17893729974"])
+	})
+
+	t.Run("full cycle with order source only", func(t *testing.T) {
+		amount := decimal.RequireFromString("500")
+		processing := map[string]accrual.OrderAccrual{
+			"17893729974": {OrderNumber: "17893729974", Status: accrual.StatusProcessing},
+			"2377225624":  {OrderNumber: "2377225624", Status: accrual.StatusInvalid},
+		}
+		processed := map[string]accrual.OrderAccrual{
+			"17893729974": {OrderNumber: "17893729974", Status: accrual.StatusProcessed, Accrual: &amount},
+		}
+		calls := 0
+		client := testutil.AccrualClientMap(processing)
+		s := &orderSourceMock{orders: []models.Order{
+			{Number: "17893729974", Status: models.OrderStatusNew},
+			{Number: "2377225624", Status: models.OrderStatusNew},
+		}}
+		// Batching and max age need capabilities the source doesn't have, so they are off
+		p := New(Config{BatchAccruals: true, OrderMaxAge: time.Hour}, testutil.AccrualClientFunc(func(ctx context.Context, number string) (accrual.OrderAccrual, error) {
+			calls++
+			return client.GetOrderAccrual(ctx, number)
+		}), logger.NewNoOpLogger(), s)
+		require.False(t, p.consumer.batchAccruals)
+		require.Nil(t, p.producer.retirer)
+		require.Nil(t, p.pollStates)
+
+		err := p.RunOnce(t.Context())
+		require.NoError(t, err)
+		require.Equal(t, models.OrderStatusProcessing, s.order("17893729974").Status)
+		require.Equal(t, models.OrderStatusInvalid, s.order("2377225624").Status)
+
+		client = testutil.AccrualClientMap(processed)
+		err = p.RunOnce(t.Context())
+
+		require.NoError(t, err)
+		require.Equal(t, 3, calls, "final order must not be claimed again")
+		order := s.order("17893729974")
+		require.Equal(t, models.OrderStatusProcessed, order.Status)
+		require.True(t, amount.Equal(*order.Accrual))
+
+		// Nothing is left to claim, so the cycle is empty
+		err = p.RunOnce(t.Context())
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+
+		// Polling states can't be kept by the source, so start and shutdown don't fail
+		ctx, cancel := context.WithCancel(t.Context())
+		stopped := p.Process(ctx)
+		cancel()
+		<-stopped
+	})
+
+	t.Run("health", func(t *testing.T) {
+		p := New(Config{HealthThreshold: time.Minute}, testutil.AccrualClientMap(nil), logger.NewNoOpLogger(), &orderServiceMock{})
+		require.False(t, p.Healthy(), "not started processor is never healthy")
+		require.True(t, p.LastCycleAt().IsZero())
+
+		err := p.RunOnce(t.Context())
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), p.LastCycleAt(), time.Second)
+		require.True(t, p.Healthy())
+
+		// Processor stuck for longer than the threshold
+		p.producer.lastCycleAt.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+		require.False(t, p.Healthy())
+	})
+
+	t.Run("health while accrual service asks to wait", func(t *testing.T) {
+		client := testutil.AccrualClientFunc(func(context.Context, string) (accrual.OrderAccrual, error) {
+			return accrual.OrderAccrual{}, accrual.NewAccrualError(accrual.CodeRetryAfter, 5*60, fmt.Errorf("too many requests"))
+		})
+		s := &orderServiceMock{orders: []models.Order{{Number: "17893729974"}, {Number: "2377225624"}}}
+		p := New(Config{HealthThreshold: time.Minute}, client, logger.NewNoOpLogger(), s)
+		// Workers and producer are blocked by the pause longer than the threshold
+		p.startedAt.Store(time.Now().Add(-10 * time.Minute).UnixNano())
+		p.producer.lastCycleAt.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+
+		err := p.RunOnce(t.Context())
+		require.NoError(t, err)
+
+		require.True(t, p.Healthy(), "pause asked by accrual service is not a stuck processor")
+
+		// Pause is over, but processor didn't complete a cycle after it
+		p.consumer.waitUntil.Store(time.Now().Add(-2 * time.Minute).Unix())
+		require.False(t, p.Healthy())
+	})
+
+	t.Run("health of started processor", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+		p := New(Config{HealthThreshold: time.Minute}, testutil.AccrualClientMap(nil), logger.NewNoOpLogger(), &orderServiceMock{})
+		p.producer.interval = 10 * time.Millisecond
+		stopped := p.Process(ctx)
+		defer func() { cancel(); <-stopped }()
+
+		require.True(t, p.Healthy(), "just started processor is given threshold to complete the first cycle")
+
+		p.startedAt.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+		require.Eventually(t, p.Healthy, time.Second, 10*time.Millisecond, "first cycle has to make processor healthy")
+	})
+}
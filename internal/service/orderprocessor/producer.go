@@ -2,18 +2,26 @@ package orderprocessor
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
-	"github.com/nkiryanov/gophermart/internal/repository"
 )
 
 type Producer struct {
-	interval     time.Duration
-	logger       logger.Logger
-	orderService orderService
-	batchSize    int
+	interval  time.Duration
+	logger    logger.Logger
+	source    OrderSource
+	batchSize int
+
+	// Orders uploaded earlier than maxAge ago are retired instead of polled
+	// Zero or order source that can't retire orders disables it
+	maxAge  time.Duration
+	retirer orderRetirer
+
+	// Unix nano time of the last cycle that fetched orders and handed all of them to workers
+	lastCycleAt atomic.Int64
 }
 
 func (p *Producer) Produce(ctx context.Context, out chan<- models.Order) <-chan struct{} {
@@ -35,10 +43,7 @@ func (p *Producer) Produce(ctx context.Context, out chan<- models.Order) <-chan
 			case <-ticker.C:
 				p.logger.Debug("Producer tick: fetching orders")
 
-				orders, err := p.orderService.ListOrders(ctx, repository.ListOrdersOpts{
-					Statuses: []string{models.OrderStatusNew, models.OrderStatusProcessing},
-					Limit:    p.batchSize,
-				})
+				orders, err := p.fetch(ctx)
 				if err != nil {
 					p.logger.Error("Failed to list orders", "error", err)
 					continue
@@ -54,9 +59,32 @@ func (p *Producer) Produce(ctx context.Context, out chan<- models.Order) <-chan
 						p.logger.Debug("Order sent to channel", "orderID", order.ID)
 					}
 				}
+				p.lastCycleAt.Store(time.Now().UnixNano())
 			}
 		}
 	}()
 
 	return idleStopped
 }
+
+// Get batch of orders waiting for accrual. Orders older than max age are retired first
+// Orders another processor or worker is applying accrual to right now are left for the next cycle
+func (p *Producer) fetch(ctx context.Context) ([]models.Order, error) {
+	if p.maxAge > 0 && p.retirer != nil {
+		p.retire(ctx, time.Now().Add(-p.maxAge))
+	}
+
+	return p.source.ClaimOrders(ctx, p.batchSize)
+}
+
+// Retire orders uploaded before the time, so they are not polled anymore
+func (p *Producer) retire(ctx context.Context, uploadedBefore time.Time) {
+	orders, err := p.retirer.RetireOrders(ctx, uploadedBefore)
+	if err != nil {
+		p.logger.Error("Failed to retire old orders", "error", err)
+		return
+	}
+	for _, order := range orders {
+		p.logger.Warn("Order retired after max age", "order_number", order.Number, "uploaded_at", order.UploadedAt, "status", order.Status)
+	}
+}
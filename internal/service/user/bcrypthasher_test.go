@@ -45,3 +45,27 @@ func Test_BcryptHasher(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func Benchmark_BcryptHasher(b *testing.B) {
+	h := BcryptHasher{}
+
+	b.Run("hash", func(b *testing.B) {
+		for b.Loop() {
+			_, err := h.Hash("password")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("compare", func(b *testing.B) {
+		hash, err := h.Hash("password")
+		require.NoError(b, err)
+
+		for b.Loop() {
+			if err := h.Compare(hash, "password"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
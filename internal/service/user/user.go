@@ -2,13 +2,20 @@ package user
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/cache"
+	"github.com/nkiryanov/gophermart/internal/logger"
+	"github.com/nkiryanov/gophermart/internal/mailer"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository"
+	"github.com/nkiryanov/gophermart/internal/service/audit"
 	"github.com/nkiryanov/gophermart/internal/service/validate"
 	"github.com/shopspring/decimal"
 )
@@ -17,6 +24,12 @@ var (
 	DefaultHasher = BcryptHasher{}
 )
 
+// How many times withdrawal is retried if it conflicts with concurrent one
+const withdrawalTxRetries = 3
+
+// Time to send a withdrawal receipt. It is sent after the request, so request deadline doesn't apply
+const receiptTimeout = 30 * time.Second
+
 // Interface to create or compare user password hashes
 type PasswordHasher interface {
 	// Generate Hash from password
@@ -30,21 +43,102 @@ type PasswordHasher interface {
 type UserService struct {
 	hasher  PasswordHasher
 	storage repository.Storage
+
+	// Balances cache, nil if caching disabled
+	balances *cache.Cache[uuid.UUID, models.Balance]
+
+	// Max sum of single withdrawal, zero means unlimited
+	maxWithdrawal decimal.Decimal
+
+	// Max sum of user's withdrawals within the window, zero means unlimited
+	withdrawalLimit       decimal.Decimal
+	withdrawalLimitWindow time.Duration
+
+	// Logger to audit money movements
+	audit logger.Logger
+
+	// Withdrawal receipts are sent with mailer to users with email, failures are logged with mailLogger
+	// Receipts are not sent if mailer is nil
+	mailer     mailer.Mailer
+	mailLogger logger.Logger
+
+	// Receipts being sent in background
+	receipts sync.WaitGroup
+}
+
+type Option func(*UserService)
+
+// Cache balances returned by GetBalance
+// The cache has to be shared with every service that changes balances, so they could invalidate it
+func WithBalanceCache(c *cache.Cache[uuid.UUID, models.Balance]) Option {
+	return func(s *UserService) {
+		s.balances = c
+	}
+}
+
+// Reject withdrawals greater than max. Zero means unlimited
+func WithMaxWithdrawal(max decimal.Decimal) Option {
+	return func(s *UserService) {
+		s.maxWithdrawal = max
+	}
 }
 
-func NewService(hasher PasswordHasher, storage repository.Storage) *UserService {
+// Reject withdrawal if sum of user's withdrawals within the window (including it) exceeds the limit
+// Zero limit means unlimited
+func WithWithdrawalLimit(limit decimal.Decimal, window time.Duration) Option {
+	return func(s *UserService) {
+		s.withdrawalLimit = limit
+		s.withdrawalLimitWindow = window
+	}
+}
+
+// Log every committed withdrawal to audit logger
+func WithAuditLogger(l logger.Logger) Option {
+	return func(s *UserService) {
+		s.audit = l
+	}
+}
+
+// Send receipt of every committed withdrawal to user's email
+// Receipt is sent in background, so withdrawal is not delayed or failed by mailer. Errors are logged with l
+func WithMailer(m mailer.Mailer, l logger.Logger) Option {
+	return func(s *UserService) {
+		s.mailer = m
+		s.mailLogger = l
+	}
+}
+
+func NewService(hasher PasswordHasher, storage repository.Storage, opts ...Option) *UserService {
 	if hasher == nil {
 		hasher = DefaultHasher
 	}
 
-	return &UserService{
+	s := &UserService{
 		hasher:  hasher,
 		storage: storage,
+		audit:   logger.NewNoOpLogger(),
+
+		mailLogger: logger.NewNoOpLogger(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
-func (s *UserService) CreateUser(ctx context.Context, username string, password string) (models.User, error) {
+// Usernames are unique case-sensitively, so only surrounding whitespace is dropped
+// Passwords are never normalized
+func normalizeUsername(username string) string {
+	return strings.TrimSpace(username)
+}
+
+// Create user with zero balance. Options are applied to created user, e.g. to set email
+func (s *UserService) CreateUser(ctx context.Context, username string, password string, opts ...repository.CreateUserOption) (models.User, error) {
 	var user models.User
+	username = normalizeUsername(username)
+	if username == "" {
+		return user, fmt.Errorf("username can't be empty")
+	}
 	if password == "" {
 		return user, fmt.Errorf("password can't be empty")
 	}
@@ -55,12 +149,13 @@ func (s *UserService) CreateUser(ctx context.Context, username string, password
 	}
 
 	err = s.storage.InTx(ctx, func(storage repository.Storage) error {
-		user, err = s.storage.User().CreateUser(ctx, username, hash)
+		user, err = storage.User().CreateUser(ctx, username, hash, opts...)
 		if err != nil {
 			return fmt.Errorf("can't create user. Err: %w", err)
 		}
 
-		err = s.storage.Balance().CreateBalance(ctx, user.ID)
+		// User is rolled back if balance can't be created, so there are no users without balance
+		err = storage.Balance().CreateBalance(ctx, user.ID)
 		if err != nil {
 			return fmt.Errorf("can't create user balance. Err: %w", err)
 		}
@@ -74,16 +169,22 @@ func (s *UserService) CreateUser(ctx context.Context, username string, password
 	return user, nil
 }
 
+// Returns apperrors.ErrUserNotFound if user not exists and apperrors.ErrInvalidCredentials if password is wrong
+// Callers must not expose the difference to clients
 func (s *UserService) Login(ctx context.Context, username string, password string) (models.User, error) {
-	// Ignore error for now, but prefer to log it
-	// It's safe to use user now, because it's always not empty
-	user, _ := s.storage.User().GetUserByUsername(ctx, username)
+	// It's safe to use user even on error, because it's always not empty
+	user, findErr := s.storage.User().GetUserByUsername(ctx, normalizeUsername(username))
 
 	// Always compare password to prevent timing attacks
 	// It will always fail if user not found
 	err := s.hasher.Compare(user.HashedPassword, password)
-	if err != nil {
+	switch {
+	case errors.Is(findErr, apperrors.ErrUserNotFound):
 		return user, apperrors.ErrUserNotFound
+	case findErr != nil:
+		return user, fmt.Errorf("can't get user. Err: %w", findErr)
+	case err != nil:
+		return user, apperrors.ErrInvalidCredentials
 	}
 
 	return user, nil
@@ -93,12 +194,94 @@ func (s *UserService) GetUserByID(ctx context.Context, userID uuid.UUID) (models
 	return s.storage.User().GetUserByID(ctx, userID)
 }
 
+// Set user's email. Empty email unsets it
+// Returns apperrors.ErrEmailInvalid if email is malformed
+func (s *UserService) SetEmail(ctx context.Context, userID uuid.UUID, email string) (models.User, error) {
+	if email != "" && validate.Email(email) != nil {
+		return models.User{}, apperrors.ErrEmailInvalid
+	}
+	return s.storage.User().SetEmail(ctx, userID, email)
+}
+
 func (s *UserService) GetBalance(ctx context.Context, userID uuid.UUID) (models.Balance, error) {
-	return s.storage.Balance().GetBalance(ctx, userID, false)
+	if s.balances == nil {
+		return s.storage.Balance().GetBalance(ctx, userID, false)
+	}
+
+	if balance, ok := s.balances.Get(userID); ok {
+		return balance, nil
+	}
+
+	// Take generation before read, so balance changed concurrently is not cached
+	generation := s.balances.Generation()
+	balance, err := s.storage.Balance().GetBalance(ctx, userID, false)
+	if err != nil {
+		return balance, err
+	}
+	s.balances.Set(userID, balance, generation)
+	return balance, nil
+}
+
+// Drop cached balance. Has to be called after transaction that changes the balance is committed
+func (s *UserService) invalidateBalance(userID uuid.UUID) {
+	if s.balances != nil {
+		s.balances.Delete(userID)
+	}
 }
 
 func (s *UserService) GetWithdrawals(ctx context.Context, userID uuid.UUID) ([]models.Transaction, error) {
-	return s.storage.Balance().ListTransactions(ctx, userID, []string{models.TransactionTypeWithdrawal})
+	return s.storage.Balance().ListTransactions(ctx, userID, []models.TransactionType{models.TransactionTypeWithdrawal}, repository.Page{})
+}
+
+// Page of user's accruals and withdrawals, newest first
+func (s *UserService) GetTransactions(ctx context.Context, userID uuid.UUID, page repository.Page) ([]models.Transaction, error) {
+	return s.storage.Balance().ListTransactions(ctx, userID, nil, page)
+}
+
+// Count all user's accruals and withdrawals
+func (s *UserService) CountTransactions(ctx context.Context, userID uuid.UUID) (int, error) {
+	return s.storage.Balance().CountTransactions(ctx, userID, nil)
+}
+
+// Call fn for every user's transaction as they are read from storage, newest first
+func (s *UserService) ForEachTransaction(ctx context.Context, userID uuid.UUID, fn func(models.Transaction) error) error {
+	return s.storage.Balance().ForEachTransaction(ctx, userID, nil, fn)
+}
+
+// Aggregate user's orders and transactions
+func (s *UserService) GetStats(ctx context.Context, userID uuid.UUID) (models.UserStats, error) {
+	var stats models.UserStats
+
+	counts, err := s.storage.Order().CountOrdersByStatus(ctx, userID)
+	if err != nil {
+		return stats, fmt.Errorf("can't count orders. Err: %w", err)
+	}
+	totals, err := s.storage.Balance().SumTransactionsByType(ctx, userID)
+	if err != nil {
+		return stats, fmt.Errorf("can't sum transactions. Err: %w", err)
+	}
+	balance, err := s.GetBalance(ctx, userID)
+	if err != nil {
+		return stats, fmt.Errorf("can't get balance. Err: %w", err)
+	}
+
+	stats.OrdersByStatus = counts
+	for _, count := range counts {
+		stats.OrdersTotal += count
+	}
+	stats.TransactionTotals = totals
+	stats.Current = balance.Current
+	return stats, nil
+}
+
+// User's balance after every transaction (or at the end of every day), the oldest first
+func (s *UserService) GetBalanceHistory(ctx context.Context, userID uuid.UUID, opts repository.BalanceHistoryOpts) ([]models.BalancePoint, error) {
+	return s.storage.Balance().BalanceHistory(ctx, userID, opts)
+}
+
+// Withdrawals summed per order
+func (s *UserService) GetWithdrawalsSummary(ctx context.Context, userID uuid.UUID) ([]models.WithdrawalSummary, error) {
+	return s.storage.Balance().SumWithdrawalsByOrder(ctx, userID)
 }
 
 // Withdraw from user balance in transaction
@@ -110,8 +293,16 @@ func (s *UserService) Withdraw(ctx context.Context, userID uuid.UUID, orderNumbe
 		return balance, apperrors.ErrOrderNumberInvalid
 	}
 
-	err = s.storage.InTx(ctx, func(storage repository.Storage) error {
-		existedBalance, err := s.storage.Balance().GetBalance(ctx, userID, true)
+	// Check before balance is locked
+	if s.maxWithdrawal.IsPositive() && amount.GreaterThan(s.maxWithdrawal) {
+		return balance, apperrors.ErrWithdrawalTooLarge
+	}
+
+	// Serializable isolation guarantees the balance and withdrawals sum checked are not changed concurrently
+	// till the withdrawal is committed, so no update is lost. Conflicting withdrawal is retried
+	var t models.Transaction
+	err = s.storage.InTxWithRetry(ctx, withdrawalTxRetries, func(storage repository.Storage) error {
+		existedBalance, err := storage.Balance().GetBalance(ctx, userID, true)
 		if err != nil {
 			return err
 		}
@@ -120,28 +311,110 @@ func (s *UserService) Withdraw(ctx context.Context, userID uuid.UUID, orderNumbe
 			return apperrors.ErrBalanceInsufficient
 		}
 
-		t, err := s.storage.Balance().CreateTransaction(ctx, models.Transaction{
-			ID:          uuid.New(),
-			ProcessedAt: time.Now(),
-			UserID:      userID,
-			OrderNumber: orderNumber,
-			Type:        models.TransactionTypeWithdrawal,
-			Amount:      amount,
-		})
+		// Balance is locked, so concurrent withdrawals can't exceed the limit together
+		if s.withdrawalLimit.IsPositive() {
+			withdrawn, err := storage.Balance().SumTransactions(ctx, userID, models.TransactionTypeWithdrawal, time.Now().Add(-s.withdrawalLimitWindow))
+			if err != nil {
+				return err
+			}
+			if withdrawn.Add(amount).GreaterThan(s.withdrawalLimit) {
+				return apperrors.ErrWithdrawalLimitExceeded
+			}
+		}
+
+		t, err = models.NewWithdrawal(userID, orderNumber, amount)
+		if err != nil {
+			return err
+		}
+		t, err = storage.Balance().CreateTransaction(ctx, t)
 		if err != nil {
 			return err
 		}
 
-		balance, err = s.storage.Balance().UpdateBalance(ctx, t)
+		balance, err = storage.Balance().UpdateBalance(ctx, t)
 		if err != nil {
 			return err
 		}
 
 		return nil
-	})
+	}, repository.WithIsolation(repository.IsolationSerializable))
+	s.invalidateBalance(userID)
 	if err != nil {
 		return balance, fmt.Errorf("withdrawn failed: %w", err)
 	}
 
+	// Only committed withdrawals are audited
+	audit.Transaction(ctx, s.audit, t, balance)
+	s.sendWithdrawalReceipt(ctx, t, balance)
+
 	return balance, nil
 }
+
+func (s *UserService) sendWithdrawalReceipt(ctx context.Context, t models.Transaction, balance models.Balance) {
+	if s.mailer == nil {
+		return
+	}
+
+	// Withdrawal is committed already, so receipt is not bound to request context
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), receiptTimeout)
+	s.receipts.Add(1)
+	go func() {
+		defer s.receipts.Done()
+		defer cancel()
+
+		user, err := s.storage.User().GetUserByID(ctx, t.UserID)
+		if err != nil {
+			s.mailLogger.Error("Failed to get user to send withdrawal receipt", "error", err, "user_id", t.UserID)
+			return
+		}
+		if user.Email == "" {
+			return
+		}
+
+		body := fmt.Sprintf("Withdrawn %s for order %s.\nCurrent balance: %s", t.Amount, t.OrderNumber, balance.Current)
+		err = s.mailer.Send(ctx, user.Email, "Withdrawal receipt", body)
+		if err != nil {
+			s.mailLogger.Error("Failed to send withdrawal receipt", "error", err, "user_id", t.UserID, "transaction_id", t.ID)
+		}
+	}()
+}
+
+// Wait till receipts being sent in background are sent or failed
+// Has to be called on shutdown before storage is closed
+func (s *UserService) WaitReceipts() {
+	s.receipts.Wait()
+}
+
+// Find balances that don't match user's transactions sums
+// If repair set, balances are recalculated from transactions. Returns found mismatches anyway
+func (s *UserService) ReconcileBalances(ctx context.Context, repair bool) ([]models.BalanceMismatch, error) {
+	if !repair {
+		return s.storage.Balance().ListBalanceMismatches(ctx, false)
+	}
+
+	var mismatches []models.BalanceMismatch
+	err := s.storage.InTx(ctx, func(storage repository.Storage) error {
+		var err error
+		mismatches, err = storage.Balance().ListBalanceMismatches(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range mismatches {
+			_, err = storage.Balance().SetBalance(ctx, m.UserID, m.ExpectedCurrent, m.ExpectedWithdrawn)
+			if err != nil {
+				return fmt.Errorf("can't repair balance of user %s. Err: %w", m.UserID, err)
+			}
+		}
+
+		return nil
+	})
+	for _, m := range mismatches {
+		s.invalidateBalance(m.UserID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reconcile failed: %w", err)
+	}
+
+	return mismatches, nil
+}
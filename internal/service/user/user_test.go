@@ -1,7 +1,11 @@
 package user
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -9,12 +13,39 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/nkiryanov/gophermart/internal/apperrors"
+	"github.com/nkiryanov/gophermart/internal/cache"
+	"github.com/nkiryanov/gophermart/internal/logger"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/repository/postgres"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 )
 
+// Storage which balances can't be created, in transactions as well
+type failingBalanceStorage struct {
+	repository.Storage
+	err error
+}
+
+func (s failingBalanceStorage) Balance() repository.BalanceRepo {
+	return failingBalanceRepo{s.Storage.Balance(), s.err}
+}
+
+func (s failingBalanceStorage) InTx(ctx context.Context, fn func(repository.Storage) error, opts ...repository.TxOption) error {
+	return s.Storage.InTx(ctx, func(storage repository.Storage) error {
+		return fn(failingBalanceStorage{storage, s.err})
+	}, opts...)
+}
+
+type failingBalanceRepo struct {
+	repository.BalanceRepo
+	err error
+}
+
+func (r failingBalanceRepo) CreateBalance(context.Context, uuid.UUID) error {
+	return r.err
+}
+
 func TestUser(t *testing.T) {
 	t.Parallel()
 
@@ -60,6 +91,40 @@ func TestUser(t *testing.T) {
 			})
 		})
 
+		t.Run("username trimmed", func(t *testing.T) {
+			inTx(t, func(s *UserService, _ repository.Storage) {
+				user, err := s.CreateUser(t.Context(), "  alice\t", "  password123  ")
+				require.NoError(t, err)
+
+				require.Equal(t, "alice", user.Username)
+				_, err = s.Login(t.Context(), "alice", "password123")
+				require.ErrorIs(t, err, apperrors.ErrInvalidCredentials, "password must not be trimmed")
+				_, err = s.Login(t.Context(), "alice", "  password123  ")
+				require.NoError(t, err)
+			})
+		})
+
+		t.Run("blank username fail", func(t *testing.T) {
+			inTx(t, func(s *UserService, _ repository.Storage) {
+				_, err := s.CreateUser(t.Context(), "   ", "password123")
+
+				require.Error(t, err)
+			})
+		})
+
+		t.Run("user rolled back if balance not created", func(t *testing.T) {
+			inTx(t, func(_ *UserService, storage repository.Storage) {
+				balanceErr := errors.New("user balance already exists")
+				s := NewService(DefaultHasher, failingBalanceStorage{storage, balanceErr})
+
+				_, err := s.CreateUser(t.Context(), "test-user", "password123")
+
+				require.ErrorIs(t, err, balanceErr)
+				_, err = storage.User().GetUserByUsername(t.Context(), "test-user")
+				require.ErrorIs(t, err, apperrors.ErrUserNotFound, "user without balance must not be left")
+			})
+		})
+
 		t.Run("create duplicate user fail", func(t *testing.T) {
 			inTx(t, func(s *UserService, _ repository.Storage) {
 				_, err := s.CreateUser(t.Context(), "test-user", "password123")
@@ -89,6 +154,18 @@ func TestUser(t *testing.T) {
 			})
 		})
 
+		t.Run("login with untrimmed username", func(t *testing.T) {
+			inTx(t, func(s *UserService, _ repository.Storage) {
+				createdUser, err := s.CreateUser(t.Context(), "alice", "password123")
+				require.NoError(t, err)
+
+				user, err := s.Login(t.Context(), "  alice  ", "password123")
+
+				require.NoError(t, err)
+				require.Equal(t, createdUser.ID, user.ID)
+			})
+		})
+
 		t.Run("invalid password fail", func(t *testing.T) {
 			inTx(t, func(s *UserService, _ repository.Storage) {
 				// Create user first
@@ -98,7 +175,7 @@ func TestUser(t *testing.T) {
 				_, err = s.Login(t.Context(), "test-user", "wrong-password")
 
 				require.Error(t, err, "login with wrong password should fail")
-				require.ErrorIs(t, err, apperrors.ErrUserNotFound)
+				require.ErrorIs(t, err, apperrors.ErrInvalidCredentials)
 			})
 		})
 
@@ -139,6 +216,36 @@ func TestUser(t *testing.T) {
 		})
 	})
 
+	t.Run("SetEmail", func(t *testing.T) {
+		t.Run("email set", func(t *testing.T) {
+			inTx(t, func(s *UserService, _ repository.Storage) {
+				created, err := s.CreateUser(t.Context(), "test-user", "password123")
+				require.NoError(t, err)
+
+				user, err := s.SetEmail(t.Context(), created.ID, "test@example.com")
+
+				require.NoError(t, err)
+				require.Equal(t, "test@example.com", user.Email)
+			})
+		})
+
+		t.Run("invalid email fail", func(t *testing.T) {
+			inTx(t, func(s *UserService, _ repository.Storage) {
+				created, err := s.CreateUser(t.Context(), "test-user", "password123", repository.WithEmail("test@example.com"))
+				require.NoError(t, err)
+
+				for _, email := range []string{"not-an-email", "Test <test@example.com>", "test@example.com "} {
+					_, err = s.SetEmail(t.Context(), created.ID, email)
+					require.ErrorIs(t, err, apperrors.ErrEmailInvalid, "email: %q", email)
+				}
+
+				user, err := s.GetUserByID(t.Context(), created.ID)
+				require.NoError(t, err)
+				require.Equal(t, "test@example.com", user.Email, "email must not be changed")
+			})
+		})
+	})
+
 	t.Run("GetBalance", func(t *testing.T) {
 		t.Run("new user", func(t *testing.T) {
 			inTx(t, func(s *UserService, _ repository.Storage) {
@@ -154,6 +261,33 @@ func TestUser(t *testing.T) {
 				require.True(t, balance.Withdrawn.IsZero(), "initial withdrawn should be zero")
 			})
 		})
+
+		t.Run("cached", func(t *testing.T) {
+			testutil.InTx(pg.Pool, t, func(tx pgx.Tx) {
+				storage := postgres.NewStorage(tx)
+				s := NewService(DefaultHasher, storage, WithBalanceCache(cache.New[uuid.UUID, models.Balance](time.Hour)))
+				user, err := s.CreateUser(t.Context(), "test-user", "password123")
+				require.NoError(t, err)
+				_, err = storage.Balance().UpdateBalance(t.Context(), models.Transaction{
+					UserID: user.ID,
+					Type:   models.TransactionTypeAccrual,
+					Amount: decimal.NewFromInt(1000),
+				})
+				require.NoError(t, err)
+
+				balance, err := s.GetBalance(t.Context(), user.ID)
+				require.NoError(t, err)
+				require.Equal(t, "1000", balance.Current.String())
+
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(300))
+				require.NoError(t, err)
+				balance, err = s.GetBalance(t.Context(), user.ID)
+
+				require.NoError(t, err)
+				require.Equal(t, "700", balance.Current.String(), "withdrawal has to be reflected immediately")
+				require.Equal(t, "300", balance.Withdrawn.String())
+			})
+		})
 	})
 
 	t.Run("Withdrawn", func(t *testing.T) {
@@ -197,6 +331,237 @@ func TestUser(t *testing.T) {
 			})
 		})
 
+		t.Run("withdrawn totals stored", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				user := setup(t, s, storage)
+
+				_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.RequireFromString("250.5"))
+				require.NoError(t, err)
+				returned, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(100))
+				require.NoError(t, err)
+
+				stored, err := storage.Balance().GetBalance(t.Context(), user.ID, false)
+
+				require.NoError(t, err)
+				require.Equal(t, "649.5", stored.Current.String(), "withdrawals have to be subtracted from current")
+				require.Equal(t, "350.5", stored.Withdrawn.String(), "withdrawals have to be added to withdrawn")
+				require.True(t, returned.Current.Equal(stored.Current), "returned balance has to be the stored one")
+				require.True(t, returned.Withdrawn.Equal(stored.Withdrawn))
+			})
+		})
+
+		t.Run("withdrawn listed", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				user := setup(t, s, storage)
+
+				_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(300))
+				require.NoError(t, err)
+
+				withdrawals, err := s.GetWithdrawals(t.Context(), user.ID)
+
+				require.NoError(t, err)
+				require.Len(t, withdrawals, 1, "withdrawal has to be recorded with withdrawal type")
+				require.Equal(t, models.TransactionTypeWithdrawal, withdrawals[0].Type)
+				require.Equal(t, "2444", withdrawals[0].OrderNumber)
+				require.Equal(t, "300", withdrawals[0].Amount.String())
+			})
+		})
+
+		t.Run("withdrawn max amount", func(t *testing.T) {
+			tests := []struct {
+				name    string
+				amount  int64
+				wantErr error
+			}{
+				{"under max", 499, nil},
+				{"at max", 500, nil},
+				{"over max", 501, apperrors.ErrWithdrawalTooLarge},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					inTx(t, func(s *UserService, storage repository.Storage) {
+						WithMaxWithdrawal(decimal.NewFromInt(500))(s)
+						user := setup(t, s, storage)
+
+						balance, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(tt.amount))
+
+						if tt.wantErr != nil {
+							require.ErrorIs(t, err, tt.wantErr)
+							return
+						}
+						require.NoError(t, err)
+						require.True(t, balance.Withdrawn.Equal(decimal.NewFromInt(tt.amount)))
+					})
+				})
+			}
+		})
+
+		t.Run("withdrawn limit within window", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				WithWithdrawalLimit(decimal.NewFromInt(300), 24*time.Hour)(s)
+				user := setup(t, s, storage)
+
+				// Seed withdrawals: earlier today and out of the window
+				for _, w := range []struct {
+					amount int64
+					ago    time.Duration
+				}{{200, 2 * time.Hour}, {500, 30 * time.Hour}} {
+					_, err := storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+						ID:          uuid.New(),
+						ProcessedAt: time.Now().Add(-w.ago),
+						UserID:      user.ID,
+						OrderNumber: "2444",
+						Type:        models.TransactionTypeWithdrawal,
+						Amount:      decimal.NewFromInt(w.amount),
+					})
+					require.NoError(t, err)
+				}
+
+				_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(101))
+				require.ErrorIs(t, err, apperrors.ErrWithdrawalLimitExceeded, "withdrawals within window has to be limited")
+
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(100))
+				require.NoError(t, err, "withdrawals out of window must not be counted")
+
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(1))
+				require.ErrorIs(t, err, apperrors.ErrWithdrawalLimitExceeded)
+			})
+		})
+
+		t.Run("withdrawn audited", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				l := &auditLogger{}
+				WithAuditLogger(l)(s)
+				user := setup(t, s, storage)
+
+				_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(1500))
+				require.Error(t, err)
+				require.Empty(t, l.records, "failed withdrawal must not be audited")
+
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(300))
+
+				require.NoError(t, err)
+				require.Len(t, l.records, 1)
+				record := l.records[0]
+				require.Equal(t, true, record["audit"])
+				require.Equal(t, user.ID, record["user_id"])
+				require.Equal(t, "2444", record["order_number"])
+				require.Equal(t, models.TransactionTypeWithdrawal, record["type"])
+				require.Equal(t, "300", record["amount"])
+				require.Equal(t, "700", record["balance_current"])
+				require.NotZero(t, record["processed_at"])
+			})
+		})
+
+		t.Run("withdrawal receipt sent", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				m := &fakeMailer{}
+				WithMailer(m, logger.NewNoOpLogger())(s)
+				user := setup(t, s, storage)
+
+				_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(300))
+				require.NoError(t, err)
+				s.WaitReceipts()
+				require.Empty(t, m.sent, "receipt is not sent to user without email")
+
+				_, err = s.SetEmail(t.Context(), user.ID, "test@example.com")
+				require.NoError(t, err)
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(1500))
+				require.Error(t, err)
+				require.Empty(t, m.sent, "receipt is not sent for failed withdrawal")
+
+				_, err = s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(200))
+
+				require.NoError(t, err)
+				s.WaitReceipts()
+				require.Len(t, m.sent, 1)
+				require.Equal(t, "test@example.com", m.sent[0].to)
+				require.Equal(t, "Withdrawal receipt", m.sent[0].subject)
+				require.Contains(t, m.sent[0].body, "Withdrawn 200 for order 2444")
+				require.Contains(t, m.sent[0].body, "Current balance: 500")
+			})
+		})
+
+		t.Run("withdrawal not failed by mailer", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				m := &fakeMailer{err: errors.New("smtp is down")}
+				WithMailer(m, logger.NewNoOpLogger())(s)
+				user := setup(t, s, storage)
+				_, err := s.SetEmail(t.Context(), user.ID, "test@example.com")
+				require.NoError(t, err)
+
+				balance, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(300))
+
+				require.NoError(t, err)
+				require.Equal(t, "700", balance.Current.String())
+				s.WaitReceipts()
+				require.Len(t, m.sent, 1)
+			})
+		})
+
+		t.Run("withdrawal not delayed by mailer", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				release := make(chan struct{})
+				m := &fakeMailer{wait: release}
+				WithMailer(m, logger.NewNoOpLogger())(s)
+				user := setup(t, s, storage)
+				_, err := s.SetEmail(t.Context(), user.ID, "test@example.com")
+				require.NoError(t, err)
+				ctx, cancel := context.WithCancel(t.Context())
+
+				_, err = s.Withdraw(ctx, user.ID, "2444", decimal.NewFromInt(300))
+				cancel()
+
+				require.NoError(t, err, "withdrawal returns while receipt is still being sent")
+				close(release)
+				s.WaitReceipts()
+				require.Len(t, m.sent, 1)
+				require.NoError(t, m.ctxErr, "receipt is not canceled with request context")
+			})
+		})
+
+		t.Run("concurrent withdrawals", func(t *testing.T) {
+			// Withdrawals are committed for real to run concurrently on different connections
+			storage := postgres.NewStorage(pg.Pool)
+			s := NewService(DefaultHasher, storage)
+			user, err := s.CreateUser(t.Context(), "concurrent-user", "password123")
+			require.NoError(t, err)
+			_, err = storage.Balance().UpdateBalance(t.Context(), models.Transaction{
+				UserID: user.ID,
+				Type:   models.TransactionTypeAccrual,
+				Amount: decimal.NewFromInt(100),
+			})
+			require.NoError(t, err)
+
+			errs := make(chan error, 3)
+			var wg sync.WaitGroup
+			for range 3 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := s.Withdraw(t.Context(), user.ID, "2444", decimal.NewFromInt(40))
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			succeeded := 0
+			for err := range errs {
+				if err == nil {
+					succeeded++
+					continue
+				}
+				require.ErrorIs(t, err, apperrors.ErrBalanceInsufficient, "conflicting withdrawal has to be retried till balance is checked")
+			}
+			require.Equal(t, 2, succeeded, "only withdrawals covered by balance have to succeed")
+			balance, err := s.GetBalance(t.Context(), user.ID)
+			require.NoError(t, err)
+			require.Equal(t, "20", balance.Current.String())
+			require.Equal(t, "80", balance.Withdrawn.String())
+		})
+
 		t.Run("withdrawn with invalid number", func(t *testing.T) {
 			inTx(t, func(s *UserService, storage repository.Storage) {
 				user := setup(t, s, storage)
@@ -208,4 +573,92 @@ func TestUser(t *testing.T) {
 			})
 		})
 	})
+	t.Run("ReconcileBalances", func(t *testing.T) {
+		// Create user with balance that has accrual 100 without transaction
+		setup := func(t *testing.T, userService *UserService, storage repository.Storage) models.User {
+			user, err := userService.CreateUser(t.Context(), "test-user", "password123")
+			require.NoError(t, err)
+
+			_, err = storage.Balance().UpdateBalance(t.Context(), models.Transaction{
+				UserID: user.ID,
+				Type:   models.TransactionTypeAccrual,
+				Amount: decimal.NewFromInt(100),
+			})
+			require.NoError(t, err)
+
+			return user
+		}
+
+		t.Run("detect mismatch", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				user := setup(t, s, storage)
+
+				mismatches, err := s.ReconcileBalances(t.Context(), false)
+
+				require.NoError(t, err)
+				require.Len(t, mismatches, 1)
+				require.Equal(t, user.ID, mismatches[0].UserID)
+				require.True(t, mismatches[0].ExpectedCurrent.IsZero(), "no transactions, so expected balance is zero")
+
+				balance, err := s.GetBalance(t.Context(), user.ID)
+				require.NoError(t, err)
+				require.True(t, balance.Current.Equal(decimal.NewFromInt(100)), "balance must not be changed without repair")
+			})
+		})
+
+		t.Run("repair mismatch", func(t *testing.T) {
+			inTx(t, func(s *UserService, storage repository.Storage) {
+				user := setup(t, s, storage)
+
+				mismatches, err := s.ReconcileBalances(t.Context(), true)
+				require.NoError(t, err)
+				require.Len(t, mismatches, 1)
+
+				balance, err := s.GetBalance(t.Context(), user.ID)
+				require.NoError(t, err)
+				require.True(t, balance.Current.IsZero(), "balance has to be recalculated from transactions")
+
+				mismatches, err = s.ReconcileBalances(t.Context(), false)
+				require.NoError(t, err)
+				require.Empty(t, mismatches, "no mismatches after repair")
+			})
+		})
+	})
+}
+
+// Mailer that records sent emails
+// If wait is set, sending is blocked till it's closed
+type fakeMailer struct {
+	err  error
+	wait chan struct{}
+
+	sent   []struct{ to, subject, body string }
+	ctxErr error
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	if m.wait != nil {
+		<-m.wait
+	}
+	m.sent = append(m.sent, struct{ to, subject, body string }{to, subject, body})
+	m.ctxErr = ctx.Err()
+	return m.err
+}
+
+// Logger that keeps attributes of info records
+type auditLogger struct {
+	records []map[string]any
+}
+
+func (l *auditLogger) Info(msg string, args ...any) {
+	record := map[string]any{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		record[args[i].(string)] = args[i+1]
+	}
+	l.records = append(l.records, record)
 }
+func (l *auditLogger) Debug(msg string, args ...any)       {}
+func (l *auditLogger) Warn(msg string, args ...any)        {}
+func (l *auditLogger) Error(msg string, args ...any)       {}
+func (l *auditLogger) With(args ...any) logger.Logger      { return l }
+func (l *auditLogger) WithGroup(name string) logger.Logger { return l }
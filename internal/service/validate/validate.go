@@ -2,8 +2,21 @@ package validate
 
 import (
 	"errors"
+	"net/mail"
 )
 
+// Check email is a bare address like 'user@example.com', without display name
+func Email(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return err
+	}
+	if addr.Name != "" || addr.Address != email {
+		return errors.New("email has to be bare address")
+	}
+	return nil
+}
+
 func Luhn(number string) error {
 	// Convert number in digits and save in slice in reverse order
 	// It's ok to work with string as bytes here
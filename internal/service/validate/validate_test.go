@@ -0,0 +1,19 @@
+package validate
+
+import (
+	"testing"
+)
+
+func BenchmarkLuhn(b *testing.B) {
+	for name, number := range map[string]string{
+		"short": "2377225624",
+		"card":  "4561261212345467",
+		"long":  "4561261212345467456126121234546745612612123454670",
+	} {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				_ = Luhn(number)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package testutil
+
+import (
+	"context"
+
+	"github.com/nkiryanov/gophermart/internal/service/accrual"
+)
+
+// Accrual client mock: the function is called on every GetOrderAccrual call
+type AccrualClientFunc func(ctx context.Context, number string) (accrual.OrderAccrual, error)
+
+func (f AccrualClientFunc) GetOrderAccrual(ctx context.Context, number string) (accrual.OrderAccrual, error) {
+	return f(ctx, number)
+}
+
+// Accrual client mock that returns responses by order number
+// Orders not in the map are not registered in accrual service (no content)
+func AccrualClientMap(responses map[string]accrual.OrderAccrual) AccrualClientFunc {
+	return func(_ context.Context, number string) (accrual.OrderAccrual, error) {
+		a, ok := responses[number]
+		if !ok {
+			return a, accrual.NewAccrualError(accrual.CodeNoContent, 0, nil)
+		}
+		return a, nil
+	}
+}
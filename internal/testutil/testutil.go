@@ -39,7 +39,7 @@ type PostgresContainer struct {
 // Start container with postgres
 // Stop if error happened, so you may be sure container started ok
 // Should be stopped when tests stopped
-func StartPostgresContainer(t *testing.T) PostgresContainer {
+func StartPostgresContainer(t testing.TB) PostgresContainer {
 	t.Helper()
 
 	// Fail if docker rootless not found
@@ -93,7 +93,7 @@ type dbtx interface {
 
 // Create db transaction and rollback at test end
 // So you may be sure db remains unchanged when test stops
-func InTx(dbtx dbtx, t *testing.T, testFunc func(tx pgx.Tx)) {
+func InTx(dbtx dbtx, t testing.TB, testFunc func(tx pgx.Tx)) {
 	tx, err := dbtx.Begin(t.Context())
 	require.NoError(t, err)
 
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+func Test_AdminMaintenance(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	maintenance := new(atomic.Bool)
+	maintenance.Store(true)
+	cfg := handlers.Config{AdminUsernames: []string{"admin"}, Maintenance: maintenance}
+
+	e2e.ServeInTxWithConfig(pg.Pool, t, cfg, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		_, err := s.UserService.CreateUser(t.Context(), "admin", "pwd")
+		require.NoError(t, err)
+
+		t.Run("admin logs in and disables maintenance", func(t *testing.T) {
+			resp, err := http.Get(srvURL + "/api/user/orders")
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "user API is down in maintenance")
+
+			resp, err = http.Post(srvURL+"/api/user/login", "application/json", strings.NewReader(`{"login": "admin", "password": "pwd"}`))
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode, "login has to stay up in maintenance")
+			access := resp.Header.Get("Authorization")
+			require.NotEmpty(t, access)
+
+			// Refresh token is issued by login, so it's refreshed too
+			req, err := http.NewRequest(http.MethodPost, srvURL+"/api/user/refresh", nil)
+			require.NoError(t, err)
+			for _, c := range resp.Cookies() {
+				req.AddCookie(c)
+			}
+			resp, err = http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode, "refresh has to stay up in maintenance")
+
+			req, err = http.NewRequest(http.MethodPost, srvURL+"/admin/maintenance", strings.NewReader(`{"enabled": false}`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", access)
+			resp, err = http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.False(t, maintenance.Load())
+		})
+	})
+}
@@ -0,0 +1,207 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/handlers"
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+const OrdersURL = "/admin/orders"
+
+func Test_AdminCreateOrder(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	cfg := handlers.Config{AdminUsernames: []string{"admin"}}
+
+	e2e.ServeInTxWithConfig(pg.Pool, t, cfg, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		pwd := "pwd"
+		_, err := s.UserService.CreateUser(t.Context(), "admin", pwd)
+		require.NoError(t, err)
+		user, err := s.UserService.CreateUser(t.Context(), "test-user", pwd)
+		require.NoError(t, err)
+
+		createOrder := func(t *testing.T, username string, body any) (int, string) {
+			data, err := json.Marshal(body)
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPost, srvURL+OrdersURL, bytes.NewReader(data))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			pair, err := s.AuthService.Login(t.Context(), username, pwd)
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+			respBody, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			return resp.StatusCode, string(respBody)
+		}
+
+		t.Run("processed order with accrual created", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				status, body := createOrder(t, "admin", map[string]any{
+					"user_id": user.ID,
+					"number":  "4561261212345467",
+					"status":  models.OrderStatusProcessed,
+					"accrual": 500.5,
+				})
+
+				require.Equalf(t, http.StatusCreated, status, "Body: %s", body)
+				order, err := s.OrderService.GetOrder(t.Context(), "4561261212345467", user.ID)
+				require.NoError(t, err, "order has to be created for the user")
+				require.Equal(t, models.OrderStatusProcessed, order.Status)
+				require.NotNil(t, order.Accrual)
+				require.Equal(t, "500.5", order.Accrual.String())
+			})
+		})
+
+		t.Run("not admin forbidden", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				status, body := createOrder(t, "test-user", map[string]any{
+					"user_id": user.ID,
+					"number":  "4561261212345467",
+				})
+
+				require.Equalf(t, http.StatusForbidden, status, "Body: %s", body)
+				_, err := s.OrderService.GetOrder(t.Context(), "4561261212345467", user.ID)
+				require.Error(t, err, "order must not be created")
+			})
+		})
+
+		t.Run("accrual of not processed order rejected", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				status, body := createOrder(t, "admin", map[string]any{
+					"user_id": user.ID,
+					"number":  "4561261212345467",
+					"status":  models.OrderStatusNew,
+					"accrual": 10,
+				})
+
+				require.Equalf(t, http.StatusUnprocessableEntity, status, "Body: %s", body)
+			})
+		})
+
+		t.Run("user id required", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				status, body := createOrder(t, "admin", map[string]any{
+					"number": "4561261212345467",
+				})
+
+				require.Equalf(t, http.StatusUnprocessableEntity, status, "Body: %s", body)
+			})
+		})
+
+		t.Run("unknown user", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				status, body := createOrder(t, "admin", map[string]any{
+					"user_id": "00000000-0000-0000-0000-000000000001",
+					"number":  "4561261212345467",
+				})
+
+				require.Equalf(t, http.StatusNotFound, status, "Body: %s", body)
+			})
+		})
+
+		t.Run("unauthorized", func(t *testing.T) {
+			resp, err := http.Post(srvURL+OrdersURL, "application/json", bytes.NewReader([]byte(`{}`)))
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+
+			require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	})
+}
+
+func Test_AdminReprocessOrder(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	cfg := handlers.Config{AdminUsernames: []string{"admin"}}
+
+	e2e.ServeInTxWithConfig(pg.Pool, t, cfg, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		pwd := "pwd"
+		_, err := s.UserService.CreateUser(t.Context(), "admin", pwd)
+		require.NoError(t, err)
+		user, err := s.UserService.CreateUser(t.Context(), "test-user", pwd)
+		require.NoError(t, err)
+
+		reprocess := func(t *testing.T, username string, number string) (int, string) {
+			req, err := http.NewRequest(http.MethodPost, srvURL+OrdersURL+"/"+number+"/reprocess", nil)
+			require.NoError(t, err)
+			pair, err := s.AuthService.Login(t.Context(), username, pwd)
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			return resp.StatusCode, string(body)
+		}
+
+		t.Run("invalid order reset to new", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				_, err := s.OrderService.CreateOrder(t.Context(), "4561261212345467", &user, repository.WithOrderStatus(models.OrderStatusInvalid))
+				require.NoError(t, err)
+
+				status, body := reprocess(t, "admin", "4561261212345467")
+
+				require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+				order, err := s.OrderService.GetOrder(t.Context(), "4561261212345467", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusNew, order.Status)
+			})
+		})
+
+		t.Run("processed order conflict", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				_, err := s.OrderService.CreateOrder(t.Context(), "4561261212345467", &user, repository.WithOrderStatus(models.OrderStatusProcessed))
+				require.NoError(t, err)
+
+				status, body := reprocess(t, "admin", "4561261212345467")
+
+				require.Equalf(t, http.StatusConflict, status, "Body: %s", body)
+			})
+		})
+
+		t.Run("not admin forbidden", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				_, err := s.OrderService.CreateOrder(t.Context(), "4561261212345467", &user, repository.WithOrderStatus(models.OrderStatusInvalid))
+				require.NoError(t, err)
+
+				status, body := reprocess(t, "test-user", "4561261212345467")
+
+				require.Equalf(t, http.StatusForbidden, status, "Body: %s", body)
+				order, err := s.OrderService.GetOrder(t.Context(), "4561261212345467", user.ID)
+				require.NoError(t, err)
+				require.Equal(t, models.OrderStatusInvalid, order.Status, "order must not be changed")
+			})
+		})
+
+		t.Run("not existed order", func(t *testing.T) {
+			status, body := reprocess(t, "admin", "4561261212345467")
+
+			require.Equalf(t, http.StatusNotFound, status, "Body: %s", body)
+		})
+	})
+}
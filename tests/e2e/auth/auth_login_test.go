@@ -10,6 +10,7 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/service/auth"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 	"github.com/nkiryanov/gophermart/tests/e2e"
 )
@@ -59,26 +60,94 @@ func Test_Login(t *testing.T) {
 			})
 		})
 
-		t.Run("login failed", func(t *testing.T) {
+		t.Run("login saves client info", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
-				data := `{"login": "nk", "password": "WrongPassword"}`
-
-				resp, err := http.Post(srvURL+LoginURL, "application/json", strings.NewReader(data))
+				data := `{"login": "nk", "password": "StrongEnoughPassword"}`
+				req, err := http.NewRequest(http.MethodPost, srvURL+LoginURL, strings.NewReader(data))
 				require.NoError(t, err)
-				body, err := io.ReadAll(resp.Body)
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("User-Agent", "gophermart-test/1.0")
+
+				resp, err := http.DefaultClient.Do(req)
 				require.NoError(t, err)
 				defer func() { _ = resp.Body.Close() }()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, 1, len(resp.Cookies()))
 
-				require.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "not expected code. Body: %s", string(body))
-				require.JSONEq(t, `
-					{
-						"error": "service_error",
-						"message": "User not found"
-					}`, string(body))
-
-				require.Equal(t, 0, len(resp.Cookies()), "no cookies should be set on login error")
-				require.NotContains(t, resp.Header, "Authorization", "Authorization header should not be set")
+				token, err := s.Storage.Refresh().Get(t.Context(), resp.Cookies()[0].Value)
+				require.NoError(t, err)
+				require.Equal(t, "gophermart-test/1.0", token.UserAgent)
+				require.Equal(t, "127.0.0.1", token.IP, "test server is requested from localhost")
 			})
 		})
+
+		// Wrong password and unknown user have to be indistinguishable for client
+		for name, data := range map[string]string{
+			"login failed":       `{"login": "nk", "password": "WrongPassword"}`,
+			"unknown user login": `{"login": "not-existed-user", "password": "StrongEnoughPassword"}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				testutil.InTx(tx, t, func(_ pgx.Tx) {
+					resp, err := http.Post(srvURL+LoginURL, "application/json", strings.NewReader(data))
+					require.NoError(t, err)
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					defer func() { _ = resp.Body.Close() }()
+
+					require.Equalf(t, http.StatusUnauthorized, resp.StatusCode, "not expected code. Body: %s", string(body))
+					require.JSONEq(t, `
+						{
+							"error": "service_error",
+							"code": "invalid_credentials",
+							"message": "Invalid login or password"
+						}`, string(body))
+
+					require.Equal(t, 0, len(resp.Cookies()), "no cookies should be set on login error")
+					require.NotContains(t, resp.Header, "Authorization", "Authorization header should not be set")
+				})
+			})
+		}
+	})
+}
+
+func Test_LoginCustomAuthNames(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	authCfg := auth.Config{
+		RefreshCookieName: "gm_refresh",
+		AccessHeaderName:  "X-Access-Token",
+		AccessAuthScheme:  "Token",
+	}
+
+	e2e.ServeInTxWithAuthConfig(pg.Pool, t, authCfg, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		_, err := s.AuthService.Register(t.Context(), "nk", "StrongEnoughPassword")
+		require.NoError(t, err)
+
+		data := `{"login": "nk", "password": "StrongEnoughPassword"}`
+		resp, err := http.Post(srvURL+LoginURL, "application/json", strings.NewReader(data))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 1, len(resp.Cookies()))
+		require.Equal(t, "gm_refresh", resp.Cookies()[0].Name, "refresh cookie has to be named by config")
+		require.NotContains(t, resp.Header, "Authorization")
+		require.True(t, strings.HasPrefix(resp.Header.Get("X-Access-Token"), "Token "), "access token has to be set to configured header with configured scheme")
+
+		// Tokens are accepted back with the same names
+		req, err := http.NewRequest(http.MethodPost, srvURL+RefreshURL, nil)
+		require.NoError(t, err)
+		req.AddCookie(resp.Cookies()[0])
+		req.Header.Set("X-Access-Token", resp.Header.Get("X-Access-Token"))
+
+		refreshResp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = refreshResp.Body.Close() }()
+
+		require.Equal(t, http.StatusOK, refreshResp.StatusCode)
+		require.Equal(t, "gm_refresh", refreshResp.Cookies()[0].Name)
 	})
 }
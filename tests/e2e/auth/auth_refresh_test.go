@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/handlers"
 	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 	"github.com/nkiryanov/gophermart/tests/e2e"
@@ -92,10 +93,38 @@ func Test_AuthRefresh(t *testing.T) {
 				require.JSONEq(t, `
 					{
 						"error": "service_error",
-						"message": "Refresh token not found"
+						"code": "refresh_token_used",
+						"message": "Refresh token reused, please login again"
 					}`, string(body2))
 			})
 		})
+	})
+
+	e2e.ServeInTxWithConfig(pg.Pool, t, handlers.Config{RefreshRateLimit: 2}, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		pair, err := s.AuthService.Register(t.Context(), "nk", "StrongEnoughPassword")
+		require.NoError(t, err)
 
+		t.Run("refresh rate limited", func(t *testing.T) {
+			refresh := func(pair models.TokenPair) *http.Response {
+				req, err := http.NewRequest(http.MethodPost, srvURL+RefreshURL, nil)
+				require.NoError(t, err)
+				s.AuthService.SetTokenPairToRequest(req, pair)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "refresh request should always complete")
+				_ = resp.Body.Close()
+				return resp
+			}
+
+			resp := refresh(pair)
+			require.Equal(t, http.StatusOK, resp.StatusCode, "single refresh has to succeed")
+
+			// Grind with the same token: it's rejected by auth but still counted
+			resp = refresh(pair)
+			require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+			resp = refresh(pair)
+			require.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "requests over the limit have to be rejected")
+			require.NotEmpty(t, resp.Header.Get("Retry-After"))
+		})
 	})
 }
@@ -10,12 +10,14 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/apperrors"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 	"github.com/nkiryanov/gophermart/tests/e2e"
 )
 
 const (
 	RegisterURL = "/api/user/register"
+	MeURL       = "/api/user/me"
 )
 
 func Test_AuthRegister(t *testing.T) {
@@ -56,6 +58,81 @@ func Test_AuthRegister(t *testing.T) {
 			})
 		})
 
+		t.Run("register with email", func(t *testing.T) {
+			// Register user and return /me response
+			registerAndGetMe := func(t *testing.T, data string) string {
+				resp, err := http.Post(srvURL+RegisterURL, "application/json", strings.NewReader(data))
+				require.NoError(t, err)
+				defer func() { _ = resp.Body.Close() }()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+
+				req, err := http.NewRequest(http.MethodGet, srvURL+MeURL, nil)
+				require.NoError(t, err)
+				req.Header.Set("Authorization", resp.Header.Get("Authorization"))
+				meResp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer func() { _ = meResp.Body.Close() }()
+				body, err := io.ReadAll(meResp.Body)
+				require.NoError(t, err)
+				require.Equalf(t, http.StatusOK, meResp.StatusCode, "Body: %s", string(body))
+				return string(body)
+			}
+
+			t.Run("email stored", func(t *testing.T) {
+				testutil.InTx(tx, t, func(_ pgx.Tx) {
+					body := registerAndGetMe(t, `{"login": "nk", "password": "StrongEnoughPassword", "email": "nk@example.com"}`)
+
+					user, err := s.Storage.User().GetUserByUsername(t.Context(), "nk")
+					require.NoError(t, err)
+					require.Equal(t, "nk@example.com", user.Email)
+					require.JSONEq(t, `{"id": "`+user.ID.String()+`", "username": "nk", "email": "nk@example.com"}`, body)
+				})
+			})
+
+			t.Run("no email", func(t *testing.T) {
+				testutil.InTx(tx, t, func(_ pgx.Tx) {
+					body := registerAndGetMe(t, `{"login": "nk", "password": "StrongEnoughPassword"}`)
+
+					user, err := s.Storage.User().GetUserByUsername(t.Context(), "nk")
+					require.NoError(t, err)
+					require.Empty(t, user.Email)
+					require.JSONEq(t, `{"id": "`+user.ID.String()+`", "username": "nk"}`, body)
+				})
+			})
+
+			t.Run("invalid email", func(t *testing.T) {
+				testutil.InTx(tx, t, func(_ pgx.Tx) {
+					data := `{"login": "nk", "password": "StrongEnoughPassword", "email": "not-an-email"}`
+
+					resp, err := http.Post(srvURL+RegisterURL, "application/json", strings.NewReader(data))
+					require.NoError(t, err)
+					defer func() { _ = resp.Body.Close() }()
+
+					require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+					_, err = s.Storage.User().GetUserByUsername(t.Context(), "nk")
+					require.ErrorIs(t, err, apperrors.ErrUserNotFound, "user must not be created")
+				})
+			})
+		})
+
+		t.Run("register with surrounding spaces", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				data := `{"login": "  alice  ", "password": "StrongEnoughPassword"}`
+				resp, err := http.Post(srvURL+RegisterURL, "application/json", strings.NewReader(data))
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				defer func() { _ = resp.Body.Close() }()
+				require.Equalf(t, http.StatusOK, resp.StatusCode, "login has to be trimmed before validation. Body: %s", string(body))
+
+				data = `{"login": "alice", "password": "StrongEnoughPassword"}`
+				loginResp, err := http.Post(srvURL+LoginURL, "application/json", strings.NewReader(data))
+				require.NoError(t, err)
+				defer func() { _ = loginResp.Body.Close() }()
+				require.Equal(t, http.StatusOK, loginResp.StatusCode, "user has to log in with trimmed login")
+			})
+		})
+
 		t.Run("register existed user fails", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
 				_, err := s.AuthService.Register(t.Context(), "nk", "StrongEnoughPassword")
@@ -72,6 +149,7 @@ func Test_AuthRegister(t *testing.T) {
 				require.JSONEq(t, `
 					{
 						"error": "service_error",
+						"code": "user_already_exists",
 						"message": "User already exists"
 					}`, string(body))
 
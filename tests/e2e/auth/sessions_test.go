@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+const (
+	SessionsURL = "/api/user/sessions"
+)
+
+func Test_Sessions(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	e2e.ServeInTx(pg.Pool, t, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		_, err := s.AuthService.Register(t.Context(), "nk", "StrongEnoughPassword")
+		require.NoError(t, err)
+		_, err = s.AuthService.Register(t.Context(), "other", "StrongEnoughPassword")
+		require.NoError(t, err)
+
+		// Send request authorized with the pair and return status and body
+		send := func(t *testing.T, method string, url string, pair models.TokenPair) (int, []byte) {
+			req, err := http.NewRequest(method, url, nil)
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, body
+		}
+
+		type session struct {
+			ID uuid.UUID `json:"id"`
+		}
+
+		t.Run("list sessions", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				pair, err := s.AuthService.Login(t.Context(), "nk", "StrongEnoughPassword")
+				require.NoError(t, err)
+				token, err := s.Storage.Refresh().Get(t.Context(), pair.Refresh.Value)
+				require.NoError(t, err)
+
+				code, body := send(t, http.MethodGet, srvURL+SessionsURL, pair)
+
+				require.Equalf(t, http.StatusOK, code, "Body: %s", string(body))
+				var sessions []session
+				require.NoError(t, json.Unmarshal(body, &sessions))
+				require.Len(t, sessions, 2, "sessions of register and login expected")
+				require.Equal(t, token.ID, sessions[0].ID, "newest session has to be first")
+				require.NotContains(t, string(body), pair.Refresh.Value[:8], "no part of the token may be returned")
+			})
+		})
+
+		t.Run("revoke session", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				pair, err := s.AuthService.Login(t.Context(), "nk", "StrongEnoughPassword")
+				require.NoError(t, err)
+				token, err := s.Storage.Refresh().Get(t.Context(), pair.Refresh.Value)
+				require.NoError(t, err)
+
+				code, body := send(t, http.MethodDelete, srvURL+SessionsURL+"/"+token.ID.String(), pair)
+
+				require.Equalf(t, http.StatusNoContent, code, "Body: %s", string(body))
+				_, err = s.AuthService.RefreshPair(t.Context(), pair.Refresh.Value)
+				require.Error(t, err, "revoked session can't be refreshed")
+			})
+		})
+
+		t.Run("revoke other user session not found", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				pair, err := s.AuthService.Login(t.Context(), "nk", "StrongEnoughPassword")
+				require.NoError(t, err)
+				otherPair, err := s.AuthService.Login(t.Context(), "other", "StrongEnoughPassword")
+				require.NoError(t, err)
+				otherToken, err := s.Storage.Refresh().Get(t.Context(), otherPair.Refresh.Value)
+				require.NoError(t, err)
+
+				code, body := send(t, http.MethodDelete, srvURL+SessionsURL+"/"+otherToken.ID.String(), pair)
+
+				require.Equal(t, http.StatusNotFound, code)
+				require.JSONEq(t, `{
+					"error": "service_error",
+					"code": "session_not_found",
+					"message": "Session not found"
+				}`, string(body))
+				code, _ = send(t, http.MethodDelete, srvURL+SessionsURL+"/not-uuid", pair)
+				require.Equal(t, http.StatusNotFound, code)
+			})
+		})
+	})
+}
@@ -6,8 +6,11 @@ import (
 	"testing"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nkiryanov/gophermart/internal/handlers"
+	"github.com/nkiryanov/gophermart/internal/models"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 	"github.com/nkiryanov/gophermart/tests/e2e"
 )
@@ -56,6 +59,34 @@ func Test_Balance(t *testing.T) {
 			})
 		})
 
+		t.Run("get balance as strings", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				user, err := s.Storage.User().GetUserByUsername(t.Context(), "test-user")
+				require.NoError(t, err)
+				_, err = s.Storage.Balance().UpdateBalance(t.Context(), models.Transaction{
+					UserID: user.ID,
+					Type:   models.TransactionTypeAccrual,
+					Amount: decimal.RequireFromString("1000.01"),
+				})
+				require.NoError(t, err)
+
+				req := authReq("test-user", "pwd", t)
+				req.URL.RawQuery = "format=string"
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "failed to send request")
+				defer resp.Body.Close() // nolint:errcheck
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err, "failed to read response body")
+
+				require.Equalf(t, http.StatusOK, resp.StatusCode, "balance request should return 200. Body: %s", string(body))
+				require.JSONEq(t, `{
+					"current": "1000.01",
+					"withdrawn": "0.00"
+				}`, string(body))
+			})
+		})
+
 		t.Run("unauthorized request", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
 				req, err := http.NewRequest(http.MethodGet, srvURL+BalanceURL, nil)
@@ -73,3 +104,37 @@ func Test_Balance(t *testing.T) {
 		})
 	})
 }
+
+func Test_BalanceUnit(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	e2e.ServeInTxWithConfig(pg.Pool, t, handlers.Config{AmountUnit: "points"}, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		_, err := s.UserService.CreateUser(t.Context(), "test-user", "pwd")
+		require.NoError(t, err)
+
+		t.Run("unit included", func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srvURL+BalanceURL, nil)
+			require.NoError(t, err)
+			pair, err := s.AuthService.Login(t.Context(), "test-user", "pwd")
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err, "failed to send request")
+			defer resp.Body.Close() // nolint:errcheck
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equalf(t, http.StatusOK, resp.StatusCode, "balance request should return 200. Body: %s", string(body))
+			require.JSONEq(t, `{
+				"current": 0,
+				"withdrawn": 0,
+				"unit": "points"
+			}`, string(body))
+		})
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
 	"github.com/nkiryanov/gophermart/internal/testutil"
 	"github.com/nkiryanov/gophermart/tests/e2e"
 )
@@ -38,12 +39,15 @@ func Test_BalanceWithdraw(t *testing.T) {
 		user, err := s.UserService.CreateUser(t.Context(), username, pwd)
 		require.NoError(t, err)
 
-		doWithdraw := func(t *testing.T, data request) *http.Response {
+		doWithdrawWithKey := func(t *testing.T, data request, idempotencyKey string) *http.Response {
 			// Create request
 			d, err := json.Marshal(data)
 			require.NoError(t, err, "failed to marshal withdraw request")
 			req, err := http.NewRequest(http.MethodPost, srvURL+WithdrawURL, bytes.NewReader(d))
 			require.NoError(t, err, "failed to create request")
+			if idempotencyKey != "" {
+				req.Header.Set("Idempotency-Key", idempotencyKey)
+			}
 
 			// Set authentication data
 			pair, err := s.AuthService.Login(t.Context(), username, pwd)
@@ -56,6 +60,9 @@ func Test_BalanceWithdraw(t *testing.T) {
 
 			return resp
 		}
+		doWithdraw := func(t *testing.T, data request) *http.Response {
+			return doWithdrawWithKey(t, data, "")
+		}
 
 		t.Run("withdraw insufficient fail", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
@@ -68,6 +75,7 @@ func Test_BalanceWithdraw(t *testing.T) {
 
 				require.JSONEq(t, `{
 					"error": "service_error",
+					"code": "balance_insufficient",
 					"message": "Insufficient balance"
 				}`, string(body), "not expected response body")
 			})
@@ -94,6 +102,44 @@ func Test_BalanceWithdraw(t *testing.T) {
 					"current": 0.01,
 					"withdrawn": 1000
 				}`, string(body), "not expected response body")
+				require.Contains(t, string(body), `"current":0.01,`, "amount has to be exact decimal literal")
+			})
+		})
+
+		t.Run("withdraw with idempotency key", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				_, err := s.Storage.Balance().UpdateBalance(t.Context(), models.Transaction{
+					ID:          uuid.New(),
+					UserID:      user.ID,
+					ProcessedAt: testutil.MustParseTime(t, "2024-11-01 15:04:05Z"),
+					Amount:      decimal.RequireFromString("1000"),
+					Type:        models.TransactionTypeAccrual,
+				})
+				require.NoError(t, err, "failed to update balance")
+
+				withdraw := func(idempotencyKey string) (int, string) {
+					resp := doWithdrawWithKey(t, request{Order: "2444", Sum: 100}, idempotencyKey)
+					defer resp.Body.Close() // nolint:errcheck
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err, "failed to read response body")
+					return resp.StatusCode, string(body)
+				}
+
+				status, body := withdraw("withdraw-1")
+				require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+				require.JSONEq(t, `{"current": 900, "withdrawn": 100}`, body)
+
+				status, body = withdraw("withdraw-1")
+				require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+				require.JSONEq(t, `{"current": 900, "withdrawn": 100}`, body, "repeated key has to return original result")
+
+				status, body = withdraw("withdraw-2")
+				require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+				require.JSONEq(t, `{"current": 800, "withdrawn": 200}`, body, "other key has to withdraw again")
+
+				withdrawals, err := s.Storage.Balance().ListTransactions(t.Context(), user.ID, []models.TransactionType{models.TransactionTypeWithdrawal}, repository.Page{})
+				require.NoError(t, err)
+				require.Len(t, withdrawals, 2)
 			})
 		})
 
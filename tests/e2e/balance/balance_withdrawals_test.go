@@ -18,7 +18,8 @@ import (
 )
 
 const (
-	ListWithdrawalURL = "/api/user/withdrawals"
+	ListWithdrawalURL     = "/api/user/withdrawals"
+	WithdrawalsSummaryURL = "/api/user/balance/withdrawals/summary"
 )
 
 func Test_BalanceListWithdraw(t *testing.T) {
@@ -85,6 +86,44 @@ func Test_BalanceListWithdraw(t *testing.T) {
 			})
 		})
 
+		t.Run("multiple withdrawals per order", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				for _, sum := range []string{"100", "23.34"} {
+					_, err = s.Storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+						ID:          uuid.New(),
+						ProcessedAt: testutil.MustParseTime(t, "2024-11-01 15:04:05Z"),
+						UserID:      user.ID,
+						OrderNumber: "1234",
+						Amount:      decimal.RequireFromString(sum),
+						Type:        models.TransactionTypeWithdrawal,
+					})
+					require.NoError(t, err)
+				}
+
+				resp := listWithdrawals(t)
+				defer resp.Body.Close() // nolint:errcheck
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				var withdrawals []map[string]any
+				require.NoError(t, json.Unmarshal(body, &withdrawals))
+				require.Len(t, withdrawals, 2, "every withdrawal has to be listed separately")
+
+				req, err := http.NewRequest(http.MethodGet, srvURL+WithdrawalsSummaryURL, nil)
+				require.NoError(t, err)
+				pair, err := s.AuthService.Login(t.Context(), username, pwd)
+				require.NoError(t, err)
+				s.AuthService.SetTokenPairToRequest(req, pair)
+				summaryResp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer summaryResp.Body.Close() // nolint:errcheck
+				body, err = io.ReadAll(summaryResp.Body)
+				require.NoError(t, err)
+
+				require.Equalf(t, http.StatusOK, summaryResp.StatusCode, "Body: %s", string(body))
+				require.JSONEq(t, `[{"order": "1234", "sum": 123.34, "count": 2}]`, string(body))
+			})
+		})
+
 		t.Run("exclude accruals", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
 				// Crete accrual transaction
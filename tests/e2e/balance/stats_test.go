@@ -0,0 +1,118 @@
+package balance
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/repository"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+const StatsURL = "/api/user/stats"
+
+func Test_UserStats(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	e2e.ServeInTx(pg.Pool, t, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		username := "test-user"
+		pwd := "pwd"
+		user, err := s.UserService.CreateUser(t.Context(), username, pwd)
+		require.NoError(t, err)
+
+		getStats := func(t *testing.T) (int, string) {
+			req, err := http.NewRequest(http.MethodGet, srvURL+StatsURL, nil)
+			require.NoError(t, err)
+			pair, err := s.AuthService.Login(t.Context(), username, pwd)
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			return resp.StatusCode, string(body)
+		}
+
+		t.Run("empty stats", func(t *testing.T) {
+			status, body := getStats(t)
+
+			require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+			require.JSONEq(t, `{
+				"orders": {"total": 0, "by_status": {"NEW": 0, "PROCESSING": 0, "INVALID": 0, "PROCESSED": 0}},
+				"accrued": 0,
+				"withdrawn": 0,
+				"current": 0
+			}`, body)
+		})
+
+		t.Run("stats aggregated", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				for _, o := range []struct {
+					number string
+					status string
+				}{
+					{"111", models.OrderStatusNew},
+					{"222", models.OrderStatusProcessed},
+					{"333", models.OrderStatusProcessed},
+					{"444", models.OrderStatusInvalid},
+				} {
+					_, err := s.Storage.Order().CreateOrder(t.Context(), o.number, user.ID, repository.WithOrderStatus(o.status))
+					require.NoError(t, err)
+				}
+				for _, tr := range []struct {
+					number string
+					typ    models.TransactionType
+					amount string
+				}{
+					{"222", models.TransactionTypeAccrual, "300"},
+					{"333", models.TransactionTypeAccrual, "200.5"},
+					{"555", models.TransactionTypeWithdrawal, "120"},
+				} {
+					transaction, err := s.Storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+						ID:          uuid.New(),
+						ProcessedAt: time.Now(),
+						UserID:      user.ID,
+						OrderNumber: tr.number,
+						Type:        tr.typ,
+						Amount:      decimal.RequireFromString(tr.amount),
+					})
+					require.NoError(t, err)
+					_, err = s.Storage.Balance().UpdateBalance(t.Context(), transaction)
+					require.NoError(t, err)
+				}
+
+				status, body := getStats(t)
+
+				require.Equalf(t, http.StatusOK, status, "Body: %s", body)
+				require.JSONEq(t, `{
+					"orders": {"total": 4, "by_status": {"NEW": 1, "PROCESSING": 0, "INVALID": 1, "PROCESSED": 2}},
+					"accrued": 500.5,
+					"withdrawn": 120,
+					"current": 380.5
+				}`, body)
+			})
+		})
+
+		t.Run("unauthorized", func(t *testing.T) {
+			resp, err := http.Get(srvURL + StatsURL)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+
+			require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package balance
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+const TransactionsURL = "/api/user/transactions"
+
+func Test_Transactions(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	e2e.ServeInTx(pg.Pool, t, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		username := "test-user"
+		pwd := "pwd"
+		user, err := s.UserService.CreateUser(t.Context(), username, pwd)
+		require.NoError(t, err)
+
+		for _, tr := range []struct {
+			number string
+			typ    models.TransactionType
+			amount string
+			at     string
+		}{
+			{"2377225624", models.TransactionTypeAccrual, "500.5", "2024-11-01 10:00:00Z"},
+			{"17893729974", models.TransactionTypeWithdrawal, "120", "2024-11-02 10:00:00Z"},
+		} {
+			_, err := s.Storage.Balance().CreateTransaction(t.Context(), models.Transaction{
+				ID:          uuid.New(),
+				ProcessedAt: testutil.MustParseTime(t, tr.at),
+				UserID:      user.ID,
+				OrderNumber: tr.number,
+				Type:        tr.typ,
+				Amount:      decimal.RequireFromString(tr.amount),
+			})
+			require.NoError(t, err)
+		}
+
+		getTransactions := func(t *testing.T, query string) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, srvURL+TransactionsURL+query, nil)
+			require.NoError(t, err)
+			pair, err := s.AuthService.Login(t.Context(), username, pwd)
+			require.NoError(t, err)
+			s.AuthService.SetTokenPairToRequest(req, pair)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			return resp
+		}
+
+		t.Run("list transactions", func(t *testing.T) {
+			resp := getTransactions(t, "")
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equalf(t, http.StatusOK, resp.StatusCode, "Body: %s", string(body))
+			var got []struct {
+				Order       string    `json:"order"`
+				Type        string    `json:"type"`
+				Amount      float64   `json:"amount"`
+				ProcessedAt time.Time `json:"processed_at"`
+			}
+			require.NoError(t, json.Unmarshal(body, &got))
+			require.Len(t, got, 2)
+			require.Equal(t, "17893729974", got[0].Order, "newest transaction has to be first")
+			require.Equal(t, models.TransactionTypeWithdrawal, got[0].Type)
+			require.Equal(t, -120.0, got[0].Amount, "withdrawal has to be negative")
+			require.True(t, got[0].ProcessedAt.Equal(testutil.MustParseTime(t, "2024-11-02 10:00:00Z")))
+			require.Equal(t, "2377225624", got[1].Order)
+			require.Equal(t, models.TransactionTypeAccrual, got[1].Type)
+			require.Equal(t, 500.5, got[1].Amount)
+		})
+
+		t.Run("export csv", func(t *testing.T) {
+			resp := getTransactions(t, "?format=csv")
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equalf(t, http.StatusOK, resp.StatusCode, "Body: %s", string(body))
+			require.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+			require.Equal(t, "attachment; filename=transactions.csv", resp.Header.Get("Content-Disposition"))
+			require.Equal(t, "order,type,amount,processed_at\n"+
+				"17893729974,WITHDRAWAL,-120,2024-11-02T10:00:00Z\n"+
+				"2377225624,ACCRUAL,500.5,2024-11-01T10:00:00Z\n", string(body))
+		})
+	})
+}
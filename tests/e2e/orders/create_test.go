@@ -71,6 +71,79 @@ func Test_OrdersCreate(t *testing.T) {
 			})
 		})
 
+		t.Run("prefer respond-async sets location", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				req := createOrderReq("test-user", "pwd", "17893729974", t)
+				req.Header.Set("Prefer", "respond-async, wait=10")
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "failed to send request")
+				defer resp.Body.Close() // nolint:errcheck
+
+				require.Equal(t, http.StatusAccepted, resp.StatusCode, "not expected status code")
+				require.Equal(t, "/api/user/orders/17893729974", resp.Header.Get("Location"), "location has to point to the order")
+				require.Equal(t, "respond-async", resp.Header.Get("Preference-Applied"))
+
+				// Follow the location to poll the order status
+				pollReq := createOrderReq("test-user", "pwd", "", t)
+				pollReq.Method = http.MethodGet
+				pollReq.URL, err = pollReq.URL.Parse(resp.Header.Get("Location"))
+				require.NoError(t, err)
+				pollResp, err := http.DefaultClient.Do(pollReq)
+				require.NoError(t, err, "failed to send request")
+				defer pollResp.Body.Close() // nolint:errcheck
+				body, err := io.ReadAll(pollResp.Body)
+				require.NoError(t, err, "failed to read response body")
+
+				require.Equalf(t, http.StatusOK, pollResp.StatusCode, "order has to be available by location. Body: %s", string(body))
+				var response Response
+				err = json.Unmarshal(body, &response)
+				require.NoError(t, err, "failed to unmarshal response body")
+				assert.Equal(t, "17893729974", response.Number)
+				assert.Equal(t, "NEW", response.Status)
+			})
+		})
+
+		t.Run("no location without prefer header", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				req := createOrderReq("test-user", "pwd", "17893729974", t)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "failed to send request")
+				defer resp.Body.Close() // nolint:errcheck
+
+				require.Equal(t, http.StatusAccepted, resp.StatusCode, "not expected status code")
+				require.Empty(t, resp.Header.Get("Location"), "location is set only if client prefers async response")
+			})
+		})
+
+		t.Run("idempotency key", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				create := func(number string, idempotencyKey string) (int, string) {
+					req := createOrderReq("test-user", "pwd", number, t)
+					req.Header.Set("Idempotency-Key", idempotencyKey)
+					resp, err := http.DefaultClient.Do(req)
+					require.NoError(t, err, "failed to send request")
+					defer resp.Body.Close() // nolint:errcheck
+					body, err := io.ReadAll(resp.Body)
+					require.NoError(t, err, "failed to read response body")
+					return resp.StatusCode, string(body)
+				}
+
+				status, body := create("17893729974", "create-1")
+				require.Equalf(t, http.StatusAccepted, status, "Body: %s", body)
+
+				retryStatus, retryBody := create("17893729974", "create-1")
+				require.Equal(t, http.StatusAccepted, retryStatus, "retry has to get original response, not 'already exists'")
+				require.Equal(t, body, retryBody)
+
+				status, body = create("2377225624", "create-2")
+				require.Equalf(t, http.StatusAccepted, status, "Body: %s", body)
+
+				orders, err := s.OrderService.ListOrders(t.Context(), repository.ListOrdersOpts{UserID: &user.ID})
+				require.NoError(t, err)
+				require.Len(t, orders, 2, "distinct keys has to create distinct orders")
+			})
+		})
+
 		t.Run("fail if number invalid", func(t *testing.T) {
 			testutil.InTx(tx, t, func(_ pgx.Tx) {
 				req := createOrderReq("test-user", "pwd", "178", t)
@@ -128,6 +201,7 @@ func Test_OrdersCreate(t *testing.T) {
 				require.Equalf(t, http.StatusConflict, resp.StatusCode, "if the number is taken by order by other user then 409 expected", string(body))
 				require.JSONEq(t, `{
 					"error": "service_error",
+					"code": "order_number_taken",
 					"message": "Order number already taken"
 				}`, string(body))
 			})
@@ -0,0 +1,87 @@
+package orders
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nkiryanov/gophermart/internal/models"
+	"github.com/nkiryanov/gophermart/internal/testutil"
+	"github.com/nkiryanov/gophermart/tests/e2e"
+)
+
+const (
+	EventsURL      = "/api/user/events"
+	EventsTokenURL = "/api/user/events/token"
+)
+
+func Test_OrderEvents(t *testing.T) {
+	t.Parallel()
+
+	pg := testutil.StartPostgresContainer(t)
+	t.Cleanup(pg.Terminate)
+
+	e2e.ServeInTx(pg.Pool, t, func(tx pgx.Tx, srvURL string, s e2e.Services) {
+		user, err := s.UserService.CreateUser(t.Context(), "test-user", "pwd")
+		require.NoError(t, err)
+		_, err = s.OrderService.CreateOrder(t.Context(), "17893729974", &user)
+		require.NoError(t, err)
+
+		pair, err := s.AuthService.Login(t.Context(), "test-user", "pwd")
+		require.NoError(t, err)
+		mainToken := pair.Access.Value
+
+		// Send request with bearer token and return response status and body
+		do := func(t *testing.T, method string, url string, token string) (int, string) {
+			req, err := http.NewRequest(method, srvURL+url, nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close() // nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp.StatusCode, string(body)
+		}
+
+		eventsToken := func(t *testing.T) string {
+			code, body := do(t, http.MethodPost, EventsTokenURL, mainToken)
+			require.Equalf(t, http.StatusOK, code, "Body: %s", body)
+			var resp struct {
+				Token string `json:"token"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &resp))
+			require.NotEmpty(t, resp.Token)
+			return resp.Token
+		}
+
+		t.Run("events streamed with events token", func(t *testing.T) {
+			code, body := do(t, http.MethodGet, EventsURL, eventsToken(t))
+
+			require.Equalf(t, http.StatusOK, code, "Body: %s", body)
+			require.Contains(t, body, "event: order\n")
+			require.Contains(t, body, `"number":"17893729974"`)
+			require.Contains(t, body, `"status":"`+models.OrderStatusNew+`"`)
+		})
+
+		t.Run("main API token rejected by events", func(t *testing.T) {
+			code, _ := do(t, http.MethodGet, EventsURL, mainToken)
+
+			require.Equal(t, http.StatusUnauthorized, code)
+		})
+
+		t.Run("events token rejected by main API", func(t *testing.T) {
+			token := eventsToken(t)
+
+			code, _ := do(t, http.MethodGet, OrderCreateURL, token)
+			require.Equal(t, http.StatusUnauthorized, code)
+
+			code, _ = do(t, http.MethodPost, EventsTokenURL, token)
+			require.Equal(t, http.StatusUnauthorized, code, "events token must not be exchanged for a new one")
+		})
+	})
+}
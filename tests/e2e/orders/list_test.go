@@ -58,6 +58,46 @@ func Test_OrdersList(t *testing.T) {
 				require.NoError(t, err, "failed to read response body")
 				require.Equalf(t, http.StatusNoContent, resp.StatusCode, "empty list should return 204. Body: %s", string(body))
 				require.Empty(t, string(body), "body should be empty for 204 status")
+				require.Empty(t, resp.Header.Get("Content-Type"), "no content type expected without body")
+			})
+		})
+
+		t.Run("export csv", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				_, err := s.OrderService.CreateOrder(t.Context(), "4242424242424242", &user,
+					repository.WithOrderStatus(models.OrderStatusProcessed),
+					repository.WithOrderAccrual(decimal.RequireFromString("100.50")),
+					repository.WithUploadedAt(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)),
+				)
+				require.NoError(t, err)
+
+				req := listOrdersReq("test-user", "pwd", t)
+				req.URL.RawQuery = "format=csv"
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "failed to send request")
+				defer resp.Body.Close() // nolint:errcheck
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err, "failed to read response body")
+
+				require.Equalf(t, http.StatusOK, resp.StatusCode, "Body: %s", string(body))
+				require.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+				require.Equal(t, "attachment; filename=orders.csv", resp.Header.Get("Content-Disposition"))
+				require.Equal(t, "number,status,accrual,uploaded_at\n4242424242424242,PROCESSED,100.5,2024-01-01T12:00:00Z\n", string(body))
+			})
+		})
+
+		t.Run("export csv without orders", func(t *testing.T) {
+			testutil.InTx(tx, t, func(_ pgx.Tx) {
+				req := listOrdersReq("test-user", "pwd", t)
+				req.URL.RawQuery = "format=csv"
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err, "failed to send request")
+				defer resp.Body.Close() // nolint:errcheck
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err, "failed to read response body")
+
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, "number,status,accrual,uploaded_at\n", string(body), "file has to have header row only")
 			})
 		})
 
@@ -30,21 +30,36 @@ type Services struct {
 // Create db transaction and run server in with that connection (one connection cause one transaction)
 // The created transaction passed to inner function: so, you can safely use testutil.WithTx with it
 func ServeInTx(dbpool *pgxpool.Pool, t *testing.T, fn func(tx pgx.Tx, srvURL string, services Services)) {
+	ServeInTxWithConfig(dbpool, t, handlers.Config{}, fn)
+}
+
+// Same as ServeInTx but router is created with the config
+func ServeInTxWithConfig(dbpool *pgxpool.Pool, t *testing.T, cfg handlers.Config, fn func(tx pgx.Tx, srvURL string, services Services)) {
+	serveInTx(dbpool, t, cfg, auth.Config{}, fn)
+}
+
+// Same as ServeInTx but auth service is created with the config
+func ServeInTxWithAuthConfig(dbpool *pgxpool.Pool, t *testing.T, authCfg auth.Config, fn func(tx pgx.Tx, srvURL string, services Services)) {
+	serveInTx(dbpool, t, handlers.Config{}, authCfg, fn)
+}
+
+func serveInTx(dbpool *pgxpool.Pool, t *testing.T, cfg handlers.Config, authCfg auth.Config, fn func(tx pgx.Tx, srvURL string, services Services)) {
 	testutil.InTx(dbpool, t, func(tx pgx.Tx) {
 		// Initialize repositories
 		storage := postgres.NewStorage(tx)
 
 		// Initialize services
-		tokenManager, err := tokenmanager.New(tokenmanager.Config{SecretKey: "test-secret"}, storage)
+		tokenManager, err := tokenmanager.New(tokenmanager.Config{SecretKey: "test-secret-key-32-bytes-minimum"}, storage)
 		require.NoError(t, err, "token manager should be created without errors")
 
 		orderService := order.NewService(storage)
 		userService := user.NewService(user.DefaultHasher, storage)
-		authService, err := auth.NewService(auth.Config{}, tokenManager, userService)
+		authService, err := auth.NewService(authCfg, tokenManager, userService)
 		require.NoError(t, err, "auth service starting error", err)
 
 		// Complete all together as router
 		router := handlers.NewRouter(
+			cfg,
 			authService,
 			orderService,
 			userService,